@@ -77,6 +77,7 @@ var (
 	aciToModify    string
 	ociToModify    string
 	disableHistory bool
+	cachePath      string
 
 	cmdExitCode int
 
@@ -106,20 +107,29 @@ func init() {
 	cmdAcbuild.PersistentFlags().StringVar(&aciToModify, "modify-appc", "", "Path to an ACI to modify (ignores build context)")
 	cmdAcbuild.PersistentFlags().StringVar(&ociToModify, "modify-oci", "", "Path to an OCI image to modify (ignores build context)")
 	cmdAcbuild.PersistentFlags().BoolVar(&disableHistory, "no-history", false, "Don't add annotations with the command that was run")
+	cmdAcbuild.PersistentFlags().StringVar(&cachePath, "cache-path", lib.DefaultCachePath(), "Path to keep the build cache in")
 
 	cobra.EnablePrefixMatching = true
 }
 
 func newACBuild() (*lib.ACBuild, error) {
+	if scriptBuild != nil {
+		return scriptBuild, nil
+	}
 	bmode, err := lib.GetBuildMode(contextpath)
 	if err != nil {
 		return nil, err
 	}
-	return lib.NewACBuild(contextpath, debug, bmode)
+	return newACBuildWithBuildMode(bmode)
 }
 
 func newACBuildWithBuildMode(bmode lib.BuildMode) (*lib.ACBuild, error) {
-	return lib.NewACBuild(contextpath, debug, bmode)
+	a, err := lib.NewACBuild(contextpath, debug, bmode)
+	if err != nil {
+		return nil, err
+	}
+	a.CachePath = cachePath
+	return a, nil
 }
 
 func getErrorCode(err error) int {
@@ -146,7 +156,7 @@ func runWrapper(cf func(cmd *cobra.Command, args []string) (exit int)) func(cmd
 		if aciToModify == "" && ociToModify == "" {
 			cmdExitCode = cf(cmd, args)
 			switch cmd.Name() {
-			case "cat-manifest", "begin", "write", "end", "version", "gen-man-pages", "script":
+			case "cat-manifest", "begin", "write", "push", "end", "version", "gen-man-pages", "script", "cache-prune":
 				return
 			}
 			if cmdExitCode == 0 && !disableHistory {
@@ -167,7 +177,7 @@ func runWrapper(cf func(cmd *cobra.Command, args []string) (exit int)) func(cmd
 		}
 
 		switch cmd.Name() {
-		case "begin", "write", "end", "version", "gen-man-pages", "script":
+		case "begin", "from-dockerfile", "write", "push", "end", "version", "gen-man-pages", "script", "cache-prune":
 			stderr("Can't use --modify flags with %s.", cmd.Name())
 			cmdExitCode = 1
 			return
@@ -259,7 +269,7 @@ func runWrapper(cf func(cmd *cobra.Command, args []string) (exit int)) func(cmd
 		dir, file := path.Split(aciToModify)
 		tmpFile := path.Join(dir, "."+file+".tmp")
 
-		_, err = a.Write(tmpFile, true)
+		_, err = a.Write(tmpFile, true, nil)
 		if err != nil {
 			stderr("%v", err)
 			cmdExitCode = getErrorCode(err)
@@ -308,6 +318,9 @@ func main() {
 
 func stderr(format string, a ...interface{}) {
 	out := fmt.Sprintf(format, a...)
+	if scriptLine != "" {
+		out = scriptLine + ": " + out
+	}
 	fmt.Fprintln(os.Stderr, strings.TrimSuffix(out, "\n"))
 }
 
@@ -15,14 +15,22 @@
 package main
 
 import (
+	"os"
+	"strconv"
+
 	"github.com/spf13/cobra"
 
 	"github.com/containers/build/lib"
+	"github.com/containers/build/registry"
+	"github.com/containers/build/util"
 )
 
 var (
-	mode     string
-	cmdBegin = &cobra.Command{
+	mode                  string
+	layerCompression      string
+	layerCompressionLevel int
+	reproducible          bool
+	cmdBegin              = &cobra.Command{
 		Use:     "begin [START_ACI]",
 		Short:   "Start a new build, with either a new and empty image or an existing image",
 		Example: "acbuild begin",
@@ -32,8 +40,13 @@ var (
 
 func init() {
 	cmdAcbuild.AddCommand(cmdBegin)
-	cmdBegin.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over an unencrypted connection")
+	cmdBegin.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over an unencrypted connection and without verifying their signatures")
+	cmdBegin.Flags().BoolVar(&skipVerify, "insecure-skip-verify", false, "Allows fetching ACIs without verifying their signatures")
+	cmdBegin.Flags().Var(newStringSlice(&trustedKeys, registry.DefaultTrustedKeysPaths), "trusted-keys", "Trust stores holding the keys fetched ACIs must be signed with")
 	cmdBegin.Flags().StringVar(&mode, "build-mode", "appc", "Which build mode to operate in. Accepts: appc, oci")
+	cmdBegin.Flags().StringVar(&layerCompression, "layer-compression", "gzip", "How layers are compressed in the oci build mode. Accepts: none, gzip, zstd")
+	cmdBegin.Flags().IntVar(&layerCompressionLevel, "layer-compression-level", 0, "The level to compress layers at, or 0 for the default level")
+	cmdBegin.Flags().BoolVar(&reproducible, "reproducible", false, "Produce the same image from the same build on any machine. Implied if SOURCE_DATE_EPOCH is set")
 }
 
 func runBegin(cmd *cobra.Command, args []string) (exit int) {
@@ -48,6 +61,22 @@ func runBegin(cmd *cobra.Command, args []string) (exit int) {
 		return 1
 	}
 
+	lcompression, err := util.ParseCompression(layerCompression, layerCompressionLevel)
+	if err != nil {
+		stderr("begin: %v", err)
+		return 1
+	}
+
+	var sourceDateEpoch int64
+	if sde := os.Getenv("SOURCE_DATE_EPOCH"); sde != "" {
+		sourceDateEpoch, err = strconv.ParseInt(sde, 10, 64)
+		if err != nil {
+			stderr("begin: invalid SOURCE_DATE_EPOCH: %q", sde)
+			return 1
+		}
+		reproducible = true
+	}
+
 	if debug {
 		if len(args) == 0 {
 			stderr("Beginning build with an empty ACI")
@@ -61,6 +90,12 @@ func runBegin(cmd *cobra.Command, args []string) (exit int) {
 		stderr("%v", err)
 		return 1
 	}
+	a.TrustedKeysPaths = trustedKeys
+	a.SkipVerify = skipVerify
+	a.LayerCompression = lcompression
+	a.LayerCompressionLevel = layerCompressionLevel
+	a.Reproducible = reproducible
+	a.SourceDateEpoch = sourceDateEpoch
 	if len(args) == 0 {
 		err = a.Begin("", insecure, bmode)
 	} else {
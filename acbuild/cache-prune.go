@@ -0,0 +1,59 @@
+// Copyright 2015 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/containers/build/lib"
+)
+
+var (
+	pruneOlderThan time.Duration
+	cmdCachePrune  = &cobra.Command{
+		Use:     "cache-prune",
+		Short:   "Remove layers from the build cache",
+		Long:    "Remove the layers kept in the build cache, or only the ones that haven't been used for a while",
+		Example: "acbuild cache-prune --older-than 168h",
+		Run:     runWrapper(runCachePrune),
+	}
+)
+
+func init() {
+	cmdAcbuild.AddCommand(cmdCachePrune)
+	cmdCachePrune.Flags().DurationVar(&pruneOlderThan, "older-than", 0, "Only remove layers that haven't been used for this long")
+}
+
+func runCachePrune(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 0 {
+		stderr("cache-prune: incorrect number of arguments")
+		return 1
+	}
+
+	if debug {
+		stderr("Pruning the build cache at %s", cachePath)
+	}
+
+	removed, freed, err := lib.PruneCache(cachePath, pruneOlderThan)
+	if err != nil {
+		stderr("cache-prune: %v", err)
+		return getErrorCode(err)
+	}
+
+	stdout("Removed %d cache entries, freeing %d bytes", removed, freed)
+	return 0
+}
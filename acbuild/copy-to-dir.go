@@ -32,6 +32,7 @@ var (
 
 func init() {
 	cmdAcbuild.AddCommand(cmdCopyToDir)
+	cmdCopyToDir.Flags().BoolVar(&noCache, "no-cache", false, "Always copy the files, rather than reusing the layer copying them produced in an earlier build")
 }
 
 func runCopyToDir(cmd *cobra.Command, args []string) (exit int) {
@@ -59,6 +60,7 @@ func runCopyToDir(cmd *cobra.Command, args []string) (exit int) {
 		stderr("%v", err)
 		return 1
 	}
+	a.NoCache = noCache
 	err = a.CopyToDir(args[:len(args)-1], args[len(args)-1])
 
 	if err != nil {
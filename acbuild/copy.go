@@ -30,6 +30,7 @@ var (
 
 func init() {
 	cmdAcbuild.AddCommand(cmdCopy)
+	cmdCopy.Flags().BoolVar(&noCache, "no-cache", false, "Always copy the files, rather than reusing the layer copying them produced in an earlier build")
 }
 
 func runCopy(cmd *cobra.Command, args []string) (exit int) {
@@ -58,6 +59,7 @@ func runCopy(cmd *cobra.Command, args []string) (exit int) {
 		stderr("%v", err)
 		return 1
 	}
+	a.NoCache = noCache
 	err = a.CopyToTarget(args[0], args[1])
 
 	if err != nil {
@@ -172,3 +172,7 @@ func (ls *labellist) Set(input string) error {
 func (ls *labellist) Type() string {
 	return "Labels"
 }
+
+func (ls *labellist) reset() {
+	*ls = nil
+}
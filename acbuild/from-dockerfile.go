@@ -0,0 +1,553 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/containers/build/engine"
+	"github.com/containers/build/engine/ociruntime"
+	"github.com/containers/build/lib"
+	"github.com/containers/build/lib/dockerfile"
+)
+
+var (
+	dockerfileContext = ""
+	cmdFromDockerfile = &cobra.Command{
+		Use:     "from-dockerfile DOCKERFILE",
+		Short:   "Start a new oci build from the instructions in a Dockerfile",
+		Example: "acbuild from-dockerfile --context . Dockerfile",
+		Run:     runWrapper(runFromDockerfile),
+	}
+)
+
+func init() {
+	cmdAcbuild.AddCommand(cmdFromDockerfile)
+
+	cmdFromDockerfile.Flags().StringVar(&dockerfileContext, "context", "", "The directory COPY and ADD take files from, which is the Dockerfile's directory by default")
+	cmdFromDockerfile.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching the image in FROM over http")
+	cmdFromDockerfile.Flags().BoolVar(&noCache, "no-cache", false, "Always run RUN instructions and copy files, rather than reusing the layers they produced in an earlier build")
+	cmdFromDockerfile.Flags().StringVar(&engineName, "engine", "systemd-nspawn", "The engine used to run RUN instructions, which is rootless by default when not run as root")
+	cmdFromDockerfile.Flags().StringVar(&ociRuntimeEngine.Runtime, "runtime", ociruntime.DefaultRuntime, "The OCI runtime the oci-runtime engine runs RUN instructions with")
+}
+
+func runFromDockerfile(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 1 {
+		cmd.Usage()
+		return 1
+	}
+
+	if !cmd.Flags().Changed("engine") && os.Geteuid() != 0 {
+		engineName = "rootless"
+	}
+	runEngine, ok := engines[engineName]
+	if !ok {
+		stderr("from-dockerfile: no such engine %q", engineName)
+		return 1
+	}
+	if cmd.Flags().Changed("runtime") && engineName != "oci-runtime" {
+		stderr("from-dockerfile: --runtime can only be used with --engine=oci-runtime")
+		return 1
+	}
+
+	name := args[0]
+	blob, err := ioutil.ReadFile(name)
+	if err != nil {
+		stderr("from-dockerfile: %v", err)
+		return 1
+	}
+	df, err := dockerfile.Parse(blob)
+	if err != nil {
+		stderr("from-dockerfile: %s", dockerfileError(name, err))
+		return 1
+	}
+	if dockerfileContext == "" {
+		dockerfileContext = filepath.Dir(name)
+	}
+	if _, err := os.Stat(filepath.Join(dockerfileContext, ".dockerignore")); err == nil {
+		stderr("warning: .dockerignore isn't supported, so it's ignored")
+	}
+
+	a, err := newACBuildWithBuildMode(lib.BuildModeOCI)
+	if err != nil {
+		stderr("%v", err)
+		return 1
+	}
+	a.NoCache = noCache
+
+	b := &dockerfileBuild{
+		a:       a,
+		df:      df,
+		context: dockerfileContext,
+		engine:  runEngine,
+		env:     make(map[string]string),
+	}
+	err = b.build()
+	if err != nil {
+		stderr("from-dockerfile: %s", dockerfileError(name, err))
+		if b.begun {
+			err1 := a.End()
+			if err1 != nil {
+				stderr("from-dockerfile: %v", err1)
+			}
+		}
+		return 1
+	}
+	return 0
+}
+
+// dockerfileError formats err with the name of the Dockerfile, and the line it
+// was found on if it's known.
+func dockerfileError(name string, err error) string {
+	if e, ok := err.(*dockerfile.Error); ok {
+		return fmt.Sprintf("%s:%d: %v", name, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", name, err)
+}
+
+// dockerfileBuild is the state of a build as the instructions of a Dockerfile
+// are applied to it.
+type dockerfileBuild struct {
+	a       *lib.ACBuild
+	df      *dockerfile.Dockerfile
+	context string
+	engine  engine.Engine
+
+	begun      bool
+	env        map[string]string // The image's environment, for expanding variables
+	workingDir string
+	user       string
+	entrypoint []string
+	cmd        []string
+}
+
+func (b *dockerfileBuild) build() error {
+	if len(b.df.Instructions) == 0 {
+		return fmt.Errorf("no instructions in Dockerfile")
+	}
+	for _, inst := range b.df.Instructions {
+		if debug {
+			stderr("Line %d: %s", inst.Line, inst.Original)
+		}
+		err := b.apply(inst)
+		if err != nil {
+			return &dockerfile.Error{Line: inst.Line, Err: err}
+		}
+	}
+	return nil
+}
+
+func (b *dockerfileBuild) apply(inst dockerfile.Instruction) error {
+	name := strings.ToUpper(inst.Command)
+	if inst.Command != "from" && !b.begun {
+		return fmt.Errorf("%s comes before FROM", name)
+	}
+	for flag := range inst.Flags {
+		return fmt.Errorf("%s --%s isn't supported", name, flag)
+	}
+
+	var err error
+	switch inst.Command {
+	case "from":
+		err = b.from(inst)
+	case "run":
+		err = b.run(inst)
+	case "copy", "add":
+		err = b.copy(inst)
+	case "env":
+		err = b.setEnv(inst)
+	case "label":
+		err = b.label(inst)
+	case "expose":
+		err = b.expose(inst)
+	case "volume":
+		err = b.volume(inst)
+	case "user":
+		err = b.setUser(inst)
+	case "workdir":
+		err = b.setWorkingDir(inst)
+	case "cmd", "entrypoint":
+		err = b.setExec(inst)
+	case "arg", "healthcheck", "maintainer", "onbuild", "shell", "stopsignal":
+		return fmt.Errorf("%s isn't supported", name)
+	default:
+		return fmt.Errorf("unknown instruction %s", name)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// from begins the build, which must only be done once, since multi-stage
+// builds aren't supported.
+func (b *dockerfileBuild) from(inst dockerfile.Instruction) error {
+	if b.begun {
+		return fmt.Errorf("multi-stage builds aren't supported, so there can only be one FROM")
+	}
+	words, err := b.df.Words(inst.Args, nil)
+	if err != nil {
+		return err
+	}
+	if len(words) != 1 && (len(words) != 3 || strings.ToLower(words[1]) != "as") {
+		return fmt.Errorf("FROM takes an image, optionally followed by AS NAME")
+	}
+
+	start := words[0]
+	if start == "scratch" {
+		start = ""
+	}
+	err = b.a.Begin(start, insecure, lib.BuildModeOCI)
+	if err != nil {
+		return err
+	}
+	b.begun = true
+
+	env, err := b.a.GetEnv()
+	if err != nil {
+		return err
+	}
+	for name, value := range env {
+		b.env[name] = value
+	}
+	return nil
+}
+
+// run runs the command in a new layer, or the top one if it's still empty, as
+// the user and in the working directory set so far.
+func (b *dockerfileBuild) run(inst dockerfile.Instruction) error {
+	cmd := inst.Exec
+	if cmd == nil {
+		cmd = []string{"/bin/sh", "-c", inst.Args}
+	}
+	if len(cmd) == 0 || inst.Args == "" {
+		return fmt.Errorf("no command given")
+	}
+
+	err := b.a.NewLayer()
+	if err != nil {
+		return err
+	}
+	opts := engine.RunOptions{
+		Network: engine.NetworkHost,
+		User:    b.user,
+	}
+	return b.a.Run(cmd, b.workingDir, insecure, b.engine, opts)
+}
+
+// copy copies files from the context into a new layer, or the top one if it's
+// still empty. A directory's contents are copied rather than the directory
+// itself, as Docker does.
+func (b *dockerfileBuild) copy(inst dockerfile.Instruction) error {
+	words := inst.Exec
+	if words == nil {
+		var err error
+		words, err = b.df.Words(inst.Args, b.env)
+		if err != nil {
+			return err
+		}
+	}
+	if len(words) < 2 {
+		return fmt.Errorf("a source and a destination are needed")
+	}
+	srcs, dest := words[:len(words)-1], words[len(words)-1]
+	if !path.IsAbs(dest) {
+		dir := b.workingDir
+		if dir == "" {
+			dir = "/"
+		}
+		// Join would remove the trailing slash marking it as a directory
+		if strings.HasSuffix(dest, "/") {
+			dest = path.Join(dir, dest) + "/"
+		} else {
+			dest = path.Join(dir, dest)
+		}
+	}
+
+	var matches []string
+	for _, src := range srcs {
+		if inst.Command == "add" {
+			if strings.Contains(src, "://") {
+				return fmt.Errorf("adding files from URLs isn't supported, so %s should be fetched with RUN", src)
+			}
+			if isArchive(src) {
+				return fmt.Errorf("archives aren't extracted, so %s should be copied with COPY and extracted with RUN", src)
+			}
+		}
+		pattern := filepath.Join(b.context, src)
+		rel, err := filepath.Rel(b.context, pattern)
+		if err != nil {
+			return err
+		}
+		if rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("%s is outside of the context", src)
+		}
+		found, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 {
+			return fmt.Errorf("%s: no such file or directory in the context", src)
+		}
+		matches = append(matches, found...)
+	}
+
+	var froms []string
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			froms = append(froms, match)
+			continue
+		}
+		entries, err := ioutil.ReadDir(match)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			froms = append(froms, filepath.Join(match, entry.Name()))
+		}
+	}
+
+	if len(matches) > 1 && !strings.HasSuffix(dest, "/") {
+		return fmt.Errorf("the destination must end with / when there's more than one source")
+	}
+	err := b.a.NewLayer()
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(matches) == 1 && len(froms) == 1 && froms[0] == matches[0] && !strings.HasSuffix(dest, "/"):
+		return b.a.CopyToTarget(matches[0], dest)
+	default:
+		return b.a.CopyToDir(froms, dest)
+	}
+}
+
+// isArchive returns whether ADD would extract the file at src.
+func isArchive(src string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz"} {
+		if strings.HasSuffix(src, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyValues parses the NAME=VALUE pairs of an ENV or LABEL instruction, or the
+// single NAME VALUE pair of their legacy form.
+func (b *dockerfileBuild) keyValues(inst dockerfile.Instruction) ([][2]string, error) {
+	first := strings.FieldsFunc(inst.Args, func(r rune) bool { return r == ' ' || r == '\t' })
+	if len(first) == 0 {
+		return nil, fmt.Errorf("no NAME=VALUE pairs given")
+	}
+	if !strings.Contains(first[0], "=") {
+		name := first[0]
+		value, err := b.df.Word(strings.TrimSpace(strings.TrimPrefix(inst.Args, name)), b.env)
+		if err != nil {
+			return nil, err
+		}
+		return [][2]string{{name, value}}, nil
+	}
+
+	words, err := b.df.Words(inst.Args, b.env)
+	if err != nil {
+		return nil, err
+	}
+	var pairs [][2]string
+	for _, word := range words {
+		parts := strings.SplitN(word, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q isn't NAME=VALUE", word)
+		}
+		pairs = append(pairs, [2]string{parts[0], parts[1]})
+	}
+	return pairs, nil
+}
+
+func (b *dockerfileBuild) setEnv(inst dockerfile.Instruction) error {
+	pairs, err := b.keyValues(inst)
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		err = b.a.AddEnv(pair[0], pair[1])
+		if err != nil {
+			return err
+		}
+		b.env[pair[0]] = pair[1]
+	}
+	return nil
+}
+
+// label adds annotations to the image's manifest, since labels can't be set in
+// the oci build mode.
+func (b *dockerfileBuild) label(inst dockerfile.Instruction) error {
+	pairs, err := b.keyValues(inst)
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		err = b.a.AddAnnotation(pair[0], pair[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expose adds each PORT[/PROTOCOL], named after its number and protocol.
+func (b *dockerfileBuild) expose(inst dockerfile.Instruction) error {
+	words, err := b.df.Words(inst.Args, b.env)
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 {
+		return fmt.Errorf("no ports given")
+	}
+	for _, word := range words {
+		parts := strings.SplitN(word, "/", 2)
+		protocol := "tcp"
+		if len(parts) == 2 {
+			protocol = strings.ToLower(parts[1])
+		}
+		switch protocol {
+		case "tcp", "udp", "sctp":
+		default:
+			return fmt.Errorf("unknown protocol %q", protocol)
+		}
+		if strings.Contains(parts[0], "-") {
+			return fmt.Errorf("port ranges such as %s aren't supported", parts[0])
+		}
+		port, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil || port == 0 {
+			return fmt.Errorf("invalid port %q", parts[0])
+		}
+		err = b.a.AddPort(fmt.Sprintf("%d-%s", port, protocol), protocol, uint(port), 1, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// volume adds a mount for each path, named after the path.
+func (b *dockerfileBuild) volume(inst dockerfile.Instruction) error {
+	paths := inst.Exec
+	if paths == nil {
+		var err error
+		paths, err = b.df.Words(inst.Args, b.env)
+		if err != nil {
+			return err
+		}
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no paths given")
+	}
+	for _, p := range paths {
+		if !path.IsAbs(p) {
+			p = path.Join("/", b.workingDir, p)
+		}
+		p = path.Clean(p)
+		name := strings.Replace(strings.Trim(p, "/"), "/", "-", -1)
+		if name == "" {
+			name = "root"
+		}
+		err := b.a.AddMount(name, p, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setUser sets the image's user, and group if one's given, which RUN
+// instructions after it are run as too.
+func (b *dockerfileBuild) setUser(inst dockerfile.Instruction) error {
+	user, err := b.df.Word(inst.Args, b.env)
+	if err != nil {
+		return err
+	}
+	if user == "" {
+		return fmt.Errorf("no user given")
+	}
+	parts := strings.SplitN(user, ":", 2)
+	err = b.a.SetUser(parts[0])
+	if err != nil {
+		return err
+	}
+	if len(parts) == 2 {
+		err = b.a.SetGroup(parts[1])
+		if err != nil {
+			return err
+		}
+	}
+	b.user = user
+	return nil
+}
+
+// setWorkingDir sets the image's working directory, relative to the last one,
+// and makes it in the top layer.
+func (b *dockerfileBuild) setWorkingDir(inst dockerfile.Instruction) error {
+	dir, err := b.df.Word(inst.Args, b.env)
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		return fmt.Errorf("no directory given")
+	}
+	if !path.IsAbs(dir) {
+		dir = path.Join("/", b.workingDir, dir)
+	}
+	dir = path.Clean(dir)
+	err = b.a.CopyToDir(nil, dir)
+	if err != nil {
+		return err
+	}
+	err = b.a.SetWorkingDir(dir)
+	if err != nil {
+		return err
+	}
+	b.workingDir = dir
+	return nil
+}
+
+// setExec sets the image's exec command to the entrypoint followed by the
+// command, as they're set so far.
+func (b *dockerfileBuild) setExec(inst dockerfile.Instruction) error {
+	exec := inst.Exec
+	if exec == nil {
+		if inst.Args == "" {
+			return fmt.Errorf("no command given")
+		}
+		exec = []string{"/bin/sh", "-c", inst.Args}
+	}
+	if inst.Command == "entrypoint" {
+		b.entrypoint = exec
+	} else {
+		b.cmd = exec
+	}
+	return b.a.SetExec(append(append([]string{}, b.entrypoint...), b.cmd...))
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var (
+	pushCreds string
+	cmdPush   = &cobra.Command{
+		Use:     "push IMAGE_NAME",
+		Short:   "Push the image from the current build to a registry (OCI only)",
+		Example: "acbuild push --creds myuser quay.io/example/myapp:v1.0.0",
+		Run:     runWrapper(runPush),
+	}
+)
+
+func init() {
+	cmdAcbuild.AddCommand(cmdPush)
+
+	cmdPush.Flags().BoolVar(&insecure, "insecure", false, "Allows pushing over an unencrypted connection and skips TLS verification")
+	cmdPush.Flags().StringVar(&pushCreds, "creds", "", "Credentials for the registry, as USERNAME[:PASSWORD]. The password is prompted for if omitted")
+}
+
+func runPush(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 1 {
+		cmd.Usage()
+		return 1
+	}
+
+	username, password, err := parseCreds(pushCreds)
+	if err != nil {
+		stderr("push: %v", err)
+		return 1
+	}
+
+	if debug {
+		stderr("Pushing image to %s", args[0])
+	}
+
+	a, err := newACBuild()
+	if err != nil {
+		stderr("%v", err)
+		return 1
+	}
+	err = a.Push(args[0], insecure, username, password)
+
+	if err != nil {
+		stderr("push: %v", err)
+		return getErrorCode(err)
+	}
+
+	return 0
+}
+
+// parseCreds splits a USERNAME[:PASSWORD] string, prompting for the password
+// on the terminal if it wasn't provided.
+func parseCreds(creds string) (string, string, error) {
+	if creds == "" {
+		return "", "", nil
+	}
+	tokens := strings.SplitN(creds, ":", 2)
+	if len(tokens) == 2 {
+		return tokens[0], tokens[1], nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", "", fmt.Errorf("no password given for %s and stdin is not a terminal", tokens[0])
+	}
+	fmt.Fprintf(os.Stderr, "Password for %s: ", tokens[0])
+	password, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", "", err
+	}
+	return tokens[0], string(password), nil
+}
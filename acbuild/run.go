@@ -15,30 +15,54 @@
 package main
 
 import (
+	"encoding/csv"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/containers/build/engine"
 	"github.com/containers/build/engine/chroot"
+	"github.com/containers/build/engine/ociruntime"
+	"github.com/containers/build/engine/rootless"
 	"github.com/containers/build/engine/systemdnspawn"
+	"github.com/containers/build/registry"
 
 	"github.com/spf13/cobra"
 )
 
 var (
-	insecure   = false
-	workingdir = ""
-	engineName = ""
-	cmdRun     = &cobra.Command{
+	insecure    = false
+	skipVerify  = false
+	trustedKeys []string
+	noCache     = false
+	workingdir  = ""
+	engineName  = ""
+	networkName = ""
+	proxyAllow  []string
+	addHosts    []string
+	dnsServers  []string
+	binds       bindlist
+	secrets     secretlist
+	memoryLimit memorysize
+	cpusLimit   float64
+	pidsLimit   int64
+	timeout     time.Duration
+	runUser     string
+	cmdRun      = &cobra.Command{
 		Use:     "run -- CMD [ARGS]",
 		Short:   "Run a command in the image, saving changes made",
 		Example: "acbuild run -- yum install nginx",
 		Run:     runWrapper(runRun),
 	}
 
-	engines = map[string]engine.Engine{
+	ociRuntimeEngine = &ociruntime.Engine{}
+	engines          = map[string]engine.Engine{
 		"systemd-nspawn": systemdnspawn.Engine{},
 		"chroot":         chroot.Engine{},
+		"rootless":       rootless.Engine{},
+		"oci-runtime":    ociRuntimeEngine,
 	}
 )
 
@@ -51,9 +75,24 @@ func init() {
 	}
 	engineList := fmt.Sprintf("[%s]", strings.Join(engineNames, ","))
 
-	cmdRun.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over http")
+	cmdRun.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over http and without verifying their signatures")
+	cmdRun.Flags().BoolVar(&skipVerify, "insecure-skip-verify", false, "Allows fetching dependencies without verifying their signatures")
+	cmdRun.Flags().Var(newStringSlice(&trustedKeys, registry.DefaultTrustedKeysPaths), "trusted-keys", "Trust stores holding the keys dependencies must be signed with")
 	cmdRun.Flags().StringVar(&workingdir, "working-dir", "", "The working directory inside the container for this command")
-	cmdRun.Flags().StringVar(&engineName, "engine", "systemd-nspawn", "The engine used to run the command. Supported engines: "+engineList)
+	cmdRun.Flags().BoolVar(&noCache, "no-cache", false, "Always run the command, rather than reusing the layer it produced in an earlier build")
+	cmdRun.Flags().StringVar(&engineName, "engine", "systemd-nspawn", "The engine used to run the command, which is rootless by default when not run as root. Supported engines: "+engineList)
+	cmdRun.Flags().StringVar(&ociRuntimeEngine.Runtime, "runtime", ociruntime.DefaultRuntime, "The OCI runtime the oci-runtime engine runs the command with, such as runc or crun")
+	cmdRun.Flags().StringVar(&networkName, "network", string(engine.NetworkHost), "The network the command is run with: host, none, or private, which only allows requests to the hosts given with --proxy-allow")
+	cmdRun.Flags().Var(newStringSlice(&proxyAllow, nil), "proxy-allow", "Hosts the command may reach through the proxy of a private network, as HOST or HOST:PORT, where HOST may start with *.")
+	cmdRun.Flags().Var(newStringSlice(&addHosts, nil), "add-host", "Entries to add to /etc/hosts while the command is run, as HOST:IP")
+	cmdRun.Flags().Var(newStringSlice(&dnsServers, nil), "dns", "Nameservers to put in /etc/resolv.conf while the command is run")
+	cmdRun.Flags().Var(&binds, "bind", "Host paths to mount in the container while the command is run, as HOST:CONTAINER[:ro]")
+	cmdRun.Flags().Var(&memoryLimit, "memory", "The most memory the command may use, in bytes or with a k, m or g suffix")
+	cmdRun.Flags().Float64Var(&cpusLimit, "cpus", 0, "How many CPUs' worth of time the command may use")
+	cmdRun.Flags().Int64Var(&pidsLimit, "pids-limit", 0, "The most processes the command may have at once")
+	cmdRun.Flags().DurationVar(&timeout, "timeout", 0, "How long the command may run for before it and every process it started are killed, such as 30m")
+	cmdRun.Flags().StringVar(&runUser, "user", "", "The user, and optionally group, to run the command as, as NAME|UID[:GROUP], which are looked up in the image's /etc/passwd and /etc/group")
+	cmdRun.Flags().Var(&secrets, "secret", "Files to mount at /run/secrets/ID while the command is run, which are never written to the image, as id=ID,src=PATH")
 }
 
 func runRun(cmd *cobra.Command, args []string) (exit int) {
@@ -66,18 +105,64 @@ func runRun(cmd *cobra.Command, args []string) (exit int) {
 		stderr("Running: %v", args)
 	}
 
-	engine, ok := engines[engineName]
+	if !cmd.Flags().Changed("engine") && os.Geteuid() != 0 {
+		engineName = "rootless"
+	}
+
+	runEngine, ok := engines[engineName]
 	if !ok {
 		stderr("run: no such engine %q", engineName)
 		return 1
 	}
 
+	if cmd.Flags().Changed("runtime") && engineName != "oci-runtime" {
+		stderr("run: --runtime can only be used with --engine=oci-runtime")
+		return 1
+	}
+
+	switch engine.Network(networkName) {
+	case engine.NetworkHost, engine.NetworkNone, engine.NetworkPrivate:
+	default:
+		stderr("run: no such network %q", networkName)
+		return 1
+	}
+	if len(proxyAllow) > 0 && engine.Network(networkName) != engine.NetworkPrivate {
+		stderr("run: --proxy-allow can only be used with --network=private")
+		return 1
+	}
+	opts := engine.RunOptions{
+		Network:        engine.Network(networkName),
+		ProxyAllowlist: proxyAllow,
+		Hosts:          addHosts,
+		DNS:            dnsServers,
+		Binds:          binds,
+		Secrets:        secrets,
+		Limits: engine.Limits{
+			Memory: int64(memoryLimit),
+			CPUs:   cpusLimit,
+			Pids:   pidsLimit,
+		},
+		Timeout: timeout,
+		User:    runUser,
+	}
+	if cpusLimit < 0 || (cpusLimit > 0 && cpusLimit < 0.01) {
+		stderr("run: --cpus must be at least 0.01")
+		return 1
+	}
+	if pidsLimit < 0 || timeout < 0 {
+		stderr("run: --pids-limit and --timeout can't be negative")
+		return 1
+	}
+
 	a, err := newACBuild()
 	if err != nil {
 		stderr("%v", err)
 		return 1
 	}
-	err = a.Run(args, workingdir, insecure, engine)
+	a.TrustedKeysPaths = trustedKeys
+	a.SkipVerify = skipVerify
+	a.NoCache = noCache
+	err = a.Run(args, workingdir, insecure, runEngine, opts)
 
 	if err != nil {
 		stderr("run: %v", err)
@@ -86,3 +171,156 @@ func runRun(cmd *cobra.Command, args []string) (exit int) {
 
 	return 0
 }
+
+type bindlist []engine.Bind
+
+func (bl *bindlist) String() string {
+	strBinds := make([]string, len(*bl))
+	for i, b := range *bl {
+		strBinds[i] = b.Source + ":" + b.Target
+		if b.ReadOnly {
+			strBinds[i] += ":ro"
+		}
+	}
+	return strings.Join(strBinds, " ")
+}
+
+func (bl *bindlist) Set(input string) error {
+	parts := strings.Split(input, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("%q isn't HOST:CONTAINER[:ro]", input)
+	}
+	bind := engine.Bind{Source: parts[0], Target: parts[1]}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			bind.ReadOnly = true
+		case "rw":
+		default:
+			return fmt.Errorf("unknown bind option %q", parts[2])
+		}
+	}
+	*bl = append(*bl, bind)
+	return nil
+}
+
+func (bl *bindlist) Type() string {
+	return "Binds"
+}
+
+func (bl *bindlist) reset() {
+	*bl = nil
+}
+
+type secretlist []engine.Secret
+
+func (sl *secretlist) String() string {
+	strSecrets := make([]string, len(*sl))
+	for i, s := range *sl {
+		strSecrets[i] = fmt.Sprintf("id=%s,src=%s", s.ID, s.Source)
+	}
+	return strings.Join(strSecrets, " ")
+}
+
+func (sl *secretlist) Set(input string) error {
+	var secret engine.Secret
+	for _, field := range strings.Split(input, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("no '=' character in %q", field)
+		}
+		switch parts[0] {
+		case "id":
+			secret.ID = parts[1]
+		case "src", "source":
+			secret.Source = parts[1]
+		default:
+			return fmt.Errorf("unknown secret option %q", parts[0])
+		}
+	}
+	if secret.ID == "" || secret.Source == "" {
+		return fmt.Errorf("%q isn't id=ID,src=PATH", input)
+	}
+	*sl = append(*sl, secret)
+	return nil
+}
+
+func (sl *secretlist) Type() string {
+	return "Secrets"
+}
+
+func (sl *secretlist) reset() {
+	*sl = nil
+}
+
+type memorysize int64
+
+func (m *memorysize) String() string {
+	return strconv.FormatInt(int64(*m), 10)
+}
+
+func (m *memorysize) Set(input string) error {
+	var unit int64 = 1
+	number := strings.ToLower(input)
+	for suffix, size := range map[string]int64{"k": 1 << 10, "m": 1 << 20, "g": 1 << 30} {
+		if strings.HasSuffix(number, suffix) {
+			number, unit = strings.TrimSuffix(number, suffix), size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("%q isn't a positive size", input)
+	}
+	*m = memorysize(n * unit)
+	return nil
+}
+
+func (m *memorysize) Type() string {
+	return "Bytes"
+}
+
+func (m *memorysize) reset() {
+	*m = 0
+}
+
+// stringslice is a comma separated list of strings, like pflag's StringSlice,
+// which replaces its default when first set, and is appended to after that.
+// Unlike pflag's, it can be reset to its default.
+type stringslice struct {
+	value    *[]string
+	defaults []string
+	changed  bool
+}
+
+func newStringSlice(p *[]string, defaults []string) *stringslice {
+	*p = defaults
+	return &stringslice{value: p, defaults: defaults}
+}
+
+func (s *stringslice) String() string {
+	return "[" + strings.Join(*s.value, ",") + "]"
+}
+
+func (s *stringslice) Set(input string) error {
+	values, err := csv.NewReader(strings.NewReader(input)).Read()
+	if err != nil {
+		return err
+	}
+	if !s.changed {
+		*s.value = values
+	} else {
+		*s.value = append(*s.value, values...)
+	}
+	s.changed = true
+	return nil
+}
+
+func (s *stringslice) Type() string {
+	return "stringSlice"
+}
+
+func (s *stringslice) reset() {
+	*s.value = s.defaults
+	s.changed = false
+}
@@ -0,0 +1,252 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+
+	"github.com/appc/spec/discovery"
+	"github.com/appc/spec/schema/types"
+	"github.com/spf13/cobra"
+
+	"github.com/containers/build/lib"
+	"github.com/containers/build/lib/appc"
+)
+
+// unlimited is the most arguments a command taking any number of them takes.
+const unlimited = -1
+
+// scriptArgCounts is the fewest and most arguments each command takes.
+var scriptArgCounts = map[string][2]int{
+	"annotation add":              {2, 2},
+	"annotation remove":           {1, 1},
+	"begin":                       {0, 1},
+	"cache-prune":                 {0, 0},
+	"cat-manifest":                {0, 0},
+	"copy":                        {2, 2},
+	"copy-to-dir":                 {2, unlimited},
+	"dependency add":              {1, 1},
+	"dependency remove":           {1, 1},
+	"end":                         {0, 0},
+	"environment add":             {2, 2},
+	"environment remove":          {1, 1},
+	"from-dockerfile":             {1, 1},
+	"isolator add":                {2, 2},
+	"isolator remove":             {1, 1},
+	"label add":                   {2, 2},
+	"label remove":                {1, 1},
+	"layer":                       {0, 0},
+	"mount add":                   {2, 2},
+	"mount remove":                {1, 1},
+	"port add":                    {3, 3},
+	"port remove":                 {1, 1},
+	"push":                        {1, 1},
+	"replace-manifest":            {1, 1},
+	"run":                         {1, unlimited},
+	"script":                      {1, 1},
+	"set-event-handler pre-start": {1, unlimited},
+	"set-event-handler post-stop": {1, unlimited},
+	"set-exec":                    {1, unlimited},
+	"set-group":                   {1, 1},
+	"set-name":                    {1, 1},
+	"set-supp-groups":             {1, unlimited},
+	"set-tag":                     {1, 1},
+	"set-user":                    {1, 1},
+	"set-working-directory":       {1, 1},
+	"version":                     {0, 0},
+	"write":                       {1, 1},
+}
+
+// scriptModes is the build mode of the commands that only work in one.
+var scriptModes = map[string]lib.BuildMode{
+	"dependency add":              lib.BuildModeAppC,
+	"dependency remove":           lib.BuildModeAppC,
+	"isolator add":                lib.BuildModeAppC,
+	"isolator remove":             lib.BuildModeAppC,
+	"label add":                   lib.BuildModeAppC,
+	"label remove":                lib.BuildModeAppC,
+	"set-event-handler pre-start": lib.BuildModeAppC,
+	"set-event-handler post-stop": lib.BuildModeAppC,
+	"set-name":                    lib.BuildModeAppC,
+	"set-supp-groups":             lib.BuildModeAppC,
+	"layer":                       lib.BuildModeOCI,
+	"push":                        lib.BuildModeOCI,
+}
+
+// scriptChecker checks the commands of scripts without running them, keeping
+// track of the build mode they would be run in.
+type scriptChecker struct {
+	begun    bool
+	mode     lib.BuildMode // Empty when the script doesn't begin its build
+	files    []string      // The scripts being checked, innermost last
+	problems []error
+}
+
+// check checks the script in rawScript, read from file, with the variables in
+// vars set, adding the problems found to c.problems. Only the branches of
+// conditionals taken with those variables are checked.
+func (c *scriptChecker) check(file string, rawScript []byte, vars map[string]string) {
+	c.files = append(c.files, file)
+	defer func() {
+		c.files = c.files[:len(c.files)-1]
+	}()
+
+	p := newScriptParser(vars)
+	err := p.parse(file, rawScript)
+	if err != nil {
+		c.problems = append(c.problems, err)
+		return
+	}
+	p.warnUnusedVars()
+
+	for _, sc := range p.commands {
+		err := c.checkCommand(sc.args)
+		if err != nil {
+			c.problems = append(c.problems, &scriptError{sc.file, sc.line, err})
+		}
+	}
+}
+
+func (c *scriptChecker) checkCommand(args []string) error {
+	cmd, done, err := parseScriptCommand(args)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	name := scriptCommandName(cmd)
+	args = cmd.Flags().Args()
+	if counts, ok := scriptArgCounts[name]; ok {
+		err := checkArgCount(len(args), counts[0], counts[1])
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	if mode, ok := scriptModes[name]; ok && c.mode != "" && c.mode != mode {
+		return fmt.Errorf("%s: only supported in %s builds", name, mode)
+	}
+	err = c.checkValues(cmd, name, args)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// checkValues checks the arguments and flags of the command name, as far as
+// can be done without a build.
+func (c *scriptChecker) checkValues(cmd *cobra.Command, name string, args []string) error {
+	switch name {
+	case "begin", "from-dockerfile":
+		if c.begun {
+			return fmt.Errorf("a build has already begun")
+		}
+		c.begun = true
+		c.mode = lib.BuildModeOCI
+		if name == "begin" {
+			c.mode = lib.BuildMode(mode)
+		}
+		if c.mode != lib.BuildModeAppC && c.mode != lib.BuildModeOCI {
+			c.mode = ""
+			return fmt.Errorf("invalid build mode: %s", mode)
+		}
+	case "set-name", "label add", "label remove", "dependency remove":
+		_, err := types.NewACIdentifier(args[0])
+		return err
+	case "dependency add":
+		_, err := discovery.NewAppFromString(args[0])
+		if err != nil {
+			return fmt.Errorf("couldn't parse dependency name: %v", err)
+		}
+		if imageId != "" {
+			_, err = types.NewHash(imageId)
+			if err != nil {
+				return fmt.Errorf("couldn't parse image ID: %v", err)
+			}
+		}
+	case "isolator add":
+		// A value read from stdin can't be checked
+		if args[1] == "-" {
+			return nil
+		}
+		value, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		_, err = appc.NewIsolator(args[0], value)
+		return err
+	case "port add":
+		if args[1] != "tcp" && args[1] != "udp" {
+			return fmt.Errorf("protocol must be tcp or udp, not %q", args[1])
+		}
+		_, err := strconv.ParseUint(args[2], 10, 16)
+		if err != nil {
+			return fmt.Errorf("port must be a number between 0 and 65535")
+		}
+		if c.mode == lib.BuildModeOCI {
+			for _, flag := range []string{"count", "socket-activated"} {
+				if cmd.Flags().Changed(flag) {
+					return fmt.Errorf("--%s is only supported in appc builds", flag)
+				}
+			}
+		}
+	case "set-supp-groups":
+		for _, group := range args {
+			_, err := strconv.Atoi(group)
+			if err != nil {
+				return fmt.Errorf("group %q isn't a number", group)
+			}
+		}
+	case "script":
+		// The commands of a script run by this one are checked as if
+		// they were part of it
+		vars := scriptVars
+		for _, f := range c.files {
+			if filepath.Clean(f) == filepath.Clean(args[0]) {
+				return fmt.Errorf("%s runs itself", args[0])
+			}
+		}
+		rawScript, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		c.check(args[0], rawScript, vars)
+	}
+	return nil
+}
+
+// checkArgCount returns an error if n arguments were given to a command that
+// takes at least min and at most max of them.
+func checkArgCount(n, min, max int) error {
+	if n >= min && (max == unlimited || n <= max) {
+		return nil
+	}
+	switch {
+	case min == max:
+		return fmt.Errorf("expected %s, got %d", pluralArgs(min), n)
+	case max == unlimited:
+		return fmt.Errorf("expected at least %s, got %d", pluralArgs(min), n)
+	}
+	return fmt.Errorf("expected %d to %d arguments, got %d", min, max, n)
+}
+
+func pluralArgs(n int) string {
+	if n == 1 {
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", n)
+}
@@ -0,0 +1,111 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+)
+
+const scriptCheckpointFile = "scriptCheckpoint"
+
+// scriptCheckpoint is saved in the context of a build made by a script run
+// with --keep-on-failure, recording the commands of the script that have been
+// run, so that a failed run can be resumed from the command after the last of
+// them.
+type scriptCheckpoint struct {
+	Done []checkpointCommand `json:"done"`
+}
+
+type checkpointCommand struct {
+	File string   `json:"file"`
+	Line int      `json:"line"`
+	Args []string `json:"args"`
+}
+
+// saveScriptCheckpoint records that the commands in done have been run by the
+// script.
+func saveScriptCheckpoint(done []scriptCommand) error {
+	var cp scriptCheckpoint
+	for _, c := range done {
+		cp.Done = append(cp.Done, checkpointCommand{c.file, c.line, c.args})
+	}
+	blob, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(scriptBuild.ContextPath, scriptCheckpointFile), blob, 0644)
+}
+
+// keepScriptBuild leaves the build of a script that failed at c in place,
+// along with its checkpoint, so that it can be resumed.
+func keepScriptBuild(c scriptCommand) error {
+	a := scriptBuild
+	scriptBuild = nil
+	err := a.Release()
+	if err != nil {
+		return err
+	}
+	stderr("script: the build was kept in %s, run the script again with --resume to continue from %s:%d", a.ContextPath, c.file, c.line)
+	return nil
+}
+
+// resumeScriptBuild picks up the build kept by a failed run of the script
+// running commands, and returns the index of the command to continue from.
+// The commands run before must be unchanged, since their results are kept.
+func resumeScriptBuild(commands []scriptCommand) (start int, err error) {
+	err = holdScriptBuild()
+	if err != nil {
+		return 0, err
+	}
+	if scriptBuild == nil {
+		return 0, fmt.Errorf("there's no build kept by a failed script in the work path to resume")
+	}
+	defer func() {
+		// A build that can't be resumed is left alone
+		if err != nil {
+			scriptBuild.Release()
+			scriptBuild = nil
+		}
+	}()
+
+	blob, err := ioutil.ReadFile(path.Join(scriptBuild.ContextPath, scriptCheckpointFile))
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("the build in the work path wasn't kept by a failed script, so it can't be resumed")
+	}
+	if err != nil {
+		return 0, err
+	}
+	var cp scriptCheckpoint
+	err = json.Unmarshal(blob, &cp)
+	if err != nil {
+		return 0, fmt.Errorf("error loading script checkpoint: %v", err)
+	}
+
+	for i, done := range cp.Done {
+		if i == len(commands) || !reflect.DeepEqual(commands[i].args, done.Args) {
+			return 0, &scriptError{done.File, done.Line, fmt.Errorf("the script has changed since this line was run, so the build can't be resumed")}
+		}
+	}
+	start = len(cp.Done)
+	if debug && start < len(commands) {
+		stderr("Resuming script from %s:%d", commands[start].file, commands[start].line)
+	}
+	return start, nil
+}
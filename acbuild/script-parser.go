@@ -0,0 +1,291 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+var varNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validVarName(name string) bool {
+	return varNameRegexp.MatchString(name)
+}
+
+// scriptError is an error in a script, at the line it was found on.
+type scriptError struct {
+	file string
+	line int
+	err  error
+}
+
+func (e *scriptError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.file, e.line, e.err)
+}
+
+// scriptCommand is an acbuild command run by a script.
+type scriptCommand struct {
+	file string // The script the command is in
+	line int    // The line the command starts on
+	args []string
+}
+
+// conditional is an if block being parsed.
+type conditional struct {
+	line    int
+	active  bool // Whether the lines of the branch being parsed are run
+	taken   bool // Whether no later branch is run
+	sawElse bool
+}
+
+// scriptParser turns scripts into the commands they run, setting variables,
+// picking the branches of conditionals and reading included scripts as it
+// goes.
+type scriptParser struct {
+	vars      map[string]string
+	overrides map[string]string // The variables given with --var
+	declared  map[string]bool   // The variables declared with arg
+	files     []string          // The scripts being parsed, innermost last
+	commands  []scriptCommand
+}
+
+func newScriptParser(overrides map[string]string) *scriptParser {
+	p := &scriptParser{
+		vars: map[string]string{
+			"ARCH": runtime.GOARCH,
+			"OS":   runtime.GOOS,
+		},
+		overrides: overrides,
+		declared:  make(map[string]bool),
+	}
+	for name, value := range overrides {
+		p.vars[name] = value
+	}
+	return p
+}
+
+// parse parses the script in rawScript, read from file, adding the commands
+// it runs to p.commands.
+func (p *scriptParser) parse(file string, rawScript []byte) error {
+	p.files = append(p.files, file)
+	defer func() {
+		p.files = p.files[:len(p.files)-1]
+	}()
+
+	lines := strings.Split(string(rawScript), "\n")
+	for i, s := range lines {
+		lines[i] = strings.TrimSpace(s)
+	}
+	joined := joinLines(append([]string(nil), lines...))
+
+	var blocks []*conditional
+	for i, line := range joined {
+		if line == "" {
+			continue
+		}
+		// A continued line is joined onto the last one, but starts on
+		// the first
+		start := i
+		for start > 0 && strings.HasSuffix(lines[start-1], `\`) {
+			start--
+		}
+		err := p.parseLine(file, start+1, line, &blocks)
+		if err != nil {
+			if _, ok := err.(*scriptError); ok {
+				return err
+			}
+			return &scriptError{file, start + 1, err}
+		}
+	}
+	if len(blocks) > 0 {
+		return &scriptError{file, blocks[len(blocks)-1].line, fmt.Errorf("if without endif")}
+	}
+	return nil
+}
+
+func (p *scriptParser) parseLine(file string, line int, text string, blocks *[]*conditional) error {
+	// Variables are only expanded once it's known that the line is run,
+	// since they needn't be defined in branches that aren't
+	raw, err := tokenizeLine(text, nil)
+	if err != nil {
+		return err
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+	active := len(*blocks) == 0 || (*blocks)[len(*blocks)-1].active
+
+	switch strings.ToLower(raw[0]) {
+	case "if":
+		b := &conditional{line: line, taken: !active}
+		if active {
+			b.active, err = p.condition(text, 1)
+			if err != nil {
+				return err
+			}
+			b.taken = b.active
+		}
+		*blocks = append(*blocks, b)
+		return nil
+	case "else":
+		if len(*blocks) == 0 {
+			return fmt.Errorf("else without if")
+		}
+		b := (*blocks)[len(*blocks)-1]
+		if b.sawElse {
+			return fmt.Errorf("else after else")
+		}
+		elseIf := len(raw) > 1
+		if elseIf && strings.ToLower(raw[1]) != "if" {
+			return fmt.Errorf("else takes no arguments, except for else if")
+		}
+		b.active = false
+		if !b.taken {
+			b.active = true
+			if elseIf {
+				b.active, err = p.condition(text, 2)
+				if err != nil {
+					return err
+				}
+			}
+			b.taken = b.active
+		}
+		b.sawElse = !elseIf
+		return nil
+	case "endif":
+		if len(*blocks) == 0 {
+			return fmt.Errorf("endif without if")
+		}
+		if len(raw) > 1 {
+			return fmt.Errorf("endif takes no arguments")
+		}
+		*blocks = (*blocks)[:len(*blocks)-1]
+		return nil
+	}
+	if !active {
+		return nil
+	}
+
+	args, err := tokenizeLine(text, p.vars)
+	if err != nil {
+		return err
+	}
+	args[0] = strings.ToLower(args[0])
+	switch args[0] {
+	case "arg":
+		name, value, err := p.assignment(args, false)
+		if err != nil {
+			return err
+		}
+		p.declared[name] = true
+		if override, ok := p.overrides[name]; ok {
+			value = override
+		}
+		p.vars[name] = value
+	case "set":
+		name, value, err := p.assignment(args, true)
+		if err != nil {
+			return err
+		}
+		p.vars[name] = value
+	case "include":
+		if len(args) != 2 {
+			return fmt.Errorf("include takes one script")
+		}
+		included := args[1]
+		if !filepath.IsAbs(included) {
+			included = filepath.Join(filepath.Dir(file), included)
+		}
+		for _, f := range p.files {
+			if filepath.Clean(f) == filepath.Clean(included) {
+				return fmt.Errorf("%s includes itself", included)
+			}
+		}
+		rawScript, err := ioutil.ReadFile(included)
+		if err != nil {
+			return err
+		}
+		return p.parse(included, rawScript)
+	case "end":
+		return fmt.Errorf("calling end is unnecessary in a script, cleanup is done automatically")
+	default:
+		p.commands = append(p.commands, scriptCommand{file, line, args})
+	}
+	return nil
+}
+
+// condition evaluates the condition in text, which follows skip words, and is
+// either a word, which is true unless it's empty, or two words compared with
+// == or !=.
+func (p *scriptParser) condition(text string, skip int) (bool, error) {
+	words, err := tokenizeLine(text, p.vars)
+	if err != nil {
+		return false, err
+	}
+	words = words[skip:]
+	switch {
+	case len(words) == 1:
+		return words[0] != "", nil
+	case len(words) == 3 && words[1] == "==":
+		return words[0] == words[2], nil
+	case len(words) == 3 && words[1] == "!=":
+		return words[0] != words[2], nil
+	}
+	return false, fmt.Errorf("the condition must be VALUE, VALUE == VALUE or VALUE != VALUE")
+}
+
+// assignment parses the NAME=VALUE given to arg and set. The value may only be
+// left out if it isn't required, in which case it's empty.
+func (p *scriptParser) assignment(args []string, valueRequired bool) (string, string, error) {
+	usage := fmt.Errorf("%s takes NAME=VALUE", args[0])
+	if !valueRequired {
+		usage = fmt.Errorf("%s takes NAME or NAME=VALUE", args[0])
+	}
+	if len(args) != 2 {
+		return "", "", usage
+	}
+	parts := strings.SplitN(args[1], "=", 2)
+	if len(parts) != 2 {
+		if valueRequired {
+			return "", "", usage
+		}
+		parts = append(parts, "")
+	}
+	if !validVarName(parts[0]) {
+		return "", "", fmt.Errorf("invalid variable name %q", parts[0])
+	}
+	return parts[0], parts[1], nil
+}
+
+// warnUnusedVars warns about variables given with --var that the script didn't
+// declare with arg, which are likely to be misspelt.
+func (p *scriptParser) warnUnusedVars() {
+	var unused []string
+	for name := range p.overrides {
+		if !p.declared[name] && name != "ARCH" && name != "OS" {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	for _, name := range unused {
+		stderr("warning: --var %s was given, but isn't declared with arg in the script", name)
+	}
+}
@@ -19,21 +19,33 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"sort"
 	"strings"
 
 	"github.com/spf13/cobra"
-)
+	"github.com/spf13/pflag"
 
-const (
-	nestedScriptEnvVar = "ACBUILD_NESTED_SCRIPT"
+	"github.com/containers/build/lib"
 )
 
 var (
 	errSingleQuote = fmt.Errorf("unterminated single quote block")
 	errDoubleQuote = fmt.Errorf("unterminated double quote block")
 	errEscape      = fmt.Errorf("ended with an escape")
-	cmdScript      = &cobra.Command{
+	errBrace       = fmt.Errorf("unterminated ${ block")
+	scriptVars     varlist
+	scriptCheck    bool
+	// scriptKeepOnFailure and scriptResume are only read by the script
+	// acbuild is run with, not the ones it runs
+	scriptKeepOnFailure bool
+	scriptResume        bool
+	// scriptBuild is the build the commands in a script share once it has
+	// begun, which holds the lock on it until the script is done.
+	scriptBuild *lib.ACBuild
+	// scriptLine is where the command being run by a script is in it, as
+	// FILE:LINE, which is put before everything it prints.
+	scriptLine string
+	cmdScript  = &cobra.Command{
 		Use:     "script SCRIPT_FILE",
 		Short:   "Runs an acbuild script",
 		Example: "acbuild script build-myapp.acb",
@@ -43,6 +55,10 @@ var (
 
 func init() {
 	cmdAcbuild.AddCommand(cmdScript)
+	cmdScript.Flags().Var(&scriptVars, "var", "Variables to set in the script, overriding the defaults given with arg, as NAME=VALUE")
+	cmdScript.Flags().BoolVar(&scriptCheck, "check", false, "Check the script for problems, printing every one found, instead of running it")
+	cmdScript.Flags().BoolVar(&scriptKeepOnFailure, "keep-on-failure", false, "Build in the work path, and keep the build there if a command fails, so that it can be resumed")
+	cmdScript.Flags().BoolVar(&scriptResume, "resume", false, "Resume the build kept in the work path by a failed run of the script, from the command that failed. Implies --keep-on-failure")
 }
 
 func runScript(cmd *cobra.Command, args []string) (exit int) {
@@ -58,70 +74,99 @@ func runScript(cmd *cobra.Command, args []string) (exit int) {
 		return getErrorCode(err)
 	}
 
+	if scriptCheck {
+		c := &scriptChecker{}
+		c.check(scriptName, rawScript, scriptVars)
+		for _, problem := range c.problems {
+			stderr("%v", problem)
+		}
+		if len(c.problems) > 0 {
+			return 1
+		}
+		return 0
+	}
+
 	if debug {
 		stderr("Running script from %s", scriptName)
 	}
 
-	err = execScript(rawScript)
+	err = execScript(scriptName, rawScript)
 	if err != nil {
+		if cerr, ok := err.(*commandError); ok {
+			return cerr.exit
+		}
 		stderr("script: %v", err)
 		return getErrorCode(err)
 	}
 	return 0
 }
 
-func execScript(rawScript []byte) error {
-	script := strings.Split(string(rawScript), "\n")
-	for i, s := range script {
-		s = strings.TrimSpace(s)
-		script[i] = s
+func execScript(name string, rawScript []byte) error {
+	// The flags of the script are reset once it runs its first command
+	keep, resume := scriptKeepOnFailure || scriptResume, scriptResume
 
-		if strings.HasPrefix(strings.ToLower(s), "run") && os.Geteuid() != 0 {
-			return fmt.Errorf("scripts using the run subcommand must be run as root")
-		}
-
-		if strings.HasPrefix(strings.ToLower(s), "end") {
-			return fmt.Errorf("calling end is unnecessary in a script, cleanup is done automatically")
-		}
+	p := newScriptParser(scriptVars)
+	err := p.parse(name, rawScript)
+	if err != nil {
+		return err
 	}
-	script = joinLines(script)
+	p.warnUnusedVars()
 
-	var tmpDir string
-	nestedScript := false
-	if inheritedPath := os.Getenv(nestedScriptEnvVar); inheritedPath != "" {
-		tmpDir = inheritedPath
-		nestedScript = true
-	} else {
-		var err error
-		tmpDir, err = ioutil.TempDir("", "acbuild")
-		if err != nil {
-			return err
+	// A script run by another shares its build
+	nestedScript := scriptLine != ""
+	start := 0
+	if !nestedScript {
+		// A build that may be kept is made in the work path, where it
+		// can be found again to be resumed
+		if !keep {
+			tmpDir, err := ioutil.TempDir("", "acbuild")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tmpDir)
+			contextpath = tmpDir
+		}
+		debug = true
+		if resume {
+			start, err = resumeScriptBuild(p.commands)
+			if err != nil {
+				return err
+			}
 		}
-		defer os.RemoveAll(tmpDir)
-		contextpath = tmpDir
 	}
 
-	a, err := newACBuild()
-	if err != nil {
-		return err
-	}
-	for _, line := range script {
-		if line == "" {
-			continue
+	for i := start; i < len(p.commands); i++ {
+		c := p.commands[i]
+		exit := execACBuild(c)
+		if exit == 0 && scriptBuild == nil {
+			err = holdScriptBuild()
+			if err != nil {
+				err = &scriptError{c.file, c.line, err}
+			}
 		}
-		err := execACBuild(tmpDir, line)
-		if err != nil {
-			if !strings.HasPrefix(line, "begin") && !nestedScript {
-				err1 := a.End()
+		if exit == 0 && err == nil && keep && !nestedScript && scriptBuild != nil {
+			err = saveScriptCheckpoint(p.commands[:i+1])
+		}
+		if exit != 0 || err != nil {
+			if !nestedScript {
+				var err1 error
+				if keep && scriptBuild != nil {
+					err1 = keepScriptBuild(c)
+				} else {
+					err1 = endScriptBuild()
+				}
 				if err1 != nil {
 					stderr("script: %v", err1)
 				}
 			}
-			return err
+			if err != nil {
+				return err
+			}
+			return &commandError{exit}
 		}
 	}
 	if !nestedScript {
-		err := a.End()
+		err := endScriptBuild()
 		if err != nil {
 			return err
 		}
@@ -133,29 +178,135 @@ func execScript(rawScript []byte) error {
 	return nil
 }
 
-func execACBuild(workPath, line string) error {
-	suppliedArgs, err := tokenizeLine(line)
+// holdScriptBuild makes the build begun by a script the one its commands
+// share, and takes the lock on it until the script is done. It does nothing if
+// the script hasn't begun its build yet.
+func holdScriptBuild() error {
+	bmode, err := lib.GetBuildMode(contextpath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	a, err := newACBuildWithBuildMode(bmode)
 	if err != nil {
 		return err
 	}
-	if len(suppliedArgs) == 0 {
+	err = a.Hold()
+	if err != nil {
+		return err
+	}
+	scriptBuild = a
+	return nil
+}
+
+// endScriptBuild ends the build begun by a script, if it got that far.
+func endScriptBuild() error {
+	if scriptBuild == nil {
 		return nil
 	}
-	suppliedArgs[0] = strings.ToLower(suppliedArgs[0])
-	if suppliedArgs[0] == "run" || suppliedArgs[0] == "set-exec" {
-		suppliedArgs = insertRunTacks(suppliedArgs)
+	a := scriptBuild
+	scriptBuild = nil
+	return a.End()
+}
+
+// execACBuild runs the acbuild command of a script in this process, and
+// returns its exit code. What it prints is prefixed with where it is in the
+// script.
+func execACBuild(c scriptCommand) (exit int) {
+	outerLine := scriptLine
+	scriptLine = fmt.Sprintf("%s:%d", c.file, c.line)
+	defer func() {
+		scriptLine = outerLine
+	}()
+
+	cmd, done, err := parseScriptCommand(c.args)
+	if err != nil {
+		stderr("%v", err)
+		return getErrorCode(errCobra)
+	}
+	defer done()
+
+	cmdExitCode = 0
+	cmd.Run(cmd, cmd.Flags().Args())
+	return cmdExitCode
+}
+
+// parseScriptCommand finds the command of a script in acbuild's command tree,
+// and parses its flags, which keep their values until done is called.
+func parseScriptCommand(args []string) (cmd *cobra.Command, done func(), err error) {
+	if args[0] == "run" || args[0] == "set-exec" {
+		args = insertRunTacks(args)
 	}
-	args := []string{"--debug", "--work-path=" + workPath}
-	args = append(args, suppliedArgs...)
-	cmd := exec.Command(os.Args[0], args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Env = os.Environ()
-	if suppliedArgs[0] == "script" {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", nestedScriptEnvVar, workPath))
+
+	cmd, flags, err := cmdAcbuild.Find(args)
+	if err != nil {
+		return nil, nil, err
 	}
-	return cmd.Run()
+	if !cmd.Runnable() {
+		var subcmds []string
+		for _, subcmd := range cmd.Commands() {
+			subcmds = append(subcmds, subcmd.Name())
+		}
+		return nil, nil, fmt.Errorf("%s needs a subcommand: %s", scriptCommandName(cmd), strings.Join(subcmds, ", "))
+	}
+
+	// The commands share their flags, so each one starts from the defaults,
+	// and can't change the flags acbuild was run with for the rest
+	persistent := make(map[string]string)
+	cmdAcbuild.PersistentFlags().VisitAll(func(f *pflag.Flag) {
+		persistent[f.Name] = f.Value.String()
+	})
+	done = func() {
+		resetFlags(cmd)
+		cmdAcbuild.PersistentFlags().VisitAll(func(f *pflag.Flag) {
+			f.Value.Set(persistent[f.Name])
+		})
+	}
+	resetFlags(cmd)
+
+	err = cmd.ParseFlags(flags)
+	if err != nil {
+		done()
+		return nil, nil, fmt.Errorf("%s: %v", scriptCommandName(cmd), err)
+	}
+	return cmd, done, nil
+}
+
+// scriptCommandName returns the name cmd is run with in a script, such as
+// "label add".
+func scriptCommandName(cmd *cobra.Command) string {
+	return strings.TrimPrefix(cmd.CommandPath(), cliName+" ")
+}
+
+// resetFlags puts the flags of cmd, other than the ones every command has,
+// back to their defaults.
+func resetFlags(cmd *cobra.Command) {
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if !f.Changed || cmdAcbuild.PersistentFlags().Lookup(f.Name) != nil {
+			return
+		}
+		// Values that are appended to can't be reset with Set
+		if r, ok := f.Value.(interface {
+			reset()
+		}); ok {
+			r.reset()
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	})
+}
+
+// commandError is returned by execScript when a command in the script fails.
+// The command has already printed why, so only its exit code is kept.
+type commandError struct {
+	exit int
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("exit status %d", e.exit)
 }
 
 func joinLines(script []string) []string {
@@ -169,14 +320,20 @@ func joinLines(script []string) []string {
 	return script
 }
 
-func tokenizeLine(line string) ([]string, error) {
+// tokenizeLine splits line into its words, expanding ${NAME} outside of single
+// quotes with the variables in vars, and leaving it as it is if NAME isn't one
+// of them. Variables aren't expanded if vars is nil.
+func tokenizeLine(line string, vars map[string]string) ([]string, error) {
 	var tokens []string
 	buf := &bytes.Buffer{}
+	inToken := false
 	inSingleQuoteBlock := false
 	inDoubleQuoteBlock := false
 	isEscaped := false
+	chars := []rune(line)
 lineLoop:
-	for _, char := range line {
+	for i := 0; i < len(chars); i++ {
+		char := chars[i]
 		if isEscaped {
 			buf.WriteRune(char)
 			isEscaped = false
@@ -185,23 +342,41 @@ lineLoop:
 		switch {
 		case char == '\\':
 			isEscaped = true
+			inToken = true
 		case (char == ' ' || char == '	') && !inSingleQuoteBlock && !inDoubleQuoteBlock:
-			if buf.Len() > 0 {
+			if inToken {
 				tokens = append(tokens, buf.String())
 				buf.Reset()
+				inToken = false
 			}
 		case char == '\'' && !inDoubleQuoteBlock:
 			inSingleQuoteBlock = !inSingleQuoteBlock
+			inToken = true
 		case char == '"' && !inSingleQuoteBlock:
 			inDoubleQuoteBlock = !inDoubleQuoteBlock
+			inToken = true
 		case char == '#' && !inSingleQuoteBlock && !inDoubleQuoteBlock:
-			if buf.Len() > 0 {
-				tokens = append(tokens, buf.String())
-				buf.Reset()
-			}
 			break lineLoop
+		case char == '$' && vars != nil && !inSingleQuoteBlock && i+1 < len(chars) && chars[i+1] == '{':
+			end := i + 2
+			for end < len(chars) && chars[end] != '}' {
+				end++
+			}
+			if end == len(chars) {
+				return nil, errBrace
+			}
+			// A variable the script doesn't set is left for the command,
+			// which may be a shell expanding it
+			value, ok := vars[string(chars[i+2:end])]
+			if !ok {
+				value = string(chars[i : end+1])
+			}
+			buf.WriteString(value)
+			inToken = true
+			i = end
 		default:
 			buf.WriteRune(char)
+			inToken = true
 		}
 	}
 	if inSingleQuoteBlock {
@@ -213,7 +388,7 @@ lineLoop:
 	if isEscaped {
 		return nil, errEscape
 	}
-	if buf.Len() > 0 {
+	if inToken {
 		tokens = append(tokens, buf.String())
 	}
 	return tokens, nil
@@ -228,7 +403,7 @@ func insertRunTacks(tokens []string) []string {
 		if tok == "--" {
 			return tokens
 		}
-		if tok[0] != '-' {
+		if !strings.HasPrefix(tok, "-") {
 			insertLocation = i
 			break
 		}
@@ -242,3 +417,35 @@ func insertRunTacks(tokens []string) []string {
 	newTokens = append(newTokens, tokens[insertLocation:]...)
 	return newTokens
 }
+
+// varlist is the variables given to a script with --var.
+type varlist map[string]string
+
+func (vl *varlist) String() string {
+	var strVars []string
+	for name, value := range *vl {
+		strVars = append(strVars, name+"="+value)
+	}
+	sort.Strings(strVars)
+	return strings.Join(strVars, " ")
+}
+
+func (vl *varlist) Set(input string) error {
+	parts := strings.SplitN(input, "=", 2)
+	if len(parts) != 2 || !validVarName(parts[0]) {
+		return fmt.Errorf("%q isn't NAME=VALUE", input)
+	}
+	if *vl == nil {
+		*vl = make(varlist)
+	}
+	(*vl)[parts[0]] = parts[1]
+	return nil
+}
+
+func (vl *varlist) Type() string {
+	return "Vars"
+}
+
+func (vl *varlist) reset() {
+	*vl = nil
+}
@@ -15,7 +15,17 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+
+	"github.com/spf13/pflag"
+
+	"github.com/containers/build/registry"
 )
 
 func TestJoinLines(t *testing.T) {
@@ -237,7 +247,7 @@ func TestTokenizeLine(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		output, err := tokenizeLine(c.input)
+		output, err := tokenizeLine(c.input, nil)
 		if err != c.err {
 			t.Errorf("error, expected:%v actual:%v", c.err, err)
 		}
@@ -247,6 +257,237 @@ func TestTokenizeLine(t *testing.T) {
 	}
 }
 
+func TestTokenizeLineVars(t *testing.T) {
+	vars := map[string]string{"NAME": "app", "EMPTY": "", "SPACE": "a b"}
+	type testcase struct {
+		input  string
+		output []string
+		err    bool
+	}
+	cases := []testcase{
+		testcase{
+			`set-name example.com/${NAME}`,
+			[]string{"set-name", "example.com/app"},
+			false,
+		},
+		testcase{
+			`run -- echo ${SPACE} "${SPACE}" '${SPACE}' \${SPACE}`,
+			[]string{"run", "--", "echo", "a b", "a b", "${SPACE}", "${SPACE}"},
+			false,
+		},
+		testcase{
+			`if ${EMPTY} == ""`,
+			[]string{"if", "", "==", ""},
+			false,
+		},
+		testcase{
+			`run -- echo ${UNDEFINED}`,
+			[]string{"run", "--", "echo", "${UNDEFINED}"},
+			false,
+		},
+		testcase{
+			`run -- sh -c "echo ${HOME} ${NAME}"`,
+			[]string{"run", "--", "sh", "-c", "echo ${HOME} app"},
+			false,
+		},
+		testcase{
+			`run -- echo ${NAME`,
+			nil,
+			true,
+		},
+	}
+	for _, c := range cases {
+		output, err := tokenizeLine(c.input, vars)
+		if (err != nil) != c.err {
+			t.Errorf("%q: unexpected error %v", c.input, err)
+		}
+		if !equal(output, c.output) {
+			t.Errorf("%q, expected:%q actual:%q", c.input, c.output, output)
+		}
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-script-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "common.acb"), []byte(`
+set-name example.com/${NAME}
+if ${ENV} == prod
+	set SUFFIX=
+else
+	set SUFFIX=-${ENV}
+endif
+`), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	script := `begin
+arg NAME=app
+arg ENV=dev
+include common.acb
+if ${ARCH} == amd64
+	run -- echo amd64
+else if ${ARCH} == arm64
+	run -- echo arm64 ${UNDEFINED_IN_SKIPPED_BRANCHES}
+else
+	run -- echo other
+endif
+if ${ENV} != prod
+	if ${NAME} == never
+		run -- echo never
+	endif
+	run -- \
+	  echo debug
+endif
+write ${NAME}${SUFFIX}.aci
+`
+	type testcase struct {
+		vars     varlist
+		commands []scriptCommand
+	}
+	name := filepath.Join(dir, "build.acb")
+	common := filepath.Join(dir, "common.acb")
+	arch := "other"
+	if runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64" {
+		arch = runtime.GOARCH
+	}
+	cases := []testcase{
+		testcase{
+			nil,
+			[]scriptCommand{
+				{name, 1, []string{"begin"}},
+				{common, 2, []string{"set-name", "example.com/app"}},
+				{name, 6, []string{"run", "--", "echo", arch}},
+				{name, 16, []string{"run", "--", "echo", "debug"}},
+				{name, 19, []string{"write", "app-dev.aci"}},
+			},
+		},
+		testcase{
+			varlist{"NAME": "web", "ENV": "prod", "ARCH": "amd64"},
+			[]scriptCommand{
+				{name, 1, []string{"begin"}},
+				{common, 2, []string{"set-name", "example.com/web"}},
+				{name, 6, []string{"run", "--", "echo", "amd64"}},
+				{name, 19, []string{"write", "web.aci"}},
+			},
+		},
+	}
+	for _, c := range cases {
+		p := newScriptParser(c.vars)
+		err := p.parse(name, []byte(script))
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		if !reflect.DeepEqual(p.commands, c.commands) {
+			t.Errorf("commands with %v, expected:\n%v\nactual:\n%v", c.vars, c.commands, p.commands)
+		}
+	}
+}
+
+func TestParseScriptErrors(t *testing.T) {
+	cases := map[string]string{
+		"begin\nrun -- echo ${NAME\n":       "build.acb:2: unterminated ${ block",
+		"if ${ARCH} == amd64\nbegin\n":      "build.acb:1: if without endif",
+		"begin\nelse\n":                     "build.acb:2: else without if",
+		"if a\nelse\nelse\nendif\n":         "build.acb:3: else after else",
+		"begin\nendif\n":                    "build.acb:2: endif without if",
+		"if a = b\nendif\n":                 "build.acb:1: the condition must be VALUE, VALUE == VALUE or VALUE != VALUE",
+		"set NAME\n":                        "build.acb:1: set takes NAME=VALUE",
+		"arg 1NAME=x\n":                     "build.acb:1: invalid variable name \"1NAME\"",
+		"begin\n\nend\n":                    "build.acb:3: calling end is unnecessary in a script, cleanup is done automatically",
+		"begin\nrun -- \\\n  echo ${NAME\n": "build.acb:2: unterminated ${ block",
+		"include build.acb\n":               "build.acb:1: build.acb includes itself",
+	}
+	for script, expected := range cases {
+		p := newScriptParser(nil)
+		err := p.parse("build.acb", []byte(script))
+		if err == nil || err.Error() != expected {
+			t.Errorf("%q, expected error:%q actual:%v", script, expected, err)
+		}
+	}
+}
+
+func TestCheckScript(t *testing.T) {
+	type testcase struct {
+		vars     varlist
+		problems []string
+	}
+	script := `arg MODE=appc
+begin --build-mode=${MODE}
+set-name example.com/app
+label add Version 1.0
+label add arch
+port add http sctp 80
+port add https tcp 443 --count 2
+label
+copy --bogus a b
+set-exec
+layer
+begin
+port add http tcp 65536
+`
+	cases := []testcase{
+		testcase{
+			nil,
+			[]string{
+				`build.acb:4: label add: ACIdentifier must contain only lower case alphanumeric characters plus "-._~/"`,
+				"build.acb:5: label add: expected 2 arguments, got 1",
+				`build.acb:6: port add: protocol must be tcp or udp, not "sctp"`,
+				"build.acb:8: label needs a subcommand: add, remove",
+				"build.acb:9: copy: unknown flag: --bogus",
+				"build.acb:10: set-exec: expected at least 1 argument, got 0",
+				"build.acb:11: layer: only supported in oci builds",
+				"build.acb:12: begin: a build has already begun",
+				"build.acb:13: port add: port must be a number between 0 and 65535",
+			},
+		},
+		testcase{
+			varlist{"MODE": "oci"},
+			[]string{
+				"build.acb:3: set-name: only supported in appc builds",
+				"build.acb:4: label add: only supported in appc builds",
+				"build.acb:5: label add: expected 2 arguments, got 1",
+				`build.acb:6: port add: protocol must be tcp or udp, not "sctp"`,
+				"build.acb:7: port add: --count is only supported in appc builds",
+				"build.acb:8: label needs a subcommand: add, remove",
+				"build.acb:9: copy: unknown flag: --bogus",
+				"build.acb:10: set-exec: expected at least 1 argument, got 0",
+				"build.acb:12: begin: a build has already begun",
+				"build.acb:13: port add: port must be a number between 0 and 65535",
+			},
+		},
+		testcase{
+			varlist{"MODE": "docker"},
+			[]string{
+				"build.acb:2: begin: invalid build mode: docker",
+				`build.acb:4: label add: ACIdentifier must contain only lower case alphanumeric characters plus "-._~/"`,
+				"build.acb:5: label add: expected 2 arguments, got 1",
+				`build.acb:6: port add: protocol must be tcp or udp, not "sctp"`,
+				"build.acb:8: label needs a subcommand: add, remove",
+				"build.acb:9: copy: unknown flag: --bogus",
+				"build.acb:10: set-exec: expected at least 1 argument, got 0",
+				"build.acb:12: begin: a build has already begun",
+				"build.acb:13: port add: port must be a number between 0 and 65535",
+			},
+		},
+	}
+	for _, c := range cases {
+		checker := &scriptChecker{}
+		checker.check("build.acb", []byte(script), c.vars)
+		var problems []string
+		for _, problem := range checker.problems {
+			problems = append(problems, problem.Error())
+		}
+		if !reflect.DeepEqual(problems, c.problems) {
+			t.Errorf("problems with %v, expected:\n%s\nactual:\n%s", c.vars, strings.Join(c.problems, "\n"), strings.Join(problems, "\n"))
+		}
+	}
+}
+
 func TestInsertRunTacks(t *testing.T) {
 	type testcase struct {
 		input  []string
@@ -277,6 +518,14 @@ func TestInsertRunTacks(t *testing.T) {
 			[]string{"run", "--foo", "--", "test", "--bar"},
 			[]string{"run", "--foo", "--", "test", "--bar"},
 		},
+		testcase{
+			[]string{"run", "", "foo"},
+			[]string{"run", "--", "", "foo"},
+		},
+		testcase{
+			[]string{"set-exec", ""},
+			[]string{"set-exec", "--", ""},
+		},
 	}
 	for _, c := range cases {
 		output := insertRunTacks(c.input)
@@ -298,3 +547,33 @@ func equal(s1 []string, s2 []string) bool {
 	}
 	return true
 }
+
+func TestResetFlags(t *testing.T) {
+	err := cmdRun.ParseFlags([]string{"--trusted-keys=/a,/b", "--dns", "10.0.0.1", "--bind", "/src:/dst", "--memory", "1g", "--working-dir", "/app", "--", "true"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	resetFlags(cmdRun)
+	if !reflect.DeepEqual(trustedKeys, registry.DefaultTrustedKeysPaths) {
+		t.Errorf("trusted keys weren't reset: %v", trustedKeys)
+	}
+	if dnsServers != nil || binds != nil || memoryLimit != 0 || workingdir != "" {
+		t.Errorf("flags weren't reset: dns:%v bind:%v memory:%d working-dir:%q", dnsServers, binds, memoryLimit, workingdir)
+	}
+	cmdRun.Flags().VisitAll(func(f *pflag.Flag) {
+		if f.Changed && cmdAcbuild.PersistentFlags().Lookup(f.Name) == nil {
+			t.Errorf("--%s is still changed", f.Name)
+		}
+	})
+
+	// Once reset, a list replaces its default again rather than being
+	// appended to
+	err = cmdRun.ParseFlags([]string{"--trusted-keys=/c"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer resetFlags(cmdRun)
+	if !reflect.DeepEqual(trustedKeys, []string{"/c"}) {
+		t.Errorf("trusted keys, expected:[/c] actual:%v", trustedKeys)
+	}
+}
@@ -15,16 +15,29 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/containers/build/util"
+	"github.com/containers/build/util/gpg"
 )
 
 var (
-	overwrite = false
-	sign      = false
-	cmdWrite  = &cobra.Command{
+	overwrite      = false
+	sign           = false
+	signKeyring    = ""
+	signKey        = ""
+	gpgAgentSocket = ""
+	compression    = ""
+	compressionLvl = 0
+	cmdWrite       = &cobra.Command{
 		Use:     "write ACI_PATH",
-		Short:   "Write the image from the current build to a file",
-		Example: "acbuild write --sign mynewapp.aci -- --no-default-keyring --keyring ./rkt.gpg",
+		Short:   "Write the image from the current build to a file, or to stdout if the path is -",
+		Example: "acbuild write --sign --keyring ./signing-key.gpg mynewapp.aci",
 		Run:     runWrapper(runWrite),
 	}
 )
@@ -33,20 +46,39 @@ func init() {
 	cmdAcbuild.AddCommand(cmdWrite)
 
 	cmdWrite.Flags().BoolVar(&overwrite, "overwrite", false, "overwrite the resulting ACI")
-	cmdWrite.Flags().BoolVar(&sign, "sign", false, "(removed) sign the resulting ACI")
+	cmdWrite.Flags().StringVar(&compression, "compression", "gzip", "how the image is compressed. Accepts: none, gzip, zstd (oci build mode only), xz")
+	cmdWrite.Flags().IntVar(&compressionLvl, "compression-level", 0, "the level to compress the image at, or 0 for the default level")
+	cmdWrite.Flags().BoolVar(&sign, "sign", false, "sign the resulting image")
+	cmdWrite.Flags().StringVar(&signKeyring, "keyring", "", "keyring file holding the key to sign with")
+	cmdWrite.Flags().StringVar(&signKey, "signing-key", "", "ID, fingerprint, or user ID of the key in the keyring to sign with")
+	cmdWrite.Flags().StringVar(&gpgAgentSocket, "gpg-agent-socket", "", "sign with the private key held by the gpg-agent listening on this socket")
 }
 
 func runWrite(cmd *cobra.Command, args []string) (exit int) {
-	if sign {
-		stderr("write: the sign flag has been removed, please invoke gpg directly")
+	if len(args) != 1 {
+		cmd.Usage()
 		return 1
 	}
 
-	if len(args) != 1 {
-		cmd.Usage()
+	imageCompression, err := util.ParseCompression(compression, compressionLvl)
+	if err != nil {
+		stderr("write: %v", err)
 		return 1
 	}
 
+	if args[0] == "-" {
+		return runWriteStream(imageCompression)
+	}
+
+	var signer *openpgp.Entity
+	if sign {
+		signer, err = loadSigner()
+		if err != nil {
+			stderr("write: %v", err)
+			return 1
+		}
+	}
+
 	if debug {
 		stderr("Writing ACI to %s", args[0])
 	}
@@ -56,7 +88,9 @@ func runWrite(cmd *cobra.Command, args []string) (exit int) {
 		stderr("%v", err)
 		return 1
 	}
-	id, err := a.Write(args[0], overwrite)
+	a.ImageCompression = imageCompression
+	a.ImageCompressionLevel = compressionLvl
+	id, err := a.Write(args[0], overwrite, signer)
 
 	if err != nil {
 		stderr("write: %v", err)
@@ -65,3 +99,75 @@ func runWrite(cmd *cobra.Command, args []string) (exit int) {
 	stdout(id)
 	return 0
 }
+
+// runWriteStream writes the image to stdout, so it can be piped into another
+// program. The image's ID is printed to stderr instead of stdout.
+func runWriteStream(imageCompression util.Compression) (exit int) {
+	if sign {
+		stderr("write: images written to stdout can't be signed")
+		return 1
+	}
+	if terminal.IsTerminal(int(os.Stdout.Fd())) {
+		stderr("write: refusing to write the image to a terminal")
+		return 1
+	}
+
+	if debug {
+		stderr("Writing image to stdout")
+	}
+
+	a, err := newACBuild()
+	if err != nil {
+		stderr("%v", err)
+		return 1
+	}
+	a.ImageCompression = imageCompression
+	a.ImageCompressionLevel = compressionLvl
+	id, err := a.WriteStream(os.Stdout)
+
+	if err != nil {
+		stderr("write: %v", err)
+		return getErrorCode(err)
+	}
+	stderr("%s", id)
+	return 0
+}
+
+// loadSigner finds the key picked by the signing flags, prompting for its
+// passphrase on the terminal if it's encrypted.
+func loadSigner() (*openpgp.Entity, error) {
+	if signKeyring == "" {
+		return nil, fmt.Errorf("--keyring is required when signing")
+	}
+	keyring, err := gpg.LoadKeyring(signKeyring)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := gpg.SelectKey(keyring, signKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if gpgAgentSocket != "" {
+		err = gpg.UseAgent(signer, gpgAgentSocket)
+		if err != nil {
+			return nil, err
+		}
+		return signer, nil
+	}
+
+	err = gpg.Unlock(signer, func() ([]byte, error) {
+		fd := int(os.Stdin.Fd())
+		if !terminal.IsTerminal(fd) {
+			return nil, fmt.Errorf("signing key is encrypted and stdin is not a terminal")
+		}
+		fmt.Fprintf(os.Stderr, "Passphrase for %s: ", signer.PrimaryKey.KeyIdString())
+		pass, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return pass, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
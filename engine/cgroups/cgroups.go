@@ -0,0 +1,480 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cgroups runs commands in cgroups, which limit the resources they may
+// use and keep track of every process they start, so that those can be killed
+// when the command times out or exits.
+//
+// The unified cgroup v2 hierarchy is used where it's mounted at /sys/fs/cgroup,
+// and otherwise a cgroup is made in each of the cgroup v1 hierarchies needed.
+package cgroups
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coreos/rkt/pkg/multicall"
+
+	"github.com/containers/build/engine"
+)
+
+const (
+	root = "/sys/fs/cgroup"
+	// parentName is the cgroup the cgroups of commands are made in.
+	parentName = "acbuild"
+
+	cgroup2SuperMagic = 0x63677270
+
+	// cpuPeriod is the period CPU time is limited over, in microseconds.
+	cpuPeriod = 100000
+
+	// killTimeout is how long the processes in a cgroup are waited on to
+	// exit once they've been killed.
+	killTimeout = 10 * time.Second
+)
+
+var execEntrypoint multicall.Entrypoint
+
+func init() {
+	execEntrypoint = multicall.Add("acbuild-cgroup-exec", runExec)
+}
+
+// Cgroup is a cgroup a command is run in.
+type Cgroup struct {
+	// paths holds the directory of the cgroup in each hierarchy it was made
+	// in. There's only one with cgroup v2.
+	paths []string
+	// unified is whether the cgroup is in the cgroup v2 hierarchy.
+	unified bool
+	// freezer is the directory of the cgroup in the cgroup v1 freezer
+	// hierarchy, if it's mounted.
+	freezer string
+}
+
+// New makes a cgroup that limits what the processes in it may use to limits.
+// Destroy must be called on it once the command run in it has exited.
+func New(limits engine.Limits) (*Cgroup, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(root, &st)
+	if err != nil {
+		return nil, fmt.Errorf("cgroups aren't mounted at %s: %v", root, err)
+	}
+	name := strconv.Itoa(os.Getpid())
+
+	var c *Cgroup
+	if int64(st.Type) == cgroup2SuperMagic {
+		c, err = newUnified(name, limits)
+	} else {
+		c, err = newV1(name, limits)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error making cgroup: %v", err)
+	}
+
+	err = c.limit(limits)
+	if err != nil {
+		c.Destroy()
+		return nil, fmt.Errorf("error limiting resources: %v", err)
+	}
+	return c, nil
+}
+
+func newUnified(name string, limits engine.Limits) (*Cgroup, error) {
+	var controllers []string
+	if limits.Memory != 0 {
+		controllers = append(controllers, "memory")
+	}
+	if limits.CPUs != 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if limits.Pids != 0 {
+		controllers = append(controllers, "pids")
+	}
+
+	parent := filepath.Join(root, parentName)
+	err := os.MkdirAll(parent, 0755)
+	if err != nil {
+		return nil, err
+	}
+	// The parent has no processes in it, so unlike the cgroup acbuild is
+	// in it may pass the controllers on to the command's
+	for _, dir := range []string{root, parent} {
+		for _, controller := range controllers {
+			err := writeFile(filepath.Join(dir, "cgroup.subtree_control"), "+"+controller)
+			if err != nil {
+				return nil, fmt.Errorf("error enabling the %s controller: %v", controller, err)
+			}
+		}
+	}
+
+	dir := filepath.Join(parent, name)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Cgroup{paths: []string{dir}, unified: true}, nil
+}
+
+func newV1(name string, limits engine.Limits) (*Cgroup, error) {
+	mounts, err := v1Mounts()
+	if err != nil {
+		return nil, err
+	}
+
+	// The pids hierarchy is always used, to keep track of the processes
+	controllers := []string{"pids"}
+	if limits.Memory != 0 {
+		controllers = append(controllers, "memory")
+	}
+	if limits.CPUs != 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if _, ok := mounts["freezer"]; ok {
+		controllers = append(controllers, "freezer")
+	}
+
+	c := &Cgroup{}
+	for _, controller := range controllers {
+		mount, ok := mounts[controller]
+		if !ok {
+			c.Destroy()
+			return nil, fmt.Errorf("the %s controller isn't mounted", controller)
+		}
+		dir := filepath.Join(mount, parentName, name)
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			c.Destroy()
+			return nil, err
+		}
+		c.paths = append(c.paths, dir)
+		if controller == "freezer" {
+			c.freezer = dir
+		}
+	}
+	return c, nil
+}
+
+// v1Mounts returns where each cgroup v1 controller is mounted.
+func v1Mounts() (map[string]string, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] != "cgroup" {
+			continue
+		}
+		for _, option := range strings.Split(fields[3], ",") {
+			if _, ok := mounts[option]; !ok {
+				mounts[option] = fields[1]
+			}
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+func (c *Cgroup) limit(limits engine.Limits) error {
+	var files [][2]string
+	if c.unified {
+		if limits.Memory != 0 {
+			files = append(files, [2]string{"memory.max", strconv.FormatInt(limits.Memory, 10)})
+			// Without this the limit could be dodged by swapping
+			if c.exists("memory.swap.max") {
+				files = append(files, [2]string{"memory.swap.max", "0"})
+			}
+		}
+		if limits.CPUs != 0 {
+			files = append(files, [2]string{"cpu.max", fmt.Sprintf("%d %d", int64(limits.CPUs*cpuPeriod), cpuPeriod)})
+		}
+	} else {
+		if limits.Memory != 0 {
+			files = append(files, [2]string{"memory.limit_in_bytes", strconv.FormatInt(limits.Memory, 10)})
+			if c.exists("memory.memsw.limit_in_bytes") {
+				files = append(files, [2]string{"memory.memsw.limit_in_bytes", strconv.FormatInt(limits.Memory, 10)})
+			}
+		}
+		if limits.CPUs != 0 {
+			files = append(files,
+				[2]string{"cpu.cfs_period_us", strconv.Itoa(cpuPeriod)},
+				[2]string{"cpu.cfs_quota_us", strconv.FormatInt(int64(limits.CPUs*cpuPeriod), 10)})
+		}
+	}
+	if limits.Pids != 0 {
+		files = append(files, [2]string{"pids.max", strconv.FormatInt(limits.Pids, 10)})
+	}
+
+	for _, file := range files {
+		p, ok := c.find(file[0])
+		if !ok {
+			return fmt.Errorf("%s isn't supported", file[0])
+		}
+		err := writeFile(p, file[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// find returns the path of the file of the cgroup with the given name, in
+// whichever hierarchy has it.
+func (c *Cgroup) find(name string) (string, bool) {
+	for _, dir := range c.paths {
+		p := filepath.Join(dir, name)
+		if _, err := os.Stat(p); err == nil {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+func (c *Cgroup) exists(name string) bool {
+	_, ok := c.find(name)
+	return ok
+}
+
+// Wrap changes cmd, which mustn't have been started, so that it's run in the
+// cgroup. The process is put in the cgroup before the command is executed, so
+// that every process it starts is in it too.
+func (c *Cgroup) Wrap(cmd *exec.Cmd) {
+	args := append(append([]string{}, c.paths...), "--", cmd.Path)
+	args = append(args, cmd.Args...)
+	wrapped := execEntrypoint.Cmd(args...)
+	cmd.Path = wrapped.Path
+	cmd.Args = wrapped.Args
+}
+
+// runExec puts itself in the cgroups given as its arguments, and executes the
+// command that follows them.
+func runExec() error {
+	args := os.Args[1:]
+	i := 0
+	for i < len(args) && args[i] != "--" {
+		i++
+	}
+	if len(args)-i < 3 {
+		return fmt.Errorf("usage: %s CGROUP... -- PATH ARG0 [ARGS]", os.Args[0])
+	}
+	for _, dir := range args[:i] {
+		err := writeFile(filepath.Join(dir, "cgroup.procs"), "0")
+		if err != nil {
+			return fmt.Errorf("error joining cgroup: %v", err)
+		}
+	}
+	return syscall.Exec(args[i+1], args[i+2:], os.Environ())
+}
+
+// Wait waits for cmd, which must have been wrapped with Wrap, to exit. If
+// timeout isn't 0 and passes first, every process in the cgroup is killed.
+func (c *Cgroup) Wait(cmd *exec.Cmd, timeout time.Duration) error {
+	if timeout == 0 {
+		return cmd.Wait()
+	}
+	timedOut := make(chan error, 1)
+	timer := time.AfterFunc(timeout, func() {
+		timedOut <- c.Kill()
+	})
+	err := cmd.Wait()
+	if timer.Stop() {
+		return err
+	}
+	if killErr := <-timedOut; killErr != nil {
+		return fmt.Errorf("command timed out after %v, and couldn't be killed: %v", timeout, killErr)
+	}
+	return fmt.Errorf("command timed out after %v", timeout)
+}
+
+// Kill kills every process in the cgroup, and waits for them to exit.
+func (c *Cgroup) Kill() error {
+	if c.unified {
+		killFile := filepath.Join(c.paths[0], "cgroup.kill")
+		if _, err := os.Stat(killFile); err == nil {
+			err := writeFile(killFile, "1")
+			if err != nil {
+				return err
+			}
+			return c.waitEmpty()
+		}
+	}
+
+	deadline := time.Now().Add(killTimeout)
+	for {
+		// Freezing the processes first keeps them from starting others
+		// while they're killed
+		err := c.freeze(true)
+		if err != nil {
+			return err
+		}
+		pids, err := c.pids()
+		if err != nil {
+			c.freeze(false)
+			return err
+		}
+		for _, pid := range pids {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+		err = c.freeze(false)
+		if err != nil {
+			return err
+		}
+		if len(pids) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("processes are still running: %v", pids)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// freeze freezes or thaws the processes in the cgroup, if that's supported.
+func (c *Cgroup) freeze(frozen bool) error {
+	switch {
+	case c.unified && c.exists("cgroup.freeze"):
+		value := "0"
+		if frozen {
+			value = "1"
+		}
+		return writeFile(filepath.Join(c.paths[0], "cgroup.freeze"), value)
+	case c.freezer != "":
+		state := "THAWED"
+		if frozen {
+			state = "FROZEN"
+		}
+		err := writeFile(filepath.Join(c.freezer, "freezer.state"), state)
+		if err != nil || !frozen {
+			return err
+		}
+		// Freezing takes a while to finish
+		deadline := time.Now().Add(killTimeout)
+		for {
+			blob, err := ioutil.ReadFile(filepath.Join(c.freezer, "freezer.state"))
+			if err != nil {
+				return err
+			}
+			if strings.TrimSpace(string(blob)) == "FROZEN" {
+				return nil
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("processes couldn't be frozen")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return nil
+}
+
+func (c *Cgroup) waitEmpty() error {
+	deadline := time.Now().Add(killTimeout)
+	for {
+		pids, err := c.pids()
+		if err != nil {
+			return err
+		}
+		if len(pids) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("processes are still running: %v", pids)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// pids returns the processes in the cgroup, and the cgroups below it, which
+// engines such as systemd-nspawn make.
+func (c *Cgroup) pids() ([]int, error) {
+	var pids []int
+	err := filepath.Walk(c.paths[0], func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		blob, err := ioutil.ReadFile(filepath.Join(p, "cgroup.procs"))
+		if err != nil {
+			return err
+		}
+		for _, field := range strings.Fields(string(blob)) {
+			pid, err := strconv.Atoi(field)
+			if err != nil {
+				return err
+			}
+			pids = append(pids, pid)
+		}
+		return nil
+	})
+	return pids, err
+}
+
+// Destroy kills any processes left in the cgroup, such as daemons the command
+// started, and removes it.
+func (c *Cgroup) Destroy() error {
+	var err error
+	if len(c.paths) > 0 {
+		err = c.Kill()
+	}
+	for _, dir := range c.paths {
+		err1 := removeCgroup(dir)
+		if err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// removeCgroup removes the cgroup at dir, and the ones below it.
+func removeCgroup(dir string) error {
+	var dirs []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		dirs = append(dirs, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// The cgroup is busy until the killed processes have been reaped
+		deadline := time.Now().Add(killTimeout)
+		for {
+			err = os.Remove(dirs[i])
+			if err == nil || os.IsNotExist(err) {
+				break
+			}
+			if err.(*os.PathError).Err != syscall.EBUSY || time.Now().After(deadline) {
+				return err
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+func writeFile(p, value string) error {
+	return ioutil.WriteFile(p, []byte(value), 0644)
+}
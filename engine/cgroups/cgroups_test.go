@@ -0,0 +1,104 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroups
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coreos/rkt/pkg/multicall"
+
+	"github.com/containers/build/engine"
+)
+
+func TestMain(m *testing.M) {
+	// Wrap runs commands through the test binary
+	multicall.MaybeExec()
+	os.Exit(m.Run())
+}
+
+func TestTimeout(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; cgroups can only be made as root")
+	}
+	c, err := New(engine.Limits{Pids: 10})
+	if err != nil {
+		t.Skipf("skipping test; cgroups aren't usable: %v", err)
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", "sleep 1000 & echo $!; sleep 1000")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	c.Wrap(cmd)
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	buf := make([]byte, 32)
+	n, err := stdout.Read(buf)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	child, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	start := time.Now()
+	err = c.Wait(cmd, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("the command wasn't killed when it timed out")
+	}
+	if !exited(child) {
+		t.Errorf("the command's child wasn't killed when it timed out")
+	}
+
+	err = c.Destroy()
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	for _, dir := range c.paths {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("cgroup %s wasn't removed", dir)
+		}
+	}
+}
+
+// exited returns whether the process with the given pid has exited, though it
+// might not have been reaped yet.
+func exited(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	if err == syscall.ESRCH {
+		return true
+	}
+	blob, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+	// The state follows the command, which is in parentheses
+	fields := strings.Fields(string(blob[strings.LastIndex(string(blob), ")")+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
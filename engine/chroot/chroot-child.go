@@ -23,28 +23,17 @@ import (
 	"syscall"
 
 	"github.com/spf13/cobra"
+
+	"github.com/containers/build/engine"
+	"github.com/containers/build/engine/mounts"
+	"github.com/containers/build/engine/network"
 )
 
-func init() {
-	cmdACBuildChroot.PersistentFlags().StringVar(&flagCmd, "cmd", "", "The command to run")
-	cmdACBuildChroot.PersistentFlags().StringSliceVar(&flagArgs, "args", nil, "arguments for the command")
-	cmdACBuildChroot.PersistentFlags().StringSliceVar(&flagEnv, "env", nil, "environment for the command")
-	cmdACBuildChroot.PersistentFlags().StringVar(&flagChroot, "chroot", "", "dir to chroot into")
-	cmdACBuildChroot.PersistentFlags().StringVar(&flagWorkingDir, "working-dir", "", "working directory for the command")
+var cmdACBuildChroot = &cobra.Command{
+	Use: "",
+	Run: runChroot,
 }
 
-var (
-	flagCmd          string
-	flagArgs         []string
-	flagEnv          []string
-	flagChroot       string
-	flagWorkingDir   string
-	cmdACBuildChroot = &cobra.Command{
-		Use: "",
-		Run: runChroot,
-	}
-)
-
 func stderr(format string, a ...interface{}) {
 	out := fmt.Sprintf(format, a...)
 	fmt.Fprintln(os.Stderr, strings.TrimSuffix(out, "\n"))
@@ -57,7 +46,38 @@ func errAndExit(format string, a ...interface{}) {
 
 func runChroot(cmd *cobra.Command, args []string) {
 	runtime.LockOSThread()
-	err := syscall.Chroot(flagChroot)
+	specFile := os.NewFile(3, "spec")
+	sp, err := readSpec(specFile)
+	if err != nil {
+		errAndExit("couldn't read spec: %v", err)
+	}
+	specFile.Close()
+
+	var proxySock *os.File
+	if sp.Network == engine.NetworkPrivate {
+		proxySock = os.NewFile(4, "netns-child")
+	}
+	err = network.SetUp(sp.Network, proxySock)
+	if err != nil {
+		errAndExit("couldn't set up network: %v", err)
+	}
+
+	// The command was cloned into a mount namespace of its own, which its
+	// mounts mustn't propagate out of
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		errAndExit("couldn't make mounts private: %v", err)
+	}
+	err = mounts.MountAPIFilesystems(sp.Chroot)
+	if err != nil {
+		errAndExit("couldn't mount: %v", err)
+	}
+	_, err = mounts.SetUp(sp.Chroot, sp.Binds, sp.Secrets, sp.Credential)
+	if err != nil {
+		errAndExit("couldn't mount: %v", err)
+	}
+
+	err = syscall.Chroot(sp.Chroot)
 	if err != nil {
 		errAndExit("couldn't chroot: %v", err)
 	}
@@ -66,19 +86,25 @@ func runChroot(cmd *cobra.Command, args []string) {
 		errAndExit("couldn't cd: %v", err)
 	}
 
-	if flagWorkingDir != "" {
-		err = os.Chdir(flagWorkingDir)
+	if sp.WorkingDir != "" {
+		err = os.Chdir(sp.WorkingDir)
 		if err != nil {
 			errAndExit("couldn't cd: %v", err)
 		}
 	}
 
-	execCmd := exec.Command(flagCmd, flagArgs...)
-	execCmd.Env = flagEnv
+	execCmd := exec.Command(sp.Command, sp.Args...)
+	execCmd.Env = sp.Env
 	execCmd.Stdin = os.Stdin
 	execCmd.Stdout = os.Stdout
 	execCmd.Stderr = os.Stderr
+	if c := sp.Credential; c != nil {
+		execCmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: c.UID, Gid: c.GID, Groups: c.Groups},
+		}
+	}
 	err = execCmd.Run()
+	killRemaining()
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			code := exitErr.Sys().(syscall.WaitStatus).ExitStatus()
@@ -87,3 +113,22 @@ func runChroot(cmd *cobra.Command, args []string) {
 		errAndExit("%v", err)
 	}
 }
+
+// killRemaining kills and reaps every process the command left running, such
+// as daemons started by a package's install scripts. acbuild-chroot is the
+// init of the command's PID namespace, so this is every other process in it.
+func killRemaining() {
+	err := syscall.Kill(-1, syscall.SIGKILL)
+	if err != nil && err != syscall.ESRCH {
+		stderr("couldn't kill remaining processes: %v", err)
+	}
+	for {
+		_, err := syscall.Wait4(-1, nil, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
+}
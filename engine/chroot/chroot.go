@@ -15,25 +15,54 @@
 package chroot
 
 import (
+	"encoding/gob"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"syscall"
 
 	"github.com/containers/build/engine"
+	"github.com/containers/build/engine/cgroups"
+	"github.com/containers/build/engine/mounts"
+	"github.com/containers/build/engine/network"
 	"github.com/coreos/rkt/pkg/fileutil"
 	"github.com/coreos/rkt/pkg/multicall"
 )
 
 type Engine struct{}
 
+// cloneflags are the namespaces acbuild-chroot is cloned into, so that /proc
+// can be mounted for the command and nothing it starts outlives it.
+const cloneflags = syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+
+// spec is what acbuild-chroot is told to run, and how. It's written to a pipe
+// acbuild-chroot inherits as file descriptor 3. gob is used rather than JSON,
+// which would replace bytes that aren't valid UTF-8, so that the arguments and
+// environment reach the command exactly as they were given.
+type spec struct {
+	Command    string
+	Args       []string
+	Env        []string
+	Chroot     string
+	WorkingDir string
+	Network    engine.Network
+	Binds      []engine.Bind
+	Secrets    []engine.Secret
+	Credential *engine.Credential
+}
+
 func init() {
 	multicall.Add("acbuild-chroot", cmdACBuildChroot.Execute)
 }
 
-func (e Engine) Run(command string, args []string, environment map[string]string, chroot, workingDir string) error {
+func (e Engine) Run(command string, args []string, environment map[string]string, chroot, workingDir string, opts engine.RunOptions) (err error) {
 	resolvConfFile := filepath.Join(chroot, "/etc/resolv.conf")
-	_, err := os.Stat(resolvConfFile)
+	_, err = os.Stat(resolvConfFile)
 	switch {
+	case os.IsNotExist(err) && opts.Isolated():
+		// The host's nameservers can't be reached from the command's network
 	case os.IsNotExist(err):
 		err := os.MkdirAll(filepath.Dir(resolvConfFile), 0755)
 		if err != nil {
@@ -47,20 +76,6 @@ func (e Engine) Run(command string, args []string, environment map[string]string
 	case err != nil:
 		return err
 	}
-	var serializedArgs string
-	for _, arg := range args {
-		if serializedArgs != "" {
-			serializedArgs += ","
-		}
-		serializedArgs += arg
-	}
-	var serializedEnv string
-	for name, value := range environment {
-		if serializedEnv != "" {
-			serializedEnv += ","
-		}
-		serializedEnv += name + "=" + value
-	}
 	path := "PATH="
 	for _, p := range engine.Pathlist {
 		if path != "PATH=" {
@@ -68,21 +83,100 @@ func (e Engine) Run(command string, args []string, environment map[string]string
 		}
 		path += p
 	}
-	chrootArgs := []string{
-		"--cmd", command,
-		"--chroot", chroot,
-		"--working-dir", workingDir,
+	sp := spec{
+		Command:    command,
+		Args:       args,
+		Chroot:     chroot,
+		WorkingDir: workingDir,
+		Network:    opts.Network,
+		Binds:      opts.Binds,
+		Secrets:    opts.Secrets,
+		Credential: opts.Credential,
+	}
+	for name, value := range environment {
+		sp.Env = append(sp.Env, name+"="+value)
 	}
-	if len(serializedArgs) > 0 {
-		chrootArgs = append(chrootArgs, "--args", serializedArgs)
+
+	removeAPIDirs, err := mounts.MakeAPIDirs(chroot)
+	if err != nil {
+		return err
 	}
-	if len(serializedEnv) > 0 {
-		chrootArgs = append(chrootArgs, "--env", serializedEnv)
+	defer removeAPIDirs()
+
+	ns, err := network.NewNamespace(opts)
+	if err != nil {
+		return err
 	}
-	cmd := exec.Command("acbuild-chroot", chrootArgs...)
+	defer ns.Close()
+
+	specReader, specWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer specWriter.Close()
+	defer specReader.Close()
+
+	cmd := exec.Command("acbuild-chroot")
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Env = []string{path}
-	return cmd.Run()
+	cmd.ExtraFiles = []*os.File{specReader}
+	if f := ns.ChildFile(); f != nil {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: cloneflags | ns.Cloneflags()}
+
+	var cg *cgroups.Cgroup
+	if opts.Limits != (engine.Limits{}) || opts.Timeout != 0 {
+		cg, err = cgroups.New(opts.Limits)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err1 := cg.Destroy(); err == nil {
+				err = err1
+			}
+		}()
+		cg.Wrap(cmd)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	specReader.Close()
+	err = writeSpec(specWriter, sp)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("error writing spec: %v", err)
+	}
+	serveErr := ns.Serve()
+	if cg != nil {
+		err = cg.Wait(cmd, opts.Timeout)
+	} else {
+		err = cmd.Wait()
+	}
+	if err != nil {
+		// The command's error explains why the namespace wasn't set up
+		return err
+	}
+	return serveErr
+}
+
+// writeSpec writes sp to w and closes it.
+func writeSpec(w io.WriteCloser, sp spec) error {
+	err := gob.NewEncoder(w).Encode(sp)
+	if err1 := w.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// readSpec reads the spec writeSpec wrote to r.
+func readSpec(r io.Reader) (spec, error) {
+	var sp spec
+	err := gob.NewDecoder(r).Decode(&sp)
+	return sp, err
 }
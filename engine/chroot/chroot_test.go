@@ -0,0 +1,50 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chroot
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSpecRoundTrip(t *testing.T) {
+	sp := spec{
+		Command: "/bin/sh",
+		Args:    []string{"-c", "echo a,b", "line one\nline two", "a=b=c", "", "\x00\xff"},
+		Env: []string{
+			"JAVA_OPTS=-Xa,-Xb",
+			"MULTILINE=one\ntwo",
+			"EQUALS=a=b",
+			"EMPTY=",
+		},
+		Chroot:     "/var/lib/acbuild/target,1",
+		WorkingDir: "/work dir",
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer r.Close()
+	go writeSpec(w, sp)
+	got, err := readSpec(r)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(got, sp) {
+		t.Errorf("spec changed on the way\nexpected: %#v\ngot:      %#v", sp, got)
+	}
+}
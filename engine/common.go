@@ -14,9 +14,110 @@
 
 package engine
 
+import (
+	"time"
+)
+
 var Pathlist = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin",
 	"/usr/bin", "/sbin", "/bin"}
 
+// Network is the network a command is run with.
+type Network string
+
+const (
+	// NetworkHost shares the host's network with the command.
+	NetworkHost Network = "host"
+	// NetworkNone runs the command in a network namespace of its own, with
+	// nothing but a loopback interface.
+	NetworkNone Network = "none"
+	// NetworkPrivate is like NetworkNone, except that the command can reach
+	// the hosts in RunOptions.ProxyAllowlist through an HTTP proxy.
+	NetworkPrivate Network = "private"
+)
+
+// RunOptions holds the settings a command is run with, besides the command
+// itself and the container it is run in.
+type RunOptions struct {
+	// Network is the network the command is run with. It is the host's
+	// network if empty.
+	Network Network
+	// ProxyAllowlist holds the hosts the proxy of a private network lets
+	// requests through to, as "host" or "host:port", where host may start
+	// with "*." to match any of its subdomains.
+	ProxyAllowlist []string
+	// Hosts holds entries added to /etc/hosts while the command is run, as
+	// "host:ip".
+	Hosts []string
+	// DNS holds the nameservers written to /etc/resolv.conf while the
+	// command is run. The engine leaves /etc/resolv.conf alone if it's set.
+	DNS []string
+	// Binds holds host paths mounted into the container while the command
+	// is run.
+	Binds []Bind
+	// Secrets holds files mounted in SecretsDir while the command is run,
+	// from a tmpfs so that they're never written to the image.
+	Secrets []Secret
+	// Limits holds the resources the command may use.
+	Limits Limits
+	// Timeout is how long the command may run for before it and every
+	// process it started are killed. It may run forever if Timeout is 0.
+	Timeout time.Duration
+	// User is the user, and optionally group, the command is run as, given
+	// as NAME|UID[:GROUP]. lib.Run resolves it into Credential against the
+	// image's /etc/passwd and /etc/group.
+	User string
+	// Credential is who the command is run as. It's run as root if nil.
+	Credential *Credential
+}
+
+// Credential is the user and groups a command is run as.
+type Credential struct {
+	UID uint32
+	GID uint32
+	// Groups holds the supplementary groups.
+	Groups []uint32
+	// Name is the user's name in the image's /etc/passwd, or "" if they
+	// aren't in it.
+	Name string
+}
+
+// Limits holds the resources a command may use, which are enforced with
+// cgroups. Zero values mean there's no limit.
+type Limits struct {
+	// Memory is the most memory the command may use, in bytes.
+	Memory int64
+	// CPUs is how many CPUs' worth of time the command may use.
+	CPUs float64
+	// Pids is the most processes the command may have at once.
+	Pids int64
+}
+
+// SecretsDir is the directory in the container secrets are mounted in.
+const SecretsDir = "/run/secrets"
+
+// Bind is a host path mounted into the container.
+type Bind struct {
+	// Source is the absolute path on the host.
+	Source string
+	// Target is the absolute path in the container, which must exist.
+	Target string
+	// ReadOnly makes the mount read-only.
+	ReadOnly bool
+}
+
+// Secret is a file on the host that is copied to SecretsDir/ID in the
+// container.
+type Secret struct {
+	ID     string
+	Source string
+}
+
+// Isolated returns whether the command is run in a network namespace of its
+// own.
+func (o RunOptions) Isolated() bool {
+	return o.Network != "" && o.Network != NetworkHost
+}
+
 // Engine is an interface which is accepted by lib.Run, and used to perform the
 // actual execution of a binary inside the container.
 type Engine interface {
@@ -26,6 +127,30 @@ type Engine interface {
 	// binary, chroot is the path on the host where the container's root
 	// filesystem exists, and workingDir specifies the path inside the
 	// container that should be the current working directory for the binary.
-	// If workingDir is "", the default should be "/".
-	Run(command string, args []string, environment map[string]string, chroot, workingDir string) error
+	// If workingDir is "", the default should be "/". opts holds the rest of
+	// the settings the command is run with.
+	Run(command string, args []string, environment map[string]string, chroot, workingDir string, opts RunOptions) error
+}
+
+// Layers describes a root filesystem made of a stack of directories.
+type Layers struct {
+	// Lower holds the directories changes aren't made to, bottom-most first.
+	Lower []string
+	// Upper is the directory on top of the others, which changes are made to.
+	Upper string
+	// Target is an empty directory the layers may be assembled at.
+	Target string
+	// Work is an empty directory on the same filesystem as Upper.
+	Work string
+}
+
+// LayeredEngine is an Engine that assembles the root filesystem from its
+// layers itself, rather than being given one lib.Run has already assembled. It
+// is used for engines that don't need to be run as root, since lib.Run can
+// only mount overlayfs when it is.
+type LayeredEngine interface {
+	Engine
+	// RunLayered is like Run, except that the root filesystem is made of
+	// layers. Only the upper layer may be changed.
+	RunLayered(command string, args []string, environment map[string]string, layers Layers, workingDir string, opts RunOptions) error
 }
@@ -0,0 +1,279 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mounts mounts the binds and secrets of a command, and the API
+// filesystems it may need, into the root filesystem it is run in. The mounts
+// must be made in a mount namespace of the command's own, whose mounts don't
+// propagate to the host.
+package mounts
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/containers/build/engine"
+)
+
+// statfsFlags maps the flags statfs reports for a mount to the mount flags
+// they were set with.
+var statfsFlags = map[int64]uintptr{
+	0x0002: syscall.MS_NOSUID,     // ST_NOSUID
+	0x0004: syscall.MS_NODEV,      // ST_NODEV
+	0x0008: syscall.MS_NOEXEC,     // ST_NOEXEC
+	0x0400: syscall.MS_NOATIME,    // ST_NOATIME
+	0x0800: syscall.MS_NODIRATIME, // ST_NODIRATIME
+	0x1000: syscall.MS_RELATIME,   // ST_RELATIME
+}
+
+// SetUp mounts binds and secrets into root, whose mount points must already
+// exist, with the secrets owned by owner if it isn't nil. It returns a function
+// that unmounts them.
+func SetUp(root string, binds []engine.Bind, secrets []engine.Secret, owner *engine.Credential) (func() error, error) {
+	var targets []string
+	unmount := func() error {
+		for i := len(targets) - 1; i >= 0; i-- {
+			err := syscall.Unmount(targets[i], syscall.MNT_DETACH)
+			if err != nil {
+				return fmt.Errorf("error unmounting %s: %v", targets[i], err)
+			}
+		}
+		return nil
+	}
+
+	for _, b := range binds {
+		target := filepath.Join(root, b.Target)
+		// Mount points are made in the image beforehand, except on the
+		// tmpfs mounted at /dev, which hides them
+		err := makeMountPoint(b.Source, target)
+		if err != nil {
+			unmount()
+			return nil, fmt.Errorf("error mounting %s at %s: %v", b.Source, b.Target, err)
+		}
+		err = syscall.Mount(b.Source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+		if err != nil {
+			unmount()
+			return nil, fmt.Errorf("error mounting %s at %s: %v", b.Source, b.Target, err)
+		}
+		targets = append(targets, target)
+		if b.ReadOnly {
+			err = remountReadOnly(target)
+			if err != nil {
+				unmount()
+				return nil, fmt.Errorf("error making %s read-only: %v", b.Target, err)
+			}
+		}
+	}
+
+	if len(secrets) > 0 {
+		target := filepath.Join(root, engine.SecretsDir)
+		err := MountSecrets(target, secrets, owner)
+		if err != nil {
+			unmount()
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+
+	return unmount, nil
+}
+
+// MountSecrets mounts a read-only tmpfs at dir holding secrets, each at its ID.
+// Only their owner can read them, which is root unless owner is given, so
+// that a command run as another user can read its secrets.
+func MountSecrets(dir string, secrets []engine.Secret, owner *engine.Credential) error {
+	// The secrets are read first, in case they're in dir
+	contents := make([][]byte, len(secrets))
+	for i, s := range secrets {
+		var err error
+		contents[i], err = ioutil.ReadFile(s.Source)
+		if err != nil {
+			return fmt.Errorf("error reading secret %q: %v", s.ID, err)
+		}
+	}
+
+	const flags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+	err := syscall.Mount("tmpfs", dir, "tmpfs", flags, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("error mounting tmpfs for secrets: %v", err)
+	}
+	for i, s := range secrets {
+		secretPath := filepath.Join(dir, s.ID)
+		err = ioutil.WriteFile(secretPath, contents[i], 0400)
+		if err == nil && owner != nil {
+			err = os.Chown(secretPath, int(owner.UID), int(owner.GID))
+		}
+		if err != nil {
+			syscall.Unmount(dir, syscall.MNT_DETACH)
+			return fmt.Errorf("error writing secret %q: %v", s.ID, err)
+		}
+	}
+	err = syscall.Mount("", dir, "", syscall.MS_REMOUNT|syscall.MS_RDONLY|flags, "")
+	if err != nil {
+		syscall.Unmount(dir, syscall.MNT_DETACH)
+		return fmt.Errorf("error making secrets read-only: %v", err)
+	}
+	return nil
+}
+
+// makeMountPoint makes an empty file or directory at target to mount source on,
+// if there's nothing there yet.
+func makeMountPoint(source, target string) error {
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		return err
+	}
+	fi, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return os.MkdirAll(target, 0755)
+	}
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(target, nil, 0644)
+}
+
+// remountReadOnly makes the bind mount at target read-only. The flags it was
+// mounted with are kept, since in a user namespace they can't be cleared.
+func remountReadOnly(target string) error {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(target, &st)
+	if err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for stFlag, msFlag := range statfsFlags {
+		if int64(st.Flags)&stFlag != 0 {
+			flags |= msFlag
+		}
+	}
+	return syscall.Mount("", target, "", flags, "")
+}
+
+// apiDirs are the directories MountAPIFilesystems mounts on.
+var apiDirs = []string{"proc", "sys", "dev"}
+
+// MakeAPIDirs makes the directories in root that /proc, /sys and /dev are
+// mounted on, where they're missing. It returns a function that removes the
+// ones it made, so that they're not left in the image. Anything but a
+// directory already there is refused, since a symlink would have the mount
+// made outside of root.
+func MakeAPIDirs(root string) (func(), error) {
+	var made []string
+	remove := func() {
+		for _, dir := range made {
+			os.Remove(dir)
+		}
+	}
+	for _, name := range apiDirs {
+		dir := filepath.Join(root, name)
+		info, err := os.Lstat(dir)
+		switch {
+		case os.IsNotExist(err):
+			err = os.Mkdir(dir, 0755)
+			if err != nil {
+				remove()
+				return nil, err
+			}
+			made = append(made, dir)
+		case err != nil:
+			remove()
+			return nil, err
+		case !info.IsDir():
+			remove()
+			return nil, fmt.Errorf("can't mount /%s, since it isn't a directory", name)
+		}
+	}
+	return remove, nil
+}
+
+// devices are the devices bound into /dev from the host.
+var devices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// MountAPIFilesystems mounts /proc, a minimal /dev and a read-only /sys in
+// root, whose directories for them must already exist. The process must be in
+// a PID namespace of its own for /proc to only show the command's processes.
+func MountAPIFilesystems(root string) error {
+	const flags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+
+	err := syscall.Mount("proc", filepath.Join(root, "proc"), "proc", flags, "")
+	if err != nil {
+		return fmt.Errorf("error mounting /proc: %v", err)
+	}
+
+	sys := filepath.Join(root, "sys")
+	err = syscall.Mount("sysfs", sys, "sysfs", flags|syscall.MS_RDONLY, "")
+	if err != nil {
+		// Where sysfs can't be mounted afresh, such as in some
+		// containers, the host's is bound instead
+		err = syscall.Mount("/sys", sys, "", syscall.MS_BIND|syscall.MS_REC, "")
+		if err == nil {
+			err = remountReadOnly(sys)
+		}
+		if err != nil {
+			return fmt.Errorf("error mounting /sys: %v", err)
+		}
+	}
+
+	dev := filepath.Join(root, "dev")
+	err = syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("error mounting /dev: %v", err)
+	}
+	for _, name := range devices {
+		target := filepath.Join(dev, name)
+		err := ioutil.WriteFile(target, nil, 0666)
+		if err == nil {
+			err = syscall.Mount(filepath.Join("/dev", name), target, "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("error making /dev/%s: %v", name, err)
+		}
+	}
+
+	for _, dir := range []string{"pts", "shm"} {
+		err := os.Mkdir(filepath.Join(dev, dir), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	err = syscall.Mount("devpts", filepath.Join(dev, "pts"), "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620")
+	if err != nil {
+		return fmt.Errorf("error mounting /dev/pts: %v", err)
+	}
+	err = syscall.Mount("shm", filepath.Join(dev, "shm"), "tmpfs", flags, "mode=1777")
+	if err != nil {
+		return fmt.Errorf("error mounting /dev/shm: %v", err)
+	}
+
+	links := map[string]string{
+		"ptmx":   "pts/ptmx",
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	}
+	for name, target := range links {
+		err := os.Symlink(target, filepath.Join(dev, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package network sets up the network namespaces commands are run in when
+// they aren't given the host's network.
+//
+// A private network is a network namespace with nothing but a loopback
+// interface, on which a listener is opened at ProxyAddr. The listener is sent
+// to acbuild, outside of the namespace, which serves a proxy on it that makes
+// the requests it lets through from the host's network.
+package network
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	"github.com/coreos/rkt/pkg/multicall"
+
+	"github.com/containers/build/engine"
+)
+
+// ProxyAddr is the address the proxy of a private network is reached at from
+// within it.
+const ProxyAddr = "127.0.0.1:3128"
+
+var holderEntrypoint multicall.Entrypoint
+
+func init() {
+	holderEntrypoint = multicall.Add("acbuild-netns", runHolder)
+}
+
+// ProxyEnv returns the environment variables that point commands run in a
+// private network at its proxy.
+func ProxyEnv() map[string]string {
+	proxyURL := "http://" + ProxyAddr
+	return map[string]string{
+		"http_proxy":  proxyURL,
+		"https_proxy": proxyURL,
+		"HTTP_PROXY":  proxyURL,
+		"HTTPS_PROXY": proxyURL,
+	}
+}
+
+// Namespace is acbuild's side of the network namespace a command is run in.
+type Namespace struct {
+	opts       engine.RunOptions
+	parentSock *os.File
+	childSock  *os.File
+	listener   net.Listener
+
+	holder      *exec.Cmd
+	holderStdin io.Closer
+}
+
+// NewNamespace returns the Namespace of a command run with opts. The process
+// the command is run in must be cloned with Cloneflags, and must call SetUp
+// with ChildFile before running the command. Serve must be called once the
+// process has been started, and Close once it has exited.
+func NewNamespace(opts engine.RunOptions) (*Namespace, error) {
+	ns := &Namespace{opts: opts}
+	switch opts.Network {
+	case "", engine.NetworkHost, engine.NetworkNone:
+	case engine.NetworkPrivate:
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return nil, err
+		}
+		ns.parentSock = os.NewFile(uintptr(fds[0]), "netns-parent")
+		ns.childSock = os.NewFile(uintptr(fds[1]), "netns-child")
+	default:
+		return nil, fmt.Errorf("unknown network %q", opts.Network)
+	}
+	return ns, nil
+}
+
+// Cloneflags returns the flags the process the command is run in must be
+// cloned with.
+func (ns *Namespace) Cloneflags() uintptr {
+	if ns.opts.Isolated() {
+		return syscall.CLONE_NEWNET
+	}
+	return 0
+}
+
+// ChildFile returns the file that must be passed to SetUp, or nil if there
+// isn't one.
+func (ns *Namespace) ChildFile() *os.File {
+	return ns.childSock
+}
+
+// Serve receives the listener SetUp opens in a private network, and serves the
+// proxy on it until Close is called. It does nothing for other networks.
+func (ns *Namespace) Serve() error {
+	if ns.parentSock == nil {
+		return nil
+	}
+	ns.childSock.Close()
+	f, err := receiveFile(ns.parentSock)
+	if err != nil {
+		return fmt.Errorf("error receiving the proxy's listener: %v", err)
+	}
+	defer f.Close()
+	ns.listener, err = net.FileListener(f)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: NewProxy(ns.opts.ProxyAllowlist)}
+	go server.Serve(ns.listener)
+	return nil
+}
+
+// StartHolder starts a process that does nothing but hold a network namespace
+// set up for the command, for engines that join one rather than create it.
+// The path of the namespace is returned. The process is stopped by Close.
+func (ns *Namespace) StartHolder() (string, error) {
+	ns.holder = holderEntrypoint.Cmd(string(ns.opts.Network))
+	ns.holder.Stderr = os.Stderr
+	if ns.childSock != nil {
+		ns.holder.ExtraFiles = []*os.File{ns.childSock}
+	}
+	// The holder exits once its stdin is closed
+	stdin, err := ns.holder.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	ns.holderStdin = stdin
+	ready, err := ns.holder.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	ns.holder.SysProcAttr = &syscall.SysProcAttr{Cloneflags: ns.Cloneflags()}
+	err = ns.holder.Start()
+	if err != nil {
+		return "", err
+	}
+	err = ns.Serve()
+	if err == nil {
+		// The namespace is set up once the holder closes its stdout
+		_, err = ready.Read(make([]byte, 1))
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		ns.holder.Process.Kill()
+		ns.holder.Wait()
+		ns.holder = nil
+		return "", fmt.Errorf("error setting up network namespace: %v", err)
+	}
+	return fmt.Sprintf("/proc/%d/ns/net", ns.holder.Process.Pid), nil
+}
+
+// Close stops the proxy and the holder of the namespace, if there are any.
+func (ns *Namespace) Close() error {
+	if ns.listener != nil {
+		ns.listener.Close()
+	}
+	if ns.parentSock != nil {
+		ns.parentSock.Close()
+		ns.childSock.Close()
+	}
+	if ns.holder != nil {
+		ns.holderStdin.Close()
+		ns.holder.Wait()
+	}
+	return nil
+}
+
+// SetUp sets up the network namespace the current process was cloned into for
+// the given network. The loopback interface is brought up, and in a private
+// network a listener for the proxy is opened and sent over sock.
+func SetUp(network engine.Network, sock *os.File) error {
+	if network == "" || network == engine.NetworkHost {
+		return nil
+	}
+	err := bringUpLoopback()
+	if err != nil {
+		return fmt.Errorf("error bringing up the loopback interface: %v", err)
+	}
+	if network != engine.NetworkPrivate {
+		return nil
+	}
+	if sock == nil {
+		return fmt.Errorf("no socket to send the proxy's listener over")
+	}
+	defer sock.Close()
+
+	l, err := net.Listen("tcp", ProxyAddr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return sendFile(sock, f)
+}
+
+// runHolder sets up the network namespace it was cloned into and waits for its
+// stdin to be closed.
+func runHolder() error {
+	if len(os.Args) != 2 {
+		return fmt.Errorf("usage: %s NETWORK", os.Args[0])
+	}
+	var sock *os.File
+	if engine.Network(os.Args[1]) == engine.NetworkPrivate {
+		sock = os.NewFile(3, "netns-child")
+	}
+	err := SetUp(engine.Network(os.Args[1]), sock)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Close()
+	buf := make([]byte, 1)
+	for {
+		if _, err := os.Stdin.Read(buf); err != nil {
+			return nil
+		}
+	}
+}
+
+// ifreqFlags is struct ifreq as used by the SIOCGIFFLAGS and SIOCSIFFLAGS
+// ioctls.
+type ifreqFlags struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+func bringUpLoopback() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var ifr ifreqFlags
+	copy(ifr.name[:], "lo")
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return errno
+	}
+	ifr.flags |= syscall.IFF_UP
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func sendFile(sock, f *os.File) error {
+	return syscall.Sendmsg(int(sock.Fd()), []byte{0}, syscall.UnixRights(int(f.Fd())), nil, 0)
+}
+
+func receiveFile(sock *os.File) (*os.File, error) {
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(int(sock.Fd()), buf, oob, 0)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("the namespace was closed before it was set up")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		return nil, fmt.Errorf("expected 1 file, got %d", len(fds))
+	}
+	syscall.CloseOnExec(fds[0])
+	return os.NewFile(uintptr(fds[0]), "proxy-listener"), nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strings"
+)
+
+// Proxy is an HTTP proxy that only lets requests through to the hosts in its
+// allowlist. HTTPS requests are tunnelled through it with CONNECT.
+type Proxy struct {
+	allowlist    []string
+	reverseProxy *httputil.ReverseProxy
+}
+
+// NewProxy returns a Proxy that lets requests through to the hosts in
+// allowlist, which are given as "host" or "host:port", where host may start
+// with "*." to match any of its subdomains.
+func NewProxy(allowlist []string) *Proxy {
+	return &Proxy{
+		allowlist: allowlist,
+		// The requests made to a proxy already hold the URL to fetch
+		reverseProxy: &httputil.ReverseProxy{Director: func(*http.Request) {}},
+	}
+}
+
+// Allowed returns whether requests to hostport, which is "host:port", are let
+// through.
+func (p *Proxy) Allowed(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	for _, entry := range p.allowlist {
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			entryHost, entryPort = entry, ""
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		entryHost = strings.ToLower(entryHost)
+		if strings.HasPrefix(entryHost, "*.") {
+			if strings.HasSuffix(host, entryHost[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == entryHost {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hostport := r.Host
+	if r.Method != http.MethodConnect {
+		if !r.URL.IsAbs() {
+			http.Error(w, "acbuild: only proxy requests are served", http.StatusBadRequest)
+			return
+		}
+		hostport = r.URL.Host
+		if _, _, err := net.SplitHostPort(hostport); err != nil {
+			hostport = net.JoinHostPort(r.URL.Hostname(), "80")
+		}
+	}
+	if !p.Allowed(hostport) {
+		fmt.Fprintf(os.Stderr, "warning: the proxy refused a request to %s, which isn't in the allowlist\n", hostport)
+		http.Error(w, fmt.Sprintf("acbuild: %s isn't in the proxy allowlist", hostport), http.StatusForbidden)
+		return
+	}
+
+	if r.Method != http.MethodConnect {
+		p.reverseProxy.ServeHTTP(w, r)
+		return
+	}
+
+	upstream, err := net.Dial("tcp", hostport)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "acbuild: connection can't be tunnelled", http.StatusInternalServerError)
+		return
+	}
+	client, buf, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	_, err = client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// Anything the client sent after the request has been buffered
+		io.Copy(upstream, buf)
+		if tcpConn, ok := upstream.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+	<-done
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestProxyAllowed(t *testing.T) {
+	p := NewProxy([]string{"example.com", "*.golang.org", "registry.local:5000"})
+	tests := []struct {
+		hostport string
+		allowed  bool
+	}{
+		{"example.com:80", true},
+		{"EXAMPLE.com:443", true},
+		{"www.example.com:443", false},
+		{"proxy.golang.org:443", true},
+		{"golang.org:443", false},
+		{"notgolang.org:443", false},
+		{"registry.local:5000", true},
+		{"registry.local:443", false},
+		{"example.com", false},
+	}
+	for _, tt := range tests {
+		if allowed := p.Allowed(tt.hostport); allowed != tt.allowed {
+			t.Errorf("%s: got allowed %v, wanted %v", tt.hostport, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(backend.Config.Handler)
+	defer tlsBackend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	tlsBackendURL, _ := url.Parse(tlsBackend.URL)
+
+	tests := []struct {
+		allowlist  []string
+		url        string
+		wantStatus int
+	}{
+		{[]string{backendURL.Host}, backend.URL, http.StatusOK},
+		{[]string{"127.0.0.1:1"}, backend.URL, http.StatusForbidden},
+		{[]string{tlsBackendURL.Host}, tlsBackend.URL, http.StatusOK},
+		{nil, tlsBackend.URL, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		proxy := httptest.NewServer(NewProxy(tt.allowlist))
+		proxyURL, _ := url.Parse(proxy.URL)
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+
+		resp, err := client.Get(tt.url)
+		switch {
+		case tt.wantStatus == http.StatusOK && err != nil:
+			t.Errorf("%s: %v", tt.url, err)
+		case tt.wantStatus == http.StatusOK:
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+				t.Errorf("%s: got %d %q, wanted 200 \"hello\"", tt.url, resp.StatusCode, body)
+			}
+		case err == nil:
+			// Refused plain HTTP requests get a response
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("%s: got status %d, wanted %d", tt.url, resp.StatusCode, tt.wantStatus)
+			}
+		}
+		proxy.Close()
+	}
+}
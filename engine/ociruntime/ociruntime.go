@@ -0,0 +1,156 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ociruntime runs commands with an OCI runtime, such as runc or crun,
+// so that they get the namespaces, capabilities and seccomp filter containers
+// run by those runtimes get.
+package ociruntime
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/coreos/rkt/pkg/fileutil"
+
+	"github.com/containers/build/engine"
+	"github.com/containers/build/engine/mounts"
+	"github.com/containers/build/engine/network"
+)
+
+// DefaultRuntime is the runtime used if Engine.Runtime isn't set.
+const DefaultRuntime = "runc"
+
+// Engine runs commands by writing an OCI bundle for them, whose root
+// filesystem is the chroot, and running it with Runtime.
+type Engine struct {
+	// Runtime is the runtime's binary, which is looked for in $PATH if it
+	// isn't a path. It must take runc's run, kill and delete commands.
+	Runtime string
+}
+
+func (e *Engine) Run(command string, args []string, environment map[string]string, chroot, workingDir string, opts engine.RunOptions) (err error) {
+	runtime := e.Runtime
+	if runtime == "" {
+		runtime = DefaultRuntime
+	}
+	runtimePath, err := exec.LookPath(runtime)
+	if err != nil {
+		return fmt.Errorf("can't find the OCI runtime: %v", err)
+	}
+
+	resolvConfFile := filepath.Join(chroot, "/etc/resolv.conf")
+	_, err = os.Stat(resolvConfFile)
+	switch {
+	case os.IsNotExist(err) && opts.Isolated():
+		// The host's nameservers can't be reached from the command's network
+	case os.IsNotExist(err):
+		err := os.MkdirAll(filepath.Dir(resolvConfFile), 0755)
+		if err != nil {
+			return err
+		}
+		err = fileutil.CopyRegularFile("/etc/resolv.conf", resolvConfFile)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(resolvConfFile)
+	case err != nil:
+		return err
+	}
+
+	// The runtime would make the mount points itself, and leave them in
+	// the image
+	removeAPIDirs, err := mounts.MakeAPIDirs(chroot)
+	if err != nil {
+		return err
+	}
+	defer removeAPIDirs()
+
+	var netns string
+	if opts.Isolated() {
+		ns, err := network.NewNamespace(opts)
+		if err != nil {
+			return err
+		}
+		defer ns.Close()
+		netns, err = ns.StartHolder()
+		if err != nil {
+			return err
+		}
+	}
+
+	var secretsDir string
+	if len(opts.Secrets) > 0 {
+		secretsDir, err = ioutil.TempDir("", "acbuild-secrets")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(secretsDir)
+		err = mounts.MountSecrets(secretsDir, opts.Secrets, opts.Credential)
+		if err != nil {
+			return err
+		}
+		defer syscall.Unmount(secretsDir, syscall.MNT_DETACH)
+	}
+
+	bundle, err := ioutil.TempDir("", "acbuild-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(bundle)
+	rootfs, err := filepath.Abs(chroot)
+	if err != nil {
+		return err
+	}
+	s := newSpec(command, args, environment, rootfs, workingDir, opts, netns, secretsDir)
+	blob, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(bundle, "config.json"), blob, 0644)
+	if err != nil {
+		return err
+	}
+
+	id := fmt.Sprintf("acbuild-%d-%d", os.Getpid(), time.Now().UnixNano())
+	cmd := exec.Command(runtimePath, "run", "--bundle", bundle, id)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	// The container is left behind if the runtime is killed, or fails
+	// after making it
+	defer exec.Command(runtimePath, "delete", "--force", id).Run()
+
+	if opts.Timeout == 0 {
+		return cmd.Wait()
+	}
+	// Killing the container's init kills every process in its PID namespace
+	timer := time.AfterFunc(opts.Timeout, func() {
+		exec.Command(runtimePath, "kill", id, "KILL").Run()
+	})
+	err = cmd.Wait()
+	if !timer.Stop() {
+		return fmt.Errorf("command timed out after %v", opts.Timeout)
+	}
+	return err
+}
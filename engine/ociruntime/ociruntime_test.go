@@ -0,0 +1,158 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociruntime
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/containers/build/engine"
+)
+
+// fakeRuntime is a runtime that logs how it's called, and keeps the
+// config.json of the bundle it's told to run.
+const fakeRuntime = `#!/bin/sh
+echo "$@" >> %[1]s/log
+if [ "$1" = run ]; then
+	cp "$3/config.json" %[1]s/config.json
+	exit %[2]d
+fi
+`
+
+// runFake runs command with a fake runtime that exits with exitCode, and
+// returns the config.json it was given and the commands it was called with.
+func runFake(t *testing.T, command string, args []string, env map[string]string, workingDir string, opts engine.RunOptions, exitCode int) (spec, []string, error) {
+	dir, err := ioutil.TempDir("", "acbuild-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	runtime := filepath.Join(dir, "fake-runtime")
+	err = ioutil.WriteFile(runtime, []byte(fmt.Sprintf(fakeRuntime, dir, exitCode)), 0755)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	rootfs := filepath.Join(dir, "rootfs")
+	err = os.MkdirAll(filepath.Join(rootfs, "etc"), 0755)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	e := Engine{Runtime: runtime}
+	runErr := e.Run(command, args, env, rootfs, workingDir, opts)
+
+	for _, name := range []string{"proc", "sys", "dev"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, name)); !os.IsNotExist(err) {
+			t.Errorf("/%s was left in the root filesystem", name)
+		}
+	}
+
+	var s spec
+	blob, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = json.Unmarshal(blob, &s)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.Root.Path != rootfs {
+		t.Errorf("expected the root path %s, got %s", rootfs, s.Root.Path)
+	}
+	log, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return s, strings.Split(strings.TrimSpace(string(log)), "\n"), runErr
+}
+
+func TestRunConfig(t *testing.T) {
+	opts := engine.RunOptions{
+		Binds:      []engine.Bind{{Source: "/tmp", Target: "/host", ReadOnly: true}},
+		Credential: &engine.Credential{UID: 1000, GID: 1000, Groups: []uint32{1000, 50}},
+		Limits:     engine.Limits{Memory: 1 << 20, Pids: 10},
+	}
+	env := map[string]string{"JAVA_OPTS": "-Xa,-Xb=c"}
+	s, calls, err := runFake(t, "/bin/sh", []string{"-c", "echo a,b"}, env, "/work", opts, 0)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if len(calls) != 2 || !strings.HasPrefix(calls[0], "run --bundle ") || !strings.HasPrefix(calls[1], "delete --force ") {
+		t.Errorf("unexpected runtime calls: %q", calls)
+	}
+
+	p := s.Process
+	if expected := []string{"/bin/sh", "-c", "echo a,b"}; !reflect.DeepEqual(p.Args, expected) {
+		t.Errorf("expected args %q, got %q", expected, p.Args)
+	}
+	expectedEnv := []string{"JAVA_OPTS=-Xa,-Xb=c", "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+	if !reflect.DeepEqual(p.Env, expectedEnv) {
+		t.Errorf("expected env %q, got %q", expectedEnv, p.Env)
+	}
+	if p.Cwd != "/work" {
+		t.Errorf("expected cwd /work, got %s", p.Cwd)
+	}
+	if expected := (user{UID: 1000, GID: 1000, AdditionalGids: []uint32{1000, 50}}); !reflect.DeepEqual(p.User, expected) {
+		t.Errorf("expected user %+v, got %+v", expected, p.User)
+	}
+	if p.Capabilities == nil || len(p.Capabilities.Bounding) == 0 || len(p.Capabilities.Effective) != 0 {
+		t.Errorf("a user other than root was given capabilities: %+v", p.Capabilities)
+	}
+
+	var bound bool
+	for _, m := range s.Mounts {
+		if m.Destination == "/host" {
+			bound = m.Source == "/tmp" && reflect.DeepEqual(m.Options, []string{"rbind", "ro"})
+		}
+	}
+	if !bound {
+		t.Errorf("the bind isn't in the mounts: %+v", s.Mounts)
+	}
+	for _, ns := range s.Linux.Namespaces {
+		if ns.Type == "network" {
+			t.Errorf("the host's network wasn't used")
+		}
+	}
+	r := s.Linux.Resources
+	if r == nil || r.Memory == nil || r.Memory.Limit != 1<<20 || r.Pids == nil || r.Pids.Limit != 10 || r.CPU != nil {
+		t.Errorf("unexpected resources: %+v", r)
+	}
+}
+
+func TestRunExitCode(t *testing.T) {
+	s, _, err := runFake(t, "true", nil, map[string]string{"PATH": "/bin"}, "", engine.RunOptions{}, 3)
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.Sys().(syscall.WaitStatus).ExitStatus() != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+	if s.Process.Cwd != "/" {
+		t.Errorf("expected cwd /, got %s", s.Process.Cwd)
+	}
+	if expected := []string{"PATH=/bin"}; !reflect.DeepEqual(s.Process.Env, expected) {
+		t.Errorf("expected env %q, got %q", expected, s.Process.Env)
+	}
+	if c := s.Process.Capabilities; c == nil || len(c.Effective) == 0 {
+		t.Errorf("root wasn't given capabilities")
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociruntime
+
+import (
+	"sort"
+
+	"github.com/containers/build/engine"
+)
+
+// The types below are the parts of the OCI runtime spec's config.json that
+// acbuild sets. See https://github.com/opencontainers/runtime-spec.
+
+const ociVersion = "1.0.0"
+
+type spec struct {
+	OCIVersion string  `json:"ociVersion"`
+	Process    process `json:"process"`
+	Root       root    `json:"root"`
+	Mounts     []mount `json:"mounts"`
+	Linux      linux   `json:"linux"`
+}
+
+type process struct {
+	Terminal        bool          `json:"terminal"`
+	User            user          `json:"user"`
+	Args            []string      `json:"args"`
+	Env             []string      `json:"env"`
+	Cwd             string        `json:"cwd"`
+	Capabilities    *capabilities `json:"capabilities,omitempty"`
+	NoNewPrivileges bool          `json:"noNewPrivileges"`
+}
+
+type user struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
+type capabilities struct {
+	Bounding    []string `json:"bounding"`
+	Effective   []string `json:"effective"`
+	Inheritable []string `json:"inheritable"`
+	Permitted   []string `json:"permitted"`
+}
+
+type root struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
+type mount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type linux struct {
+	Namespaces    []namespace `json:"namespaces"`
+	Resources     *resources  `json:"resources,omitempty"`
+	MaskedPaths   []string    `json:"maskedPaths"`
+	ReadonlyPaths []string    `json:"readonlyPaths"`
+	Seccomp       *seccomp    `json:"seccomp,omitempty"`
+}
+
+type namespace struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+}
+
+type resources struct {
+	Memory *memory `json:"memory,omitempty"`
+	CPU    *cpu    `json:"cpu,omitempty"`
+	Pids   *pids   `json:"pids,omitempty"`
+}
+
+type memory struct {
+	Limit int64 `json:"limit"`
+	// Swap is the limit of memory and swap together
+	Swap int64 `json:"swap"`
+}
+
+type cpu struct {
+	Quota  int64  `json:"quota"`
+	Period uint64 `json:"period"`
+}
+
+type pids struct {
+	Limit int64 `json:"limit"`
+}
+
+type seccomp struct {
+	DefaultAction string        `json:"defaultAction"`
+	Syscalls      []syscallRule `json:"syscalls"`
+}
+
+type syscallRule struct {
+	Names  []string `json:"names"`
+	Action string   `json:"action"`
+}
+
+// defaultCapabilities are the capabilities commands run as root are given,
+// which are those container engines give containers by default.
+var defaultCapabilities = []string{
+	"CAP_AUDIT_WRITE",
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_MKNOD",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_RAW",
+	"CAP_SETFCAP",
+	"CAP_SETGID",
+	"CAP_SETPCAP",
+	"CAP_SETUID",
+	"CAP_SYS_CHROOT",
+}
+
+// blockedSyscalls are the syscalls commands may not make, which would let them
+// reach past the container, and which the capabilities above don't already
+// rule out. Syscalls the architecture doesn't have are skipped by runtimes.
+var blockedSyscalls = []string{
+	"acct", "add_key", "bpf", "clock_adjtime", "clock_settime",
+	"create_module", "delete_module", "finit_module", "get_kernel_syms",
+	"init_module", "ioperm", "iopl", "kcmp", "kexec_file_load",
+	"kexec_load", "keyctl", "lookup_dcookie", "mount", "name_to_handle_at",
+	"nfsservctl", "open_by_handle_at", "perf_event_open", "pivot_root",
+	"process_vm_readv", "process_vm_writev", "ptrace", "query_module",
+	"quotactl", "reboot", "request_key", "setns", "settimeofday", "stime",
+	"swapoff", "swapon", "_sysctl", "umount", "umount2", "unshare",
+	"uselib", "userfaultfd", "ustat", "vm86", "vm86old",
+}
+
+var maskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/sys/firmware",
+}
+
+var readonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// cpuPeriod is the period CPU time is limited over, in microseconds.
+const cpuPeriod = 100000
+
+// newSpec returns the config.json of a container running command with args and
+// environment, in workingDir of the root filesystem at rootfs. netns is the
+// path of the network namespace to join, or "" for the host's network, and
+// secretsDir the directory on the host holding the secrets, if there are any.
+func newSpec(command string, args []string, environment map[string]string, rootfs, workingDir string, opts engine.RunOptions, netns, secretsDir string) spec {
+	s := spec{
+		OCIVersion: ociVersion,
+		Process: process{
+			Args: append([]string{command}, args...),
+			Cwd:  workingDir,
+		},
+		Root: root{Path: rootfs},
+		Linux: linux{
+			Namespaces: []namespace{
+				{Type: "pid"},
+				{Type: "ipc"},
+				{Type: "uts"},
+				{Type: "mount"},
+			},
+			MaskedPaths:   maskedPaths,
+			ReadonlyPaths: readonlyPaths,
+			Seccomp: &seccomp{
+				DefaultAction: "SCMP_ACT_ALLOW",
+				Syscalls: []syscallRule{
+					{Names: blockedSyscalls, Action: "SCMP_ACT_ERRNO"},
+				},
+			},
+		},
+	}
+	if s.Process.Cwd == "" {
+		s.Process.Cwd = "/"
+	}
+
+	for name, value := range environment {
+		s.Process.Env = append(s.Process.Env, name+"="+value)
+	}
+	if _, ok := environment["PATH"]; !ok {
+		path := "PATH="
+		for i, p := range engine.Pathlist {
+			if i > 0 {
+				path += ":"
+			}
+			path += p
+		}
+		s.Process.Env = append(s.Process.Env, path)
+	}
+	sort.Strings(s.Process.Env)
+
+	// Users other than root keep the capabilities in the bounding set,
+	// which they get back by running setuid binaries such as sudo
+	caps := &capabilities{Bounding: defaultCapabilities}
+	if c := opts.Credential; c != nil {
+		s.Process.User = user{UID: c.UID, GID: c.GID, AdditionalGids: c.Groups}
+	}
+	if s.Process.User.UID == 0 {
+		caps.Effective = defaultCapabilities
+		caps.Inheritable = defaultCapabilities
+		caps.Permitted = defaultCapabilities
+	}
+	s.Process.Capabilities = caps
+
+	s.Mounts = []mount{
+		{Destination: "/proc", Type: "proc", Source: "proc", Options: []string{"nosuid", "noexec", "nodev"}},
+		{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+		{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}},
+		{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+		{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+	}
+	if netns != "" {
+		s.Linux.Namespaces = append(s.Linux.Namespaces, namespace{Type: "network", Path: netns})
+		s.Mounts = append(s.Mounts, mount{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}})
+	} else {
+		// sysfs can only be mounted afresh in a network namespace of
+		// the container's own
+		s.Mounts = append(s.Mounts, mount{Destination: "/sys", Type: "bind", Source: "/sys", Options: []string{"rbind", "nosuid", "noexec", "nodev", "ro"}})
+	}
+
+	for _, b := range opts.Binds {
+		options := []string{"rbind"}
+		if b.ReadOnly {
+			options = append(options, "ro")
+		}
+		s.Mounts = append(s.Mounts, mount{Destination: b.Target, Type: "bind", Source: b.Source, Options: options})
+	}
+	if secretsDir != "" {
+		s.Mounts = append(s.Mounts, mount{Destination: engine.SecretsDir, Type: "bind", Source: secretsDir, Options: []string{"rbind", "ro"}})
+	}
+
+	var r resources
+	if l := opts.Limits.Memory; l > 0 {
+		r.Memory = &memory{Limit: l, Swap: l}
+	}
+	if cpus := opts.Limits.CPUs; cpus > 0 {
+		r.CPU = &cpu{Quota: int64(cpus * cpuPeriod), Period: cpuPeriod}
+	}
+	if l := opts.Limits.Pids; l > 0 {
+		r.Pids = &pids{Limit: l}
+	}
+	if r != (resources{}) {
+		s.Linux.Resources = &r
+	}
+	return s
+}
@@ -0,0 +1,248 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rootless
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/coreos/rkt/pkg/fileutil"
+
+	"github.com/containers/build/engine"
+	"github.com/containers/build/engine/mounts"
+	"github.com/containers/build/engine/network"
+	"github.com/containers/build/util"
+	"github.com/containers/build/util/fsdiffer"
+)
+
+// runRootless is run as root in the user namespace the command is run in. The
+// spec is read from file descriptor 3.
+func runRootless() error {
+	err := util.EnterUserNamespace()
+	if err != nil {
+		return err
+	}
+
+	specFile := os.NewFile(3, "spec")
+	s, err := readSpec(specFile)
+	specFile.Close()
+	if err != nil {
+		return fmt.Errorf("error reading spec: %v", err)
+	}
+
+	var proxySock *os.File
+	if s.Network == engine.NetworkPrivate {
+		proxySock = os.NewFile(4, "netns-child")
+	}
+	err = network.SetUp(s.Network, proxySock)
+	if err != nil {
+		return fmt.Errorf("error setting up network: %v", err)
+	}
+
+	// Keep the mounts made here from propagating out of the namespace
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("error making mounts private: %v", err)
+	}
+
+	err = runLayered(s)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		os.Exit(exitErr.Sys().(syscall.WaitStatus).ExitStatus())
+	}
+	return err
+}
+
+func runLayered(s spec) error {
+	if len(s.Layers.Lower) == 0 {
+		return runInRoot(s, s.Layers.Upper)
+	}
+
+	unmount, err := mountLayers(s.Layers)
+	if err == nil {
+		err = runInRoot(s, s.Layers.Target)
+		if err1 := unmount(); err == nil {
+			err = err1
+		}
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "warning: copying layers, since neither overlayfs nor fuse-overlayfs could be mounted: %v\n", err)
+	return runCopiedUp(s)
+}
+
+// mountLayers mounts the layers at their target with overlayfs, which newer
+// kernels allow in user namespaces, or else with fuse-overlayfs. It returns a
+// function that unmounts them.
+func mountLayers(layers engine.Layers) (func() error, error) {
+	// Overlayfs takes the topmost lower directory first
+	var lower []string
+	for i := len(layers.Lower) - 1; i >= 0; i-- {
+		lower = append(lower, layers.Lower[i])
+	}
+	options := "lowerdir=" + strings.Join(lower, ":") +
+		",upperdir=" + layers.Upper +
+		",workdir=" + layers.Work
+	unmount := func() error {
+		err := syscall.Unmount(layers.Target, 0)
+		if err != nil {
+			return err
+		}
+		// Overlayfs leaves directories in its work dir that only root can
+		// remove, which it is here but might not be outside the namespace
+		return os.RemoveAll(filepath.Join(layers.Work, "work"))
+	}
+
+	overlayErr := syscall.Mount("overlay", layers.Target, "overlay", 0, options+",userxattr")
+	if overlayErr == nil {
+		return unmount, nil
+	}
+
+	fuseOverlayfs, err := exec.LookPath("fuse-overlayfs")
+	if err != nil {
+		return nil, fmt.Errorf("overlayfs: %v, and fuse-overlayfs isn't installed", overlayErr)
+	}
+	out, err := exec.Command(fuseOverlayfs, "-o", options, layers.Target).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("overlayfs: %v, fuse-overlayfs: %v: %s", overlayErr, err, strings.TrimSpace(string(out)))
+	}
+	return unmount, nil
+}
+
+// runCopiedUp copies the layers into their target, runs the command there,
+// and copies what it changed into the upper layer.
+func runCopiedUp(s spec) error {
+	err := util.MergeLayers(append(s.Layers.Lower, s.Layers.Upper), s.Layers.Target)
+	if err != nil {
+		return err
+	}
+	differ, err := fsdiffer.NewTemporalFSDiffer(s.Layers.Target)
+	if err != nil {
+		return err
+	}
+
+	err = runInRoot(s, s.Layers.Target)
+	if err != nil {
+		return err
+	}
+
+	changes, err := differ.Diff()
+	if err != nil {
+		return err
+	}
+	unremovable, err := util.CopyChanges(changes, s.Layers.Target, s.Layers.Upper, s.Layers.Lower)
+	if err != nil {
+		return err
+	}
+	for _, p := range unremovable {
+		fmt.Fprintf(os.Stderr, "warning: %s was removed from a lower layer, which can't be recorded when layers are copied\n", p)
+	}
+	return nil
+}
+
+// runInRoot runs the command in the spec with root as its root filesystem. If
+// the command fails, the *exec.ExitError is returned.
+func runInRoot(s spec, root string) (err error) {
+	resolvConfFile := filepath.Join(root, "/etc/resolv.conf")
+	_, err = os.Stat(resolvConfFile)
+	switch {
+	case os.IsNotExist(err) && (engine.RunOptions{Network: s.Network}).Isolated():
+		// The host's nameservers can't be reached from the command's network
+	case os.IsNotExist(err):
+		err := os.MkdirAll(filepath.Dir(resolvConfFile), 0755)
+		if err != nil {
+			return err
+		}
+		err = fileutil.CopyRegularFile("/etc/resolv.conf", resolvConfFile)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(resolvConfFile)
+	case err != nil:
+		return err
+	}
+
+	command, err := findCmdInPath(engine.Pathlist, s.Command, root)
+	if err != nil {
+		return err
+	}
+
+	// The mounts are taken down afterwards, so that what's in them isn't
+	// seen as changes when the layers were copied
+	unmount, err := mounts.SetUp(root, s.Binds, s.Secrets, s.Credential)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := unmount(); err == nil {
+			err = err1
+		}
+	}()
+	workingDir := s.WorkingDir
+	if workingDir == "" {
+		workingDir = "/"
+	}
+
+	cmd := exec.Command(command, s.Args...)
+	cmd.Env = s.Env
+	cmd.Dir = workingDir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: root}
+	if c := s.Credential; c != nil {
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    c.UID,
+			Gid:    c.GID,
+			Groups: c.Groups,
+			// Where setgroups is denied, root's group is the only one
+			// mapped, and so the only one checkMapped let through
+			NoSetGroups: setgroupsDenied(),
+		}
+	}
+	err = cmd.Run()
+	return err
+}
+
+// findCmdInPath returns the path inside of root of cmd, which is looked for in
+// pathlist if it isn't absolute.
+func findCmdInPath(pathlist []string, cmd, root string) (string, error) {
+	if path.IsAbs(cmd) {
+		return cmd, nil
+	}
+
+	for _, p := range pathlist {
+		_, err := os.Lstat(path.Join(root, p, cmd))
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return "", err
+		}
+		return path.Join(p, cmd), nil
+	}
+	return "", fmt.Errorf("%s not found in any of: %v", cmd, pathlist)
+}
+
+// setgroupsDenied returns whether the user namespace doesn't allow setgroups,
+// which it doesn't when acbuild mapped its user's group itself.
+func setgroupsDenied() bool {
+	blob, err := ioutil.ReadFile("/proc/self/setgroups")
+	return err == nil && strings.TrimSpace(string(blob)) == "deny"
+}
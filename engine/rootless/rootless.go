@@ -0,0 +1,197 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rootless provides an engine that runs commands as root in a user
+// namespace, and so doesn't need acbuild to be run as root.
+package rootless
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/coreos/rkt/pkg/multicall"
+
+	"github.com/containers/build/engine"
+	"github.com/containers/build/engine/network"
+	"github.com/containers/build/util"
+)
+
+var rootlessEntrypoint multicall.Entrypoint
+
+func init() {
+	rootlessEntrypoint = multicall.Add("acbuild-rootless", runRootless)
+}
+
+type Engine struct{}
+
+// spec is what the acbuild-rootless command is told to do, which it's sent over
+// a pipe with gob, like the chroot engine's, so that the arguments and
+// environment reach the command byte for byte. The socket the namespace of a
+// private network is set up with is passed to it as file descriptor 4.
+type spec struct {
+	Command    string
+	Args       []string
+	Env        []string
+	Layers     engine.Layers
+	WorkingDir string
+	Network    engine.Network
+	Binds      []engine.Bind
+	Secrets    []engine.Secret
+	Credential *engine.Credential
+}
+
+func (e Engine) Run(command string, args []string, environment map[string]string, chroot, workingDir string, opts engine.RunOptions) error {
+	return e.RunLayered(command, args, environment, engine.Layers{Upper: chroot}, workingDir, opts)
+}
+
+func (e Engine) RunLayered(command string, args []string, environment map[string]string, layers engine.Layers, workingDir string, opts engine.RunOptions) error {
+	if opts.Limits != (engine.Limits{}) {
+		return fmt.Errorf("resource limits can't be set with the rootless engine")
+	}
+
+	idMap, err := util.RootlessIDMap()
+	if err != nil {
+		return err
+	}
+	if c := opts.Credential; c != nil {
+		err = checkMapped(idMap, c)
+		if err != nil {
+			return err
+		}
+	}
+
+	s := spec{
+		Command:    command,
+		Args:       args,
+		Layers:     layers,
+		WorkingDir: workingDir,
+		Network:    opts.Network,
+		Binds:      opts.Binds,
+		Secrets:    opts.Secrets,
+		Credential: opts.Credential,
+	}
+	for name, value := range environment {
+		s.Env = append(s.Env, name+"="+value)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	defer w.Close()
+
+	ns, err := network.NewNamespace(opts)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	cmd := rootlessEntrypoint.Cmd()
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{r}
+	if f := ns.ChildFile(); f != nil {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: ns.Cloneflags()}
+	if opts.Timeout != 0 {
+		// The process is the init of a PID namespace, which is killed
+		// along with every process in it when it is
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWPID
+	}
+	err = idMap.StartInUserNamespace(cmd)
+	if err != nil {
+		return err
+	}
+	r.Close()
+	err = writeSpec(w, s)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	serveErr := ns.Serve()
+	err = waitWithTimeout(cmd, opts.Timeout)
+	if err == nil {
+		err = serveErr
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code := exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		return fmt.Errorf("non-zero exit code: %d", code)
+	}
+	return err
+}
+
+// waitWithTimeout waits for cmd to exit, killing it if timeout isn't 0 and
+// passes first.
+func waitWithTimeout(cmd *exec.Cmd, timeout time.Duration) error {
+	if timeout == 0 {
+		return cmd.Wait()
+	}
+	timer := time.AfterFunc(timeout, func() {
+		cmd.Process.Kill()
+	})
+	err := cmd.Wait()
+	if !timer.Stop() {
+		return fmt.Errorf("command timed out after %v", timeout)
+	}
+	return err
+}
+
+// checkMapped returns an error if the user or any of the groups in c isn't
+// mapped in the user namespace of idMap.
+func checkMapped(idMap *util.IDMap, c *engine.Credential) error {
+	const hint = "; subordinate IDs for it can be given in /etc/subuid and /etc/subgid"
+	if !isMapped(idMap.UIDs, c.UID) {
+		return fmt.Errorf("user %d isn't mapped in the rootless engine's user namespace"+hint, c.UID)
+	}
+	for _, gid := range append([]uint32{c.GID}, c.Groups...) {
+		if !isMapped(idMap.GIDs, gid) {
+			return fmt.Errorf("group %d isn't mapped in the rootless engine's user namespace"+hint, gid)
+		}
+	}
+	return nil
+}
+
+func isMapped(mappings []util.IDMapping, id uint32) bool {
+	for _, m := range mappings {
+		if id >= m.ContainerID && id-m.ContainerID < m.Size {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSpec writes s to w and closes it.
+func writeSpec(w io.WriteCloser, s spec) error {
+	err := gob.NewEncoder(w).Encode(s)
+	if err1 := w.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// readSpec reads the spec writeSpec wrote to r.
+func readSpec(r io.Reader) (spec, error) {
+	var s spec
+	err := gob.NewDecoder(r).Decode(&s)
+	return s, err
+}
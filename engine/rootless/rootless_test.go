@@ -0,0 +1,46 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rootless
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/containers/build/engine"
+)
+
+func TestSpecRoundTrip(t *testing.T) {
+	s := spec{
+		Command: "/bin/sh",
+		Args:    []string{"-c", "echo a,b", "line one\nline two", "", "\x00\xff"},
+		Env:     []string{"MULTILINE=one\ntwo", "EMPTY=", "LATIN1=caf\xe9"},
+		Layers:  engine.Layers{Upper: "/var/lib/acbuild/upper"},
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer r.Close()
+	go writeSpec(w, s)
+	got, err := readSpec(r)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("spec changed on the way\nexpected: %#v\ngot:      %#v", s, got)
+	}
+}
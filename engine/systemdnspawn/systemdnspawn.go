@@ -16,6 +16,7 @@ package systemdnspawn
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
@@ -23,11 +24,14 @@ import (
 	"syscall"
 
 	"github.com/containers/build/engine"
+	"github.com/containers/build/engine/cgroups"
+	"github.com/containers/build/engine/mounts"
+	"github.com/containers/build/engine/network"
 )
 
 type Engine struct{}
 
-func (e Engine) Run(command string, args []string, environment map[string]string, chroot, workingDir string) error {
+func (e Engine) Run(command string, args []string, environment map[string]string, chroot, workingDir string, opts engine.RunOptions) (err error) {
 	nspawncmd := []string{"systemd-nspawn", "-D", chroot}
 
 	systemdVersion, err := getSystemdVersion()
@@ -64,6 +68,73 @@ func (e Engine) Run(command string, args []string, environment map[string]string
 		}
 	}
 
+	switch opts.Network {
+	case "", engine.NetworkHost:
+	case engine.NetworkNone:
+		nspawncmd = append(nspawncmd, "--private-network")
+	case engine.NetworkPrivate:
+		if systemdVersion < 236 {
+			return fmt.Errorf("the private network can only be used on systems with systemd-nspawn >= 236")
+		}
+		ns, err := network.NewNamespace(opts)
+		if err != nil {
+			return err
+		}
+		defer ns.Close()
+		nsPath, err := ns.StartHolder()
+		if err != nil {
+			return err
+		}
+		nspawncmd = append(nspawncmd, "--network-namespace-path="+nsPath)
+	default:
+		return fmt.Errorf("unknown network %q", opts.Network)
+	}
+	if len(opts.DNS) > 0 {
+		if systemdVersion >= 239 {
+			nspawncmd = append(nspawncmd, "--resolv-conf=off")
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: systemd-nspawn version %d might replace the nameservers given with --dns\n", systemdVersion)
+		}
+	}
+
+	for _, b := range opts.Binds {
+		if strings.Contains(b.Source, ":") || strings.Contains(b.Target, ":") {
+			return fmt.Errorf("systemd-nspawn can't bind paths holding colons: %s:%s", b.Source, b.Target)
+		}
+		if b.ReadOnly {
+			nspawncmd = append(nspawncmd, "--bind-ro="+b.Source+":"+b.Target)
+		} else {
+			nspawncmd = append(nspawncmd, "--bind="+b.Source+":"+b.Target)
+		}
+	}
+	if len(opts.Secrets) > 0 {
+		// The secrets are put in a tmpfs on the host, which is bound into
+		// the container
+		secretsDir, err := ioutil.TempDir("", "acbuild-secrets")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(secretsDir)
+		err = mounts.MountSecrets(secretsDir, opts.Secrets, opts.Credential)
+		if err != nil {
+			return err
+		}
+		defer syscall.Unmount(secretsDir, syscall.MNT_DETACH)
+		nspawncmd = append(nspawncmd, "--bind-ro="+secretsDir+":"+engine.SecretsDir)
+	}
+
+	if c := opts.Credential; c != nil {
+		// systemd-nspawn looks the user up in the container itself, with
+		// getent, and runs the command with the user's own groups
+		if c.Name == "" {
+			return fmt.Errorf("the systemd-nspawn engine can only run the command as a user in the image's /etc/passwd")
+		}
+		if strings.Contains(opts.User, ":") {
+			return fmt.Errorf("the systemd-nspawn engine can't run the command with a group other than the user's own")
+		}
+		nspawncmd = append(nspawncmd, "--user="+c.Name)
+	}
+
 	for name, value := range environment {
 		nspawncmd = append(nspawncmd, "--setenv", name+"="+value)
 	}
@@ -96,7 +167,25 @@ func (e Engine) Run(command string, args []string, environment map[string]string
 	execCmd.Stderr = os.Stderr
 	execCmd.Env = []string{"SYSTEMD_LOG_LEVEL=err"}
 
-	err = execCmd.Run()
+	if opts.Limits != (engine.Limits{}) || opts.Timeout != 0 {
+		var cg *cgroups.Cgroup
+		cg, err = cgroups.New(opts.Limits)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err1 := cg.Destroy(); err == nil {
+				err = err1
+			}
+		}()
+		cg.Wrap(execCmd)
+		err = execCmd.Start()
+		if err == nil {
+			err = cg.Wait(execCmd, opts.Timeout)
+		}
+	} else {
+		err = execCmd.Run()
+	}
 	if err == exec.ErrNotFound {
 		return fmt.Errorf("systemd-nspawn is required but not found")
 	}
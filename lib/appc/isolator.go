@@ -24,20 +24,38 @@ import (
 
 // AddIsolator adds an isolator of name and value to the current manifest
 func (m *Manifest) AddIsolator(name string, value []byte) error {
-	acid, err := types.NewACIdentifier(name)
+	i, err := NewIsolator(name, value)
 	if err != nil {
 		return err
 	}
-	rawMsg := json.RawMessage(value)
 
 	if m.manifest.App == nil {
 		m.manifest.App = newManifestApp()
 	}
+	removeIsolatorFromMan(i.Name, m.manifest)
+	m.manifest.App.Isolators = append(m.manifest.App.Isolators, *i)
+	return m.save()
+}
+
+// NewIsolator returns the isolator of name and value, returning an error if
+// there's no such isolator or value isn't a valid value for it.
+func NewIsolator(name string, value []byte) (*types.Isolator, error) {
+	acid, err := types.NewACIdentifier(name)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = json.Unmarshal(value, &v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for isolator %s: %v", name, err)
+	}
+	rawMsg := json.RawMessage(value)
+
 	_, ok := types.ResourceIsolatorNames[*acid]
 	if !ok {
 		_, ok = types.LinuxIsolatorNames[*acid]
 		if !ok {
-			return fmt.Errorf("unknown isolator name: %s", name)
+			return nil, fmt.Errorf("unknown isolator name: %s", name)
 		}
 	}
 	i := &types.Isolator{
@@ -46,15 +64,13 @@ func (m *Manifest) AddIsolator(name string, value []byte) error {
 	}
 	blob, err := json.Marshal(i)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = i.UnmarshalJSON(blob)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	removeIsolatorFromMan(*acid, m.manifest)
-	m.manifest.App.Isolators = append(m.manifest.App.Isolators, *i)
-	return m.save()
+	return i, nil
 }
 
 // RemoveIsolator removes an isolator of name from the current manifest
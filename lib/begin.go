@@ -30,7 +30,8 @@ import (
 
 	"github.com/containers/build/lib/appc"
 	"github.com/containers/build/lib/oci"
-	"github.com/containers/build/registry"
+	"github.com/containers/build/registry/auth"
+	"github.com/containers/build/registry/distribution"
 	"github.com/containers/build/util"
 
 	docker2aci "github.com/appc/docker2aci/lib"
@@ -65,6 +66,16 @@ func (a *ACBuild) Begin(start string, insecure bool, mode BuildMode) (err error)
 		return fmt.Errorf("build already in progress in this working dir")
 	}
 
+	if os.Geteuid() != 0 {
+		idMap, err := util.RootlessIDMap()
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "warning: couldn't find the subordinate IDs of the current user: %v\n", err)
+		case !idMap.HasSubordinateIDs():
+			fmt.Fprintf(os.Stderr, "warning: no subordinate IDs can be mapped for the current user, so every file in the image will be owned by root. Check /etc/subuid, /etc/subgid, and that newuidmap and newgidmap are installed\n")
+		}
+	}
+
 	err = os.MkdirAll(a.ContextPath, 0755)
 	if err != nil {
 		return err
@@ -74,11 +85,6 @@ func (a *ACBuild) Begin(start string, insecure bool, mode BuildMode) (err error)
 		return err
 	}
 
-	if os.Geteuid() != 0 {
-		fmt.Fprint(os.Stderr, `please run this as superuser to avoid 
-				       filesystem permissions issues`)
-	}
-
 	defer func() {
 		if err1 := a.unlock(); err == nil {
 			err = err1
@@ -89,7 +95,7 @@ func (a *ACBuild) Begin(start string, insecure bool, mode BuildMode) (err error)
 		// If there was an error while beginning, we don't want to produce an
 		// unexpected build context
 		if err != nil {
-			os.RemoveAll(a.ContextPath)
+			util.RemoveAll(a.ContextPath)
 		}
 	}()
 
@@ -111,6 +117,29 @@ func (a *ACBuild) Begin(start string, insecure bool, mode BuildMode) (err error)
 		return err
 	}
 
+	if a.Reproducible {
+		err = a.saveSourceDateEpoch()
+		if err != nil {
+			return err
+		}
+	}
+
+	switch mode {
+	case BuildModeOCI:
+		_, err = a.LayerCompression.OCILayerMediaType()
+		if err != nil {
+			return err
+		}
+		err = a.saveLayerCompression()
+		if err != nil {
+			return err
+		}
+	case BuildModeAppC:
+		if a.LayerCompression != util.CompressionGzip || a.LayerCompressionLevel != 0 {
+			return fmt.Errorf("layer compression can only be picked in the oci build mode")
+		}
+	}
+
 	if start != "" {
 		err = os.MkdirAll(a.CurrentImagePath, 0755)
 		if err != nil {
@@ -129,11 +158,11 @@ func (a *ACBuild) Begin(start string, insecure bool, mode BuildMode) (err error)
 				return a.beginFromLocalImage(start, mode)
 			}
 		} else {
+			dockerPrefix := "docker://"
 			if mode == BuildModeOCI {
-				// TODO: fix this!
-				return fmt.Errorf("cannot start from remote OCI images currently")
+				start = strings.TrimPrefix(start, dockerPrefix)
+				return a.beginFromRemoteOCIImage(start, insecure)
 			}
-			dockerPrefix := "docker://"
 			if strings.HasPrefix(start, dockerPrefix) {
 				start = strings.TrimPrefix(start, dockerPrefix)
 				return a.beginFromRemoteDockerImage(start, insecure)
@@ -246,6 +275,14 @@ func (a *ACBuild) beginFromLocalDirectory(start string) error {
 }
 
 func (a *ACBuild) beginWithEmptyOCI() error {
+	err := a.writeOCILayout()
+	if err != nil {
+		return err
+	}
+	return a.writeSkeletonRefAndManifest()
+}
+
+func (a *ACBuild) writeOCILayout() error {
 	for _, f := range []string{"blobs/sha256", "refs"} {
 		err := os.MkdirAll(path.Join(a.CurrentImagePath, f), 0755)
 		if err != nil {
@@ -256,16 +293,12 @@ func (a *ACBuild) beginWithEmptyOCI() error {
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(path.Join(a.CurrentImagePath, "oci-layout"), ociLayoutBlob, 0755)
-	if err != nil {
-		return err
-	}
-	return a.writeSkeletonRefAndManifest()
+	return ioutil.WriteFile(path.Join(a.CurrentImagePath, "oci-layout"), ociLayoutBlob, 0755)
 }
 
 func (a *ACBuild) writeSkeletonRefAndManifest() error {
 	img := ociImage.Image{
-		Created:      time.Now().Format(time.RFC3339),
+		Created:      a.now().Format(time.RFC3339),
 		Architecture: runtime.GOARCH,
 		OS:           runtime.GOOS,
 	}
@@ -414,11 +447,9 @@ func (a *ACBuild) beginFromRemoteImage(start string, insecure bool) error {
 	}
 	defer os.RemoveAll(tmpDepStoreExpandedPath)
 
-	reg := registry.Registry{
-		DepStoreTarPath:      tmpDepStoreTarPath,
-		DepStoreExpandedPath: tmpDepStoreExpandedPath,
-		Insecure:             insecure,
-		Debug:                a.Debug,
+	reg, err := a.newRegistry(tmpDepStoreTarPath, tmpDepStoreExpandedPath, insecure)
+	if err != nil {
+		return err
 	}
 
 	err = reg.Fetch(app.Name, labels, 0, false)
@@ -473,6 +504,22 @@ func (a *ACBuild) beginFromRemoteDockerImage(start string, insecure bool) (err e
 		AllowHTTP:  insecure,
 	}
 
+	var username, password string
+	ref, err := distribution.ParseReference(start)
+	if err != nil {
+		return err
+	}
+	authConfig, err := auth.LoadConfig(a.AuthConfigPaths, a.DockerConfigPath)
+	if err != nil {
+		return err
+	}
+	if creds := authConfig.ForRegistry(ref.Registry); creds != nil {
+		if creds.Token != "" {
+			return fmt.Errorf("only a username and password can be used to fetch images from %s in the appc build mode", ref.Registry)
+		}
+		username, password = creds.Username, creds.Password
+	}
+
 	config := docker2aci.RemoteConfig{
 		CommonConfig: docker2aci.CommonConfig{
 			Squash:      true,
@@ -480,8 +527,8 @@ func (a *ACBuild) beginFromRemoteDockerImage(start string, insecure bool) (err e
 			TmpDir:      tempDir,
 			Compression: common.GzipCompression,
 		},
-		Username: "",
-		Password: "",
+		Username: username,
+		Password: password,
 		Insecure: insecureConf,
 	}
 	renderedACIs, err := docker2aci.ConvertRemoteRepo(start, config)
@@ -501,3 +548,37 @@ func (a *ACBuild) beginFromRemoteDockerImage(start string, insecure bool) (err e
 
 	return util.ExtractImage(absRenderedACI, a.CurrentImagePath, nil)
 }
+
+func (a *ACBuild) beginFromRemoteOCIImage(start string, insecure bool) error {
+	ref, err := distribution.ParseReference(start)
+	if err != nil {
+		return err
+	}
+
+	err = a.writeOCILayout()
+	if err != nil {
+		return err
+	}
+
+	client, err := a.newDistributionClient(ref.Registry, insecure)
+	if err != nil {
+		return err
+	}
+	err = client.Pull(ref, a.CurrentImagePath, "latest")
+	if err != nil {
+		return err
+	}
+
+	// Changes made during the build go into a new layer on top of the pulled
+	// ones, so the layers of the starting image stay byte for byte identical
+	// and registries that already have them won't need them uploaded again.
+	err = a.loadManifest()
+	if err != nil {
+		return err
+	}
+	newLayer, err := util.OCINewExpandedLayer(a.OCIExpandedBlobsPath)
+	if err != nil {
+		return err
+	}
+	return a.rehashAndStoreOCIBlob(newLayer, true)
+}
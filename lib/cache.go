@@ -0,0 +1,381 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containers/build/lib/oci"
+	"github.com/containers/build/util"
+)
+
+// The build cache lets run, copy and copy-to-dir reuse the layer an earlier
+// build produced when the same step is taken on top of the same layers. It
+// lives outside of the build context, since `acbuild end` removes that, and
+// is laid out like an OCI blob store, with each key in keys/ naming the blob in
+// blobs/ that its step produced.
+
+// cacheKeyVersion is mixed into every cache key, and should be changed
+// whenever what a step produces changes for the same key.
+const cacheKeyVersion = "1"
+
+// DefaultCachePath returns where the build cache is kept when no other path
+// is given, which is $XDG_CACHE_HOME/acbuild, or ~/.cache/acbuild if
+// $XDG_CACHE_HOME isn't set.
+func DefaultCachePath() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return path.Join(dir, "acbuild")
+	}
+	return path.Join(os.Getenv("HOME"), ".cache", "acbuild")
+}
+
+// cacheEntry records the layer a cached step produced.
+type cacheEntry struct {
+	Digest    string `json:"digest"`
+	DiffID    string `json:"diffID"`
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+}
+
+// cacheEnabled returns whether the build cache is used. Only layers can be
+// cached, so it is only used in the oci build mode.
+func (a *ACBuild) cacheEnabled() bool {
+	return !a.NoCache && a.CachePath != "" && a.Mode == BuildModeOCI
+}
+
+// cacheKey returns the key under which the result of a step is cached. The
+// key covers every layer currently in the image, how layers are compressed and
+// the source date epoch they're clamped to, the kind of step taken, and the
+// given parts, which hold whatever else decides what the step does, such as
+// the command run and its environment.
+func (a *ACBuild) cacheKey(step string, parts ...string) (string, error) {
+	ociMan, ok := a.man.(*oci.Image)
+	if !ok {
+		return "", fmt.Errorf("internal error: mismatched manifest type and build mode")
+	}
+
+	var epoch *int64
+	if a.Reproducible {
+		epoch = &a.SourceDateEpoch
+	}
+
+	// Encoding the key as JSON keeps parts from running into each other
+	blob, err := json.Marshal(struct {
+		Version     string           `json:"version"`
+		Layers      []string         `json:"layers"`
+		Compression layerCompression `json:"compression"`
+		Epoch       *int64           `json:"sourceDateEpoch"`
+		Step        string           `json:"step"`
+		Parts       []string         `json:"parts"`
+	}{
+		cacheKeyVersion,
+		ociMan.GetLayerDigests(),
+		layerCompression{a.LayerCompression, a.LayerCompressionLevel},
+		epoch,
+		step,
+		parts,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(blob)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// useCachedLayer replaces the top layer of the image with the layer cached
+// under key, if there is one, and returns whether it did.
+func (a *ACBuild) useCachedLayer(key string) (bool, error) {
+	if key == "" {
+		return false, nil
+	}
+	keyPath := path.Join(a.CachePath, "keys", key)
+	entry, err := readCacheEntry(keyPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	cachedBlob := path.Join(a.CachePath, "blobs", "sha256", entry.Digest)
+	if _, err := os.Stat(cachedBlob); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	err = os.MkdirAll(path.Join(a.CurrentImagePath, "blobs", "sha256"), 0755)
+	if err != nil {
+		return false, err
+	}
+	err = linkOrCopy(cachedBlob, path.Join(a.CurrentImagePath, "blobs", "sha256", entry.Digest))
+	if err != nil {
+		return false, err
+	}
+	oldTopLayerHash, err := a.replaceTopOCILayer(entry.Digest, entry.DiffID, entry.MediaType, entry.Size)
+	if err != nil {
+		return false, err
+	}
+	if oldTopLayerHash != "" {
+		// The layer is expanded again if a later step needs it
+		err = util.RemoveAll(path.Join(a.OCIExpandedBlobsPath, strings.Replace(oldTopLayerHash, ":", "/", -1)))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// The modification time of a key records when it was last used, for
+	// PruneCache
+	now := time.Now()
+	os.Chtimes(keyPath, now, now)
+
+	fmt.Fprintf(os.Stderr, "Using cached layer sha256:%s\n", entry.Digest)
+	return true, nil
+}
+
+// storeCachedLayer saves the top layer of the image in the cache under key.
+// Failing to do so doesn't fail the step that produced the layer, so errors
+// are only printed.
+func (a *ACBuild) storeCachedLayer(key string) {
+	if key == "" {
+		return
+	}
+	err := a.writeCacheEntry(key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: error adding layer to the build cache: %v\n", err)
+	}
+}
+
+func (a *ACBuild) writeCacheEntry(key string) error {
+	ociMan, ok := a.man.(*oci.Image)
+	if !ok {
+		return fmt.Errorf("internal error: mismatched manifest type and build mode")
+	}
+	layers := ociMan.GetManifest().Layers
+	diffIDs := ociMan.GetDiffIDs()
+	if len(layers) == 0 || len(diffIDs) != len(layers) {
+		return fmt.Errorf("image has no top layer to cache")
+	}
+	top := layers[len(layers)-1]
+	algo, hash, err := util.SplitOCILayerID(top.Digest)
+	if err != nil {
+		return err
+	}
+	_, diffID, err := util.SplitOCILayerID(diffIDs[len(diffIDs)-1])
+	if err != nil {
+		return err
+	}
+	if algo != "sha256" {
+		return fmt.Errorf("unsupported digest algorithm %q", algo)
+	}
+
+	for _, dir := range []string{"keys", path.Join("blobs", "sha256")} {
+		err = os.MkdirAll(path.Join(a.CachePath, dir), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	cachedBlob := path.Join(a.CachePath, "blobs", "sha256", hash)
+	if _, err := os.Stat(cachedBlob); os.IsNotExist(err) {
+		err = linkOrCopy(path.Join(a.CurrentImagePath, "blobs", algo, hash), cachedBlob)
+		if err != nil {
+			return err
+		}
+	}
+
+	blob, err := json.Marshal(cacheEntry{Digest: hash, DiffID: diffID, MediaType: top.MediaType, Size: top.Size})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(a.CachePath, "keys", key), blob)
+}
+
+func readCacheEntry(keyPath string) (*cacheEntry, error) {
+	blob, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	var entry cacheEntry
+	err = json.Unmarshal(blob, &entry)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing cache entry %s: %v", keyPath, err)
+	}
+	return &entry, nil
+}
+
+// PruneCache removes the entries in the build cache at cachePath that haven't
+// been used for longer than olderThan, or every entry if olderThan is zero,
+// along with the layers no remaining entry uses. It returns the number of
+// entries removed and the number of bytes freed.
+func PruneCache(cachePath string, olderThan time.Duration) (int, int64, error) {
+	keysPath := path.Join(cachePath, "keys")
+	blobsPath := path.Join(cachePath, "blobs", "sha256")
+
+	keys, err := ioutil.ReadDir(keysPath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	removed := 0
+	inUse := make(map[string]bool)
+	cutoff := time.Now().Add(-olderThan)
+	for _, key := range keys {
+		keyPath := path.Join(keysPath, key.Name())
+		if olderThan == 0 || key.ModTime().Before(cutoff) {
+			err := os.Remove(keyPath)
+			if err != nil {
+				return removed, 0, err
+			}
+			removed++
+			continue
+		}
+		entry, err := readCacheEntry(keyPath)
+		if err != nil {
+			// A broken entry is never a hit, so it may as well go
+			os.Remove(keyPath)
+			removed++
+			continue
+		}
+		inUse[entry.Digest] = true
+	}
+
+	blobs, err := ioutil.ReadDir(blobsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return removed, 0, err
+	}
+	var freed int64
+	for _, blob := range blobs {
+		if inUse[blob.Name()] {
+			continue
+		}
+		err := os.Remove(path.Join(blobsPath, blob.Name()))
+		if err != nil {
+			return removed, freed, err
+		}
+		freed += blob.Size()
+	}
+	return removed, freed, nil
+}
+
+// hashTree returns a digest of the contents, modes and owners of the file or
+// directory tree at root, for keying the cache entries of copy steps.
+// Modification times are left out, so that a fresh checkout of the same files
+// still hits the cache.
+func hashTree(root string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		var uid, gid uint32
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = st.Uid, st.Gid
+		}
+		fmt.Fprintf(h, "%q %v %d %d", rel, info.Mode(), uid, gid)
+		switch {
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fh := sha256.New()
+			_, err = io.Copy(fh, f)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " %x", fh.Sum(nil))
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " %q", target)
+		case info.Mode()&(os.ModeDevice|os.ModeCharDevice) != 0:
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				fmt.Fprintf(h, " %d", st.Rdev)
+			}
+		}
+		fmt.Fprintf(h, "\n")
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// linkOrCopy hard links from to to, copying it instead when that isn't
+// possible, such as when they're on different filesystems. Blobs are never
+// modified once written, so sharing them between the cache and an image is
+// safe.
+func linkOrCopy(from, to string) error {
+	err := os.Link(from, to)
+	if err == nil || os.IsExist(err) {
+		return nil
+	}
+
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpFile, err := ioutil.TempFile(path.Dir(to), "acbuild-blob")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmpFile, src)
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	err = os.Rename(tmpFile.Name(), to)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return err
+}
+
+// writeFileAtomic writes data to a temporary file next to p and renames it to
+// p, so that concurrent readers never see a partially written file.
+func writeFileAtomic(p string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(path.Dir(p), "acbuild-tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(data)
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	err = os.Rename(tmpFile.Name(), p)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return err
+}
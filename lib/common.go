@@ -16,20 +16,24 @@ package lib
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/containers/build/lib/appc"
 	"github.com/containers/build/lib/oci"
+	"github.com/containers/build/registry"
+	"github.com/containers/build/registry/auth"
+	"github.com/containers/build/registry/distribution"
 	"github.com/containers/build/util"
 )
 
@@ -68,12 +72,48 @@ type ACBuild struct {
 	OverlayTargetPath    string
 	OverlayWorkPath      string
 	BuildModePath        string
+	LayerCompressionPath string
+	SourceDateEpochPath  string
 	OCIExpandedBlobsPath string
 	Debug                bool
 	Mode                 BuildMode
 
+	// TrustedKeysPaths are the trust stores holding the keys that ACIs
+	// fetched during the build must be signed with.
+	TrustedKeysPaths []string
+	// SkipVerify disables checking the signatures of fetched ACIs.
+	SkipVerify bool
+	// AuthConfigPaths are the directories holding rkt style auth config
+	// files, which hold credentials for the hosts images are fetched from.
+	AuthConfigPaths []string
+	// DockerConfigPath is the path to Docker's config.json, which holds
+	// credentials for docker registries.
+	DockerConfigPath string
+	// CachePath is where the build cache of layers produced by run, copy and
+	// copy-to-dir in the oci build mode is kept.
+	CachePath string
+	// NoCache disables both using and adding to the build cache.
+	NoCache bool
+	// LayerCompression and LayerCompressionLevel are how layers produced
+	// in the oci build mode are compressed. They are saved by Begin, and
+	// loaded for the rest of the build.
+	LayerCompression      util.Compression
+	LayerCompressionLevel int
+	// ImageCompression and ImageCompressionLevel are how images produced by
+	// Write are compressed.
+	ImageCompression      util.Compression
+	ImageCompressionLevel int
+	// Reproducible makes the layers and images produced by the build depend
+	// only on their contents, so that the same build produces the same
+	// image on any machine. Timestamps are clamped to SourceDateEpoch,
+	// which is in seconds since the Unix epoch, and stand in for the current
+	// time. They are saved by Begin, and loaded for the rest of the build.
+	Reproducible    bool
+	SourceDateEpoch int64
+
 	man      Manifest
 	lockFile *os.File
+	held     bool
 }
 
 // NewACBuild returns a new ACBuild struct with sane defaults for all of the
@@ -88,15 +128,60 @@ func NewACBuild(cwd string, debug bool, buildMode BuildMode) (*ACBuild, error) {
 		OverlayTargetPath:    path.Join(cwd, defaultWorkPath, "target"),
 		OverlayWorkPath:      path.Join(cwd, defaultWorkPath, "work"),
 		BuildModePath:        path.Join(cwd, defaultWorkPath, "buildMode"),
+		LayerCompressionPath: path.Join(cwd, defaultWorkPath, "layerCompression"),
+		SourceDateEpochPath:  path.Join(cwd, defaultWorkPath, "sourceDateEpoch"),
 		OCIExpandedBlobsPath: path.Join(cwd, defaultWorkPath, "ociblobs"),
 		Debug:                debug,
 		Mode:                 buildMode,
+		TrustedKeysPaths:     registry.DefaultTrustedKeysPaths,
+		AuthConfigPaths:      auth.DefaultConfigPaths,
+		DockerConfigPath:     auth.DefaultDockerConfigPath(),
+		CachePath:            DefaultCachePath(),
+		LayerCompression:     util.CompressionGzip,
+		ImageCompression:     util.CompressionGzip,
 	}
-	// This might fail, and that's ok (maybe the build hasn't started yet)
+	// These might fail, and that's ok (maybe the build hasn't started yet)
 	a.loadManifest()
+	a.loadLayerCompression()
+	a.loadSourceDateEpoch()
 	return a, nil
 }
 
+// newRegistry returns a registry.Registry storing ACIs at the given paths. If
+// insecure is true images may be fetched over plain HTTP and their signatures
+// aren't checked.
+func (a *ACBuild) newRegistry(tarPath, expandedPath string, insecure bool) (registry.Registry, error) {
+	authConfig, err := auth.LoadConfig(a.AuthConfigPaths, a.DockerConfigPath)
+	if err != nil {
+		return registry.Registry{}, err
+	}
+	return registry.Registry{
+		DepStoreTarPath:      tarPath,
+		DepStoreExpandedPath: expandedPath,
+		Insecure:             insecure,
+		Debug:                a.Debug,
+		Keystore:             &registry.Keystore{Paths: a.TrustedKeysPaths},
+		SkipVerify:           insecure || a.SkipVerify,
+		Auth:                 authConfig,
+	}, nil
+}
+
+// newDistributionClient returns a distribution.Client for talking to
+// registryHost, using the credentials configured for it if there are any.
+func (a *ACBuild) newDistributionClient(registryHost string, insecure bool) (*distribution.Client, error) {
+	authConfig, err := auth.LoadConfig(a.AuthConfigPaths, a.DockerConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	client := distribution.NewClient(insecure, a.Debug)
+	if creds := authConfig.ForRegistry(registryHost); creds != nil {
+		client.Username = creds.Username
+		client.Password = creds.Password
+		client.Token = creds.Token
+	}
+	return client, nil
+}
+
 func (a *ACBuild) loadManifest() error {
 	var err error
 	switch a.Mode {
@@ -116,6 +201,72 @@ func (a *ACBuild) loadManifest() error {
 	return nil
 }
 
+// layerCompression is what's saved at a.LayerCompressionPath.
+type layerCompression struct {
+	Compression util.Compression `json:"compression"`
+	Level       int              `json:"level"`
+}
+
+func (a *ACBuild) saveLayerCompression() error {
+	blob, err := json.Marshal(layerCompression{a.LayerCompression, a.LayerCompressionLevel})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(a.LayerCompressionPath, blob, 0644)
+}
+
+func (a *ACBuild) loadLayerCompression() error {
+	blob, err := ioutil.ReadFile(a.LayerCompressionPath)
+	if err != nil {
+		// Builds begun before layer compression could be picked use the
+		// default
+		return err
+	}
+	var c layerCompression
+	err = json.Unmarshal(blob, &c)
+	if err != nil {
+		return fmt.Errorf("error loading layer compression: %v", err)
+	}
+	a.LayerCompression, a.LayerCompressionLevel = c.Compression, c.Level
+	return nil
+}
+
+func (a *ACBuild) saveSourceDateEpoch() error {
+	return ioutil.WriteFile(a.SourceDateEpochPath, []byte(strconv.FormatInt(a.SourceDateEpoch, 10)), 0644)
+}
+
+func (a *ACBuild) loadSourceDateEpoch() error {
+	blob, err := ioutil.ReadFile(a.SourceDateEpochPath)
+	if err != nil {
+		// The build isn't reproducible
+		return err
+	}
+	epoch, err := strconv.ParseInt(string(blob), 10, 64)
+	if err != nil {
+		return fmt.Errorf("error loading source date epoch: %v", err)
+	}
+	a.Reproducible, a.SourceDateEpoch = true, epoch
+	return nil
+}
+
+// now returns the time to record as the current time in images, which is the
+// source date epoch in reproducible builds.
+func (a *ACBuild) now() time.Time {
+	if a.Reproducible {
+		return time.Unix(a.SourceDateEpoch, 0).UTC()
+	}
+	return time.Now()
+}
+
+// tarHeaderEditor returns the function tar headers of layers and images are
+// passed through before they're written, or nil if they're written as is.
+func (a *ACBuild) tarHeaderEditor() func(*tar.Header) {
+	if !a.Reproducible {
+		return nil
+	}
+	return util.ReproducibleHeader(time.Unix(a.SourceDateEpoch, 0))
+}
+
 func (a *ACBuild) lock() error {
 	_, err := os.Stat(a.ContextPath)
 	switch {
@@ -125,6 +276,9 @@ func (a *ACBuild) lock() error {
 		return err
 	}
 
+	if a.held {
+		return nil
+	}
 	if a.lockFile != nil {
 		return fmt.Errorf("lock already held by this ACBuild")
 	}
@@ -155,6 +309,9 @@ func (a *ACBuild) lock() error {
 }
 
 func (a *ACBuild) unlock() error {
+	if a.held {
+		return nil
+	}
 	if a.lockFile == nil {
 		return fmt.Errorf("lock isn't held by this ACBuild")
 	}
@@ -178,6 +335,28 @@ func (a *ACBuild) unlock() error {
 	return nil
 }
 
+// Hold takes the lock on the build, and keeps it until Release is called. The
+// functions on the ACBuild don't take and drop the lock while it's held, so a
+// series of them, such as the commands in a script, only takes it once, and
+// can't be interleaved with another acbuild working on the same build.
+func (a *ACBuild) Hold() error {
+	err := a.lock()
+	if err != nil {
+		return err
+	}
+	a.held = true
+	return nil
+}
+
+// Release drops the lock taken by Hold.
+func (a *ACBuild) Release() error {
+	if !a.held {
+		return fmt.Errorf("lock isn't held by this ACBuild")
+	}
+	a.held = false
+	return a.unlock()
+}
+
 func GetBuildMode(cwd string) (BuildMode, error) {
 	mode, err := ioutil.ReadFile(path.Join(cwd, defaultWorkPath, "buildMode"))
 	if err != nil {
@@ -202,28 +381,38 @@ func (a *ACBuild) rehashAndStoreOCIBlob(targetPath string, newLayer bool) error
 	}()
 	combinedWriter := io.MultiWriter(layerDigestWriter, tmpFile)
 
-	gzipWriter := gzip.NewWriter(combinedWriter)
+	mediaType, err := a.LayerCompression.OCILayerMediaType()
+	if err != nil {
+		return err
+	}
+	compressedWriter, err := a.LayerCompression.NewWriter(combinedWriter, a.LayerCompressionLevel)
+	if err != nil {
+		return err
+	}
 	defer func() {
 		if !finishedWriting {
-			gzipWriter.Close()
+			compressedWriter.Close()
 		}
 	}()
 
 	diffIdWriter := sha256.New()
-	tarWriter := tar.NewWriter(io.MultiWriter(diffIdWriter, gzipWriter))
+	tarWriter := tar.NewWriter(io.MultiWriter(diffIdWriter, compressedWriter))
 	defer func() {
 		if !finishedWriting {
 			tarWriter.Close()
 		}
 	}()
 
-	err = filepath.Walk(targetPath, util.PathWalker(tarWriter, targetPath))
+	err = util.WriteOCILayer(tarWriter, targetPath, a.tarHeaderEditor())
 	if err != nil {
 		return err
 	}
 
 	tarWriter.Close()
-	gzipWriter.Close()
+	err = compressedWriter.Close()
+	if err != nil {
+		return err
+	}
 	tmpFile.Close()
 
 	finfo, err := os.Stat(tmpFile.Name())
@@ -239,6 +428,21 @@ func (a *ACBuild) rehashAndStoreOCIBlob(targetPath string, newLayer bool) error
 	layerDigest := hex.EncodeToString(layerDigestWriter.Sum(nil))
 	diffId := hex.EncodeToString(diffIdWriter.Sum(nil))
 
+	if newLayer {
+		// Only empty layers are added as new ones, so a top layer with the
+		// same digest is empty too, and is used instead of stacking another
+		// on it.
+		ociMan, ok := a.man.(*oci.Image)
+		if !ok {
+			return fmt.Errorf("mismatch between build mode and manifest type?!")
+		}
+		layers := ociMan.GetLayerDigests()
+		if len(layers) > 0 && layers[len(layers)-1] == "sha256:"+layerDigest {
+			os.Remove(tmpFile.Name())
+			return os.RemoveAll(targetPath)
+		}
+	}
+
 	err = os.MkdirAll(path.Join(a.CurrentImagePath, "blobs", "sha256"), 0755)
 	if err != nil {
 		return err
@@ -249,38 +453,47 @@ func (a *ACBuild) rehashAndStoreOCIBlob(targetPath string, newLayer bool) error
 		return err
 	}
 
+	// The layer is already where it belongs if it was left unchanged
 	blobStorePath := path.Dir(path.Dir(targetPath))
-	err = os.Rename(targetPath, path.Join(blobStorePath, "sha256", layerDigest))
-	if err != nil {
-		return err
-	}
-
-	var oldTopLayerHash string
-	switch ociMan := a.man.(type) {
-	case *oci.Image:
-		if newLayer {
-			// add a new top layer to the config/manifest
-			err = ociMan.NewTopLayer("sha256", layerDigest, diffId, fsize)
-			if err != nil {
-				return err
-			}
-		} else {
-			// update the top layer hash in the config/manifest, and remove the old
-			// top layer
-			oldTopLayerHash, err = ociMan.UpdateTopLayer("sha256", layerDigest, diffId, fsize)
-			if err != nil {
-				return err
-			}
+	expandedLayerPath := path.Join(blobStorePath, "sha256", layerDigest)
+	if path.Clean(targetPath) != expandedLayerPath {
+		err = os.Rename(targetPath, expandedLayerPath)
+		if err != nil {
+			return err
 		}
-	default:
-		return fmt.Errorf("mismatch between build mode and manifest type?!")
 	}
-	if !newLayer && oldTopLayerHash != "" {
-		err = os.Remove(path.Join(a.CurrentImagePath, "blobs", strings.Replace(oldTopLayerHash, ":", "/", -1)))
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error removing old top layer, hash %s: %v", oldTopLayerHash, err)
+
+	if newLayer {
+		// add a new top layer to the config/manifest
+		ociMan, ok := a.man.(*oci.Image)
+		if !ok {
+			return fmt.Errorf("mismatch between build mode and manifest type?!")
 		}
+		return ociMan.NewTopLayer("sha256", layerDigest, diffId, mediaType, fsize)
 	}
+	_, err = a.replaceTopOCILayer(layerDigest, diffId, mediaType, fsize)
+	return err
+}
 
-	return nil
+// replaceTopOCILayer updates the top layer hash in the config/manifest to the
+// sha256 layer already stored in the image, and removes the old top layer's
+// blob. The old top layer's hash is returned, or an empty string if there was
+// none or it was the same layer.
+func (a *ACBuild) replaceTopOCILayer(layerDigest, diffId, mediaType string, size int64) (string, error) {
+	ociMan, ok := a.man.(*oci.Image)
+	if !ok {
+		return "", fmt.Errorf("mismatch between build mode and manifest type?!")
+	}
+	oldTopLayerHash, err := ociMan.UpdateTopLayer("sha256", layerDigest, diffId, mediaType, size)
+	if err != nil {
+		return "", err
+	}
+	if oldTopLayerHash == "" || oldTopLayerHash == "sha256:"+layerDigest {
+		return "", nil
+	}
+	err = os.Remove(path.Join(a.CurrentImagePath, "blobs", strings.Replace(oldTopLayerHash, ":", "/", -1)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error removing old top layer, hash %s: %v", oldTopLayerHash, err)
+	}
+	return oldTopLayerHash, nil
 }
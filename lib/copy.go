@@ -110,6 +110,27 @@ func (a *ACBuild) expandTopOCILayer() (string, error) {
 }
 
 func (a *ACBuild) copyToDirOCI(froms []string, to string) error {
+	var cacheKey string
+	if a.cacheEnabled() {
+		parts := []string{to}
+		for _, from := range froms {
+			digest, err := hashTree(from)
+			if err != nil {
+				return err
+			}
+			parts = append(parts, path.Base(from), digest)
+		}
+		var err error
+		cacheKey, err = a.cacheKey("copy-to-dir", parts...)
+		if err != nil {
+			return err
+		}
+		hit, err := a.useCachedLayer(cacheKey)
+		if err != nil || hit {
+			return err
+		}
+	}
+
 	currentLayer, err := a.expandTopOCILayer()
 	if err != nil {
 		return err
@@ -138,7 +159,12 @@ func (a *ACBuild) copyToDirOCI(froms []string, to string) error {
 		}
 	}
 
-	return a.rehashAndStoreOCIBlob(currentLayer, false)
+	err = a.rehashAndStoreOCIBlob(currentLayer, false)
+	if err != nil {
+		return err
+	}
+	a.storeCachedLayer(cacheKey)
+	return nil
 }
 
 // CopyToTarget will copy a single file/directory from the from string to the
@@ -177,6 +203,22 @@ func (a *ACBuild) copyToTargetAppC(from string, to string) error {
 }
 
 func (a *ACBuild) copyToTargetOCI(from string, to string) error {
+	var cacheKey string
+	if a.cacheEnabled() {
+		digest, err := hashTree(from)
+		if err != nil {
+			return err
+		}
+		cacheKey, err = a.cacheKey("copy", to, digest)
+		if err != nil {
+			return err
+		}
+		hit, err := a.useCachedLayer(cacheKey)
+		if err != nil || hit {
+			return err
+		}
+	}
+
 	targetPath, err := a.expandTopOCILayer()
 	if err != nil {
 		return err
@@ -196,6 +238,10 @@ func (a *ACBuild) copyToTargetOCI(from string, to string) error {
 		return err
 	}
 
-	return a.rehashAndStoreOCIBlob(targetPath, false)
-
+	err = a.rehashAndStoreOCIBlob(targetPath, false)
+	if err != nil {
+		return err
+	}
+	a.storeCachedLayer(cacheKey)
+	return nil
 }
@@ -0,0 +1,185 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dockerfile parses Dockerfiles into the instructions they're made of,
+// and expands the words of their arguments as Docker would.
+package dockerfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Error is an error in a Dockerfile, at the line the instruction it was found
+// in starts on.
+type Error struct {
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Instruction is a single instruction of a Dockerfile, with any lines it was
+// continued onto joined.
+type Instruction struct {
+	Line     int               // The line the instruction starts on
+	Command  string            // The instruction, in lower case
+	Flags    map[string]string // Flags given before the arguments, such as --chown=USER
+	Args     string            // The arguments, as written
+	Exec     []string          // The arguments, if given in the JSON exec form
+	Original string            // The whole instruction, as written
+}
+
+// Dockerfile is a parsed Dockerfile.
+type Dockerfile struct {
+	Instructions []Instruction
+	// Escape is the character that escapes the next one, and continues
+	// instructions onto the next line. It's \ unless the escape parser
+	// directive changes it.
+	Escape rune
+}
+
+// flagCommands are the instructions whose arguments may start with flags.
+var flagCommands = map[string]bool{
+	"add":  true,
+	"copy": true,
+	"from": true,
+	"run":  true,
+}
+
+// execCommands are the instructions whose arguments may be given in the JSON
+// exec form.
+var execCommands = map[string]bool{
+	"add":         true,
+	"cmd":         true,
+	"copy":        true,
+	"entrypoint":  true,
+	"healthcheck": true,
+	"run":         true,
+	"shell":       true,
+	"volume":      true,
+}
+
+// Parse parses the Dockerfile in blob.
+func Parse(blob []byte) (*Dockerfile, error) {
+	d := &Dockerfile{Escape: '\\'}
+	lines := strings.Split(string(blob), "\n")
+
+	// Parser directives can only come before anything else
+	i := 0
+	for ; i < len(lines); i++ {
+		name, value, ok := parseDirective(lines[i])
+		if !ok {
+			break
+		}
+		if name == "escape" {
+			if value != `\` && value != "`" {
+				return nil, &Error{i + 1, fmt.Errorf("invalid escape character %q, which must be \\ or `", value)}
+			}
+			d.Escape = rune(value[0])
+		}
+	}
+
+	for ; i < len(lines); i++ {
+		line := strings.TrimSpace(strings.TrimSuffix(lines[i], "\r"))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		start := i
+		for strings.HasSuffix(line, string(d.Escape)) && i < len(lines)-1 {
+			line = strings.TrimSuffix(line, string(d.Escape))
+			i++
+			next := strings.TrimRightFunc(strings.TrimSuffix(lines[i], "\r"), unicode.IsSpace)
+			// Comments and empty lines don't end an instruction
+			if trimmed := strings.TrimSpace(next); trimmed == "" || trimmed[0] == '#' {
+				next = string(d.Escape)
+			}
+			line += next
+		}
+		line = strings.TrimSuffix(line, string(d.Escape))
+
+		inst, err := parseInstruction(line)
+		if err != nil {
+			return nil, &Error{start + 1, err}
+		}
+		inst.Line = start + 1
+		d.Instructions = append(d.Instructions, inst)
+	}
+	return d, nil
+}
+
+// parseDirective returns the name, in lower case, and value of the parser
+// directive on line, if it is one.
+func parseDirective(line string) (name, value string, ok bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	parts := strings.SplitN(line[1:], "=", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	name = strings.ToLower(strings.TrimSpace(parts[0]))
+	if name == "" || strings.IndexFunc(name, unicode.IsSpace) != -1 {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(parts[1]), true
+}
+
+func parseInstruction(line string) (Instruction, error) {
+	inst := Instruction{Command: line, Original: line}
+	if i := strings.IndexFunc(line, unicode.IsSpace); i != -1 {
+		inst.Command, inst.Args = line[:i], strings.TrimSpace(line[i:])
+	}
+	inst.Command = strings.ToLower(inst.Command)
+
+	if flagCommands[inst.Command] {
+		for strings.HasPrefix(inst.Args, "--") {
+			flag := inst.Args
+			inst.Args = ""
+			if i := strings.IndexFunc(flag, unicode.IsSpace); i != -1 {
+				flag, inst.Args = flag[:i], strings.TrimSpace(flag[i:])
+			}
+			parts := strings.SplitN(flag[2:], "=", 2)
+			if parts[0] == "" {
+				return inst, fmt.Errorf("invalid flag %q", flag)
+			}
+			if inst.Flags == nil {
+				inst.Flags = make(map[string]string)
+			}
+			if len(parts) == 2 {
+				inst.Flags[parts[0]] = parts[1]
+			} else {
+				inst.Flags[parts[0]] = ""
+			}
+		}
+	}
+
+	if execCommands[inst.Command] && strings.HasPrefix(inst.Args, "[") {
+		// Anything that isn't a JSON array of strings is taken to be
+		// in the shell form, as Docker does
+		var exec []string
+		if json.Unmarshal([]byte(inst.Args), &exec) == nil {
+			if exec == nil {
+				exec = []string{}
+			}
+			inst.Exec = exec
+		}
+	}
+	return inst, nil
+}
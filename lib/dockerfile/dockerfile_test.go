@@ -0,0 +1,163 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	blob := []byte(`# syntax=docker/dockerfile:1
+# A comment, after which directives are comments too
+# escape=` + "`" + `
+FROM alpine:3.7 AS build
+
+run apk add --no-cache \
+    curl \
+# this comment doesn't end the instruction
+
+    git
+COPY --chown=app:app --from=build src/ /app/
+CMD ["/app/run", "--port", "80"]
+ENTRYPOINT [not json
+ENV A=1 B="two words"
+`)
+	d, err := Parse(blob)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if d.Escape != '\\' {
+		t.Errorf("escape directive after a comment was used")
+	}
+	expected := []Instruction{
+		{
+			Line:     4,
+			Command:  "from",
+			Args:     "alpine:3.7 AS build",
+			Original: "FROM alpine:3.7 AS build",
+		},
+		{
+			Line:     6,
+			Command:  "run",
+			Args:     "apk add --no-cache     curl     git",
+			Original: "run apk add --no-cache     curl     git",
+		},
+		{
+			Line:     11,
+			Command:  "copy",
+			Flags:    map[string]string{"chown": "app:app", "from": "build"},
+			Args:     "src/ /app/",
+			Original: "COPY --chown=app:app --from=build src/ /app/",
+		},
+		{
+			Line:     12,
+			Command:  "cmd",
+			Args:     `["/app/run", "--port", "80"]`,
+			Exec:     []string{"/app/run", "--port", "80"},
+			Original: `CMD ["/app/run", "--port", "80"]`,
+		},
+		{
+			Line:     13,
+			Command:  "entrypoint",
+			Args:     "[not json",
+			Original: "ENTRYPOINT [not json",
+		},
+		{
+			Line:     14,
+			Command:  "env",
+			Args:     `A=1 B="two words"`,
+			Original: `ENV A=1 B="two words"`,
+		},
+	}
+	if !reflect.DeepEqual(d.Instructions, expected) {
+		t.Errorf("parsed instructions, expected:\n%#v\nactual:\n%#v", expected, d.Instructions)
+	}
+}
+
+func TestParseEscapeDirective(t *testing.T) {
+	d, err := Parse([]byte("# escape=`\nFROM scratch\nCOPY C:\\src `\n  C:\\dst\n"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if d.Escape != '`' {
+		t.Errorf("escape, expected:'`' actual:%q", d.Escape)
+	}
+	if len(d.Instructions) != 2 || d.Instructions[1].Args != `C:\src   C:\dst` {
+		t.Errorf("unexpected instructions: %#v", d.Instructions)
+	}
+
+	_, err = Parse([]byte("# escape=x\nFROM scratch\n"))
+	if e, ok := err.(*Error); !ok || e.Line != 1 {
+		t.Errorf("expected an error on line 1, got %v", err)
+	}
+}
+
+func TestWords(t *testing.T) {
+	env := map[string]string{
+		"NAME":  "app",
+		"SPACE": "a  b",
+		"EMPTY": "",
+	}
+	type testcase struct {
+		input  string
+		output []string
+		err    bool
+	}
+	cases := []testcase{
+		{"", nil, false},
+		{"a b\tc", []string{"a", "b", "c"}, false},
+		{`'$NAME x' "$NAME x"`, []string{"$NAME x", "app x"}, false},
+		{`/opt/$NAME/bin ${NAME}s`, []string{"/opt/app/bin", "apps"}, false},
+		{`$SPACE "$SPACE"`, []string{"a", "b", "a  b"}, false},
+		{`$UNSET $EMPTY ""`, []string{""}, false},
+		{`${UNSET:-default} ${NAME:-default} ${EMPTY:-$NAME}`, []string{"default", "app", "app"}, false},
+		{`${NAME:+set} ${UNSET:+set}x`, []string{"set", "x"}, false},
+		{`a\ b \$NAME "\"\$\x"`, []string{"a b", "$NAME", `"$\x`}, false},
+		{`cost$ $1`, []string{"cost$", "$1"}, false},
+		{`'open`, nil, true},
+		{`"open`, nil, true},
+		{`${NAME`, nil, true},
+		{`${NAME:?error}`, nil, true},
+	}
+	d := &Dockerfile{Escape: '\\'}
+	for _, c := range cases {
+		output, err := d.Words(c.input, env)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", c.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(output, c.output) {
+			t.Errorf("%q, expected:%q actual:%q", c.input, c.output, output)
+		}
+	}
+}
+
+func TestWord(t *testing.T) {
+	d := &Dockerfile{Escape: '\\'}
+	output, err := d.Word(`/usr/bin:$PATH  "and  more"`, map[string]string{"PATH": "/bin"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if expected := "/usr/bin:/bin  and  more"; output != expected {
+		t.Errorf("expected:%q actual:%q", expected, output)
+	}
+}
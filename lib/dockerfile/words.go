@@ -0,0 +1,249 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"bytes"
+	"fmt"
+	"unicode"
+)
+
+var (
+	errSingleQuote = fmt.Errorf("unterminated single quote block")
+	errDoubleQuote = fmt.Errorf("unterminated double quote block")
+	errBrace       = fmt.Errorf("unterminated ${ block")
+)
+
+// Words splits s into words on whitespace, removing quotes and escapes, and
+// expanding $VAR, ${VAR}, ${VAR:-DEFAULT} and ${VAR:+ALTERNATIVE} with the
+// variables in env. Values expanded outside of double quotes are split into
+// words as well.
+func (d *Dockerfile) Words(s string, env map[string]string) ([]string, error) {
+	l := &lexer{input: []rune(s), env: env, escape: d.Escape}
+	return l.words(true)
+}
+
+// Word is like Words, but returns s as a single word, whitespace and all.
+func (d *Dockerfile) Word(s string, env map[string]string) (string, error) {
+	l := &lexer{input: []rune(s), env: env, escape: d.Escape}
+	words, err := l.words(false)
+	if err != nil {
+		return "", err
+	}
+	return words[0], nil
+}
+
+type lexer struct {
+	input  []rune
+	pos    int
+	env    map[string]string
+	escape rune
+}
+
+func (l *lexer) words(split bool) ([]string, error) {
+	var words []string
+	word := &bytes.Buffer{}
+	inWord := !split
+	endWord := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		l.pos++
+		switch {
+		case split && unicode.IsSpace(c):
+			endWord()
+		case c == l.escape:
+			inWord = true
+			if l.pos < len(l.input) {
+				c = l.input[l.pos]
+				l.pos++
+			}
+			word.WriteRune(c)
+		case c == '\'':
+			inWord = true
+			end := l.index('\'')
+			if end == -1 {
+				return nil, errSingleQuote
+			}
+			word.WriteString(string(l.input[l.pos:end]))
+			l.pos = end + 1
+		case c == '"':
+			inWord = true
+			err := l.doubleQuoted(word)
+			if err != nil {
+				return nil, err
+			}
+		case c == '$':
+			value, err := l.variable()
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range value {
+				if split && unicode.IsSpace(r) {
+					endWord()
+					continue
+				}
+				inWord = true
+				word.WriteRune(r)
+			}
+		default:
+			inWord = true
+			word.WriteRune(c)
+		}
+	}
+	endWord()
+	return words, nil
+}
+
+// doubleQuoted writes what's quoted up to the closing double quote to word,
+// where only variables are expanded, and the escape character only escapes
+// itself, $ and ".
+func (l *lexer) doubleQuoted(word *bytes.Buffer) error {
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		l.pos++
+		switch c {
+		case '"':
+			return nil
+		case '$':
+			value, err := l.variable()
+			if err != nil {
+				return err
+			}
+			word.WriteString(value)
+		case l.escape:
+			if l.pos < len(l.input) {
+				next := l.input[l.pos]
+				if next == '"' || next == '$' || next == l.escape {
+					c = next
+					l.pos++
+				}
+			}
+			word.WriteRune(c)
+		default:
+			word.WriteRune(c)
+		}
+	}
+	return errDoubleQuote
+}
+
+// variable returns the value of the variable named after a $, or the $ itself
+// if no name follows it.
+func (l *lexer) variable() (string, error) {
+	if l.pos < len(l.input) && l.input[l.pos] == '{' {
+		l.pos++
+		name := l.name()
+		if l.pos >= len(l.input) {
+			return "", errBrace
+		}
+		if name == "" {
+			return "", fmt.Errorf("missing variable name in ${ block")
+		}
+		switch l.input[l.pos] {
+		case '}':
+			l.pos++
+			return l.env[name], nil
+		case ':':
+		default:
+			return "", fmt.Errorf("invalid character %q in ${%s block", l.input[l.pos], name)
+		}
+
+		l.pos++
+		if l.pos >= len(l.input) {
+			return "", errBrace
+		}
+		modifier := l.input[l.pos]
+		l.pos++
+		end := l.closingBrace()
+		if end == -1 {
+			return "", errBrace
+		}
+		sub := &lexer{input: l.input[l.pos:end], env: l.env, escape: l.escape}
+		l.pos = end + 1
+		words, err := sub.words(false)
+		if err != nil {
+			return "", err
+		}
+		value, set := l.env[name]
+		switch modifier {
+		case '-':
+			if !set || value == "" {
+				return words[0], nil
+			}
+			return value, nil
+		case '+':
+			if set && value != "" {
+				return words[0], nil
+			}
+			return "", nil
+		}
+		return "", fmt.Errorf("unsupported modifier :%c in ${%s}", modifier, name)
+	}
+
+	name := l.name()
+	if name == "" {
+		return "$", nil
+	}
+	return l.env[name], nil
+}
+
+// name reads the name of a variable, which may be empty.
+func (l *lexer) name() string {
+	start := l.pos
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		if c != '_' && !unicode.IsLetter(c) && (l.pos == start || !unicode.IsDigit(c)) {
+			break
+		}
+		l.pos++
+	}
+	return string(l.input[start:l.pos])
+}
+
+// index returns the index of the next c, or -1 if there isn't one.
+func (l *lexer) index(c rune) int {
+	for i := l.pos; i < len(l.input); i++ {
+		if l.input[i] == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// closingBrace returns the index of the } closing the ${ block being read,
+// skipping over any nested in it, or -1 if it isn't closed.
+func (l *lexer) closingBrace() int {
+	depth := 0
+	for i := l.pos; i < len(l.input); i++ {
+		switch {
+		case l.input[i] == l.escape:
+			i++
+		case l.input[i] == '{' && i > 0 && l.input[i-1] == '$':
+			depth++
+		case l.input[i] == '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
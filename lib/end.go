@@ -42,7 +42,7 @@ func (a *ACBuild) End() error {
 		return err
 	}
 
-	err = os.RemoveAll(a.ContextPath)
+	err = util.RemoveAll(a.ContextPath)
 	if err != nil {
 		switch err1 := err.(type) {
 		case *os.PathError:
@@ -56,5 +56,10 @@ func (a *ACBuild) End() error {
 		return err
 	}
 
+	// The lock was removed along with the rest of the context
+	a.lockFile.Close()
+	a.lockFile = nil
+	a.held = false
+
 	return nil
 }
@@ -20,6 +20,8 @@ import (
 	"github.com/containers/build/util"
 )
 
+// NewLayer starts a new, empty layer on top of the image, which the changes
+// made after it go into. If the top layer is still empty it's used instead.
 func (a *ACBuild) NewLayer() (err error) {
 	if err = a.lock(); err != nil {
 		return err
@@ -71,6 +71,27 @@ func (a *ACBuild) GetAnnotations() (m map[string]string, err error) {
 	}()
 	return a.man.GetAnnotations()
 }
+
+// GetEnv returns the environment variables set in the image's manifest.
+func (a *ACBuild) GetEnv() (env map[string]string, err error) {
+	if err = a.lock(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	switch a.Mode {
+	case BuildModeAppC:
+		return a.getEnvVarsAppC()
+	case BuildModeOCI:
+		return a.getEnvVarsOCI()
+	}
+	return nil, fmt.Errorf("unknown build mode: %s", a.Mode)
+}
+
 func (a *ACBuild) AddAnnotation(name, value string) (err error) {
 	if err = a.lock(); err != nil {
 		return err
@@ -0,0 +1,240 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containers/build/engine"
+	"github.com/containers/build/util"
+)
+
+// checkMounts checks the binds and secrets in opts, and returns opts with the
+// paths on the host made absolute.
+func checkMounts(opts engine.RunOptions) (engine.RunOptions, error) {
+	binds := make([]engine.Bind, len(opts.Binds))
+	for i, b := range opts.Binds {
+		if !path.IsAbs(b.Target) {
+			return opts, fmt.Errorf("bind target %q isn't an absolute path", b.Target)
+		}
+		b.Target = path.Clean(b.Target)
+		if b.Target == "/" {
+			return opts, fmt.Errorf("can't bind %s over the root filesystem", b.Source)
+		}
+		source, err := filepath.Abs(b.Source)
+		if err != nil {
+			return opts, err
+		}
+		if _, err := os.Stat(source); err != nil {
+			return opts, fmt.Errorf("can't bind %s: %v", b.Source, err)
+		}
+		b.Source = source
+		binds[i] = b
+	}
+
+	secrets := make([]engine.Secret, len(opts.Secrets))
+	ids := make(map[string]bool)
+	for i, s := range opts.Secrets {
+		if s.ID == "" || s.ID == "." || s.ID == ".." || strings.Contains(s.ID, "/") {
+			return opts, fmt.Errorf("invalid secret id %q", s.ID)
+		}
+		if ids[s.ID] {
+			return opts, fmt.Errorf("secret %q given more than once", s.ID)
+		}
+		ids[s.ID] = true
+		source, err := filepath.Abs(s.Source)
+		if err != nil {
+			return opts, err
+		}
+		info, err := os.Stat(source)
+		if err != nil {
+			return opts, fmt.Errorf("can't read secret %q: %v", s.ID, err)
+		}
+		if !info.Mode().IsRegular() {
+			return opts, fmt.Errorf("secret %q isn't a regular file", s.ID)
+		}
+		s.Source = source
+		secrets[i] = s
+	}
+
+	opts.Binds, opts.Secrets = binds, secrets
+	return opts, nil
+}
+
+// mountPoints returns the files and directories that must be made in the upper
+// layer to mount the binds and secrets of opts on, as OverrideFiles takes them.
+// layers holds the layers of the root filesystem, bottom-most first.
+func mountPoints(layers []string, opts engine.RunOptions) (map[string][]byte, []string, error) {
+	files := make(map[string][]byte)
+	var dirs []string
+	add := func(target string, isDir bool) error {
+		exists, err := mountPointExists(layers, target, isDir)
+		switch {
+		case err != nil:
+			return err
+		case exists:
+		case isDir:
+			dirs = append(dirs, strings.TrimPrefix(target, "/"))
+		default:
+			files[strings.TrimPrefix(target, "/")] = nil
+		}
+		return nil
+	}
+
+	for _, b := range opts.Binds {
+		info, err := os.Stat(b.Source)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = add(b.Target, info.IsDir())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(opts.Secrets) > 0 {
+		err := add(engine.SecretsDir, true)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return files, dirs, nil
+}
+
+// mountPointExists returns whether there's a file, or directory if isDir is
+// set, at target in the root filesystem made of layers. The directories above
+// it must not be symlinks, which the mount would be made through on the host.
+func mountPointExists(layers []string, target string, isDir bool) (bool, error) {
+	elems := strings.Split(strings.TrimPrefix(target, "/"), "/")
+	for i := range elems {
+		p := path.Join(elems[:i+1]...)
+		info, err := layeredLstat(layers, p)
+		if err != nil {
+			return false, err
+		}
+		if info == nil {
+			return false, nil
+		}
+		last := i == len(elems)-1
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			return false, fmt.Errorf("can't mount at %s, since /%s is a symlink", target, p)
+		case !info.IsDir() && (!last || isDir):
+			return false, fmt.Errorf("can't mount a directory at %s, since /%s isn't one", target, p)
+		case info.IsDir() && last && !isDir:
+			return false, fmt.Errorf("can't mount a file at %s, since it's a directory", target)
+		}
+	}
+	return true, nil
+}
+
+// layeredLstat returns the file info of p in the root filesystem made of
+// layers, or nil if there isn't anything there.
+func layeredLstat(layers []string, p string) (os.FileInfo, error) {
+	for i := len(layers) - 1; i >= 0; i-- {
+		info, err := os.Lstat(filepath.Join(layers[i], p))
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return nil, err
+		case isWhiteout(info):
+			return nil, nil
+		}
+		return info, nil
+	}
+	return nil, nil
+}
+
+func isWhiteout(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0
+}
+
+// checkSecretsRemoved returns an error if any of secrets was left in layer,
+// whether where it was mounted or anywhere it was copied to. What's found is
+// removed from the layer.
+func checkSecretsRemoved(layer string, secrets []engine.Secret) error {
+	if len(secrets) == 0 {
+		return nil
+	}
+	secretLeft := func(s engine.Secret, p string) error {
+		err := util.RemoveAll(filepath.Join(layer, p))
+		if err != nil {
+			return fmt.Errorf("secret %q was left in the image at /%s, and couldn't be removed: %v", s.ID, p, err)
+		}
+		return fmt.Errorf("secret %q was left in the image at /%s, and was removed from it", s.ID, p)
+	}
+
+	for _, s := range secrets {
+		p := path.Join(strings.TrimPrefix(engine.SecretsDir, "/"), s.ID)
+		_, err := os.Lstat(filepath.Join(layer, p))
+		if err == nil {
+			return secretLeft(s, p)
+		}
+	}
+
+	contents := make(map[int64][]engine.Secret)
+	for _, s := range secrets {
+		info, err := os.Stat(s.Source)
+		if err != nil {
+			return err
+		}
+		// Every empty file would be taken for an empty secret
+		if info.Size() > 0 {
+			contents[info.Size()] = append(contents[info.Size()], s)
+		}
+	}
+	// Files owned by subordinate IDs may not be readable, and are skipped
+	return filepath.Walk(layer, func(p string, info os.FileInfo, err error) error {
+		if os.IsPermission(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		candidates := contents[info.Size()]
+		if !info.Mode().IsRegular() || len(candidates) == 0 {
+			return nil
+		}
+		blob, err := ioutil.ReadFile(p)
+		if os.IsPermission(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, s := range candidates {
+			secret, err := ioutil.ReadFile(s.Source)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(blob, secret) {
+				rel, err := filepath.Rel(layer, p)
+				if err != nil {
+					return err
+				}
+				return secretLeft(s, rel)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/build/engine"
+)
+
+const defaultHosts = "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"
+
+// networkFiles returns the files that are written into the root filesystem
+// while a command is run with opts, keyed by their path in it. layers holds the
+// layers of the root filesystem, bottom-most first.
+func networkFiles(layers []string, opts engine.RunOptions) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+
+	if len(opts.Hosts) > 0 {
+		hosts, err := layeredFile(layers, "etc/hosts")
+		if err != nil {
+			return nil, err
+		}
+		if hosts == nil {
+			hosts = []byte(defaultHosts)
+		}
+		buf := bytes.NewBuffer(hosts)
+		if len(hosts) > 0 && !bytes.HasSuffix(hosts, []byte("\n")) {
+			buf.WriteString("\n")
+		}
+		for _, entry := range opts.Hosts {
+			tokens := strings.SplitN(entry, ":", 2)
+			if len(tokens) != 2 || tokens[0] == "" || net.ParseIP(tokens[1]) == nil {
+				return nil, fmt.Errorf("invalid host %q, must be HOST:IP", entry)
+			}
+			fmt.Fprintf(buf, "%s\t%s\n", tokens[1], tokens[0])
+		}
+		files["etc/hosts"] = buf.Bytes()
+	}
+
+	if len(opts.DNS) > 0 {
+		var buf bytes.Buffer
+		for _, nameserver := range opts.DNS {
+			if net.ParseIP(nameserver) == nil {
+				return nil, fmt.Errorf("invalid nameserver %q, must be an IP address", nameserver)
+			}
+			fmt.Fprintf(&buf, "nameserver %s\n", nameserver)
+		}
+		files["etc/resolv.conf"] = buf.Bytes()
+	}
+
+	return files, nil
+}
+
+// layeredFile returns the contents of the regular file at p in the root
+// filesystem made of layers, or nil if there isn't one.
+func layeredFile(layers []string, p string) ([]byte, error) {
+	for i := len(layers) - 1; i >= 0; i-- {
+		target := filepath.Join(layers[i], p)
+		info, err := os.Lstat(target)
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return nil, err
+		case !info.Mode().IsRegular():
+			// Whiteouts hide the file in lower layers, and symlinks
+			// would be followed on the host
+			return nil, nil
+		}
+		return ioutil.ReadFile(target)
+	}
+	return nil, nil
+}
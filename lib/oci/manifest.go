@@ -240,7 +240,7 @@ func (i *Image) Print(w io.Writer, prettyPrint, printConfig bool) error {
 	return nil
 }
 
-func (i *Image) UpdateTopLayer(digestAlgo, layerDigest, diffId string, size int64) (string, error) {
+func (i *Image) UpdateTopLayer(digestAlgo, layerDigest, diffId, mediaType string, size int64) (string, error) {
 	var oldLayerDigest string
 	layerDigest = digestAlgo + ":" + layerDigest
 	diffId = digestAlgo + ":" + diffId
@@ -254,7 +254,7 @@ func (i *Image) UpdateTopLayer(digestAlgo, layerDigest, diffId string, size int6
 	}
 
 	layerDescriptor := ociImage.Descriptor{
-		MediaType: ociImage.MediaTypeImageLayer,
+		MediaType: mediaType,
 		Digest:    layerDigest,
 		Size:      size,
 	}
@@ -270,7 +270,7 @@ func (i *Image) UpdateTopLayer(digestAlgo, layerDigest, diffId string, size int6
 	return oldLayerDigest, i.save()
 }
 
-func (i *Image) NewTopLayer(digestAlgo, layerDigest, diffId string, size int64) error {
+func (i *Image) NewTopLayer(digestAlgo, layerDigest, diffId, mediaType string, size int64) error {
 	layerDigest = digestAlgo + ":" + layerDigest
 	diffId = digestAlgo + ":" + diffId
 	if len(i.config.RootFS.DiffIDs) == 0 {
@@ -284,7 +284,7 @@ func (i *Image) NewTopLayer(digestAlgo, layerDigest, diffId string, size int64)
 
 	layerDescriptor :=
 		ociImage.Descriptor{
-			MediaType: ociImage.MediaTypeImageLayer,
+			MediaType: mediaType,
 			Digest:    layerDigest,
 			Size:      size,
 		}
@@ -0,0 +1,63 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+
+	"github.com/containers/build/lib/oci"
+	"github.com/containers/build/registry/distribution"
+)
+
+// Push uploads the image from the current build to a registry. dest is a
+// docker style image reference naming the registry, repository, and tag to
+// push to. Blobs the registry already has are not uploaded again. If username
+// is set, it and password are used to authenticate with the registry,
+// otherwise any credentials configured for the registry are used.
+func (a *ACBuild) Push(dest string, insecure bool, username, password string) (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	if a.Mode != BuildModeOCI {
+		return fmt.Errorf("pushing to a registry is currently only supported in OCI builds")
+	}
+
+	ref, err := distribution.ParseReference(dest)
+	if err != nil {
+		return err
+	}
+
+	ociMan, ok := a.man.(*oci.Image)
+	if !ok {
+		return fmt.Errorf("internal error: mismatched manifest type and build mode???")
+	}
+
+	client, err := a.newDistributionClient(ref.Registry, insecure)
+	if err != nil {
+		return err
+	}
+	if username != "" {
+		client.Username = username
+		client.Password = password
+		client.Token = ""
+	}
+	return client.Push(ref, a.CurrentImagePath, ociMan.GetRef())
+}
@@ -16,6 +16,7 @@ package lib
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -29,16 +30,20 @@ import (
 	"github.com/appc/spec/schema/types"
 
 	"github.com/containers/build/engine"
+	"github.com/containers/build/engine/network"
 	"github.com/containers/build/lib/oci"
 	"github.com/containers/build/registry"
 	"github.com/containers/build/util"
+	"github.com/containers/build/util/fsdiffer"
 )
 
 // Run will execute the given command in the ACI being built. a.CurrentImagePath
 // is where the untarred ACI is stored, a.DepStoreTarPath is the directory to
 // download dependencies into, a.DepStoreExpandedPath is where the dependencies
 // are expanded into, and a.OverlayWorkPath is the work directory used by
-// overlayfs.
+// overlayfs. Where overlayfs can't be used, the layers are instead copied into
+// a.OverlayTargetPath, and what the command changes there is copied back into
+// the topmost layer.
 //
 // Arguments:
 //
@@ -48,7 +53,9 @@ import (
 // changed to its value before running the given command.
 //
 // - runEngine:  The engine used to perform the execution of the command.
-func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine engine.Engine) (err error) {
+//
+// - opts:       The rest of the settings the command is run with.
+func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine engine.Engine, opts engine.RunOptions) (err error) {
 	if err = a.lock(); err != nil {
 		return err
 	}
@@ -58,14 +65,32 @@ func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine
 		}
 	}()
 
-	if os.Geteuid() != 0 {
-		return fmt.Errorf("the run subcommand must be run as root")
+	layeredEngine, isLayered := runEngine.(engine.LayeredEngine)
+	if !isLayered && os.Geteuid() != 0 {
+		return fmt.Errorf("the run subcommand must be run as root, unless the rootless engine is used")
 	}
 
 	if len(cmd) == 0 {
 		return fmt.Errorf("command to run not set")
 	}
 
+	opts, err = checkMounts(opts)
+	if err != nil {
+		return err
+	}
+
+	var cacheKey string
+	if a.cacheEnabled() {
+		cacheKey, err = a.runCacheKey(cmd, workingDir, runEngine, opts)
+		if err != nil {
+			return err
+		}
+		hit, err := a.useCachedLayer(cacheKey)
+		if err != nil || hit {
+			return err
+		}
+	}
+
 	err = util.MaybeUnmount(a.OverlayTargetPath)
 	if err != nil {
 		return err
@@ -75,12 +100,12 @@ func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(a.OverlayTargetPath)
+	defer util.RemoveAll(a.OverlayTargetPath)
 	err = util.RmAndMkdir(a.OverlayWorkPath)
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(a.OverlayWorkPath)
+	defer util.RemoveAll(a.OverlayWorkPath)
 	err = os.MkdirAll(a.DepStoreExpandedPath, 0755)
 	if err != nil {
 		return err
@@ -103,65 +128,138 @@ func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine
 		return err
 	}
 
-	if len(depPaths) != 1 {
-		if !supportsOverlay() {
-			err := exec.Command("modprobe", "overlay").Run()
-			if err != nil {
-				if _, ok := err.(*exec.ExitError); ok {
-					return fmt.Errorf("overlayfs is not supported on your system")
-				}
-				return err
-			}
-			if !supportsOverlay() {
-				return fmt.Errorf(
-					"overlayfs support required for using run with dependencies")
-			}
+	var env map[string]string
+	switch a.Mode {
+	case BuildModeOCI:
+		env, err = a.getEnvVarsOCI()
+	case BuildModeAppC:
+		env, err = a.getEnvVarsAppC()
+	default:
+		return fmt.Errorf("unknown build mode: %s", a.Mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The host's time zone would make the image differ between machines in
+	// reproducible builds, and in the oci build mode there's no rootfs
+	// outside of the layers to put it in
+	if a.Mode == BuildModeAppC && !a.Reproducible {
+		err = a.mirrorLocalZoneInfo()
+		if err != nil {
+			return err
 		}
 	}
 
-	var chrootDir string
-	if len(depPaths) == 1 {
-		chrootDir = depPaths[0]
-	} else {
-		lowerLayers := depPaths[0 : len(depPaths)-1]
-		upperLayer := depPaths[len(depPaths)-1]
-		options := "lowerdir=" + strings.Join(lowerLayers, ":") +
-			",upperdir=" + upperLayer +
-			",workdir=" + a.OverlayWorkPath
-		err := syscall.Mount("overlay", a.OverlayTargetPath, "overlay", 0, options)
+	if opts.User != "" {
+		var home string
+		opts.Credential, home, err = resolveUser(depPaths, opts.User)
 		if err != nil {
 			return err
 		}
+		if _, ok := env["HOME"]; !ok {
+			env["HOME"] = home
+		}
+	}
 
+	if opts.Network == engine.NetworkPrivate {
+		for name, value := range network.ProxyEnv() {
+			env[name] = value
+		}
+	}
+
+	// The files and mount points are made in the upper layer, rather than
+	// whatever the command is run in, so that they're removed from it
+	// afterwards rather than whited out
+	files, err := networkFiles(depPaths, opts)
+	if err != nil {
+		return err
+	}
+	mountFiles, mountDirs, err := mountPoints(depPaths, opts)
+	if err != nil {
+		return err
+	}
+	for p, contents := range mountFiles {
+		files[p] = contents
+	}
+	var overrides *util.FileOverrides
+	if len(files) > 0 || len(mountDirs) > 0 {
+		overrides, err = util.OverrideFiles(depPaths[len(depPaths)-1], files, mountDirs)
+		if err != nil {
+			return err
+		}
 		defer func() {
-			err1 := syscall.Unmount(a.OverlayTargetPath, 0)
-			if err == nil {
+			if overrides == nil {
+				return
+			}
+			if err1 := overrides.Restore(); err == nil {
 				err = err1
 			}
 		}()
+	}
 
+	var chrootDir string
+	var differ *fsdiffer.TemporalFSDiffer
+	switch {
+	case isLayered:
+		// The engine assembles the root filesystem itself
+	case len(depPaths) == 1:
+		chrootDir = depPaths[0]
+	default:
 		chrootDir = a.OverlayTargetPath
+		err = mountOverlay(depPaths, a.OverlayTargetPath, a.OverlayWorkPath)
+		if err == nil {
+			defer func() {
+				err1 := syscall.Unmount(a.OverlayTargetPath, 0)
+				if err == nil {
+					err = err1
+				}
+			}()
+			break
+		}
+
+		fmt.Fprintf(os.Stderr, "warning: copying layers, since overlayfs can't be used: %v\n", err)
+		err = util.MergeLayers(depPaths, a.OverlayTargetPath)
+		if err != nil {
+			return err
+		}
+		differ, err = fsdiffer.NewTemporalFSDiffer(a.OverlayTargetPath)
+		if err != nil {
+			return err
+		}
 	}
 
-	var env map[string]string
-	switch a.Mode {
-	case BuildModeOCI:
-		env, err = a.getEnvVarsOCI()
-	case BuildModeAppC:
-		env, err = a.getEnvVarsAppC()
-	default:
-		return fmt.Errorf("unknown build mode: %s", a.Mode)
+	if isLayered {
+		layers := engine.Layers{
+			Lower:  depPaths[:len(depPaths)-1],
+			Upper:  depPaths[len(depPaths)-1],
+			Target: a.OverlayTargetPath,
+			Work:   a.OverlayWorkPath,
+		}
+		err = layeredEngine.RunLayered(cmd[0], cmd[1:], env, layers, workingDir, opts)
+	} else {
+		err = runEngine.Run(cmd[0], cmd[1:], env, chrootDir, workingDir, opts)
 	}
 	if err != nil {
 		return err
 	}
 
-	err = a.mirrorLocalZoneInfo()
-	if err != nil {
-		return err
+	if differ != nil {
+		err = copyChangedPaths(differ, a.OverlayTargetPath, depPaths)
+		if err != nil {
+			return err
+		}
+	}
+
+	if overrides != nil {
+		err = overrides.Restore()
+		overrides = nil
+		if err != nil {
+			return err
+		}
 	}
 
-	err = runEngine.Run(cmd[0], cmd[1:], env, chrootDir, workingDir)
+	err = checkSecretsRemoved(depPaths[len(depPaths)-1], opts.Secrets)
 	if err != nil {
 		return err
 	}
@@ -171,13 +269,102 @@ func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine
 		if err != nil {
 			return err
 		}
+		a.storeCachedLayer(cacheKey)
+	}
+
+	return nil
+}
+
+// mountOverlay mounts layers, bottom-most first, at target with overlayfs,
+// loading the overlay module if overlayfs isn't supported yet.
+func mountOverlay(layers []string, target, workDir string) error {
+	if !supportsOverlay() {
+		err := exec.Command("modprobe", "overlay").Run()
+		if err != nil || !supportsOverlay() {
+			return fmt.Errorf("overlayfs is not supported on your system")
+		}
 	}
 
+	// Overlayfs takes the topmost lower directory first
+	var lowerLayers []string
+	for i := len(layers) - 2; i >= 0; i-- {
+		lowerLayers = append(lowerLayers, layers[i])
+	}
+	options := "lowerdir=" + strings.Join(lowerLayers, ":") +
+		",upperdir=" + layers[len(layers)-1] +
+		",workdir=" + workDir
+	err := syscall.Mount("overlay", target, "overlay", 0, options)
+	if err != nil {
+		return fmt.Errorf("error mounting overlayfs: %v", err)
+	}
 	return nil
 }
 
+// copyChangedPaths copies what was changed in merged, which differ watches and
+// the layers were merged into, into the topmost of the layers.
+func copyChangedPaths(differ *fsdiffer.TemporalFSDiffer, merged string, layers []string) error {
+	changes, err := differ.Diff()
+	if err != nil {
+		return err
+	}
+	upper := layers[len(layers)-1]
+	unremovable, err := util.CopyChanges(changes, merged, upper, layers[:len(layers)-1])
+	if err != nil {
+		return err
+	}
+	for _, p := range unremovable {
+		fmt.Fprintf(os.Stderr, "warning: %s was removed from a lower layer, which can't be recorded when layers are copied\n", p)
+	}
+	return nil
+}
+
+// runCacheKey returns the build cache key for running cmd, which besides the
+// command covers everything else that decides what it does, including the
+// contents of the secrets it's given. Read-only binds are only covered by
+// their paths, since they may be too large to read, like /proc. An empty key
+// is returned when the layer mustn't be cached, which is when the command is
+// given a writable bind, since what it writes there would be skipped along
+// with it.
+func (a *ACBuild) runCacheKey(cmd []string, workingDir string, runEngine engine.Engine, opts engine.RunOptions) (string, error) {
+	ociMan, ok := a.man.(*oci.Image)
+	if !ok {
+		return "", fmt.Errorf("internal error: mismatched manifest type and build mode")
+	}
+	for _, bind := range opts.Binds {
+		if !bind.ReadOnly {
+			return "", nil
+		}
+	}
+	cmdBlob, err := json.Marshal(cmd)
+	if err != nil {
+		return "", err
+	}
+	envBlob, err := json.Marshal(ociMan.GetConfig().Config.Env)
+	if err != nil {
+		return "", err
+	}
+	// The resources the command may use don't change what it does
+	opts.Limits, opts.Timeout = engine.Limits{}, 0
+	optsBlob, err := json.Marshal(opts)
+	if err != nil {
+		return "", err
+	}
+	parts := []string{string(cmdBlob), workingDir, string(envBlob), fmt.Sprintf("%T", runEngine), string(optsBlob)}
+	for _, secret := range opts.Secrets {
+		digest, err := hashTree(secret.Source)
+		if err != nil {
+			// The command is run without the cache, and fails on
+			// the secret if it can't read it either
+			fmt.Fprintf(os.Stderr, "warning: not using the build cache, since secret %q couldn't be read: %v\n", secret.ID, err)
+			return "", nil
+		}
+		parts = append(parts, digest)
+	}
+	return a.cacheKey("run", parts...)
+}
+
 func (a *ACBuild) generateOverlayPathsAppC(insecure bool) ([]string, error) {
-	deps, err := a.renderACI(insecure, a.Debug)
+	deps, err := a.renderACI(insecure)
 	if err != nil {
 		return nil, err
 	}
@@ -280,12 +467,10 @@ func supportsOverlay() bool {
 	return false
 }
 
-func (a *ACBuild) renderACI(insecure, debug bool) ([]string, error) {
-	reg := registry.Registry{
-		DepStoreTarPath:      a.DepStoreTarPath,
-		DepStoreExpandedPath: a.DepStoreExpandedPath,
-		Insecure:             insecure,
-		Debug:                debug,
+func (a *ACBuild) renderACI(insecure bool) ([]string, error) {
+	reg, err := a.newRegistry(a.DepStoreTarPath, a.DepStoreExpandedPath, insecure)
+	if err != nil {
+		return nil, err
 	}
 
 	man, err := util.GetManifest(a.CurrentImagePath)
@@ -0,0 +1,77 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/containers/build/lib/oci"
+)
+
+// SignaturePath returns the path the signature of an image written to output
+// is stored at. For ACIs this is output with ".asc" appended, which is where
+// rkt looks for it. OCI image signatures cover the image's manifest rather
+// than the written file, and are stored at output with ".manifest.asc"
+// appended.
+func (a *ACBuild) SignaturePath(output string) string {
+	if a.Mode == BuildModeOCI {
+		return output + ".manifest.asc"
+	}
+	return output + ".asc"
+}
+
+// sign writes a detached armored signature for the image written to output
+// to a.SignaturePath(output).
+func (a *ACBuild) sign(output string, signer *openpgp.Entity) error {
+	var signed io.Reader
+	switch a.Mode {
+	case BuildModeAppC:
+		f, err := os.Open(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		signed = f
+	case BuildModeOCI:
+		// Signing the manifest means the signature stays valid for the
+		// image no matter how it's packaged or where it's pushed, as the
+		// manifest covers the config and every layer by digest.
+		manDigest := a.man.(*oci.Image).GetRef().Digest
+		f, err := os.Open(path.Join(a.CurrentImagePath, "blobs", strings.Replace(manDigest, ":", "/", 1)))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		signed = f
+	}
+
+	sigFile, err := os.OpenFile(a.SignaturePath(output), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer sigFile.Close()
+
+	err = openpgp.ArmoredDetachSign(sigFile, signer, signed, nil)
+	if err != nil {
+		return fmt.Errorf("error signing image: %v", err)
+	}
+	return sigFile.Close()
+}
@@ -0,0 +1,185 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containers/build/engine"
+)
+
+// passwdEntry is a line of /etc/passwd.
+type passwdEntry struct {
+	name string
+	uid  uint32
+	gid  uint32
+	home string
+}
+
+// groupEntry is a line of /etc/group.
+type groupEntry struct {
+	name    string
+	gid     uint32
+	members []string
+}
+
+// resolveUser resolves user, given as NAME|UID[:GROUP], against the
+// /etc/passwd and /etc/group of the root filesystem made of layers. It returns
+// who to run the command as, and their home directory.
+func resolveUser(layers []string, user string) (*engine.Credential, string, error) {
+	userPart, groupPart := user, ""
+	if i := strings.Index(user, ":"); i >= 0 {
+		userPart, groupPart = user[:i], user[i+1:]
+		if groupPart == "" {
+			return nil, "", fmt.Errorf("invalid user %q: the group is empty", user)
+		}
+	}
+	if userPart == "" {
+		return nil, "", fmt.Errorf("invalid user %q: the user is empty", user)
+	}
+
+	passwdBlob, err := layeredFile(layers, "etc/passwd")
+	if err != nil {
+		return nil, "", err
+	}
+	users := parsePasswd(passwdBlob)
+	groupBlob, err := layeredFile(layers, "etc/group")
+	if err != nil {
+		return nil, "", err
+	}
+	groups := parseGroup(groupBlob)
+
+	var entry *passwdEntry
+	uid, err := parseID(userPart)
+	if err == nil {
+		for i := range users {
+			if users[i].uid == uid {
+				entry = &users[i]
+				break
+			}
+		}
+	} else {
+		for i := range users {
+			if users[i].name == userPart {
+				entry = &users[i]
+				break
+			}
+		}
+		if entry == nil {
+			return nil, "", fmt.Errorf("user %q isn't in the image's /etc/passwd", userPart)
+		}
+	}
+
+	// A user that isn't in /etc/passwd gets root's group and directory
+	cred := &engine.Credential{UID: uid}
+	home := "/"
+	if entry != nil {
+		cred.UID, cred.GID, cred.Name = entry.uid, entry.gid, entry.name
+		home = entry.home
+	}
+
+	if groupPart != "" {
+		gid, err := parseID(groupPart)
+		if err != nil {
+			found := false
+			for _, g := range groups {
+				if g.name == groupPart {
+					gid, found = g.gid, true
+					break
+				}
+			}
+			if !found {
+				return nil, "", fmt.Errorf("group %q isn't in the image's /etc/group", groupPart)
+			}
+		}
+		cred.GID = gid
+	}
+
+	cred.Groups = []uint32{cred.GID}
+	if cred.Name != "" {
+		for _, g := range groups {
+			if g.gid == cred.GID || !contains(g.members, cred.Name) {
+				continue
+			}
+			cred.Groups = append(cred.Groups, g.gid)
+		}
+	}
+	return cred, home, nil
+}
+
+// parseID parses a user or group ID.
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+// parsePasswd parses the contents of /etc/passwd. Lines that aren't valid are
+// skipped, as they are by libc.
+func parsePasswd(blob []byte) []passwdEntry {
+	var entries []passwdEntry
+	scanner := bufio.NewScanner(bytes.NewReader(blob))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) != 7 {
+			continue
+		}
+		uid, err := parseID(fields[2])
+		if err != nil {
+			continue
+		}
+		gid, err := parseID(fields[3])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, passwdEntry{name: fields[0], uid: uid, gid: gid, home: fields[5]})
+	}
+	return entries
+}
+
+// parseGroup parses the contents of /etc/group, skipping lines that aren't
+// valid.
+func parseGroup(blob []byte) []groupEntry {
+	var entries []groupEntry
+	scanner := bufio.NewScanner(bytes.NewReader(blob))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) != 4 {
+			continue
+		}
+		gid, err := parseID(fields[2])
+		if err != nil {
+			continue
+		}
+		var members []string
+		if fields[3] != "" {
+			members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, groupEntry{name: fields[0], gid: gid, members: members})
+	}
+	return entries
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
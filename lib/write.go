@@ -16,7 +16,7 @@ package lib
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bytes"
 	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
@@ -25,16 +25,21 @@ import (
 	"path"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
 	"github.com/appc/spec/schema/types"
+	"golang.org/x/crypto/openpgp"
 
 	"github.com/containers/build/util"
 )
 
 // Write will produce the resulting image from the current build context, saving
-// it to the given path, optionally signing it.
-func (a *ACBuild) Write(output string, overwrite bool) (id string, err error) {
+// it to the given path, optionally signing it. If signer is non-nil a detached
+// armored signature is written alongside the image, at the path returned by
+// SignaturePath.
+func (a *ACBuild) Write(output string, overwrite bool, signer *openpgp.Entity) (id string, err error) {
 	if err = a.lock(); err != nil {
 		return "", err
 	}
@@ -44,19 +49,9 @@ func (a *ACBuild) Write(output string, overwrite bool) (id string, err error) {
 		}
 	}()
 
-	if a.Mode == BuildModeAppC {
-		man, err := util.GetManifest(a.CurrentImagePath)
-		if err != nil {
-			return "", err
-		}
-
-		if man.App != nil && len(man.App.Exec) == 0 {
-			fmt.Fprintf(os.Stderr, "warning: exec command was never set.\n")
-		}
-
-		if man.Name == types.ACIdentifier(placeholdername) {
-			return "", fmt.Errorf("can't write ACI, name was never set")
-		}
+	err = a.checkWritable()
+	if err != nil {
+		return "", err
 	}
 
 	fileFlags := os.O_CREATE | os.O_WRONLY
@@ -74,6 +69,18 @@ func (a *ACBuild) Write(output string, overwrite bool) (id string, err error) {
 		fileFlags |= os.O_TRUNC
 	}
 
+	if signer != nil && !overwrite {
+		_, err = os.Stat(a.SignaturePath(output))
+		switch {
+		case os.IsNotExist(err):
+			break
+		case err != nil:
+			return "", err
+		default:
+			return "", fmt.Errorf("signature already exists: %s", a.SignaturePath(output))
+		}
+	}
+
 	// open/create the image file
 	ofile, err := os.OpenFile(output, fileFlags, 0644)
 	if err != nil {
@@ -86,19 +93,84 @@ func (a *ACBuild) Write(output string, overwrite bool) (id string, err error) {
 		// ACI that had been written.
 		if err != nil {
 			os.Remove(output)
-			os.Remove(output + ".asc")
+			os.Remove(a.SignaturePath(output))
+		}
+	}()
+
+	hash, err := a.writeImage(ofile)
+	if err != nil {
+		return "", err
+	}
+
+	if signer != nil {
+		err = a.sign(output, signer)
+		if err != nil {
+			return "", err
+		}
+	}
+	return hash, nil
+}
+
+// WriteStream will produce the resulting image from the current build
+// context, writing it to w, such as a pipe to another program. Images written
+// this way can't be signed, as ACI signatures cover the written file.
+func (a *ACBuild) WriteStream(w io.Writer) (id string, err error) {
+	if err = a.lock(); err != nil {
+		return "", err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
 		}
 	}()
 
+	err = a.checkWritable()
+	if err != nil {
+		return "", err
+	}
+	return a.writeImage(w)
+}
+
+// checkWritable returns an error if the image in the current build can't be
+// written yet.
+func (a *ACBuild) checkWritable() error {
+	if a.Mode != BuildModeAppC {
+		return nil
+	}
+	if a.ImageCompression == util.CompressionZstd {
+		return fmt.Errorf("ACIs can't be compressed with zstd")
+	}
+
+	man, err := util.GetManifest(a.CurrentImagePath)
+	if err != nil {
+		return err
+	}
+
+	if man.App != nil && len(man.App.Exec) == 0 {
+		fmt.Fprintf(os.Stderr, "warning: exec command was never set.\n")
+	}
+
+	if man.Name == types.ACIdentifier(placeholdername) {
+		return fmt.Errorf("can't write ACI, name was never set")
+	}
+	return nil
+}
+
+// writeImage writes the image in the current build context to w as a tarball
+// compressed with a.ImageCompression, returning its ID.
+func (a *ACBuild) writeImage(w io.Writer) (string, error) {
 	// setup compression
-	gzwriter := gzip.NewWriter(ofile)
-	defer gzwriter.Close()
+	cwriter, err := a.ImageCompression.NewWriter(w, a.ImageCompressionLevel)
+	if err != nil {
+		return "", err
+	}
+	defer cwriter.Close()
 
 	// setup hasher
 	hasher := sha512.New()
 
 	// setup tar writer
-	twriter := tar.NewWriter(&duplexer{[]io.Writer{gzwriter, hasher}})
+	twriter := tar.NewWriter(&duplexer{[]io.Writer{cwriter, hasher}})
 	defer twriter.Close()
 
 	// create the aci writer
@@ -108,8 +180,33 @@ func (a *ACBuild) Write(output string, overwrite bool) (id string, err error) {
 		if err != nil {
 			return "", err
 		}
-		aw := aci.NewImageWriter(*man, twriter)
-		err = filepath.Walk(a.CurrentImagePath, aci.BuildWalker(a.CurrentImagePath, aw, nil))
+		var aw aci.ArchiveWriter
+		var walkCallback aci.TarHeaderWalkFunc
+		editHeader := a.tarHeaderEditor()
+		if a.Reproducible {
+			aw = &reproducibleImageWriter{twriter, man, a.now()}
+			walkCallback = func(hdr *tar.Header) bool {
+				editHeader(hdr)
+				return true
+			}
+		} else {
+			aw = aci.NewImageWriter(*man, twriter)
+		}
+		if os.Geteuid() != 0 {
+			// The rootfs may hold files owned by subordinate IDs, which
+			// WalkTree reads from within a user namespace
+			err = util.WalkTree(a.CurrentImagePath, func(hdr *tar.Header, r io.Reader) error {
+				if hdr.Name == aci.ManifestFile {
+					return nil
+				}
+				if editHeader != nil {
+					editHeader(hdr)
+				}
+				return aw.AddFile(hdr, r)
+			})
+		} else {
+			err = filepath.Walk(a.CurrentImagePath, aci.BuildWalker(a.CurrentImagePath, aw, walkCallback))
+		}
 		defer aw.Close()
 		if err != nil {
 			pathErr, ok := err.(*os.PathError)
@@ -128,16 +225,65 @@ func (a *ACBuild) Write(output string, overwrite bool) (id string, err error) {
 		}
 		aw.Close()
 	case BuildModeOCI:
-		err = filepath.Walk(a.CurrentImagePath, util.PathWalker(twriter, a.CurrentImagePath))
+		err = filepath.Walk(a.CurrentImagePath, util.PathWalker(twriter, a.CurrentImagePath, a.tarHeaderEditor()))
 		if err != nil {
 			return "", err
 		}
 	}
 	twriter.Flush()
 	hash := "sha512-" + hex.EncodeToString(hasher.Sum(nil))
+
+	// The image has to be completely written before it can be signed, or
+	// before whatever is reading it sees its end
+	err = twriter.Close()
+	if err != nil {
+		return "", err
+	}
+	err = cwriter.Close()
+	if err != nil {
+		return "", err
+	}
 	return hash, nil
 }
 
+// reproducibleImageWriter is an aci.ArchiveWriter like the one returned by
+// aci.NewImageWriter, except that the manifest it adds is dated modTime instead
+// of the current time.
+type reproducibleImageWriter struct {
+	*tar.Writer
+	man     *schema.ImageManifest
+	modTime time.Time
+}
+
+func (aw *reproducibleImageWriter) AddFile(hdr *tar.Header, r io.Reader) error {
+	err := aw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		_, err = io.Copy(aw, r)
+	}
+	return err
+}
+
+func (aw *reproducibleImageWriter) Close() error {
+	manblob, err := aw.man.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	err = aw.AddFile(&tar.Header{
+		Name:     aci.ManifestFile,
+		Mode:     0644,
+		Size:     int64(len(manblob)),
+		ModTime:  aw.modTime,
+		Typeflag: tar.TypeReg,
+	}, bytes.NewReader(manblob))
+	if err != nil {
+		return err
+	}
+	return aw.Writer.Close()
+}
+
 type duplexer struct {
 	outputs []io.Writer
 }
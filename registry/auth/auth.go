@@ -0,0 +1,282 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The auth package reads the credentials acbuild uses when fetching images.
+// Credentials are read from rkt style auth config files, so hosts configured
+// for rkt work for acbuild too, and from Docker's config.json, which is where
+// `docker login` stores credentials.
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DefaultConfigPaths are the directories rkt reads auth config files from, in
+// increasing order of precedence.
+var DefaultConfigPaths = []string{
+	"/usr/lib/rkt/auth.d",
+	"/etc/rkt/auth.d",
+}
+
+// DefaultDockerConfigPath returns the path to Docker's config.json, taking
+// the DOCKER_CONFIG environment variable into account like docker does.
+func DefaultDockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return path.Join(dir, "config.json")
+	}
+	return path.Join(os.Getenv("HOME"), ".docker", "config.json")
+}
+
+// Credentials are used to authenticate with a host. Either Username and
+// Password are set, for basic auth, or Token is, for bearer auth.
+type Credentials struct {
+	Username string
+	Password string
+	Token    string
+}
+
+// Header returns the value of the Authorization header for c.
+func (c *Credentials) Header() string {
+	if c.Token != "" {
+		return "Bearer " + c.Token
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+}
+
+// Config holds the credentials for every host acbuild knows of. Credentials
+// for hosts that serve ACIs (found through AppC discovery) are kept apart from
+// credentials for docker registries, as rkt does.
+type Config struct {
+	hosts      map[string]*Credentials
+	registries map[string]*Credentials
+}
+
+type rktConfigHeader struct {
+	RktKind    string `json:"rktKind"`
+	RktVersion string `json:"rktVersion"`
+}
+
+type rktAuth struct {
+	Domains     []string `json:"domains"`
+	Type        string   `json:"type"`
+	Credentials struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+		Token    string `json:"token"`
+	} `json:"credentials"`
+}
+
+type rktDockerAuth struct {
+	Registries  []string `json:"registries"`
+	Credentials struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+	} `json:"credentials"`
+}
+
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		RegistryToken string `json:"registrytoken"`
+	} `json:"auths"`
+}
+
+// LoadConfig reads the rkt style auth config files in each of the directories
+// in configPaths, and Docker's config.json at dockerConfigPath. Directories and
+// files that don't exist are skipped. Credentials from rkt config files take
+// precedence over Docker's, and files in later directories take precedence
+// over those in earlier ones.
+func LoadConfig(configPaths []string, dockerConfigPath string) (*Config, error) {
+	c := &Config{
+		hosts:      make(map[string]*Credentials),
+		registries: make(map[string]*Credentials),
+	}
+	if dockerConfigPath != "" {
+		err := c.loadDockerConfig(dockerConfigPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// As in rkt, a file in a later directory replaces the file with the same
+	// name in earlier directories
+	files := make(map[string]string)
+	for _, dir := range configPaths {
+		infos, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.IsDir() || !strings.HasSuffix(info.Name(), ".json") {
+				continue
+			}
+			files[info.Name()] = path.Join(dir, info.Name())
+		}
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := c.loadRktConfig(files[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *Config) loadRktConfig(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var header rktConfigHeader
+	err = json.Unmarshal(data, &header)
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %v", file, err)
+	}
+	if header.RktVersion != "v1" {
+		return fmt.Errorf("%s: unsupported rktVersion %q", file, header.RktVersion)
+	}
+
+	switch header.RktKind {
+	case "auth":
+		var auth rktAuth
+		err = json.Unmarshal(data, &auth)
+		if err != nil {
+			return fmt.Errorf("error parsing %s: %v", file, err)
+		}
+		var creds *Credentials
+		switch auth.Type {
+		case "basic":
+			creds = &Credentials{Username: auth.Credentials.User, Password: auth.Credentials.Password}
+		case "oauth":
+			creds = &Credentials{Token: auth.Credentials.Token}
+		default:
+			return fmt.Errorf("%s: unsupported auth type %q", file, auth.Type)
+		}
+		for _, domain := range auth.Domains {
+			c.hosts[domain] = creds
+		}
+	case "dockerAuth":
+		var auth rktDockerAuth
+		err = json.Unmarshal(data, &auth)
+		if err != nil {
+			return fmt.Errorf("error parsing %s: %v", file, err)
+		}
+		for _, registry := range auth.Registries {
+			c.registries[normalizeRegistry(registry)] = &Credentials{
+				Username: auth.Credentials.User,
+				Password: auth.Credentials.Password,
+			}
+		}
+	default:
+		// rkt keeps other kinds of config in the same directories
+	}
+	return nil
+}
+
+func (c *Config) loadDockerConfig(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var config dockerConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %v", file, err)
+	}
+
+	for registry, entry := range config.Auths {
+		creds := &Credentials{
+			Username: entry.Username,
+			Password: entry.Password,
+			Token:    entry.RegistryToken,
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return fmt.Errorf("%s: invalid auth for %s: %v", file, registry, err)
+			}
+			tokens := strings.SplitN(string(decoded), ":", 2)
+			if len(tokens) != 2 {
+				return fmt.Errorf("%s: invalid auth for %s", file, registry)
+			}
+			creds.Username, creds.Password = tokens[0], tokens[1]
+		}
+		if creds.Username == "" && creds.Token == "" {
+			// Entries can be left empty when docker uses a credential
+			// helper, which isn't supported
+			continue
+		}
+		c.registries[normalizeRegistry(registry)] = creds
+	}
+	return nil
+}
+
+// ForHost returns the credentials for an ACI served from host, or nil if
+// there are none.
+func (c *Config) ForHost(host string) *Credentials {
+	return c.hosts[host]
+}
+
+// HostHeaders returns the Authorization header to use for each host with
+// credentials for ACIs, in the form AppC discovery takes them.
+func (c *Config) HostHeaders() map[string]http.Header {
+	headers := make(map[string]http.Header)
+	for host, creds := range c.hosts {
+		headers[host] = http.Header{"Authorization": {creds.Header()}}
+	}
+	return headers
+}
+
+// ForRegistry returns the credentials for the docker registry at registry,
+// or nil if there are none.
+func (c *Config) ForRegistry(registry string) *Credentials {
+	return c.registries[normalizeRegistry(registry)]
+}
+
+// normalizeRegistry turns the different ways a registry can be named, such as
+// "https://index.docker.io/v1/" in Docker's config.json, into its host. The
+// Docker Hub's many names are all turned into "docker.io".
+func normalizeRegistry(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	if i := strings.IndexRune(registry, '/'); i != -1 {
+		registry = registry[:i]
+	}
+	switch registry {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return registry
+}
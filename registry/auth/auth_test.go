@@ -0,0 +1,143 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeFile(t *testing.T, p, contents string) {
+	err := os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = ioutil.WriteFile(p, []byte(contents), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-auth-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	vendorDir := path.Join(dir, "usr/lib/rkt/auth.d")
+	systemDir := path.Join(dir, "etc/rkt/auth.d")
+	writeFile(t, path.Join(vendorDir, "basic.json"), `{
+		"rktKind": "auth",
+		"rktVersion": "v1",
+		"domains": ["example.com", "images.example.com"],
+		"type": "basic",
+		"credentials": {"user": "vendor", "password": "overridden"}
+	}`)
+	writeFile(t, path.Join(systemDir, "basic.json"), `{
+		"rktKind": "auth",
+		"rktVersion": "v1",
+		"domains": ["example.com"],
+		"type": "basic",
+		"credentials": {"user": "alice", "password": "hunter2"}
+	}`)
+	writeFile(t, path.Join(systemDir, "oauth.json"), `{
+		"rktKind": "auth",
+		"rktVersion": "v1",
+		"domains": ["tokens.example.com"],
+		"type": "oauth",
+		"credentials": {"token": "sekrit"}
+	}`)
+	writeFile(t, path.Join(systemDir, "docker.json"), `{
+		"rktKind": "dockerAuth",
+		"rktVersion": "v1",
+		"registries": ["quay.io"],
+		"credentials": {"user": "bob", "password": "swordfish"}
+	}`)
+	writeFile(t, path.Join(systemDir, "paths.json"), `{
+		"rktKind": "paths",
+		"rktVersion": "v1",
+		"data": "/var/lib/rkt"
+	}`)
+	dockerConfig := path.Join(dir, "docker/config.json")
+	writeFile(t, dockerConfig, `{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "Y2Fyb2w6cGFzczp3b3Jk"},
+			"quay.io": {"auth": "ZG9ja2VyOmxvc2Vz"},
+			"registry.example.com": {"registrytoken": "abc"},
+			"helper.example.com": {}
+		}
+	}`)
+
+	config, err := LoadConfig([]string{vendorDir, systemDir, path.Join(dir, "missing")}, dockerConfig)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		creds    *Credentials
+		expected *Credentials
+	}{
+		{config.ForHost("example.com"), &Credentials{Username: "alice", Password: "hunter2"}},
+		{config.ForHost("images.example.com"), nil},
+		{config.ForHost("tokens.example.com"), &Credentials{Token: "sekrit"}},
+		{config.ForHost("quay.io"), nil},
+		{config.ForRegistry("quay.io"), &Credentials{Username: "bob", Password: "swordfish"}},
+		{config.ForRegistry("registry-1.docker.io"), &Credentials{Username: "carol", Password: "pass:word"}},
+		{config.ForRegistry("registry.example.com"), &Credentials{Token: "abc"}},
+		{config.ForRegistry("helper.example.com"), nil},
+		{config.ForRegistry("example.com"), nil},
+	}
+	for i, test := range tests {
+		switch {
+		case test.expected == nil && test.creds != nil:
+			t.Errorf("%d: expected no credentials, got %+v", i, *test.creds)
+		case test.expected != nil && test.creds == nil:
+			t.Errorf("%d: expected %+v, got no credentials", i, *test.expected)
+		case test.expected != nil && *test.creds != *test.expected:
+			t.Errorf("%d: expected %+v, got %+v", i, *test.expected, *test.creds)
+		}
+	}
+
+	headers := config.HostHeaders()
+	if h := headers["example.com"].Get("Authorization"); h != "Basic YWxpY2U6aHVudGVyMg==" {
+		t.Errorf("wrong basic auth header: %q", h)
+	}
+	if h := headers["tokens.example.com"].Get("Authorization"); h != "Bearer sekrit" {
+		t.Errorf("wrong bearer auth header: %q", h)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-auth-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, contents := range []string{
+		`{"rktKind": "auth", "rktVersion": "v2"}`,
+		`{"rktKind": "auth", "rktVersion": "v1", "type": "digest"}`,
+		`{"rktKind": "auth"`,
+	} {
+		writeFile(t, path.Join(dir, "bad.json"), contents)
+		_, err := LoadConfig([]string{dir}, "")
+		if err == nil {
+			t.Errorf("expected an error loading %s", contents)
+		}
+	}
+}
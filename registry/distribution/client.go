@@ -0,0 +1,319 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The distribution package implements enough of the docker registry HTTP API
+// V2 (also known as the OCI distribution spec) to move images between a
+// registry and an OCI image layout on disk.
+package distribution
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned when the registry has no manifest or blob with
+	// the requested name.
+	ErrNotFound = fmt.Errorf("not found in registry")
+)
+
+// Client talks to registries implementing the distribution API. A Client
+// caches the scheme used to reach each registry and the auth each registry has
+// asked for, so a single Client should be used for every request of an
+// operation.
+type Client struct {
+	Insecure bool
+	Debug    bool
+
+	// Username and Password, if set, are used to answer basic auth
+	// challenges and to authenticate requests for bearer tokens.
+	Username string
+	Password string
+	// Token, if set, is used to answer bearer auth challenges instead of
+	// fetching a token from the registry's token server.
+	Token string
+
+	// ChunkSize is the number of bytes sent per request when uploading a
+	// blob. If it is 0, 10MiB is used.
+	ChunkSize int64
+
+	httpClient     *http.Client
+	schemes        map[string]string
+	tokens         map[string]string
+	basicAuthHosts map[string]bool
+}
+
+// NewClient returns a new Client. If insecure is true the client will skip TLS
+// verification and fall back to plain HTTP for registries that don't speak
+// HTTPS.
+func NewClient(insecure, debug bool) *Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+	}
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &Client{
+		Insecure:       insecure,
+		Debug:          debug,
+		httpClient:     &http.Client{Transport: transport},
+		schemes:        make(map[string]string),
+		tokens:         make(map[string]string),
+		basicAuthHosts: make(map[string]bool),
+	}
+}
+
+// baseURL returns the URL that API paths for the given registry should be
+// appended to, detecting whether the registry speaks HTTPS the first time it
+// is called for a registry.
+func (c *Client) baseURL(registry string) (string, error) {
+	if scheme, ok := c.schemes[registry]; ok {
+		return scheme + "://" + registry, nil
+	}
+
+	scheme := "https"
+	res, err := c.httpClient.Get(scheme + "://" + registry + "/v2/")
+	if err != nil {
+		if !c.Insecure {
+			return "", err
+		}
+		if c.Debug {
+			fmt.Fprintf(os.Stderr, "falling back to http for %s: %v\n", registry, err)
+		}
+		scheme = "http"
+		res, err = c.httpClient.Get(scheme + "://" + registry + "/v2/")
+		if err != nil {
+			return "", err
+		}
+	}
+	res.Body.Close()
+
+	c.schemes[registry] = scheme
+	return scheme + "://" + registry, nil
+}
+
+// do performs the given request, answering any auth challenge the registry
+// responds with and retrying the request. Basic auth challenges are answered
+// with c.Username and c.Password, and bearer auth challenges by fetching a
+// token for scope.
+func (c *Client) do(req *http.Request, scope string) (*http.Response, error) {
+	tokenKey := req.URL.Host + " " + scope
+	if token, ok := c.tokens[tokenKey]; ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if c.basicAuthHosts[req.URL.Host] {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusUnauthorized || req.Header.Get("Authorization") != "" {
+		return res, nil
+	}
+
+	chal := parseChallenge(res.Header.Get("WWW-Authenticate"))
+	res.Body.Close()
+
+	switch chal.scheme {
+	case "bearer":
+		token := c.Token
+		if token == "" {
+			token, err = c.fetchToken(chal, scope)
+			if err != nil {
+				return nil, err
+			}
+		}
+		c.tokens[tokenKey] = token
+	case "basic":
+		if c.Username == "" {
+			return nil, fmt.Errorf("%s: 401 unauthorized, credentials are required", req.URL)
+		}
+		c.basicAuthHosts[req.URL.Host] = true
+	default:
+		return nil, fmt.Errorf("%s: 401 unauthorized", req.URL)
+	}
+
+	retry, err := rewindRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(retry, scope)
+}
+
+// fetchToken requests a bearer token from the realm named in chal, scoped to
+// scope.
+func (c *Client) fetchToken(chal challenge, scope string) (string, error) {
+	realm := chal.params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("missing realm in bearer auth challenge")
+	}
+
+	req, err := http.NewRequest("GET", realm, nil)
+	if err != nil {
+		return "", err
+	}
+	query := req.URL.Query()
+	if service := chal.params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+	req.URL.RawQuery = query.Encode()
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		break
+	case http.StatusUnauthorized:
+		return "", fmt.Errorf("unable to retrieve auth token: 401 unauthorized")
+	default:
+		return "", fmt.Errorf("unexpected http code %d when retrieving auth token from %s", res.StatusCode, realm)
+	}
+
+	blob, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	tokenResp := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.Unmarshal(blob, &tokenResp)
+	if err != nil {
+		return "", err
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	if tokenResp.AccessToken != "" {
+		return tokenResp.AccessToken, nil
+	}
+	return "", fmt.Errorf("no token in response from %s", realm)
+}
+
+// rewindRequest returns a copy of req that can be sent again, with a fresh
+// copy of its body.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	retry := new(http.Request)
+	*retry = *req
+	retry.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		retry.Header[k] = v
+	}
+	if req.Body != nil {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("can't retry request to %s, body isn't rewindable", req.URL)
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return retry, nil
+}
+
+// responseError produces an error describing an unexpected response from a
+// registry, including any errors the registry put in the response body.
+func responseError(res *http.Response) error {
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusUnauthorized:
+		return fmt.Errorf("%s %s: 401 unauthorized, check your credentials", res.Request.Method, res.Request.URL)
+	}
+	errResp := struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}{}
+	blob, _ := ioutil.ReadAll(res.Body)
+	if json.Unmarshal(blob, &errResp) != nil || len(errResp.Errors) == 0 {
+		return fmt.Errorf("%s %s: unexpected http code: %d", res.Request.Method, res.Request.URL, res.StatusCode)
+	}
+	var msgs []string
+	for _, e := range errResp.Errors {
+		msgs = append(msgs, e.Code+": "+e.Message)
+	}
+	return fmt.Errorf("%s %s: %s", res.Request.Method, res.Request.URL, strings.Join(msgs, ", "))
+}
+
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenge parses the value of a WWW-Authenticate header, such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseChallenge(header string) challenge {
+	chal := challenge{params: make(map[string]string)}
+	header = strings.TrimSpace(header)
+	i := strings.IndexAny(header, " \t")
+	if i == -1 {
+		chal.scheme = strings.ToLower(header)
+		return chal
+	}
+	chal.scheme = strings.ToLower(header[:i])
+
+	rest := header[i+1:]
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		eq := strings.IndexRune(rest, '=')
+		if eq == -1 {
+			return chal
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end], rest[end+1:]
+			}
+			value = strings.Replace(value, `\"`, `"`, -1)
+		} else {
+			end := strings.IndexRune(rest, ',')
+			if end == -1 {
+				end = len(rest)
+			}
+			value, rest = strings.TrimSpace(rest[:end]), rest[end:]
+		}
+		chal.params[key] = value
+	}
+}
@@ -0,0 +1,362 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/containers/build/registry"
+)
+
+// Media types used by docker's version of the image manifest, which OCI
+// images are derived from.
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	MediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+var (
+	manifestMediaTypes = []string{
+		ociImage.MediaTypeImageManifest,
+		ociImage.MediaTypeImageManifestList,
+		MediaTypeDockerManifest,
+		MediaTypeDockerManifestList,
+		MediaTypeDockerSchema1SignedManifest,
+		MediaTypeDockerSchema1Manifest,
+	}
+
+	// dockerToOCIMediaTypes maps the media types used in docker's image
+	// manifest to their OCI equivalents.
+	dockerToOCIMediaTypes = map[string]string{
+		MediaTypeDockerManifest:     ociImage.MediaTypeImageManifest,
+		MediaTypeDockerConfig:       ociImage.MediaTypeImageConfig,
+		MediaTypeDockerLayer:        ociImage.MediaTypeImageLayer,
+		MediaTypeDockerForeignLayer: ociImage.MediaTypeImageLayerNonDistributable,
+	}
+)
+
+// Pull downloads the image identified by ref into the OCI image layout at
+// layoutPath. The manifest, config, and each of the image's layers are stored
+// as separate blobs, and a ref named refName is written pointing at the
+// manifest. Docker image manifests are rewritten to use OCI media types, and
+// docker schema1 manifests are converted into OCI manifests with a config
+// synthesized from their history.
+func (c *Client) Pull(ref *Reference, layoutPath, refName string) error {
+	manBlob, mediaType, err := c.fetchManifest(ref, ref.Object())
+	if err != nil {
+		return err
+	}
+
+	if mediaType == ociImage.MediaTypeImageManifestList || mediaType == MediaTypeDockerManifestList {
+		manDigest, err := selectPlatformManifest(manBlob)
+		if err != nil {
+			return fmt.Errorf("%s: %v", ref, err)
+		}
+		manBlob, mediaType, err = c.fetchManifest(ref, manDigest)
+		if err != nil {
+			return err
+		}
+	}
+
+	var man ociImage.Manifest
+	err = json.Unmarshal(manBlob, &man)
+	if err != nil {
+		return fmt.Errorf("error parsing manifest for %s: %v", ref, err)
+	}
+	if man.MediaType == "" {
+		man.MediaType = mediaType
+	}
+	if man.SchemaVersion == 1 {
+		man.MediaType = MediaTypeDockerSchema1Manifest
+	}
+
+	switch man.MediaType {
+	case ociImage.MediaTypeImageManifest:
+		break
+	case MediaTypeDockerManifest:
+		man, manBlob, err = convertDockerManifest(man)
+		if err != nil {
+			return err
+		}
+	case MediaTypeDockerSchema1Manifest, MediaTypeDockerSchema1SignedManifest:
+		man, manBlob, err = c.convertSchema1Manifest(ref, manBlob, layoutPath)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s: unsupported manifest type %q", ref, man.MediaType)
+	}
+
+	err = c.fetchBlob(ref, man.Config, layoutPath)
+	if err != nil {
+		return err
+	}
+	err = checkDiffIDs(layoutPath, man)
+	if err != nil {
+		return fmt.Errorf("%s: %v", ref, err)
+	}
+	for _, layer := range man.Layers {
+		err = c.fetchBlob(ref, layer, layoutPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	manDigest := digest.FromBytes(manBlob)
+	err = writeBlob(layoutPath, manDigest, manBlob)
+	if err != nil {
+		return err
+	}
+
+	refBlob, err := json.Marshal(ociImage.Descriptor{
+		MediaType: ociImage.MediaTypeImageManifest,
+		Digest:    manDigest.String(),
+		Size:      int64(len(manBlob)),
+	})
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(path.Join(layoutPath, "refs"), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(layoutPath, "refs", refName), refBlob, 0644)
+}
+
+// fetchManifest downloads the manifest identified by object (a tag or a
+// digest) from the repository in ref, returning the manifest and its media
+// type.
+func (c *Client) fetchManifest(ref *Reference, object string) ([]byte, string, error) {
+	base, err := c.baseURL(ref.Registry)
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequest("GET", base+"/v2/"+ref.Repository+"/manifests/"+object, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+
+	res, err := c.do(req, pullScope(ref))
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		err := responseError(res)
+		if err == ErrNotFound {
+			return nil, "", fmt.Errorf("manifest for %s %s", ref, err)
+		}
+		return nil, "", err
+	}
+
+	blob, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if strings.ContainsRune(object, ':') {
+		if expected := digest.Digest(object); digest.FromBytes(blob) != expected {
+			return nil, "", fmt.Errorf("manifest for %s doesn't match digest %s", ref, expected)
+		}
+	}
+
+	mediaType := res.Header.Get("Content-Type")
+	if i := strings.IndexRune(mediaType, ';'); i != -1 {
+		mediaType = mediaType[:i]
+	}
+	return blob, strings.TrimSpace(mediaType), nil
+}
+
+// fetchBlob downloads the blob described by desc from the repository in ref
+// into layoutPath, unless a blob with the same digest is already there.
+func (c *Client) fetchBlob(ref *Reference, desc ociImage.Descriptor, layoutPath string) error {
+	dgst, err := digest.ParseDigest(desc.Digest)
+	if err != nil {
+		return err
+	}
+	p, err := blobPath(layoutPath, desc.Digest)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(p)
+	switch {
+	case err == nil:
+		if c.Debug {
+			fmt.Fprintf(os.Stderr, "blob %s already present\n", dgst)
+		}
+		return nil
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	base, err := c.baseURL(ref.Registry)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", base+"/v2/"+ref.Repository+"/blobs/"+dgst.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.do(req, pullScope(ref))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		err := responseError(res)
+		if err == ErrNotFound {
+			return fmt.Errorf("blob %s for %s %s", dgst, ref, err)
+		}
+		return err
+	}
+
+	size := desc.Size
+	if size == 0 {
+		size = res.ContentLength
+	}
+	label := dgst.Hex()
+	if len(label) > 12 {
+		label = label[:12]
+	}
+	return writeBlobFrom(layoutPath, dgst, registry.NewIoprogress(label, size, res.Body))
+}
+
+// writeBlob stores blob in the OCI image layout at layoutPath under dgst.
+func writeBlob(layoutPath string, dgst digest.Digest, blob []byte) error {
+	return writeBlobFrom(layoutPath, dgst, bytes.NewReader(blob))
+}
+
+// writeBlobFrom reads a blob from r and stores it in the OCI image layout at
+// layoutPath, returning an error if its contents don't match dgst.
+func writeBlobFrom(layoutPath string, dgst digest.Digest, r io.Reader) error {
+	verifier, err := digest.NewDigestVerifier(dgst)
+	if err != nil {
+		return err
+	}
+	blobDir := path.Join(layoutPath, "blobs", string(dgst.Algorithm()))
+	err = os.MkdirAll(blobDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(blobDir, "acbuild-blob")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	_, err = io.Copy(io.MultiWriter(tmpFile, verifier), r)
+	if err != nil {
+		return fmt.Errorf("error downloading blob %s: %v", dgst, err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %s doesn't match its digest", dgst)
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path.Join(blobDir, dgst.Hex()))
+}
+
+// checkDiffIDs makes sure the config stored in layoutPath for man lists a
+// DiffID for every layer in man.
+func checkDiffIDs(layoutPath string, man ociImage.Manifest) error {
+	p, err := blobPath(layoutPath, man.Config.Digest)
+	if err != nil {
+		return err
+	}
+	configBlob, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	var config ociImage.Image
+	err = json.Unmarshal(configBlob, &config)
+	if err != nil {
+		return fmt.Errorf("error parsing image config: %v", err)
+	}
+	if len(config.RootFS.DiffIDs) != len(man.Layers) {
+		return fmt.Errorf("image has %d layers but its config lists %d diff IDs", len(man.Layers), len(config.RootFS.DiffIDs))
+	}
+	return nil
+}
+
+// selectPlatformManifest picks the manifest matching the current os and
+// architecture out of a manifest list.
+func selectPlatformManifest(listBlob []byte) (string, error) {
+	var list ociImage.ManifestList
+	err := json.Unmarshal(listBlob, &list)
+	if err != nil {
+		return "", fmt.Errorf("error parsing manifest list: %v", err)
+	}
+	for _, m := range list.Manifests {
+		if m.Platform.OS == runtime.GOOS && m.Platform.Architecture == runtime.GOARCH {
+			return m.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("no manifest for %s/%s in manifest list", runtime.GOOS, runtime.GOARCH)
+}
+
+// convertDockerManifest rewrites a docker image manifest to use OCI media
+// types, returning the new manifest and its serialized form. The config and
+// layer blobs are left untouched.
+func convertDockerManifest(man ociImage.Manifest) (ociImage.Manifest, []byte, error) {
+	converted := ociImage.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+			MediaType:     ociImage.MediaTypeImageManifest,
+		},
+		Config:      man.Config,
+		Annotations: man.Annotations,
+	}
+	converted.Config.MediaType = ociImage.MediaTypeImageConfig
+	for _, layer := range man.Layers {
+		mediaType, ok := dockerToOCIMediaTypes[layer.MediaType]
+		if !ok {
+			return ociImage.Manifest{}, nil, fmt.Errorf("unsupported layer type %q", layer.MediaType)
+		}
+		layer.MediaType = mediaType
+		converted.Layers = append(converted.Layers, layer)
+	}
+	blob, err := json.Marshal(converted)
+	if err != nil {
+		return ociImage.Manifest{}, nil, err
+	}
+	return converted, blob, nil
+}
+
+func pullScope(ref *Reference) string {
+	return "repository:" + ref.Repository + ":pull"
+}
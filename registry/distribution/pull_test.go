@@ -0,0 +1,449 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParseReference(t *testing.T) {
+	cases := []struct {
+		input  string
+		output Reference
+	}{
+		{
+			"alpine",
+			Reference{Registry: "registry-1.docker.io", Repository: "library/alpine", Tag: "latest"},
+		},
+		{
+			"coreos/etcd:v3.1.0",
+			Reference{Registry: "registry-1.docker.io", Repository: "coreos/etcd", Tag: "v3.1.0"},
+		},
+		{
+			"docker.io/library/alpine:3.5",
+			Reference{Registry: "registry-1.docker.io", Repository: "library/alpine", Tag: "3.5"},
+		},
+		{
+			"docker.io/alpine",
+			Reference{Registry: "registry-1.docker.io", Repository: "library/alpine", Tag: "latest"},
+		},
+		{
+			"index.docker.io/coreos/etcd",
+			Reference{Registry: "registry-1.docker.io", Repository: "coreos/etcd", Tag: "latest"},
+		},
+		{
+			"registry-1.docker.io/alpine",
+			Reference{Registry: "registry-1.docker.io", Repository: "library/alpine", Tag: "latest"},
+		},
+		{
+			"quay.io/coreos/etcd:v3.1.0",
+			Reference{Registry: "quay.io", Repository: "coreos/etcd", Tag: "v3.1.0"},
+		},
+		{
+			"localhost:5000/app",
+			Reference{Registry: "localhost:5000", Repository: "app", Tag: "latest"},
+		},
+		{
+			"localhost/app@sha256:" + strings.Repeat("a", 64),
+			Reference{Registry: "localhost", Repository: "app", Digest: "sha256:" + strings.Repeat("a", 64)},
+		},
+	}
+	for _, c := range cases {
+		ref, err := ParseReference(c.input)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.input, err)
+			continue
+		}
+		if *ref != c.output {
+			t.Errorf("%s: expected %+v, got %+v", c.input, c.output, *ref)
+		}
+	}
+
+	if _, err := ParseReference("Not A Reference"); err == nil {
+		t.Errorf("expected an error parsing an invalid reference")
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	chal := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:a/b:pull,push"`)
+	if chal.scheme != "bearer" {
+		t.Errorf("unexpected scheme %q", chal.scheme)
+	}
+	expected := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:a/b:pull,push",
+	}
+	for k, v := range expected {
+		if chal.params[k] != v {
+			t.Errorf("param %s: expected %q, got %q", k, v, chal.params[k])
+		}
+	}
+}
+
+// pushTestImage stores a two layer image in reg under repo:tag, using the
+// given manifest media types, and returns its manifest.
+func pushTestImage(reg *testRegistry, repo, tag, manifestType, configType, layerType string) ociImage.Manifest {
+	config := ociImage.Image{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		RootFS: ociImage.RootFS{
+			Type:    "layers",
+			DiffIDs: []string{digest.FromBytes([]byte("one")).String(), digest.FromBytes([]byte("two")).String()},
+		},
+	}
+	configBlob, _ := json.Marshal(config)
+	man := ociImage.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2, MediaType: manifestType},
+		Config: ociImage.Descriptor{
+			MediaType: configType,
+			Digest:    reg.addBlob(configBlob),
+			Size:      int64(len(configBlob)),
+		},
+	}
+	for _, layer := range []string{"layer one", "layer two"} {
+		man.Layers = append(man.Layers, ociImage.Descriptor{
+			MediaType: layerType,
+			Digest:    reg.addBlob([]byte(layer)),
+			Size:      int64(len(layer)),
+		})
+	}
+	reg.addManifest(repo, tag, manifestType, man)
+	return man
+}
+
+func loadPulledManifest(t *testing.T, layoutPath string) ociImage.Manifest {
+	refBlob, err := ioutil.ReadFile(path.Join(layoutPath, "refs", "latest"))
+	if err != nil {
+		t.Fatalf("error reading ref: %v", err)
+	}
+	var ref ociImage.Descriptor
+	err = json.Unmarshal(refBlob, &ref)
+	if err != nil {
+		t.Fatalf("error parsing ref: %v", err)
+	}
+	manBlob, err := ioutil.ReadFile(path.Join(layoutPath, "blobs", strings.Replace(ref.Digest, ":", "/", 1)))
+	if err != nil {
+		t.Fatalf("error reading manifest: %v", err)
+	}
+	var man ociImage.Manifest
+	err = json.Unmarshal(manBlob, &man)
+	if err != nil {
+		t.Fatalf("error parsing manifest: %v", err)
+	}
+	return man
+}
+
+func checkBlobsPresent(t *testing.T, layoutPath string, man ociImage.Manifest) {
+	for _, desc := range append([]ociImage.Descriptor{man.Config}, man.Layers...) {
+		_, err := os.Stat(path.Join(layoutPath, "blobs", strings.Replace(desc.Digest, ":", "/", 1)))
+		if err != nil {
+			t.Errorf("blob %s missing from layout: %v", desc.Digest, err)
+		}
+	}
+}
+
+func testPull(t *testing.T, reg *testRegistry, image string) (string, ociImage.Manifest) {
+	layoutPath, err := ioutil.TempDir("", "acbuild-pull-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ref, err := ParseReference(reg.host() + "/" + image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = NewClient(true, false).Pull(ref, layoutPath, "latest")
+	if err != nil {
+		os.RemoveAll(layoutPath)
+		t.Fatalf("pull failed: %v", err)
+	}
+	return layoutPath, loadPulledManifest(t, layoutPath)
+}
+
+func TestPullOCIImage(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+	expected := pushTestImage(reg, "app", "v1", ociImage.MediaTypeImageManifest, ociImage.MediaTypeImageConfig, ociImage.MediaTypeImageLayer)
+
+	layoutPath, man := testPull(t, reg, "app:v1")
+	defer os.RemoveAll(layoutPath)
+
+	if len(man.Layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(man.Layers))
+	}
+	for i := range man.Layers {
+		if man.Layers[i].Digest != expected.Layers[i].Digest || man.Layers[i].Size != expected.Layers[i].Size {
+			t.Errorf("layer %d: expected %v, got %v", i, expected.Layers[i], man.Layers[i])
+		}
+	}
+	checkBlobsPresent(t, layoutPath, man)
+}
+
+func TestPullDockerImage(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+	expected := pushTestImage(reg, "library/app", "latest", MediaTypeDockerManifest, MediaTypeDockerConfig, MediaTypeDockerLayer)
+
+	layoutPath, man := testPull(t, reg, "library/app")
+	defer os.RemoveAll(layoutPath)
+
+	if man.MediaType != ociImage.MediaTypeImageManifest {
+		t.Errorf("manifest media type not converted: %s", man.MediaType)
+	}
+	if man.Config.MediaType != ociImage.MediaTypeImageConfig {
+		t.Errorf("config media type not converted: %s", man.Config.MediaType)
+	}
+	if man.Config.Digest != expected.Config.Digest {
+		t.Errorf("config digest changed: expected %s, got %s", expected.Config.Digest, man.Config.Digest)
+	}
+	if len(man.Layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(man.Layers))
+	}
+	for i, layer := range man.Layers {
+		if layer.MediaType != ociImage.MediaTypeImageLayer {
+			t.Errorf("layer %d media type not converted: %s", i, layer.MediaType)
+		}
+		if layer.Digest != expected.Layers[i].Digest {
+			t.Errorf("layer %d digest changed: expected %s, got %s", i, expected.Layers[i].Digest, layer.Digest)
+		}
+	}
+	checkBlobsPresent(t, layoutPath, man)
+}
+
+func TestPullManifestList(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+	native := pushTestImage(reg, "app", "native", ociImage.MediaTypeImageManifest, ociImage.MediaTypeImageConfig, ociImage.MediaTypeImageLayer)
+	// The manifest for the other platform isn't in the registry, so pulling
+	// it would fail.
+	otherDigest := "sha256:" + strings.Repeat("0", 64)
+	nativeDigest := digest.FromBytes(reg.manifests["app/native"].blob).String()
+
+	list := ociImage.ManifestList{
+		Versioned: specs.Versioned{SchemaVersion: 2, MediaType: ociImage.MediaTypeImageManifestList},
+		Manifests: []ociImage.ManifestDescriptor{
+			{
+				Descriptor: ociImage.Descriptor{Digest: otherDigest},
+				Platform:   ociImage.Platform{OS: "plan9", Architecture: "mips"},
+			},
+			{
+				Descriptor: ociImage.Descriptor{Digest: nativeDigest},
+				Platform:   ociImage.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH},
+			},
+		},
+	}
+	reg.addManifest("app", "multi", ociImage.MediaTypeImageManifestList, list)
+
+	layoutPath, man := testPull(t, reg, "app:multi")
+	defer os.RemoveAll(layoutPath)
+
+	if man.Config.Digest != native.Config.Digest {
+		t.Errorf("wrong manifest selected from list")
+	}
+}
+
+func TestPullWithBearerToken(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+	reg.token = "sekrit"
+	pushTestImage(reg, "app", "latest", ociImage.MediaTypeImageManifest, ociImage.MediaTypeImageConfig, ociImage.MediaTypeImageLayer)
+
+	layoutPath, _ := testPull(t, reg, "app")
+	defer os.RemoveAll(layoutPath)
+}
+
+func TestPullWithConfiguredToken(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+	reg.token = "long-lived"
+	// Asking the token server for a token would fail
+	reg.username = "user"
+	reg.password = "hunter2"
+	pushTestImage(reg, "app", "latest", ociImage.MediaTypeImageManifest, ociImage.MediaTypeImageConfig, ociImage.MediaTypeImageLayer)
+
+	layoutPath, err := ioutil.TempDir("", "acbuild-pull-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(layoutPath)
+
+	ref, _ := ParseReference(reg.host() + "/app")
+	client := NewClient(true, false)
+	client.Token = "long-lived"
+	err = client.Pull(ref, layoutPath, "latest")
+	if err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	if n := countRequests(reg, "GET /token"); n != 0 {
+		t.Errorf("expected the configured token to be used, but %d tokens were requested", n)
+	}
+}
+
+func TestPullRejectsCorruptBlob(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+	man := pushTestImage(reg, "app", "latest", ociImage.MediaTypeImageManifest, ociImage.MediaTypeImageConfig, ociImage.MediaTypeImageLayer)
+	reg.blobs[man.Layers[1].Digest] = []byte("not what was promised")
+
+	layoutPath, err := ioutil.TempDir("", "acbuild-pull-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(layoutPath)
+
+	ref, _ := ParseReference(reg.host() + "/app")
+	err = NewClient(true, false).Pull(ref, layoutPath, "latest")
+	if err == nil {
+		t.Fatalf("expected pull of corrupt blob to fail")
+	}
+	_, err = os.Stat(path.Join(layoutPath, "blobs", strings.Replace(man.Layers[1].Digest, ":", "/", 1)))
+	if !os.IsNotExist(err) {
+		t.Errorf("corrupt blob was stored in layout")
+	}
+}
+
+func TestPullMissingImage(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+
+	layoutPath, err := ioutil.TempDir("", "acbuild-pull-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(layoutPath)
+
+	ref, _ := ParseReference(reg.host() + "/nope")
+	err = NewClient(true, false).Pull(ref, layoutPath, "latest")
+	if err == nil || !strings.Contains(err.Error(), ErrNotFound.Error()) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func gzipTar(t *testing.T, name, contents string) ([]byte, string) {
+	tarBuf := &bytes.Buffer{}
+	tw := tar.NewWriter(tarBuf)
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tw.Write([]byte(contents))
+	tw.Close()
+
+	gzBuf := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzBuf)
+	gw.Write(tarBuf.Bytes())
+	gw.Close()
+	return gzBuf.Bytes(), digest.FromBytes(tarBuf.Bytes()).String()
+}
+
+func TestPullDockerSchema1Image(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+
+	base, baseDiffID := gzipTar(t, "base", "base layer")
+	top, topDiffID := gzipTar(t, "top", "top layer")
+	empty, _ := gzipTar(t, "empty", "")
+
+	// Layers and history are listed newest first
+	type fsLayer struct {
+		BlobSum string `json:"blobSum"`
+	}
+	type history struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	}
+	s1 := struct {
+		SchemaVersion int       `json:"schemaVersion"`
+		Architecture  string    `json:"architecture"`
+		FSLayers      []fsLayer `json:"fsLayers"`
+		History       []history `json:"history"`
+	}{
+		SchemaVersion: 1,
+		Architecture:  "amd64",
+		FSLayers:      []fsLayer{{reg.addBlob(empty)}, {reg.addBlob(top)}, {reg.addBlob(base)}},
+		History: []history{
+			{`{"id":"c","created":"2017-01-03T00:00:00Z","os":"linux","container_config":{"Cmd":["/bin/sh","-c","#(nop) CMD [\"sh\"]"]},"config":{"Env":["PATH=/bin"],"Cmd":["sh"]},"throwaway":true}`},
+			{`{"id":"b","created":"2017-01-02T00:00:00Z","container_config":{"Cmd":["/bin/sh","-c","echo top"]}}`},
+			{`{"id":"a","created":"2017-01-01T00:00:00Z","container_config":{"Cmd":["/bin/sh","-c","echo base"]}}`},
+		},
+	}
+	reg.addManifest("old", "latest", MediaTypeDockerSchema1SignedManifest, s1)
+
+	layoutPath, man := testPull(t, reg, "old")
+	defer os.RemoveAll(layoutPath)
+
+	if len(man.Layers) != 2 {
+		t.Fatalf("expected 2 layers after dropping the empty layer, got %d", len(man.Layers))
+	}
+	if man.Layers[0].Digest != digest.FromBytes(base).String() || man.Layers[1].Digest != digest.FromBytes(top).String() {
+		t.Errorf("layers not kept in order: %v", man.Layers)
+	}
+	if man.Layers[0].Size != int64(len(base)) {
+		t.Errorf("wrong size for base layer: %d", man.Layers[0].Size)
+	}
+	checkBlobsPresent(t, layoutPath, man)
+
+	configBlob, err := ioutil.ReadFile(path.Join(layoutPath, "blobs", strings.Replace(man.Config.Digest, ":", "/", 1)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var config ociImage.Image
+	err = json.Unmarshal(configBlob, &config)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(config.RootFS.DiffIDs) != 2 || config.RootFS.DiffIDs[0] != baseDiffID || config.RootFS.DiffIDs[1] != topDiffID {
+		t.Errorf("wrong diff IDs: %v", config.RootFS.DiffIDs)
+	}
+	if len(config.History) != 3 || !config.History[2].EmptyLayer || config.History[0].CreatedBy != "/bin/sh -c echo base" {
+		t.Errorf("history not converted: %+v", config.History)
+	}
+	if len(config.Config.Cmd) != 1 || config.Config.Cmd[0] != "sh" || config.OS != "linux" || config.Architecture != "amd64" {
+		t.Errorf("config not taken from the newest history entry: %+v", config)
+	}
+}
+
+func TestPullRejectsMismatchedDiffIDs(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+	man := pushTestImage(reg, "app", "latest", ociImage.MediaTypeImageManifest, ociImage.MediaTypeImageConfig, ociImage.MediaTypeImageLayer)
+	man.Layers = append(man.Layers, man.Layers[0])
+	reg.addManifest("app", "latest", ociImage.MediaTypeImageManifest, man)
+
+	layoutPath, err := ioutil.TempDir("", "acbuild-pull-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(layoutPath)
+
+	ref, _ := ParseReference(reg.host() + "/app")
+	err = NewClient(true, false).Pull(ref, layoutPath, "latest")
+	if err == nil || !strings.Contains(err.Error(), "diff IDs") {
+		t.Errorf("expected diff ID mismatch error, got %v", err)
+	}
+}
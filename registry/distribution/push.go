@@ -0,0 +1,260 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/docker/distribution/digest"
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const defaultChunkSize = 10 * 1024 * 1024
+
+// Push uploads the image whose manifest is described by manDesc from the OCI
+// image layout at layoutPath to ref. Blobs the registry already has are not
+// uploaded again, and the rest are uploaded in chunks of c.ChunkSize bytes.
+func (c *Client) Push(ref *Reference, layoutPath string, manDesc ociImage.Descriptor) error {
+	manPath, err := blobPath(layoutPath, manDesc.Digest)
+	if err != nil {
+		return err
+	}
+	manBlob, err := ioutil.ReadFile(manPath)
+	if err != nil {
+		return err
+	}
+	var man ociImage.Manifest
+	err = json.Unmarshal(manBlob, &man)
+	if err != nil {
+		return fmt.Errorf("error parsing manifest %s: %v", manDesc.Digest, err)
+	}
+
+	for _, desc := range append(man.Layers, man.Config) {
+		err := c.pushBlob(ref, layoutPath, desc)
+		if err != nil {
+			return err
+		}
+	}
+
+	base, err := c.baseURL(ref.Registry)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", base+"/v2/"+ref.Repository+"/manifests/"+ref.Object(), bytes.NewReader(manBlob))
+	if err != nil {
+		return err
+	}
+	mediaType := man.MediaType
+	if mediaType == "" {
+		mediaType = manDesc.MediaType
+	}
+	req.Header.Set("Content-Type", mediaType)
+
+	res, err := c.do(req, pushScope(ref))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+	return nil
+}
+
+// pushBlob uploads the blob described by desc from layoutPath to the
+// repository in ref, unless the registry already has it.
+func (c *Client) pushBlob(ref *Reference, layoutPath string, desc ociImage.Descriptor) error {
+	exists, err := c.blobExists(ref, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if c.Debug {
+			fmt.Fprintf(os.Stderr, "blob %s already exists in %s\n", desc.Digest, ref.Repository)
+		}
+		return nil
+	}
+
+	p, err := blobPath(layoutPath, desc.Digest)
+	if err != nil {
+		return err
+	}
+	blobFile, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer blobFile.Close()
+
+	location, err := c.startUpload(ref)
+	if err != nil {
+		return err
+	}
+
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	chunk := make([]byte, chunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(blobFile, chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if c.Debug {
+			fmt.Fprintf(os.Stderr, "uploading %s: bytes %d-%d\n", desc.Digest, offset, offset+int64(n)-1)
+		}
+		location, err = c.uploadChunk(ref, location, chunk[:n], offset)
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+
+	return c.finishUpload(ref, location, desc.Digest)
+}
+
+// blobExists checks if the repository in ref already contains the blob with
+// the given digest.
+func (c *Client) blobExists(ref *Reference, dgst string) (bool, error) {
+	base, err := c.baseURL(ref.Registry)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("HEAD", base+"/v2/"+ref.Repository+"/blobs/"+dgst, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := c.do(req, pushScope(ref))
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, responseError(res)
+	}
+}
+
+// startUpload begins a new blob upload to the repository in ref, returning
+// the location the upload should continue at.
+func (c *Client) startUpload(ref *Reference) (*url.URL, error) {
+	base, err := c.baseURL(ref.Registry)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", base+"/v2/"+ref.Repository+"/blobs/uploads/", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(req, pushScope(ref))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusAccepted {
+		return nil, responseError(res)
+	}
+	return uploadLocation(res)
+}
+
+// uploadChunk sends chunk, which starts at offset in the blob, to the upload
+// at location, returning the location the upload should continue at.
+func (c *Client) uploadChunk(ref *Reference, location *url.URL, chunk []byte, offset int64) (*url.URL, error) {
+	req, err := http.NewRequest("PATCH", location.String(), bytes.NewReader(chunk))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(len(chunk))-1))
+
+	res, err := c.do(req, pushScope(ref))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusAccepted {
+		return nil, responseError(res)
+	}
+	return uploadLocation(res)
+}
+
+// finishUpload completes the upload at location, telling the registry the
+// digest of the blob that was uploaded.
+func (c *Client) finishUpload(ref *Reference, location *url.URL, dgst string) error {
+	query := location.Query()
+	query.Set("digest", dgst)
+	location.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("PUT", location.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.do(req, pushScope(ref))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return responseError(res)
+	}
+	return nil
+}
+
+// uploadLocation returns the absolute URL from the Location header of res.
+func uploadLocation(res *http.Response) (*url.URL, error) {
+	location := res.Header.Get("Location")
+	if location == "" {
+		return nil, fmt.Errorf("registry didn't return an upload location")
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	return res.Request.URL.ResolveReference(u), nil
+}
+
+// blobPath returns the path to the blob with the given digest in the OCI image
+// layout at layoutPath.
+func blobPath(layoutPath, dgst string) (string, error) {
+	d, err := digest.ParseDigest(dgst)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(layoutPath, "blobs", string(d.Algorithm()), d.Hex()), nil
+}
+
+func pushScope(ref *Reference) string {
+	return "repository:" + ref.Repository + ":pull,push"
+}
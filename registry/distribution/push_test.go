@@ -0,0 +1,195 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// writeTestLayout creates an OCI image layout holding a two layer image,
+// returning the path to the layout and the descriptor of the image's manifest.
+func writeTestLayout(t *testing.T) (string, ociImage.Manifest, ociImage.Descriptor) {
+	layoutPath, err := ioutil.TempDir("", "acbuild-push-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	store := func(blob []byte) ociImage.Descriptor {
+		dgst := digest.FromBytes(blob)
+		err := writeBlob(layoutPath, dgst, blob)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return ociImage.Descriptor{Digest: dgst.String(), Size: int64(len(blob))}
+	}
+
+	man := ociImage.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2, MediaType: ociImage.MediaTypeImageManifest},
+		Config:    store([]byte(`{"architecture": "amd64", "os": "linux"}`)),
+	}
+	man.Config.MediaType = ociImage.MediaTypeImageConfig
+	for _, layer := range []string{"the first layer of the image", "the second layer"} {
+		desc := store([]byte(layer))
+		desc.MediaType = ociImage.MediaTypeImageLayer
+		man.Layers = append(man.Layers, desc)
+	}
+	manBlob, err := json.Marshal(man)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	manDesc := store(manBlob)
+	manDesc.MediaType = ociImage.MediaTypeImageManifest
+	return layoutPath, man, manDesc
+}
+
+func checkPushed(t *testing.T, reg *testRegistry, repo, tag string, man ociImage.Manifest) {
+	pushed, ok := reg.manifests[repo+"/"+tag]
+	if !ok {
+		t.Fatalf("manifest wasn't pushed to %s:%s", repo, tag)
+	}
+	if pushed.mediaType != ociImage.MediaTypeImageManifest {
+		t.Errorf("manifest pushed with wrong media type: %s", pushed.mediaType)
+	}
+	for _, desc := range append([]ociImage.Descriptor{man.Config}, man.Layers...) {
+		if _, ok := reg.blobs[desc.Digest]; !ok {
+			t.Errorf("blob %s wasn't pushed", desc.Digest)
+		}
+	}
+}
+
+func countRequests(reg *testRegistry, prefix string) int {
+	var n int
+	for _, r := range reg.requests {
+		if strings.HasPrefix(r, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPushChunked(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+	layoutPath, man, manDesc := writeTestLayout(t)
+	defer os.RemoveAll(layoutPath)
+
+	ref, _ := ParseReference(reg.host() + "/app:v1")
+	client := NewClient(true, false)
+	client.ChunkSize = 5
+	err := client.Push(ref, layoutPath, manDesc)
+	if err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	checkPushed(t, reg, "app", "v1", man)
+
+	if n := countRequests(reg, "PATCH "); n <= 3 {
+		t.Errorf("expected blobs to be uploaded in several chunks, got %d PATCH requests", n)
+	}
+}
+
+func TestPushSkipsExistingBlobs(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+	layoutPath, man, manDesc := writeTestLayout(t)
+	defer os.RemoveAll(layoutPath)
+
+	for _, layer := range man.Layers {
+		blob, err := ioutil.ReadFile(layoutPath + "/blobs/" + strings.Replace(layer.Digest, ":", "/", 1))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		reg.addBlob(blob)
+	}
+
+	ref, _ := ParseReference(reg.host() + "/app")
+	err := NewClient(true, false).Push(ref, layoutPath, manDesc)
+	if err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	checkPushed(t, reg, "app", "latest", man)
+
+	if n := countRequests(reg, "POST "); n != 1 {
+		t.Errorf("expected only the config to be uploaded, got %d uploads", n)
+	}
+}
+
+func TestPushBasicAuth(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+	reg.username = "user"
+	reg.password = "hunter2"
+	layoutPath, man, manDesc := writeTestLayout(t)
+	defer os.RemoveAll(layoutPath)
+
+	ref, _ := ParseReference(reg.host() + "/app")
+	err := NewClient(true, false).Push(ref, layoutPath, manDesc)
+	if err == nil {
+		t.Fatalf("expected push without credentials to fail")
+	}
+
+	client := NewClient(true, false)
+	client.Username = "user"
+	client.Password = "wrong"
+	err = client.Push(ref, layoutPath, manDesc)
+	if err == nil {
+		t.Fatalf("expected push with wrong credentials to fail")
+	}
+
+	client = NewClient(true, false)
+	client.Username = "user"
+	client.Password = "hunter2"
+	err = client.Push(ref, layoutPath, manDesc)
+	if err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	checkPushed(t, reg, "app", "latest", man)
+}
+
+func TestPushBearerTokenWithCredentials(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+	reg.token = "sekrit"
+	reg.username = "user"
+	reg.password = "hunter2"
+	layoutPath, man, manDesc := writeTestLayout(t)
+	defer os.RemoveAll(layoutPath)
+
+	ref, _ := ParseReference(reg.host() + "/app")
+	client := NewClient(true, false)
+	client.Username = "user"
+	client.Password = "hunter2"
+	err := client.Push(ref, layoutPath, manDesc)
+	if err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	checkPushed(t, reg, "app", "latest", man)
+
+	pushed, err := ioutil.ReadFile(layoutPath + "/blobs/" + strings.Replace(manDesc.Digest, ":", "/", 1))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(pushed, reg.manifests["app/latest"].blob) {
+		t.Errorf("pushed manifest doesn't match the one in the layout")
+	}
+}
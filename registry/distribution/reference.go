@@ -0,0 +1,107 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+const (
+	defaultRegistry   = "registry-1.docker.io"
+	defaultTag        = "latest"
+	defaultRepoPrefix = "library/"
+)
+
+// dockerHubHosts are the names the Docker Hub goes by in references, which
+// don't serve the distribution API themselves.
+var dockerHubHosts = map[string]bool{
+	"docker.io":       true,
+	"index.docker.io": true,
+}
+
+// Reference identifies an image in a registry implementing the distribution
+// API.
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses a docker style image reference, such as
+// "quay.io/coreos/etcd:v3.1.0" or "alpine". References without a registry are
+// resolved against the Docker Hub, and references with neither a tag nor a
+// digest are given the tag "latest".
+func ParseReference(s string) (*Reference, error) {
+	named, err := reference.ParseNamed(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %q: %v", s, err)
+	}
+
+	ref := &Reference{}
+	ref.Registry, ref.Repository = splitReposName(named.Name())
+	if tagged, ok := named.(reference.NamedTagged); ok {
+		ref.Tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Canonical); ok {
+		ref.Digest = digested.Digest().String()
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+	return ref, nil
+}
+
+// splitReposName breaks a repository name into the registry host and the name
+// of the repository on that registry.
+func splitReposName(name string) (string, string) {
+	var registry, repo string
+	i := strings.IndexRune(name, '/')
+	if i == -1 || (!strings.ContainsAny(name[:i], ".:") && name[:i] != "localhost") {
+		registry, repo = defaultRegistry, name
+	} else {
+		registry, repo = name[:i], name[i+1:]
+	}
+	if dockerHubHosts[registry] {
+		registry = defaultRegistry
+	}
+	if registry == defaultRegistry && !strings.ContainsRune(repo, '/') {
+		repo = defaultRepoPrefix + repo
+	}
+	return registry, repo
+}
+
+// Object returns the tag or digest that identifies the manifest for this
+// reference, preferring the digest if both are set.
+func (r Reference) Object() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
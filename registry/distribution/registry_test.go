@@ -0,0 +1,216 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/digest"
+)
+
+// testRegistry is an in-process stand-in for a registry implementing the
+// distribution API. It only serves the endpoints acbuild uses.
+type testRegistry struct {
+	*httptest.Server
+
+	// token, if set, is the bearer token clients must present.
+	token string
+	// username and password, if set, are the basic auth credentials clients
+	// must present. If token is also set they are required to get a token.
+	username string
+	password string
+
+	mu        sync.Mutex
+	manifests map[string]testManifest // keyed by "repo/tag" and "repo/digest"
+	blobs     map[string][]byte       // keyed by digest
+	uploads   map[string][]byte       // keyed by upload id
+	requests  []string
+}
+
+type testManifest struct {
+	mediaType string
+	blob      []byte
+}
+
+func newTestRegistry() *testRegistry {
+	r := &testRegistry{
+		manifests: make(map[string]testManifest),
+		blobs:     make(map[string][]byte),
+		uploads:   make(map[string][]byte),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+// host returns the host:port the registry is listening on, suitable for use
+// in an image reference.
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(r.URL, "http://")
+}
+
+func (r *testRegistry) addBlob(blob []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dgst := digest.FromBytes(blob).String()
+	r.blobs[dgst] = blob
+	return dgst
+}
+
+func (r *testRegistry) addManifest(repo, tag, mediaType string, man interface{}) string {
+	blob, err := json.Marshal(man)
+	if err != nil {
+		panic(err)
+	}
+	dgst := digest.FromBytes(blob).String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manifests[repo+"/"+tag] = testManifest{mediaType, blob}
+	r.manifests[repo+"/"+dgst] = testManifest{mediaType, blob}
+	return dgst
+}
+
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+
+	if req.URL.Path == "/token" {
+		if r.username != "" && !r.checkBasicAuth(req) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"token": %q}`, r.token)
+		return
+	}
+	if req.URL.Path == "/v2/" {
+		return
+	}
+	switch {
+	case r.token != "":
+		if req.Header.Get("Authorization") != "Bearer "+r.token {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="ignored"`, r.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	case r.username != "":
+		if !r.checkBasicAuth(req) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case strings.Contains(p, "/manifests/"):
+		i := strings.LastIndex(p, "/manifests/")
+		repo, object := p[:i], p[i+len("/manifests/"):]
+		if req.Method == "PUT" {
+			blob, _ := ioutil.ReadAll(req.Body)
+			dgst := digest.FromBytes(blob).String()
+			man := testManifest{req.Header.Get("Content-Type"), blob}
+			r.manifests[repo+"/"+object] = man
+			r.manifests[repo+"/"+dgst] = man
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		man, ok := r.manifests[repo+"/"+object]
+		if !ok {
+			r.notFound(w, "MANIFEST_UNKNOWN")
+			return
+		}
+		w.Header().Set("Content-Type", man.mediaType)
+		w.Write(man.blob)
+	case strings.Contains(p, "/blobs/uploads/"):
+		r.serveUpload(w, req, p[strings.LastIndex(p, "/blobs/uploads/")+len("/blobs/uploads/"):])
+	case strings.Contains(p, "/blobs/"):
+		i := strings.LastIndex(p, "/blobs/")
+		blob, ok := r.blobs[p[i+len("/blobs/"):]]
+		if !ok {
+			r.notFound(w, "BLOB_UNKNOWN")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		if req.Method == "HEAD" {
+			return
+		}
+		w.Write(blob)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *testRegistry) serveUpload(w http.ResponseWriter, req *http.Request, id string) {
+	switch req.Method {
+	case "POST":
+		id = strconv.Itoa(len(r.uploads) + 1)
+		r.uploads[id] = nil
+	case "PATCH":
+		data, ok := r.uploads[id]
+		if !ok {
+			r.notFound(w, "BLOB_UPLOAD_UNKNOWN")
+			return
+		}
+		var start, end int
+		_, err := fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end)
+		if err != nil || start != len(data) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		chunk, _ := ioutil.ReadAll(req.Body)
+		if len(chunk) != end-start+1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.uploads[id] = append(data, chunk...)
+	case "PUT":
+		data, ok := r.uploads[id]
+		if !ok {
+			r.notFound(w, "BLOB_UPLOAD_UNKNOWN")
+			return
+		}
+		dgst := req.URL.Query().Get("digest")
+		if digest.FromBytes(data).String() != dgst {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"errors": [{"code": "DIGEST_INVALID", "message": "digest mismatch"}]}`)
+			return
+		}
+		delete(r.uploads, id)
+		r.blobs[dgst] = data
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	// Hand out relative locations with a query string, like some registries
+	// do, to make sure clients resolve and extend them properly.
+	w.Header().Set("Location", "/v2/uploads/blobs/uploads/"+id+"?state=opaque")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (r *testRegistry) checkBasicAuth(req *http.Request) bool {
+	username, password, ok := req.BasicAuth()
+	return ok && username == r.username && password == r.password
+}
+
+func (r *testRegistry) notFound(w http.ResponseWriter, code string) {
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, `{"errors": [{"code": %q, "message": "not here"}]}`, code)
+}
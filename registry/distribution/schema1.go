@@ -0,0 +1,192 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Media types for docker's original image manifest format, which predates the
+// OCI image spec and lists layers without a separate config blob.
+const (
+	MediaTypeDockerSchema1Manifest       = "application/vnd.docker.distribution.manifest.v1+json"
+	MediaTypeDockerSchema1SignedManifest = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+type schema1Manifest struct {
+	Architecture string `json:"architecture"`
+	FSLayers     []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+type schema1Image struct {
+	Created         string               `json:"created"`
+	Author          string               `json:"author"`
+	Comment         string               `json:"comment"`
+	Architecture    string               `json:"architecture"`
+	OS              string               `json:"os"`
+	Config          ociImage.ImageConfig `json:"config"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd"`
+	} `json:"container_config"`
+	ThrowAway bool `json:"throwaway"`
+}
+
+// convertSchema1Manifest converts a docker schema1 manifest into an OCI
+// manifest. Each non-empty layer listed in the manifest is downloaded into
+// layoutPath and kept as its own layer, a config is synthesized from the
+// manifest's history and stored in layoutPath, and the new manifest and its
+// serialized form are returned.
+func (c *Client) convertSchema1Manifest(ref *Reference, manBlob []byte, layoutPath string) (ociImage.Manifest, []byte, error) {
+	var s1 schema1Manifest
+	err := json.Unmarshal(manBlob, &s1)
+	if err != nil {
+		return ociImage.Manifest{}, nil, fmt.Errorf("error parsing manifest for %s: %v", ref, err)
+	}
+	if len(s1.FSLayers) != len(s1.History) || len(s1.History) == 0 {
+		return ociImage.Manifest{}, nil, fmt.Errorf("malformed manifest for %s: %d layers and %d history entries", ref, len(s1.FSLayers), len(s1.History))
+	}
+
+	man := ociImage.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+			MediaType:     ociImage.MediaTypeImageManifest,
+		},
+	}
+	config := ociImage.Image{
+		RootFS: ociImage.RootFS{
+			Type: "layers",
+		},
+	}
+
+	// The layers and history in a schema1 manifest are ordered newest first
+	for i := len(s1.History) - 1; i >= 0; i-- {
+		var img schema1Image
+		err := json.Unmarshal([]byte(s1.History[i].V1Compatibility), &img)
+		if err != nil {
+			return ociImage.Manifest{}, nil, fmt.Errorf("error parsing history for %s: %v", ref, err)
+		}
+
+		config.History = append(config.History, ociImage.History{
+			Created:    img.Created,
+			CreatedBy:  strings.Join(img.ContainerConfig.Cmd, " "),
+			Author:     img.Author,
+			Comment:    img.Comment,
+			EmptyLayer: img.ThrowAway,
+		})
+		if i == 0 {
+			config.Created = img.Created
+			config.Author = img.Author
+			config.Architecture = img.Architecture
+			config.OS = img.OS
+			config.Config = img.Config
+		}
+		if img.ThrowAway {
+			continue
+		}
+
+		layer := ociImage.Descriptor{
+			MediaType: ociImage.MediaTypeImageLayer,
+			Digest:    s1.FSLayers[i].BlobSum,
+		}
+		err = c.fetchBlob(ref, layer, layoutPath)
+		if err != nil {
+			return ociImage.Manifest{}, nil, err
+		}
+		layer.Size, config.RootFS.DiffIDs, err = layerSizeAndDiffID(layoutPath, layer.Digest, config.RootFS.DiffIDs)
+		if err != nil {
+			return ociImage.Manifest{}, nil, err
+		}
+		man.Layers = append(man.Layers, layer)
+	}
+
+	if config.Architecture == "" {
+		config.Architecture = s1.Architecture
+	}
+	if config.Architecture == "" {
+		config.Architecture = runtime.GOARCH
+	}
+	if config.OS == "" {
+		config.OS = "linux"
+	}
+
+	configBlob, err := json.Marshal(config)
+	if err != nil {
+		return ociImage.Manifest{}, nil, err
+	}
+	configDigest := digest.FromBytes(configBlob)
+	err = writeBlob(layoutPath, configDigest, configBlob)
+	if err != nil {
+		return ociImage.Manifest{}, nil, err
+	}
+	man.Config = ociImage.Descriptor{
+		MediaType: ociImage.MediaTypeImageConfig,
+		Digest:    configDigest.String(),
+		Size:      int64(len(configBlob)),
+	}
+
+	blob, err := json.Marshal(man)
+	if err != nil {
+		return ociImage.Manifest{}, nil, err
+	}
+	return man, blob, nil
+}
+
+// layerSizeAndDiffID returns the size of the gzipped layer with the given
+// digest in layoutPath, and appends the digest of its uncompressed contents to
+// diffIDs.
+func layerSizeAndDiffID(layoutPath, layerDigest string, diffIDs []string) (int64, []string, error) {
+	p, err := blobPath(layoutPath, layerDigest)
+	if err != nil {
+		return 0, nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	finfo, err := f.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	gzReader, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error decompressing layer %s: %v", layerDigest, err)
+	}
+	defer gzReader.Close()
+
+	digester := digest.Canonical.New()
+	_, err = io.Copy(digester.Hash(), gzReader)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error decompressing layer %s: %v", layerDigest, err)
+	}
+	return finfo.Size(), append(diffIDs, digester.Digest().String()), nil
+}
@@ -42,6 +42,10 @@ func (r Registry) tmppath() string {
 	return path.Join(r.DepStoreTarPath, "tmp.aci")
 }
 
+func (r Registry) tmpascpath() string {
+	return path.Join(r.DepStoreTarPath, "tmp.aci.asc")
+}
+
 func (r Registry) tmpuncompressedpath() string {
 	return path.Join(r.DepStoreTarPath, "tmp.uncompressed.aci")
 }
@@ -115,7 +119,12 @@ func (r Registry) fetchACIWithSize(imagename types.ACIdentifier, labels types.La
 		return err
 	}
 
-	//TODO: download .asc, verify the .aci with it
+	if !r.SkipVerify {
+		err = r.verify(imagename, endpoint.ASC)
+		if err != nil {
+			return err
+		}
+	}
 
 	if size != 0 {
 		finfo, err := os.Stat(r.tmppath())
@@ -125,7 +134,7 @@ func (r Registry) fetchACIWithSize(imagename types.ACIdentifier, labels types.La
 		if finfo.Size() != int64(size) {
 			return fmt.Errorf(
 				"dependency %s has incorrect size: expected=%d, actual=%d",
-				size, finfo.Size())
+				imagename, size, finfo.Size())
 		}
 	}
 
@@ -195,6 +204,46 @@ func (r Registry) fetchACIWithSize(imagename types.ACIdentifier, labels types.La
 	return nil
 }
 
+// verify downloads the signature at ascURL and checks that it is a valid
+// signature of the image at r.tmppath() by a key trusted for imagename.
+func (r Registry) verify(imagename types.ACIdentifier, ascURL string) error {
+	err := r.download(ascURL, r.tmpascpath(), string(imagename)+" signature")
+	if err == ErrNotFound {
+		return fmt.Errorf("no signature found for %s at %s", imagename, ascURL)
+	}
+	if err != nil {
+		return err
+	}
+	defer os.Remove(r.tmpascpath())
+
+	acifile, err := os.Open(r.tmppath())
+	if err != nil {
+		return err
+	}
+	defer acifile.Close()
+
+	ascfile, err := os.Open(r.tmpascpath())
+	if err != nil {
+		return err
+	}
+	defer ascfile.Close()
+
+	ks := r.Keystore
+	if ks == nil {
+		ks = &Keystore{Paths: DefaultTrustedKeysPaths}
+	}
+	entity, err := ks.CheckSignature(imagename, acifile, ascfile)
+	if err != nil {
+		return fmt.Errorf("error verifying signature of %s: %v", imagename, err)
+	}
+	if r.Debug {
+		for _, identity := range entity.Identities {
+			fmt.Fprintf(os.Stderr, "%s signed by %q\n", imagename, identity.Name)
+		}
+	}
+	return nil
+}
+
 // Need to uncompress the file to be able to generate the Image ID
 func (r Registry) uncompress() error {
 	acifile, err := os.Open(r.tmppath())
@@ -336,7 +385,12 @@ func (r Registry) discoverEndpoint(imageName types.ACIdentifier, labels types.La
 		insecure = discovery.InsecureHTTP
 	}
 
-	acis, attempts, err := discovery.DiscoverACIEndpoints(*app, nil, insecure, 0)
+	var hostHeaders map[string]http.Header
+	if r.Auth != nil {
+		hostHeaders = r.Auth.HostHeaders()
+	}
+
+	acis, attempts, err := discovery.DiscoverACIEndpoints(*app, hostHeaders, insecure, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -355,11 +409,11 @@ func (r Registry) discoverEndpoint(imageName types.ACIdentifier, labels types.La
 }
 
 func (r Registry) download(url, path, label string) error {
-	//TODO: auth
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
+	r.setAuthHeader(req)
 	transport := http.DefaultTransport
 	transport.(*http.Transport).Proxy = http.ProxyFromEnvironment
 	if r.Insecure {
@@ -367,13 +421,12 @@ func (r Registry) download(url, path, label string) error {
 	}
 
 	client := &http.Client{Transport: transport}
-	//f.setHTTPHeaders(req, etag)
 
 	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 		if len(via) >= 10 {
 			return fmt.Errorf("too many redirects")
 		}
-		//f.setHTTPHeaders(req, etag)
+		r.setAuthHeader(req)
 		return nil
 	}
 
@@ -397,7 +450,7 @@ func (r Registry) download(url, path, label string) error {
 		return err
 	}
 
-	reader := newIoprogress(label, res.ContentLength, res.Body)
+	reader := NewIoprogress(label, res.ContentLength, res.Body)
 
 	_, err = io.Copy(out, reader)
 	if err != nil {
@@ -417,7 +470,21 @@ func (r Registry) download(url, path, label string) error {
 	return nil
 }
 
-func newIoprogress(label string, size int64, rdr io.Reader) io.Reader {
+// setAuthHeader adds the credentials for req's host to req, removing any
+// credentials meant for other hosts that were carried over by a redirect.
+func (r Registry) setAuthHeader(req *http.Request) {
+	req.Header.Del("Authorization")
+	if r.Auth == nil {
+		return
+	}
+	if creds := r.Auth.ForHost(req.URL.Host); creds != nil {
+		req.Header.Set("Authorization", creds.Header())
+	}
+}
+
+// NewIoprogress wraps rdr in a reader that draws a progress bar for it on
+// stderr, labeled with label.
+func NewIoprogress(label string, size int64, rdr io.Reader) io.Reader {
 	prefix := "Downloading " + label
 	fmtBytesSize := 18
 
@@ -0,0 +1,96 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/containers/build/registry/auth"
+)
+
+func TestDownloadWithAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-fetch-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The image is served from a different host than the one that requires
+	// auth, which must not be sent that host's credentials
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "an image")
+	}))
+	defer mirror.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		username, password, ok := req.BasicAuth()
+		if !ok || username != "alice" || password != "hunter2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, req, mirror.URL+"/image.aci", http.StatusFound)
+	}))
+	defer server.Close()
+
+	authDir := path.Join(dir, "auth.d")
+	err = os.Mkdir(authDir, 0755)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = ioutil.WriteFile(path.Join(authDir, "test.json"), []byte(fmt.Sprintf(`{
+		"rktKind": "auth",
+		"rktVersion": "v1",
+		"domains": [%q],
+		"type": "basic",
+		"credentials": {"user": "alice", "password": "hunter2"}
+	}`, strings.TrimPrefix(server.URL, "http://"))), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	authConfig, err := auth.LoadConfig([]string{authDir}, "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	r := Registry{DepStoreTarPath: dir}
+	err = r.download(server.URL+"/image.aci", path.Join(dir, "unauthed.aci"), "image")
+	if err == nil {
+		t.Errorf("expected download without credentials to fail")
+	}
+
+	r.Auth = authConfig
+	err = r.download(server.URL+"/image.aci", path.Join(dir, "image.aci"), "image")
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "image.aci"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(data) != "an image" {
+		t.Errorf("wrong contents downloaded: %q", data)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+	"golang.org/x/crypto/openpgp"
+)
+
+// DefaultTrustedKeysPaths are the trust stores used when no others are
+// configured. They are the same directories rkt uses, so keys trusted with
+// `rkt trust` are also trusted by acbuild.
+var DefaultTrustedKeysPaths = []string{
+	"/usr/lib/rkt/trustedkeys",
+	"/etc/rkt/trustedkeys",
+}
+
+// Keystore finds the keys trusted to sign images with a given name. Each path
+// in Paths is a trust store laid out the way rkt lays out its trust stores:
+// keys under root.d are trusted for every image, and keys under
+// prefix.d/<prefix> are trusted for images whose names are <prefix> or start
+// with <prefix>/. For example a key at prefix.d/example.com/app is trusted for
+// example.com/app and example.com/app/db, but not for example.com/application.
+type Keystore struct {
+	Paths []string
+}
+
+// CheckSignature verifies that signature is a valid detached signature of
+// signed, made by a key trusted for images with the given name. The entity
+// that made the signature is returned.
+func (ks *Keystore) CheckSignature(name types.ACIdentifier, signed, signature io.Reader) (*openpgp.Entity, error) {
+	keyring, err := ks.loadKeyring(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("no keys are trusted for %s", name)
+	}
+	entity, err := openpgp.CheckArmoredDetachedSignature(keyring, signed, signature)
+	if err == io.EOF {
+		// An empty or unarmored signature makes the armor decoder return EOF,
+		// which isn't a helpful thing to print
+		return nil, fmt.Errorf("no signature found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+
+// loadKeyring returns every key trusted for images with the given name.
+func (ks *Keystore) loadKeyring(name types.ACIdentifier) (openpgp.EntityList, error) {
+	var dirs []string
+	prefix := string(name)
+	for {
+		dirs = append(dirs, path.Join("prefix.d", prefix))
+		i := strings.LastIndex(prefix, "/")
+		if i == -1 {
+			break
+		}
+		prefix = prefix[:i]
+	}
+	dirs = append(dirs, "root.d")
+
+	var keyring openpgp.EntityList
+	for _, storePath := range ks.Paths {
+		for _, dir := range dirs {
+			keys, err := readKeysFromDir(path.Join(storePath, dir))
+			if err != nil {
+				return nil, err
+			}
+			keyring = append(keyring, keys...)
+		}
+	}
+	return keyring, nil
+}
+
+// readKeysFromDir parses each of the armored public keys in dir. Keys in
+// subdirectories are skipped, since they belong to longer prefixes.
+func readKeysFromDir(dir string) (openpgp.EntityList, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys openpgp.EntityList
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		f, err := os.Open(path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		entities, err := openpgp.ReadArmoredKeyRing(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading key %s: %v", path.Join(dir, file.Name()), err)
+		}
+		keys = append(keys, entities...)
+	}
+	return keys, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func newTestEntity(t *testing.T, name string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// The self-signatures of a new entity are only made when its private key
+	// is serialized, and serializing the public key fails without them
+	err = entity.SerializePrivate(ioutil.Discard, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return entity
+}
+
+// trustKey stores the public key of entity in the trust store at storePath,
+// under the directory dir (such as "root.d" or "prefix.d/example.com").
+func trustKey(t *testing.T, storePath, dir string, entity *openpgp.Entity) {
+	keyDir := path.Join(storePath, dir)
+	err := os.MkdirAll(keyDir, 0755)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	f, err := os.Create(path.Join(keyDir, fmt.Sprintf("%x", entity.PrimaryKey.Fingerprint)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	w, err := armor.Encode(f, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = entity.Serialize(w)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	w.Close()
+}
+
+func sign(t *testing.T, entity *openpgp.Entity, data []byte) []byte {
+	sig := &bytes.Buffer{}
+	err := openpgp.ArmoredDetachSign(sig, entity, bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return sig.Bytes()
+}
+
+func TestKeystorePrefixes(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "acbuild-keystore-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(storePath)
+
+	appSigner := newTestEntity(t, "app")
+	rootSigner := newTestEntity(t, "root")
+	untrusted := newTestEntity(t, "untrusted")
+	trustKey(t, storePath, "prefix.d/example.com/app", appSigner)
+	trustKey(t, storePath, "root.d", rootSigner)
+
+	ks := &Keystore{Paths: []string{path.Join(storePath, "missing"), storePath}}
+	image := []byte("pretend this is an ACI")
+
+	tests := []struct {
+		name   string
+		signer *openpgp.Entity
+		ok     bool
+	}{
+		{"example.com/app", appSigner, true},
+		{"example.com/app/db", appSigner, true},
+		{"example.com/application", appSigner, false},
+		{"example.com", appSigner, false},
+		{"example.com/app", rootSigner, true},
+		{"other.com/thing", rootSigner, true},
+		{"example.com/app", untrusted, false},
+	}
+	for _, test := range tests {
+		sig := sign(t, test.signer, image)
+		entity, err := ks.CheckSignature(types.ACIdentifier(test.name), bytes.NewReader(image), bytes.NewReader(sig))
+		if test.ok && err != nil {
+			t.Errorf("%s signed by %s: unexpected error: %v", test.name, test.signer.PrimaryKey.KeyIdString(), err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s signed by %s: expected signature to be rejected", test.name, test.signer.PrimaryKey.KeyIdString())
+		}
+		if test.ok && err == nil && entity.PrimaryKey.KeyId != test.signer.PrimaryKey.KeyId {
+			t.Errorf("%s: wrong signer returned", test.name)
+		}
+	}
+}
+
+func TestKeystoreRejectsModifiedImage(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "acbuild-keystore-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(storePath)
+
+	signer := newTestEntity(t, "app")
+	trustKey(t, storePath, "root.d", signer)
+	ks := &Keystore{Paths: []string{storePath}}
+
+	sig := sign(t, signer, []byte("the real image"))
+	_, err = ks.CheckSignature("example.com/app", strings.NewReader("a different image"), bytes.NewReader(sig))
+	if err == nil {
+		t.Errorf("expected signature of a modified image to be rejected")
+	}
+
+	_, err = ks.CheckSignature("example.com/app", strings.NewReader("the real image"), strings.NewReader(""))
+	if err == nil || err.Error() != "no signature found" {
+		t.Errorf("expected missing signature error, got %v", err)
+	}
+}
+
+func TestKeystoreNoTrustedKeys(t *testing.T) {
+	ks := &Keystore{Paths: []string{"/nonexistent"}}
+	_, err := ks.CheckSignature("example.com/app", strings.NewReader(""), strings.NewReader(""))
+	if err == nil || !strings.Contains(err.Error(), "no keys are trusted") {
+		t.Errorf("expected no trusted keys error, got %v", err)
+	}
+}
@@ -33,6 +33,7 @@ import (
 	"github.com/appc/spec/schema"
 	"github.com/appc/spec/schema/types"
 
+	"github.com/containers/build/registry/auth"
 	"github.com/containers/build/util"
 )
 
@@ -51,6 +52,14 @@ type Registry struct {
 	DepStoreExpandedPath string
 	Insecure             bool
 	Debug                bool
+
+	// Keystore holds the keys fetched images must be signed with. If it is
+	// nil the trust stores in DefaultTrustedKeysPaths are used.
+	Keystore *Keystore
+	// SkipVerify disables checking the signatures of fetched images.
+	SkipVerify bool
+	// Auth, if set, holds credentials for the hosts images are fetched from.
+	Auth *auth.Config
 }
 
 // Read the ACI contents stream given the key. Use ResolveKey to
@@ -0,0 +1,192 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func ociTopLayer(t *testing.T, workingDir string) string {
+	_, manblob, _, err := runACBuild(workingDir, "cat-manifest")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var man ociImage.Manifest
+	err = json.Unmarshal([]byte(manblob), &man)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(man.Layers) == 0 {
+		t.Fatalf("image has no layers")
+	}
+	return man.Layers[len(man.Layers)-1].Digest
+}
+
+func TestCacheCopy(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	cacheDir := path.Join(workingDir, "cache")
+	source := path.Join(workingDir, "nginx.conf")
+	err := ioutil.WriteFile(source, []byte("daemon off;\n"), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	build := func(args ...string) (string, string) {
+		err := runACBuildNoHist(workingDir, "begin", "--build-mode=oci")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer runACBuildNoHist(workingDir, "end")
+		_, _, stderr, err := runACBuild(workingDir, append([]string{"--no-history", "--cache-path", cacheDir, "copy"}, args...)...)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return ociTopLayer(t, workingDir), stderr
+	}
+
+	layer, stderr := build(source, "/etc/nginx.conf")
+	if strings.Contains(stderr, "cached") {
+		t.Fatalf("first copy used the cache: %s", stderr)
+	}
+	cachedLayer, stderr := build(source, "/etc/nginx.conf")
+	if !strings.Contains(stderr, "Using cached layer") {
+		t.Errorf("second copy didn't use the cache: %s", stderr)
+	}
+	if cachedLayer != layer {
+		t.Errorf("cached copy produced layer %s, expected %s", cachedLayer, layer)
+	}
+
+	// Changing the file, the destination, or disabling the cache is a miss
+	_, stderr = build(source, "/etc/nginx/nginx.conf")
+	if strings.Contains(stderr, "cached") {
+		t.Errorf("copy to another path used the cache: %s", stderr)
+	}
+	_, stderr = build("--no-cache", source, "/etc/nginx.conf")
+	if strings.Contains(stderr, "cached") {
+		t.Errorf("copy with --no-cache used the cache: %s", stderr)
+	}
+	err = ioutil.WriteFile(source, []byte("daemon on;\n"), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, stderr = build(source, "/etc/nginx.conf")
+	if strings.Contains(stderr, "cached") {
+		t.Errorf("copy of a changed file used the cache: %s", stderr)
+	}
+
+	// Entries that were just used survive pruning old entries
+	_, stdout, _, err := runACBuild(workingDir, "--cache-path", cacheDir, "cache-prune", "--older-than", "1h")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.HasPrefix(stdout, "Removed 0 cache entries") {
+		t.Errorf("unexpected output from pruning old entries: %s", stdout)
+	}
+	_, stdout, _, err = runACBuild(workingDir, "--cache-path", cacheDir, "cache-prune")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.HasPrefix(stdout, "Removed 3 cache entries") {
+		t.Errorf("unexpected output from pruning: %s", stdout)
+	}
+	blobs, err := ioutil.ReadDir(path.Join(cacheDir, "blobs", "sha256"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("%v", err)
+	}
+	if len(blobs) != 0 {
+		t.Errorf("%d layers left in the cache after pruning", len(blobs))
+	}
+}
+
+func TestCacheRunMounts(t *testing.T) {
+	if err := exec.Command("unshare", "--user", "true").Run(); err != nil {
+		t.Skip("skipping test; user namespaces aren't available")
+	}
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	cacheDir := path.Join(workingDir, "cache")
+	hostDir := path.Join(workingDir, "host")
+	err := os.Mkdir(hostDir, 0755)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	buildProgram(t, mountprogram, path.Join(workingDir, "worker"))
+	source := path.Join(hostDir, "secret")
+
+	run := func(args ...string) string {
+		err := runACBuildNoHist(workingDir, "begin", "--build-mode=oci")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer runACBuildNoHist(workingDir, "end")
+		err = runACBuildNoHist(workingDir, "--cache-path", cacheDir, "copy", path.Join(workingDir, "worker"), "/worker")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		args = append([]string{"--no-history", "--cache-path", cacheDir, "run", "--engine=rootless"}, args...)
+		_, _, stderr, err := runACBuild(workingDir, args...)
+		if err != nil {
+			t.Fatalf("%v\n%s", err, stderr)
+		}
+		return stderr
+	}
+
+	err = ioutil.WriteFile(source, []byte("hunter2"), 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Changing what's in a secret is a miss
+	secret := []string{"--secret=id=password,src=" + source, "/worker", "/run/secrets/password"}
+	if stderr := run(secret...); strings.Contains(stderr, "cached") {
+		t.Fatalf("first run with a secret used the cache: %s", stderr)
+	}
+	if stderr := run(secret...); !strings.Contains(stderr, "Using cached layer") {
+		t.Errorf("second run with a secret didn't use the cache: %s", stderr)
+	}
+	err = ioutil.WriteFile(source, []byte("hunter3"), 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if stderr := run(secret...); strings.Contains(stderr, "cached") {
+		t.Errorf("run with a changed secret used the cache: %s", stderr)
+	}
+
+	// A read-only bind is only keyed on its path, and a writable one is
+	// never cached
+	readOnly := []string{"--bind=" + hostDir + ":/host:ro", "/worker", "/host/secret"}
+	run(readOnly...)
+	if stderr := run(readOnly...); !strings.Contains(stderr, "Using cached layer") {
+		t.Errorf("second run with a read-only bind didn't use the cache: %s", stderr)
+	}
+	writable := []string{"--bind=" + hostDir + ":/host", "/worker", "/host/secret", "/host/copy"}
+	for i := 0; i < 2; i++ {
+		if stderr := run(writable...); strings.Contains(stderr, "cached") {
+			t.Errorf("run with a writable bind used the cache: %s", stderr)
+		}
+	}
+	if _, err := os.Stat(path.Join(hostDir, "copy")); err != nil {
+		t.Errorf("the run didn't write to the bind: %v", err)
+	}
+}
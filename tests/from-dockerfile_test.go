@@ -0,0 +1,180 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"testing"
+
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const fromDockerfile = `# syntax=docker/dockerfile:1
+FROM scratch AS app
+ENV APP=/app \
+    GREETING="hello world"
+LABEL version=1.0 description="an app"
+WORKDIR $APP
+COPY files ./
+COPY nginx.conf ${APP}/etc/
+EXPOSE 80 53/udp
+VOLUME ["/var/lib/app"]
+USER 1000:1000
+ENTRYPOINT ["/app/server"]
+CMD ["--port", "80"]
+`
+
+func TestFromDockerfile(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	err := os.MkdirAll(path.Join(workingDir, "files", "bin"), 0755)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, name := range []string{"files/bin/server", "nginx.conf"} {
+		err = ioutil.WriteFile(path.Join(workingDir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	err = ioutil.WriteFile(path.Join(workingDir, "Dockerfile"), []byte(fromDockerfile), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	err = runACBuildNoHist(workingDir, "--cache-path", path.Join(workingDir, "cache"), "from-dockerfile", "Dockerfile")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer runACBuildNoHist(workingDir, "end")
+
+	_, blob, _, err := runACBuild(workingDir, "cat-manifest", "--file", "config")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var config ociImage.Image
+	err = json.Unmarshal([]byte(blob), &config)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := ociImage.ImageConfig{
+		User:         "1000:1000",
+		ExposedPorts: map[string]struct{}{"80/tcp": {}, "53/udp": {}},
+		Env:          []string{"APP=/app", "GREETING=hello world"},
+		Entrypoint:   []string{"/app/server"},
+		Cmd:          []string{"--port", "80"},
+		Volumes:      map[string]struct{}{"/var/lib/app": {}},
+		WorkingDir:   "/app",
+	}
+	if !reflect.DeepEqual(config.Config, expected) {
+		t.Errorf("unexpected config\nexpected: %#v\ngot: %#v", expected, config.Config)
+	}
+	// WORKDIR makes the first layer, and each COPY one of its own
+	if len(config.RootFS.DiffIDs) != 3 {
+		t.Errorf("expected 3 layers, got %d", len(config.RootFS.DiffIDs))
+	}
+
+	_, blob, _, err = runACBuild(workingDir, "cat-manifest")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var man ociImage.Manifest
+	err = json.Unmarshal([]byte(blob), &man)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for name, value := range map[string]string{
+		"version":                              "1.0",
+		"description":                          "an app",
+		"coreos.com/acbuild/port/80-tcp":       "number:80 protocol:tcp",
+		"coreos.com/acbuild/mount/var-lib-app": "path:/var/lib/app",
+	} {
+		if man.Annotations[name] != value {
+			t.Errorf("annotation %s, expected:%q actual:%q", name, value, man.Annotations[name])
+		}
+	}
+}
+
+func TestFromDockerfileErrors(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	cases := map[string]string{
+		"FROM scratch\nARG VERSION=1\n":             "from-dockerfile: Dockerfile:2: ARG isn't supported\n",
+		"# comment\nRUN true\nFROM scratch\n":       "from-dockerfile: Dockerfile:2: RUN comes before FROM\n",
+		"FROM scratch\n\nCOPY missing /missing\n":   "from-dockerfile: Dockerfile:3: COPY: missing: no such file or directory in the context\n",
+		"FROM scratch\nCOPY --chown=1:1 a /a\n":     "from-dockerfile: Dockerfile:2: COPY --chown isn't supported\n",
+		"FROM scratch\nEXPOSE 80 \\\n  8000-8080\n": "from-dockerfile: Dockerfile:2: EXPOSE: port ranges such as 8000-8080 aren't supported\n",
+	}
+	for dockerfile, expected := range cases {
+		err := ioutil.WriteFile(path.Join(workingDir, "Dockerfile"), []byte(dockerfile), 0644)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		_, _, stderr, err := runACBuild(workingDir, "--no-history", "from-dockerfile", "Dockerfile")
+		if err == nil {
+			t.Errorf("%q: expected an error", dockerfile)
+		}
+		if stderr != expected {
+			t.Errorf("%q: unexpected message on stderr\nexpected: %sgot: %s", dockerfile, expected, stderr)
+		}
+		if _, err := os.Stat(path.Join(workingDir, ".acbuild")); !os.IsNotExist(err) {
+			t.Fatalf("%q: the build wasn't ended", dockerfile)
+		}
+	}
+}
+
+func TestFromDockerfileRegistryImage(t *testing.T) {
+	if err := exec.Command("unshare", "--user", "true").Run(); err != nil {
+		t.Skip("skipping test; user namespaces aren't available")
+	}
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	buildProgram(t, goprogram, path.Join(workingDir, "worker"))
+	worker, err := ioutil.ReadFile(path.Join(workingDir, "worker"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	reg, image := serveTestImage(t, "base", map[string]string{"worker": string(worker)})
+	defer reg.Close()
+
+	// The first RUN and COPY go into the empty layer begun on top of the
+	// pulled one
+	for _, dockerfile := range []string{
+		"FROM " + image + "\nRUN [\"/worker\"]\nCOPY worker /bin/\n",
+		"FROM " + image + "\nCOPY worker /bin/\nRUN [\"/worker\"]\n",
+	} {
+		err = ioutil.WriteFile(path.Join(workingDir, "Dockerfile"), []byte(dockerfile), 0644)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		_, _, stderr, err := runACBuild(workingDir, "--no-history", "from-dockerfile", "--insecure", "--no-cache", "--engine=rootless", "Dockerfile")
+		if err != nil {
+			t.Fatalf("%q: %v\n%s", dockerfile, err, stderr)
+		}
+		if n := ociLayerCount(t, workingDir); n != 3 {
+			t.Errorf("%q: expected 3 layers, got %d", dockerfile, n)
+		}
+		err = runACBuildNoHist(workingDir, "end")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+}
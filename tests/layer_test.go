@@ -0,0 +1,101 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func ociLayerCount(t *testing.T, workingDir string) int {
+	_, manblob, _, err := runACBuild(workingDir, "cat-manifest")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var man ociImage.Manifest
+	err = json.Unmarshal([]byte(manblob), &man)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return len(man.Layers)
+}
+
+func TestLayerOnEmptyLayer(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	source := path.Join(workingDir, "file")
+	err := ioutil.WriteFile(source, []byte("contents\n"), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	err = runACBuildNoHist(workingDir, "begin", "--build-mode=oci")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer runACBuildNoHist(workingDir, "end")
+
+	// An empty top layer is used instead of adding another
+	for i := 0; i < 2; i++ {
+		err = runACBuildNoHist(workingDir, "layer")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if n := ociLayerCount(t, workingDir); n != 1 {
+			t.Fatalf("expected 1 layer, got %d", n)
+		}
+	}
+
+	err = runACBuildNoHist(workingDir, "copy", source, "/file")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = runACBuildNoHist(workingDir, "layer")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if n := ociLayerCount(t, workingDir); n != 2 {
+		t.Fatalf("expected 2 layers, got %d", n)
+	}
+}
+
+func TestLayerAfterPull(t *testing.T) {
+	reg, image := serveTestImage(t, "base", map[string]string{"etc/base": "base\n"})
+	defer reg.Close()
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	err := runACBuildNoHist(workingDir, "begin", "--build-mode=oci", "--insecure", "docker://"+image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer runACBuildNoHist(workingDir, "end")
+
+	// The pulled layer, and an empty one for the changes made by the build
+	if n := ociLayerCount(t, workingDir); n != 2 {
+		t.Fatalf("expected 2 layers after begin, got %d", n)
+	}
+	err = runACBuildNoHist(workingDir, "layer")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if n := ociLayerCount(t, workingDir); n != 2 {
+		t.Fatalf("expected 2 layers, got %d", n)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// serveTestImage starts a registry serving repo:latest, an OCI image with a
+// single layer holding files, which are executable, and returns it along with
+// the image's name. The registry only speaks http, so builds pulling from it
+// must be insecure.
+func serveTestImage(t *testing.T, repo string, files map[string]string) (*httptest.Server, string) {
+	tarBuf := &bytes.Buffer{}
+	tw := tar.NewWriter(tarBuf)
+	for name, contents := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(contents)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		tw.Write([]byte(contents))
+	}
+	tw.Close()
+	layerBuf := &bytes.Buffer{}
+	gw := gzip.NewWriter(layerBuf)
+	gw.Write(tarBuf.Bytes())
+	gw.Close()
+	layer := layerBuf.Bytes()
+
+	config, err := json.Marshal(ociImage.Image{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		RootFS: ociImage.RootFS{
+			Type:    "layers",
+			DiffIDs: []string{digest.FromBytes(tarBuf.Bytes()).String()},
+		},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	man, err := json.Marshal(ociImage.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2, MediaType: ociImage.MediaTypeImageManifest},
+		Config: ociImage.Descriptor{
+			MediaType: ociImage.MediaTypeImageConfig,
+			Digest:    digest.FromBytes(config).String(),
+			Size:      int64(len(config)),
+		},
+		Layers: []ociImage.Descriptor{{
+			MediaType: ociImage.MediaTypeImageLayer,
+			Digest:    digest.FromBytes(layer).String(),
+			Size:      int64(len(layer)),
+		}},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	blobs := map[string][]byte{
+		"/v2/" + repo + "/manifests/latest":                            man,
+		"/v2/" + repo + "/manifests/" + digest.FromBytes(man).String(): man,
+		"/v2/" + repo + "/blobs/" + digest.FromBytes(config).String():  config,
+		"/v2/" + repo + "/blobs/" + digest.FromBytes(layer).String():   layer,
+	}
+	reg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v2/" {
+			return
+		}
+		blob, ok := blobs[req.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if strings.Contains(req.URL.Path, "/manifests/") {
+			w.Header().Set("Content-Type", ociImage.MediaTypeImageManifest)
+		}
+		w.Write(blob)
+	}))
+	return reg, strings.TrimPrefix(reg.URL, "http://") + "/" + repo
+}
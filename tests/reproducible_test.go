@@ -0,0 +1,71 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+)
+
+// buildReproducibly builds an image in a fresh directory, so that the files in
+// it and the times it's built at differ between calls, and returns the
+// written image. The build is begun with beginArgs, and takes steps before
+// copying a file into the image.
+func buildReproducibly(t *testing.T, beginArgs []string, steps ...[]string) []byte {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	err := ioutil.WriteFile(path.Join(workingDir, "nginx.conf"), []byte("daemon off;\n"), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	steps = append([][]string{append([]string{"begin", "--reproducible"}, beginArgs...)}, steps...)
+	steps = append(steps,
+		[]string{"--cache-path", path.Join(workingDir, "cache"), "copy", "nginx.conf", "/etc/nginx/nginx.conf"},
+		[]string{"write", "out"},
+	)
+	for _, step := range steps {
+		err := runACBuildNoHist(workingDir, step...)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	image, err := ioutil.ReadFile(path.Join(workingDir, "out"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return image
+}
+
+func testReproducible(t *testing.T, beginArgs []string, steps ...[]string) {
+	first := buildReproducibly(t, beginArgs, steps...)
+	// Make sure every timestamp differs between the builds
+	time.Sleep(1100 * time.Millisecond)
+	second := buildReproducibly(t, beginArgs, steps...)
+	if !bytes.Equal(first, second) {
+		t.Errorf("building the same image twice produced different images")
+	}
+}
+
+func TestReproducibleAppC(t *testing.T) {
+	testReproducible(t, nil, []string{"set-name", "example.com/nginx"})
+}
+
+func TestReproducibleOCI(t *testing.T) {
+	testReproducible(t, []string{"--build-mode=oci"})
+}
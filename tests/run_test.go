@@ -20,6 +20,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 	"testing"
 )
 
@@ -82,6 +83,55 @@ func TestRun(t *testing.T) {
 	}
 }
 
+func TestRunRootless(t *testing.T) {
+	if err := exec.Command("unshare", "--user", "true").Run(); err != nil {
+		t.Skip("skipping test; user namespaces aren't available")
+	}
+
+	tmpsourcedir := mustTempDir()
+	defer os.RemoveAll(tmpsourcedir)
+	tmpsource := path.Join(tmpsourcedir, "thing.go")
+	err := ioutil.WriteFile(tmpsource, []byte(goprogram), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	tmprootfs := mustTempDir()
+	defer os.RemoveAll(tmprootfs)
+
+	cmd := exec.Command("go", "build", "-o", path.Join(tmprootfs, "worker"), "-tags", "netgo", "-ldflags", "-w", tmpsource)
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS=linux", "GO111MODULE=off")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(output))
+		panic(err)
+	}
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err = runACBuildNoHist(tmpdir, "begin", "--build-mode=oci")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err = runACBuildNoHist(tmpdir, "copy", path.Join(tmprootfs, "worker"), "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	// The command is run on top of a lower layer
+	err = runACBuildNoHist(tmpdir, "layer")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, stdout, _, err := runACBuild(tmpdir, "--no-history", "run", "--engine=rootless", "--no-cache", "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if stdout != "success" {
+		t.Errorf("unexpected stdout: %s", stdout)
+	}
+}
+
 func TestRunBadEngine(t *testing.T) {
 	workingDir := setUpTest(t)
 	defer cleanUpTest(workingDir)
@@ -99,3 +149,577 @@ func TestRunBadEngine(t *testing.T) {
 		t.Errorf("unexpected message on stderr: %s", stderr)
 	}
 }
+
+// netprogram prints /etc/hosts and the network interfaces it can see.
+const netprogram = `
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+func main() {
+	hosts, _ := ioutil.ReadFile("/etc/hosts")
+	fmt.Print(string(hosts))
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		panic(err)
+	}
+	var names []string
+	for _, iface := range ifaces {
+		names = append(names, iface.Name)
+	}
+	fmt.Printf("interfaces: %s\n", strings.Join(names, " "))
+}
+`
+
+// buildProgram builds a statically linked binary at dst from source.
+func buildProgram(t *testing.T, source, dst string) {
+	tmpsourcedir := mustTempDir()
+	defer os.RemoveAll(tmpsourcedir)
+	tmpsource := path.Join(tmpsourcedir, "thing.go")
+	err := ioutil.WriteFile(tmpsource, []byte(source), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cmd := exec.Command("go", "build", "-o", dst, "-tags", "netgo", "-ldflags", "-w", tmpsource)
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS=linux", "GO111MODULE=off")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+}
+
+func TestRunRootlessNetwork(t *testing.T) {
+	if err := exec.Command("unshare", "--user", "--net", "true").Run(); err != nil {
+		t.Skip("skipping test; user and network namespaces aren't available")
+	}
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err := runACBuildNoHist(tmpdir, "begin", "--build-mode=oci")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	tmprootfs := mustTempDir()
+	defer os.RemoveAll(tmprootfs)
+	buildProgram(t, netprogram, path.Join(tmprootfs, "worker"))
+	err = runACBuildNoHist(tmpdir, "copy", path.Join(tmprootfs, "worker"), "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, stdout, _, err := runACBuild(tmpdir, "--no-history", "run", "--engine=rootless", "--no-cache", "--network=none", "--add-host=example.test:192.0.2.1", "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if !strings.Contains(stdout, "192.0.2.1\texample.test\n") {
+		t.Errorf("host wasn't added to /etc/hosts: %s", stdout)
+	}
+	if !strings.HasSuffix(stdout, "interfaces: lo\n") {
+		t.Errorf("unexpected network interfaces: %s", stdout)
+	}
+
+	// /etc/hosts must not be left in the layer
+	_, stdout, _, err = runACBuild(tmpdir, "--no-history", "run", "--engine=rootless", "--no-cache", "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if strings.Contains(stdout, "example.test") {
+		t.Errorf("/etc/hosts was left in the layer: %s", stdout)
+	}
+}
+
+// mountprogram prints the file at its first argument, and copies it to its
+// second if there is one.
+const mountprogram = `
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+func main() {
+	blob, err := ioutil.ReadFile(os.Args[1])
+	if err != nil {
+		panic(err)
+	}
+	fmt.Print(string(blob))
+	if len(os.Args) > 2 {
+		err = ioutil.WriteFile(os.Args[2], blob, 0644)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+`
+
+func TestRunRootlessMounts(t *testing.T) {
+	if err := exec.Command("unshare", "--user", "true").Run(); err != nil {
+		t.Skip("skipping test; user namespaces aren't available")
+	}
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err := runACBuildNoHist(tmpdir, "begin", "--build-mode=oci")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	tmphost := mustTempDir()
+	defer os.RemoveAll(tmphost)
+	buildProgram(t, mountprogram, path.Join(tmphost, "worker"))
+	err = runACBuildNoHist(tmpdir, "copy", path.Join(tmphost, "worker"), "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err = ioutil.WriteFile(path.Join(tmphost, "secret"), []byte("hunter2"), 0600)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, stdout, _, err := runACBuild(tmpdir, "--no-history", "run", "--engine=rootless", "--no-cache", "--bind="+tmphost+":/host:ro", "/worker", "/host/secret")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if stdout != "hunter2" {
+		t.Errorf("unexpected stdout: %s", stdout)
+	}
+
+	secret := "--secret=id=password,src=" + path.Join(tmphost, "secret")
+	_, stdout, _, err = runACBuild(tmpdir, "--no-history", "run", "--engine=rootless", "--no-cache", secret, "/worker", "/run/secrets/password")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if stdout != "hunter2" {
+		t.Errorf("unexpected stdout: %s", stdout)
+	}
+
+	_, _, stderr, err := runACBuild(tmpdir, "--no-history", "run", "--engine=rootless", "--no-cache", secret, "/worker", "/run/secrets/password", "/leaked")
+	if err == nil {
+		t.Errorf("copying a secret into the image didn't fail")
+	}
+	if stderr != "run: secret \"password\" was left in the image at /leaked, and was removed from it\n" {
+		t.Errorf("unexpected message on stderr: %s", stderr)
+	}
+
+	// Neither the mount points nor the secret are left in the image
+	for _, p := range []string{"/host", "/run", "/leaked"} {
+		_, _, stderr, err = runACBuild(tmpdir, "--no-history", "run", "--engine=rootless", "--no-cache", "/worker", p)
+		if err == nil || !strings.Contains(stderr, "no such file or directory") {
+			t.Errorf("%s was left in the image", p)
+		}
+	}
+}
+
+// sleepprogram starts a child that sleeps, and sleeps itself.
+const sleepprogram = `
+package main
+
+import (
+	"os"
+	"os/exec"
+	"time"
+)
+
+func main() {
+	if len(os.Args) == 1 {
+		cmd := exec.Command(os.Args[0], "child")
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			panic(err)
+		}
+	}
+	time.Sleep(time.Hour)
+}
+`
+
+func TestRunRootlessTimeout(t *testing.T) {
+	if err := exec.Command("unshare", "--user", "--pid", "--fork", "true").Run(); err != nil {
+		t.Skip("skipping test; user and PID namespaces aren't available")
+	}
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err := runACBuildNoHist(tmpdir, "begin", "--build-mode=oci")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	tmprootfs := mustTempDir()
+	defer os.RemoveAll(tmprootfs)
+	buildProgram(t, sleepprogram, path.Join(tmprootfs, "worker"))
+	err = runACBuildNoHist(tmpdir, "copy", path.Join(tmprootfs, "worker"), "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	// The child holds stdout open, so this would hang if it weren't killed
+	_, _, stderr, err := runACBuild(tmpdir, "--no-history", "run", "--engine=rootless", "--no-cache", "--timeout=1s", "/worker")
+	if err == nil {
+		t.Errorf("the command didn't time out")
+	}
+	if stderr != "run: command timed out after 1s\n" {
+		t.Errorf("unexpected message on stderr: %s", stderr)
+	}
+
+	// The lock was released
+	err = runACBuildNoHist(tmpdir, "end")
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+}
+
+// chrootprogram prints its parent's pid and what it finds in /dev, /proc and /sys, and
+// leaves a child running that holds stdout open.
+const chrootprogram = `
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		time.Sleep(time.Hour)
+	}
+	cmd := exec.Command(os.Args[0], "child")
+	cmd.Stdout = os.Stdout
+	if err := cmd.Start(); err != nil {
+		panic(err)
+	}
+	fmt.Printf("ppid: %d\n", os.Getppid())
+	_, err := ioutil.ReadFile("/dev/null")
+	fmt.Printf("/dev/null: %v\n", err)
+	_, err = os.Stat("/proc/1/status")
+	fmt.Printf("/proc: %v\n", err)
+	err = ioutil.WriteFile("/sys/acbuild", nil, 0644)
+	fmt.Printf("/sys writable: %v\n", err == nil)
+}
+`
+
+func TestRunChroot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the chroot engine needs root")
+	}
+	if _, err := exec.LookPath("acbuild-chroot"); err != nil {
+		t.Skip("skipping test; acbuild-chroot isn't in $PATH")
+	}
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err := runACBuildNoHist(tmpdir, "begin", "--build-mode=oci")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	tmprootfs := mustTempDir()
+	defer os.RemoveAll(tmprootfs)
+	buildProgram(t, chrootprogram, path.Join(tmprootfs, "worker"))
+	err = runACBuildNoHist(tmpdir, "copy", path.Join(tmprootfs, "worker"), "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	// The child holds stdout open, so this would hang if it weren't killed
+	_, stdout, _, err := runACBuild(tmpdir, "--no-history", "run", "--engine=chroot", "--no-cache", "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	// acbuild-chroot is the init of the command's PID namespace
+	expected := "ppid: 1\n/dev/null: <nil>\n/proc: <nil>\n/sys writable: false\n"
+	if stdout != expected {
+		t.Errorf("unexpected output\nexpected:\n%s\ngot:\n%s", expected, stdout)
+	}
+
+	err = runACBuildNoHist(tmpdir, "end")
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+}
+
+// argsprogram prints its arguments and environment, quoted.
+const argsprogram = `
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Printf("%q\n", os.Args[1:])
+	fmt.Printf("%q\n", os.Getenv("JAVA_OPTS"))
+	fmt.Printf("%q\n", os.Getenv("MULTILINE"))
+}
+`
+
+func TestRunChrootArgs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the chroot engine needs root")
+	}
+	if _, err := exec.LookPath("acbuild-chroot"); err != nil {
+		t.Skip("skipping test; acbuild-chroot isn't in $PATH")
+	}
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err := runACBuildNoHist(tmpdir, "begin", "--build-mode=oci")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	tmprootfs := mustTempDir()
+	defer os.RemoveAll(tmprootfs)
+	buildProgram(t, argsprogram, path.Join(tmprootfs, "worker"))
+	err = runACBuildNoHist(tmpdir, "copy", path.Join(tmprootfs, "worker"), "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err = runACBuildNoHist(tmpdir, "environment", "add", "--", "JAVA_OPTS", "-Xa,-Xb=c")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err = runACBuildNoHist(tmpdir, "environment", "add", "MULTILINE", "one\ntwo")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, stdout, _, err := runACBuild(tmpdir, "--no-history", "run", "--engine=chroot", "--no-cache", "--", "/worker", "a,b", "line one\nline two", "x=y=z", "")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	expected := `["a,b" "line one\nline two" "x=y=z" ""]` + "\n" + `"-Xa,-Xb=c"` + "\n" + `"one\ntwo"` + "\n"
+	if stdout != expected {
+		t.Errorf("unexpected output\nexpected:\n%s\ngot:\n%s", expected, stdout)
+	}
+
+	err = runACBuildNoHist(tmpdir, "end")
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+}
+
+// userprogram prints who it's run as.
+const userprogram = `
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	groups, err := os.Getgroups()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("uid=%d gid=%d groups=%v home=%s\n", os.Getuid(), os.Getgid(), groups, os.Getenv("HOME"))
+}
+`
+
+func TestRunUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; users other than root are only mapped when run as root")
+	}
+	if err := exec.Command("unshare", "--user", "true").Run(); err != nil {
+		t.Skip("skipping test; user namespaces aren't available")
+	}
+	engines := []string{"rootless"}
+	if _, err := exec.LookPath("acbuild-chroot"); err == nil {
+		engines = append(engines, "chroot")
+	}
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err := runACBuildNoHist(tmpdir, "begin", "--build-mode=oci")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	tmprootfs := mustTempDir()
+	defer os.RemoveAll(tmprootfs)
+	buildProgram(t, userprogram, path.Join(tmprootfs, "worker"))
+	files := map[string]string{
+		"passwd": "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\n",
+		"group":  "root:x:0:\napp:x:1000:\nstaff:x:50:app\nwheel:x:10:root\n",
+	}
+	for name, contents := range files {
+		err = ioutil.WriteFile(path.Join(tmprootfs, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+
+	// /etc/passwd and /etc/group are in different layers, which are merged
+	for _, args := range [][]string{
+		{"copy", path.Join(tmprootfs, "worker"), "/worker"},
+		{"copy", path.Join(tmprootfs, "passwd"), "/etc/passwd"},
+		{"layer"},
+		{"copy", path.Join(tmprootfs, "group"), "/etc/group"},
+	} {
+		err = runACBuildNoHist(tmpdir, args...)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+
+	tests := []struct {
+		user     string
+		expected string
+	}{
+		{"app", "uid=1000 gid=1000 groups=[50 1000] home=/home/app\n"},
+		{"1000:staff", "uid=1000 gid=50 groups=[50] home=/home/app\n"},
+		{"app:10", "uid=1000 gid=10 groups=[10 50] home=/home/app\n"},
+		{"1234", "uid=1234 gid=0 groups=[0] home=/\n"},
+	}
+	for _, eng := range engines {
+		for _, tt := range tests {
+			_, stdout, stderr, err := runACBuild(tmpdir, "--no-history", "run", "--engine="+eng, "--no-cache", "--user="+tt.user, "/worker")
+			if err != nil {
+				t.Errorf("%s, --user=%s: %v\n%s", eng, tt.user, err, stderr)
+				continue
+			}
+			if stdout != tt.expected {
+				t.Errorf("%s, --user=%s: expected %q, got %q", eng, tt.user, tt.expected, stdout)
+			}
+		}
+	}
+
+	_, _, stderr, err := runACBuild(tmpdir, "--no-history", "run", "--engine=rootless", "--user=nobody", "/worker")
+	if err == nil {
+		t.Errorf("an unknown user was accepted")
+	}
+	if stderr != "run: user \"nobody\" isn't in the image's /etc/passwd\n" {
+		t.Errorf("unexpected message on stderr: %s", stderr)
+	}
+
+	// Secrets are owned by the user the command is run as
+	buildProgram(t, mountprogram, path.Join(tmprootfs, "cat"))
+	err = runACBuildNoHist(tmpdir, "copy", path.Join(tmprootfs, "cat"), "/cat")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err = ioutil.WriteFile(path.Join(tmprootfs, "secret"), []byte("hunter2"), 0600)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	secret := "--secret=id=password,src=" + path.Join(tmprootfs, "secret")
+	for _, eng := range engines {
+		_, stdout, stderr, err := runACBuild(tmpdir, "--no-history", "run", "--engine="+eng, "--no-cache", "--user=app", secret, "/cat", "/run/secrets/password")
+		if err != nil {
+			t.Errorf("%s, --secret: %v\n%s", eng, err, stderr)
+			continue
+		}
+		if stdout != "hunter2" {
+			t.Errorf("%s, --secret: expected %q, got %q", eng, "hunter2", stdout)
+		}
+	}
+
+	err = runACBuildNoHist(tmpdir, "end")
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+}
+
+// fakeruntime is an OCI runtime that runs the process of a bundle in its root
+// filesystem with nothing but chroot.
+const fakeruntime = `
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+func main() {
+	if os.Args[1] != "run" {
+		return
+	}
+	blob, err := ioutil.ReadFile(filepath.Join(os.Args[3], "config.json"))
+	if err != nil {
+		panic(err)
+	}
+	var config struct {
+		Process struct {
+			Args []string
+			Env  []string
+			Cwd  string
+		}
+		Root struct {
+			Path string
+		}
+	}
+	if err := json.Unmarshal(blob, &config); err != nil {
+		panic(err)
+	}
+	cmd := exec.Command(config.Process.Args[0], config.Process.Args[1:]...)
+	cmd.Env = config.Process.Env
+	cmd.Dir = config.Process.Cwd
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: config.Root.Path}
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.Sys().(syscall.WaitStatus).ExitStatus())
+		}
+		panic(err)
+	}
+}
+`
+
+func TestRunOCIRuntime(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the oci-runtime engine needs root")
+	}
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err := runACBuildNoHist(tmpdir, "begin", "--build-mode=oci")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	tmprootfs := mustTempDir()
+	defer os.RemoveAll(tmprootfs)
+	buildProgram(t, argsprogram, path.Join(tmprootfs, "worker"))
+	runtime := path.Join(tmprootfs, "fake-runtime")
+	buildProgram(t, fakeruntime, runtime)
+	err = runACBuildNoHist(tmpdir, "copy", path.Join(tmprootfs, "worker"), "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err = runACBuildNoHist(tmpdir, "environment", "add", "--", "JAVA_OPTS", "-Xa,-Xb=c")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, stdout, _, err := runACBuild(tmpdir, "--no-history", "run", "--engine=oci-runtime", "--runtime="+runtime, "--no-cache", "--", "/worker", "a,b", "x=y")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	expected := `["a,b" "x=y"]` + "\n" + `"-Xa,-Xb=c"` + "\n" + `""` + "\n"
+	if stdout != expected {
+		t.Errorf("unexpected output\nexpected:\n%s\ngot:\n%s", expected, stdout)
+	}
+
+	_, _, stderr, err := runACBuild(tmpdir, "--no-history", "run", "--engine=chroot", "--runtime="+runtime, "/worker")
+	if err == nil {
+		t.Errorf("--runtime was accepted with the chroot engine")
+	}
+	if stderr != "run: --runtime can only be used with --engine=oci-runtime\n" {
+		t.Errorf("unexpected message on stderr: %s", stderr)
+	}
+
+	err = runACBuildNoHist(tmpdir, "end")
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/aci"
+)
+
+const (
+	commonScript = `set-name example.com/${NAME}
+`
+	variantScript = `begin
+arg NAME=app
+arg ENV=dev
+include common.acb
+if ${ENV} == prod
+	label add tier prod
+else
+	label add tier ${ENV}
+endif
+write ${NAME}-${ENV}.aci
+`
+)
+
+func TestScriptVariants(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	for name, script := range map[string]string{"common.acb": commonScript, "build.acb": variantScript} {
+		err := ioutil.WriteFile(path.Join(workingDir, name), []byte(script), 0644)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	type testcase struct {
+		args  []string
+		image string
+		name  string
+		tier  string
+	}
+	cases := []testcase{
+		{nil, "app-dev.aci", "example.com/app", "dev"},
+		{[]string{"--var", "NAME=web", "--var", "ENV=prod"}, "web-prod.aci", "example.com/web", "prod"},
+	}
+	for _, c := range cases {
+		args := append([]string{"script"}, c.args...)
+		err := runACBuildNoHist(workingDir, append(args, "build.acb")...)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		f, err := os.Open(path.Join(workingDir, c.image))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		man, err := aci.ManifestFromImage(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if man.Name.String() != c.name {
+			t.Errorf("%s: name, expected:%s actual:%s", c.image, c.name, man.Name)
+		}
+		if tier, _ := man.Labels.Get("tier"); tier != c.tier {
+			t.Errorf("%s: tier label, expected:%s actual:%s", c.image, c.tier, tier)
+		}
+	}
+
+	if _, err := os.Stat(path.Join(workingDir, ".acbuild")); !os.IsNotExist(err) {
+		t.Errorf("the script left a build in the working directory")
+	}
+
+	// A variable the script doesn't set is left for the shell
+	err := ioutil.WriteFile(path.Join(workingDir, "shell.acb"), []byte("begin\narg NAME=app\nset-exec -- /bin/sh -c \"exec /${NAME} ${HOME}\"\ncat-manifest\n"), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, stdout, stderr, err := runACBuild(workingDir, "--no-history", "script", "shell.acb")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, stderr)
+	}
+	if expected := `"exec":["/bin/sh","-c","exec /app ${HOME}"]`; !strings.Contains(stdout, expected) {
+		t.Errorf("manifest doesn't contain %s: %s", expected, stdout)
+	}
+}
+
+func TestScriptCommandErrors(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	cases := map[string]string{
+		"begin\nlabel add version 1\n\nset-name \"Not Valid\"\n": `build.acb:4: set-name: ACIdentifier must contain only lower case alphanumeric characters plus "-._~/"`,
+		"begin\nlabel add --bogus version 1\n":                   "build.acb:2: label add: unknown flag: --bogus",
+		"begin\nfrobnicate\n":                                    `build.acb:2: unknown command "frobnicate" for "acbuild"`,
+	}
+	for script, expected := range cases {
+		err := ioutil.WriteFile(path.Join(workingDir, "build.acb"), []byte(script), 0644)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		_, _, stderr, err := runACBuild(workingDir, "--no-history", "script", "build.acb")
+		if err == nil {
+			t.Errorf("%q: expected an error", script)
+		}
+		lines := strings.Split(strings.TrimSuffix(stderr, "\n"), "\n")
+		if last := lines[len(lines)-1]; last != expected {
+			t.Errorf("%q: unexpected error\nexpected: %s\ngot: %s", script, expected, last)
+		}
+	}
+}
+
+func TestScriptEmptyArgument(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	err := ioutil.WriteFile(path.Join(workingDir, "build.acb"), []byte("begin\nset-exec \"\" --port 80\ncat-manifest\n"), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	_, stdout, stderr, err := runACBuild(workingDir, "--no-history", "script", "build.acb")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, stderr)
+	}
+	if expected := `"exec":["","--port","80"]`; !strings.Contains(stdout, expected) {
+		t.Errorf("manifest doesn't contain %s: %s", expected, stdout)
+	}
+}
+
+func TestScriptCheck(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	err := ioutil.WriteFile(path.Join(workingDir, "build.acb"), []byte("begin --build-mode oci\nset-name example.com/app\n\nport add http tcp\nwrite app.oci\n"), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	_, _, stderr, err := runACBuild(workingDir, "script", "--check", "build.acb")
+	if err == nil {
+		t.Errorf("checking a script with problems succeeded")
+	}
+	expected := "build.acb:2: set-name: only supported in appc builds\nbuild.acb:4: port add: expected 3 arguments, got 2\n"
+	if stderr != expected {
+		t.Errorf("unexpected message on stderr\nexpected: %sgot: %s", expected, stderr)
+	}
+	for _, name := range []string{".acbuild", "app.oci"} {
+		if _, err := os.Stat(path.Join(workingDir, name)); !os.IsNotExist(err) {
+			t.Errorf("checking the script made %s", name)
+		}
+	}
+}
+
+func TestScriptResume(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	writeScript := func(script string) {
+		err := ioutil.WriteFile(path.Join(workingDir, "build.acb"), []byte(script), 0644)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	writeScript("begin\nset-name example.com/app\nlabel add version 1.0\nlabel add stage\nwrite app.aci\n")
+	_, _, stderr, err := runACBuild(workingDir, "--no-history", "script", "--keep-on-failure", "build.acb")
+	if err == nil {
+		t.Fatalf("a failing script succeeded")
+	}
+	expected := "script: the build was kept in .acbuild, run the script again with --resume to continue from build.acb:4\n"
+	if !strings.HasSuffix(stderr, expected) {
+		t.Errorf("unexpected message on stderr\nexpected: %sgot: %s", expected, stderr)
+	}
+
+	// Changing the lines that were run stops the build from being resumed
+	writeScript("begin\nset-name example.com/other\nlabel add version 1.0\nlabel add stage done\nwrite app.aci\n")
+	_, _, stderr, err = runACBuild(workingDir, "--no-history", "script", "--resume", "build.acb")
+	if err == nil {
+		t.Errorf("a changed script was resumed")
+	}
+	expected = "script: build.acb:2: the script has changed since this line was run, so the build can't be resumed\n"
+	if stderr != expected {
+		t.Errorf("unexpected message on stderr\nexpected: %sgot: %s", expected, stderr)
+	}
+
+	writeScript("begin\nset-name example.com/app\nlabel add version 1.0\nlabel add stage done\nwrite app.aci\n")
+	err = runACBuildNoHist(workingDir, "script", "--resume", "build.acb")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(path.Join(workingDir, ".acbuild")); !os.IsNotExist(err) {
+		t.Errorf("the resumed script left its build in the working directory")
+	}
+	f, err := os.Open(path.Join(workingDir, "app.aci"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	man, err := aci.ManifestFromImage(f)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for name, value := range map[string]string{"version": "1.0", "stage": "done"} {
+		if actual, _ := man.Labels.Get(name); actual != value {
+			t.Errorf("label %s, expected:%s actual:%s", name, value, actual)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
+)
+
+func TestWriteToStdout(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	err := runACBuildNoHist(workingDir, "set-name", "example.com/streamed")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	_, stdout, stderr, err := runACBuild(workingDir, "write", "-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.HasPrefix(stderr, "sha512-") {
+		t.Errorf("image ID not printed to stderr: %q", stderr)
+	}
+
+	gzr, err := gzip.NewReader(strings.NewReader(stdout))
+	if err != nil {
+		t.Fatalf("image written to stdout isn't gzipped: %v", err)
+	}
+	tr := tar.NewReader(gzr)
+	var man *schema.ImageManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("error reading image written to stdout: %v", err)
+		}
+		if hdr.Name != aci.ManifestFile {
+			continue
+		}
+		blob, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		man = &schema.ImageManifest{}
+		err = man.UnmarshalJSON(blob)
+		if err != nil {
+			t.Fatalf("invalid manifest: %v", err)
+		}
+	}
+	if man == nil {
+		t.Fatalf("no manifest in image written to stdout")
+	}
+	if man.Name != "example.com/streamed" {
+		t.Errorf("wrong name in written manifest: %s", man.Name)
+	}
+
+}
+
+func TestWriteToStdoutCantSign(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	err := runACBuildNoHist(workingDir, "set-name", "example.com/streamed")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, stdout, _, err := runACBuild(workingDir, "write", "--sign", "--keyring", "keyring.gpg", "-")
+	if err == nil {
+		t.Fatalf("expected an error signing an image written to stdout")
+	}
+	if stdout != "" {
+		t.Errorf("image written to stdout despite an error")
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/appc/spec/aci"
+	"github.com/klauspost/compress/zstd"
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression is a format images and layers can be compressed with.
+type Compression string
+
+const (
+	CompressionNone = Compression("none")
+	CompressionGzip = Compression("gzip")
+	CompressionZstd = Compression("zstd")
+	CompressionXz   = Compression("xz")
+)
+
+// The media types of OCI layers that aren't defined by the version of the
+// image spec acbuild uses.
+const (
+	MediaTypeImageLayerUncompressed = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeImageLayerZstd         = "application/vnd.oci.image.layer.v1.tar+zstd"
+)
+
+// The levels each compression accepts, where a level of 0 always picks the
+// compression's default level.
+var compressionLevels = map[Compression][2]int{
+	CompressionNone: {0, 0},
+	CompressionGzip: {gzip.BestSpeed, gzip.BestCompression},
+	CompressionZstd: {1, 22},
+	CompressionXz:   {1, 9},
+}
+
+// xzDictCaps are the dictionary sizes used by the xz command's presets, which
+// are what the levels of xz compression pick between.
+var xzDictCaps = []int{
+	256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20,
+	8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
+}
+
+// ParseCompression checks that c is a known compression, and that level is a
+// valid level for it.
+func ParseCompression(c string, level int) (Compression, error) {
+	limits, ok := compressionLevels[Compression(c)]
+	if !ok {
+		return "", fmt.Errorf("unknown compression %q, must be one of none, gzip, zstd, or xz", c)
+	}
+	if level != 0 && (level < limits[0] || level > limits[1]) {
+		if c == string(CompressionNone) {
+			return "", fmt.Errorf("a compression level can't be used without compression")
+		}
+		return "", fmt.Errorf("%s compression level must be between %d and %d", c, limits[0], limits[1])
+	}
+	return Compression(c), nil
+}
+
+// NewWriter returns a writer compressing what is written to it with c at the
+// given level, and writing the result to w. Closing the returned writer
+// flushes it, but doesn't close w.
+func (c Compression) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	switch c {
+	case CompressionNone, "":
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		if level == 0 {
+			return zstd.NewWriter(w)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	case CompressionXz:
+		if level == 0 {
+			level = 6
+		}
+		return xz.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %q", c)
+}
+
+// OCILayerMediaType returns the media type of OCI layers compressed with c.
+func (c Compression) OCILayerMediaType() (string, error) {
+	switch c {
+	case CompressionNone:
+		return MediaTypeImageLayerUncompressed, nil
+	case CompressionGzip, "":
+		return ociImage.MediaTypeImageLayer, nil
+	case CompressionZstd:
+		return MediaTypeImageLayerZstd, nil
+	}
+	return "", fmt.Errorf("OCI layers can't be compressed with %s", c)
+}
+
+// zstdMagic is what zstd compressed data begins with.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// NewDecompressingReader returns a reader decompressing the image or layer r
+// holds, whichever of gzip, bzip2, xz or zstd it is compressed with, if it's
+// compressed at all.
+func NewDecompressingReader(r io.ReadSeeker) (io.ReadCloser, error) {
+	magic := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(r, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	if n == len(zstdMagic) && bytes.Equal(magic, zstdMagic) {
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	}
+	return aci.NewCompressedReader(r)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
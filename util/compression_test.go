@@ -0,0 +1,119 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("an image layer\n", 1000))
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionZstd, CompressionXz} {
+		if c == CompressionXz {
+			// xz is decompressed with the xz command
+			if _, err := exec.LookPath("xz"); err != nil {
+				continue
+			}
+		}
+		for _, level := range []int{0, compressionLevels[c][1]} {
+			buf := &bytes.Buffer{}
+			w, err := c.NewWriter(buf, level)
+			if err != nil {
+				t.Fatalf("%s level %d: %v", c, level, err)
+			}
+			_, err = w.Write(data)
+			if err != nil {
+				t.Fatalf("%s level %d: %v", c, level, err)
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatalf("%s level %d: %v", c, level, err)
+			}
+			if c != CompressionNone && buf.Len() >= len(data) {
+				t.Errorf("%s level %d: data wasn't compressed", c, level)
+			}
+
+			// Uncompressed data is only recognized if it's a tarball, so
+			// it's read back as is
+			if c == CompressionNone {
+				continue
+			}
+			r, err := NewDecompressingReader(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("%s level %d: %v", c, level, err)
+			}
+			out, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("%s level %d: %v", c, level, err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Errorf("%s level %d: data changed by compressing it", c, level)
+			}
+		}
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		compression string
+		level       int
+		valid       bool
+	}{
+		{"gzip", 0, true},
+		{"gzip", 9, true},
+		{"gzip", 10, false},
+		{"zstd", 22, true},
+		{"zstd", 23, false},
+		{"xz", 9, true},
+		{"none", 0, true},
+		{"none", 1, false},
+		{"bzip2", 0, false},
+	}
+	for _, test := range tests {
+		_, err := ParseCompression(test.compression, test.level)
+		if test.valid && err != nil {
+			t.Errorf("%s level %d: unexpected error: %v", test.compression, test.level, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s level %d: expected an error", test.compression, test.level)
+		}
+	}
+}
+
+func TestOCILayerMediaType(t *testing.T) {
+	expected := map[Compression]string{
+		CompressionNone: "application/vnd.oci.image.layer.v1.tar",
+		CompressionGzip: "application/vnd.oci.image.layer.v1.tar+gzip",
+		CompressionZstd: "application/vnd.oci.image.layer.v1.tar+zstd",
+	}
+	for c, mediaType := range expected {
+		m, err := c.OCILayerMediaType()
+		if err != nil {
+			t.Errorf("%s: %v", c, err)
+		}
+		if m != mediaType {
+			t.Errorf("%s: expected media type %s, got %s", c, mediaType, m)
+		}
+	}
+	_, err := CompressionXz.OCILayerMediaType()
+	if err == nil {
+		t.Errorf("expected an error for xz compressed layers")
+	}
+}
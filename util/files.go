@@ -20,8 +20,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 
-	"github.com/appc/spec/aci"
 	rkttar "github.com/coreos/rkt/pkg/tar"
 	"github.com/coreos/rkt/pkg/user"
 )
@@ -29,7 +29,7 @@ import (
 // RmAndMkdir will remove anything at path if it exists, and then create a
 // directory at path.
 func RmAndMkdir(path string) error {
-	err := os.RemoveAll(path)
+	err := RemoveAll(path)
 	if err != nil {
 		return err
 	}
@@ -45,19 +45,30 @@ func RmAndMkdir(path string) error {
 }
 
 // ExtractImage will extract the contents of the image at path to the directory
-// at dst. If fileMap is set, only files in it will be extracted.
+// at dst. If fileMap is set, only files in it will be extracted. Files are
+// given the owners recorded in the image, unless acbuild isn't run as root, in
+// which case the image is extracted from within a user namespace if the
+// current user has subordinate IDs, and is otherwise extracted with every file
+// owned by the current user.
 func ExtractImage(path, dst string, fileMap map[string]struct{}) error {
 	dst, err := filepath.Abs(dst)
 	if err != nil {
 		return err
 	}
+	m, err := userNamespaceIDMap()
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		return extractImageInUserNamespace(m, path, dst, fileMap, false)
+	}
 	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	dr, err := aci.NewCompressedReader(file)
+	dr, err := NewDecompressingReader(file)
 	if err != nil {
 		return fmt.Errorf("error decompressing image: %v", err)
 	}
@@ -76,7 +87,10 @@ func ExtractImage(path, dst string, fileMap map[string]struct{}) error {
 	return rkttar.ExtractTarInsecure(tar.NewReader(dr), dst, true, fileMap, editor)
 }
 
-func PathWalker(twriter *tar.Writer, tarSrcPath string) func(string, os.FileInfo, error) error {
+// PathWalker returns a filepath.WalkFunc that adds everything under
+// tarSrcPath to twriter. If editHeader is non-nil it is called on each header
+// before it is written.
+func PathWalker(twriter *tar.Writer, tarSrcPath string, editHeader func(*tar.Header)) func(string, os.FileInfo, error) error {
 	prefixLen := len(tarSrcPath + "/")
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -87,6 +101,14 @@ func PathWalker(twriter *tar.Writer, tarSrcPath string) func(string, os.FileInfo
 		}
 		hdrName := path[prefixLen:]
 
+		writeHeader := func(hdr *tar.Header) error {
+			hdr.Name = hdrName
+			if editHeader != nil {
+				editHeader(hdr)
+			}
+			return twriter.WriteHeader(hdr)
+		}
+
 		switch {
 		case info.Mode()&os.ModeSymlink != 0:
 			target, err := os.Readlink(path)
@@ -94,16 +116,23 @@ func PathWalker(twriter *tar.Writer, tarSrcPath string) func(string, os.FileInfo
 				return err
 			}
 			hdr, err := tar.FileInfoHeader(info, target)
-			hdr.Name = hdrName
-			twriter.WriteHeader(hdr)
+			if err != nil {
+				return err
+			}
+			err = writeHeader(hdr)
+			if err != nil {
+				return err
+			}
 
 		case info.Mode().IsRegular():
 			hdr, err := tar.FileInfoHeader(info, "")
 			if err != nil {
 				return err
 			}
-			hdr.Name = hdrName
-			twriter.WriteHeader(hdr)
+			err = writeHeader(hdr)
+			if err != nil {
+				return err
+			}
 
 			f, err := os.Open(path)
 			if err != nil {
@@ -123,10 +152,36 @@ func PathWalker(twriter *tar.Writer, tarSrcPath string) func(string, os.FileInfo
 			if err != nil {
 				return err
 			}
-			hdr.Name = hdrName
-			twriter.WriteHeader(hdr)
+			if info.IsDir() {
+				// Opaque directories are recorded in overlayfs layers
+				// with an xattr
+				if xattr, ok := isOpaque(path); ok {
+					hdr.PAXRecords = map[string]string{paxSchilyXattr + xattr: "y"}
+				}
+			}
+			err = writeHeader(hdr)
+			if err != nil {
+				return err
+			}
 		}
 
 		return nil
 	}
 }
+
+// ReproducibleHeader returns a function that strips what differs between
+// machines building the same image from tar headers. Modification times later
+// than epoch are clamped to it, access and change times are dropped, and user
+// and group names are removed, leaving only the numeric IDs.
+func ReproducibleHeader(epoch time.Time) func(*tar.Header) {
+	return func(hdr *tar.Header) {
+		if hdr.ModTime.After(epoch) {
+			hdr.ModTime = epoch
+		}
+		hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+		hdr.Uname = ""
+		hdr.Gname = ""
+	}
+}
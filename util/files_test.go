@@ -0,0 +1,60 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"archive/tar"
+	"testing"
+	"time"
+)
+
+func TestReproducibleHeader(t *testing.T) {
+	epoch := time.Unix(1500000000, 0)
+	edit := ReproducibleHeader(epoch)
+
+	tests := []struct {
+		modTime time.Time
+		want    time.Time
+	}{
+		{epoch.Add(time.Hour), epoch},
+		{epoch.Add(-time.Hour + 500*time.Millisecond), epoch.Add(-time.Hour)},
+		{epoch, epoch},
+	}
+	for _, tt := range tests {
+		hdr := &tar.Header{
+			Name:       "etc/nginx/nginx.conf",
+			ModTime:    tt.modTime,
+			AccessTime: time.Now(),
+			ChangeTime: time.Now(),
+			Uid:        33,
+			Gid:        33,
+			Uname:      "www-data",
+			Gname:      "www-data",
+		}
+		edit(hdr)
+		if !hdr.ModTime.Equal(tt.want) {
+			t.Errorf("modification time %v became %v, wanted %v", tt.modTime, hdr.ModTime, tt.want)
+		}
+		if !hdr.AccessTime.IsZero() || !hdr.ChangeTime.IsZero() {
+			t.Errorf("access and change times weren't removed")
+		}
+		if hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("user and group names weren't removed")
+		}
+		if hdr.Uid != 33 || hdr.Gid != 33 {
+			t.Errorf("user and group IDs were changed")
+		}
+	}
+}
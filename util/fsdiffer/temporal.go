@@ -14,7 +14,9 @@
 package fsdiffer
 
 import (
+	"os"
 	"path/filepath"
+	"syscall"
 )
 
 // TemporalFSDiffer is used to generate changes in a given directory
@@ -42,7 +44,8 @@ func NewTemporalFSDiffer(dir string) (*TemporalFSDiffer, error) {
 // since Start was called.
 //
 // To detect if a file was changed it checks the file's size and mtime (like
-// rsync does by default if no --checksum options is used)
+// rsync does by default if no --checksum options is used), and its mode and
+// owner, since changing those doesn't change its mtime.
 func (t *TemporalFSDiffer) Diff() (FSChanges, error) {
 	changes := FSChanges{}
 	after := make(map[string]fileInfo)
@@ -57,7 +60,7 @@ func (t *TemporalFSDiffer) Diff() (FSChanges, error) {
 		if !ok {
 			changes = append(changes, &FSChange{Path: relpath, ChangeType: Added})
 		} else {
-			if sourceInfo.Size() != afterInfo.Size() || sourceInfo.ModTime().Before(afterInfo.ModTime()) {
+			if changed(sourceInfo, afterInfo) {
 				changes = append(changes, &FSChange{Path: relpath, ChangeType: Modified})
 			}
 		}
@@ -71,3 +74,15 @@ func (t *TemporalFSDiffer) Diff() (FSChanges, error) {
 	}
 	return changes, nil
 }
+
+func changed(before, after os.FileInfo) bool {
+	if before.Size() != after.Size() || before.ModTime().Before(after.ModTime()) || before.Mode() != after.Mode() {
+		return true
+	}
+	beforeStat, ok := before.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	afterStat, ok := after.Sys().(*syscall.Stat_t)
+	return ok && (beforeStat.Uid != afterStat.Uid || beforeStat.Gid != afterStat.Gid)
+}
@@ -0,0 +1,217 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gpg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// The hash algorithm numbers gpg-agent's SETHASH command expects, which are
+// the ones libgcrypt uses.
+var agentHashAlgos = map[crypto.Hash]int{
+	crypto.SHA1:   2,
+	crypto.SHA256: 8,
+	crypto.SHA384: 9,
+	crypto.SHA512: 10,
+	crypto.SHA224: 11,
+}
+
+// UseAgent arranges for signatures made with entity to be made by the
+// gpg-agent listening on socketPath, so entity only needs to hold a public key,
+// such as one exported with `gpg --export`. The socket's path can be found with
+// `gpgconf --list-dirs agent-socket`. Only RSA keys are supported.
+func UseAgent(entity *openpgp.Entity, socketPath string) error {
+	pub, ok := entity.PrimaryKey.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("key %s isn't an RSA key, which is the only kind that can be used with gpg-agent", entity.PrimaryKey.KeyIdString())
+	}
+	entity.PrivateKey = &packet.PrivateKey{
+		PublicKey:  *entity.PrimaryKey,
+		PrivateKey: &agentSigner{socketPath: socketPath, pub: pub},
+	}
+	return nil
+}
+
+// agentSigner is a crypto.Signer that asks gpg-agent to sign with the key
+// matching pub.
+type agentSigner struct {
+	socketPath string
+	pub        *rsa.PublicKey
+}
+
+func (s *agentSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algo, ok := agentHashAlgos[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("gpg-agent: unsupported hash function %v", opts.HashFunc())
+	}
+
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to gpg-agent: %v", err)
+	}
+	defer conn.Close()
+	agent := &assuanConn{conn: conn, r: bufio.NewReader(conn)}
+
+	// Read the greeting
+	_, err = agent.response()
+	if err != nil {
+		return nil, err
+	}
+
+	// Tell the agent where to ask for a passphrase, if it needs one
+	if tty := os.Getenv("GPG_TTY"); tty != "" {
+		_, err = agent.transact("OPTION ttyname=" + tty)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = agent.transact("SIGKEY " + keygrip(s.pub))
+	if err != nil {
+		return nil, err
+	}
+	_, err = agent.transact(fmt.Sprintf("SETHASH %d %X", algo, digest))
+	if err != nil {
+		return nil, err
+	}
+	sexp, err := agent.transact("PKSIGN")
+	if err != nil {
+		return nil, err
+	}
+	sig, err := parseRSASignature(sexp)
+	if err != nil {
+		return nil, err
+	}
+
+	// The agent strips leading zeros from the signature, but it should be as
+	// long as the modulus, like the signatures made by crypto/rsa
+	size := (s.pub.N.BitLen() + 7) / 8
+	if len(sig) < size {
+		sig = append(make([]byte, size-len(sig)), sig...)
+	}
+	return sig, nil
+}
+
+// keygrip returns the hex encoded keygrip gpg-agent uses to identify pub,
+// which for RSA keys is the SHA-1 hash of the modulus, with a leading zero
+// byte if the modulus' high bit is set.
+func keygrip(pub *rsa.PublicKey) string {
+	n := pub.N.Bytes()
+	if len(n) > 0 && n[0]&0x80 != 0 {
+		n = append([]byte{0}, n...)
+	}
+	sum := sha1.Sum(n)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// assuanConn is a connection to a server speaking the Assuan protocol, which
+// is what gpg-agent speaks.
+type assuanConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// transact sends cmd and returns the data sent back before the final OK.
+func (c *assuanConn) transact(cmd string) ([]byte, error) {
+	_, err := io.WriteString(c.conn, cmd+"\n")
+	if err != nil {
+		return nil, fmt.Errorf("error talking to gpg-agent: %v", err)
+	}
+	return c.response()
+}
+
+// response reads lines from the server until it finishes responding to the
+// last command, returning any data it sent.
+func (c *assuanConn) response() ([]byte, error) {
+	var data []byte
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("error talking to gpg-agent: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data, nil
+		case strings.HasPrefix(line, "ERR "):
+			return nil, fmt.Errorf("gpg-agent: %s", line[len("ERR "):])
+		case strings.HasPrefix(line, "D "):
+			data = append(data, unescapeAssuan(line[len("D "):])...)
+		case strings.HasPrefix(line, "INQUIRE "):
+			// The agent asks things like whether a pinentry was launched,
+			// which don't need an answer
+			_, err = io.WriteString(c.conn, "END\n")
+			if err != nil {
+				return nil, fmt.Errorf("error talking to gpg-agent: %v", err)
+			}
+		}
+		// Status ("S") and comment ("#") lines are ignored
+	}
+}
+
+// unescapeAssuan decodes the percent escaping used in Assuan data lines.
+func unescapeAssuan(s string) []byte {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err == nil {
+				out = append(out, byte(b))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return out
+}
+
+// parseRSASignature extracts the signature from the S-expression gpg-agent
+// returns for an RSA signature, which looks like
+// (7:sig-val(3:rsa(1:s256:<signature>))).
+func parseRSASignature(sexp []byte) ([]byte, error) {
+	prefix := []byte("(3:rsa(1:s")
+	i := bytes.Index(sexp, prefix)
+	if i == -1 {
+		return nil, fmt.Errorf("gpg-agent returned an unexpected signature: %q", sexp)
+	}
+	rest := sexp[i+len(prefix):]
+	colon := bytes.IndexByte(rest, ':')
+	if colon == -1 {
+		return nil, fmt.Errorf("gpg-agent returned an unexpected signature: %q", sexp)
+	}
+	length, err := strconv.Atoi(string(rest[:colon]))
+	if err != nil || length > len(rest)-colon-1 {
+		return nil, fmt.Errorf("gpg-agent returned an unexpected signature: %q", sexp)
+	}
+	return rest[colon+1 : colon+1+length], nil
+}
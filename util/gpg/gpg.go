@@ -0,0 +1,121 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The gpg package finds the OpenPGP keys acbuild signs images with. Private
+// keys can either be read from a keyring file, or left in a running gpg-agent
+// which is asked to make each signature.
+package gpg
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// LoadKeyring reads the keys in the keyring file at path. The keyring may be
+// binary, like the output of `gpg --export-secret-keys`, or ASCII armored.
+func LoadKeyring(path string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keyring openpgp.EntityList
+	if block, err := armor.Decode(bytes.NewReader(data)); err == nil {
+		keyring, err = openpgp.ReadKeyRing(block.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading keyring %s: %v", path, err)
+		}
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("error reading keyring %s: %v", path, err)
+		}
+	}
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("no keys in keyring %s", path)
+	}
+	return keyring, nil
+}
+
+// SelectKey returns the key in keyring matching id, which may be a key ID or
+// fingerprint in hex (optionally prefixed with 0x), or part of one of the
+// key's user IDs. If id is empty the keyring must hold exactly one key, which
+// is returned.
+func SelectKey(keyring openpgp.EntityList, id string) (*openpgp.Entity, error) {
+	if id == "" {
+		if len(keyring) != 1 {
+			return nil, fmt.Errorf("keyring holds %d keys, a key to sign with must be picked", len(keyring))
+		}
+		return keyring[0], nil
+	}
+
+	hexID := strings.ToUpper(strings.TrimPrefix(strings.ToLower(id), "0x"))
+	var matches []*openpgp.Entity
+	for _, entity := range keyring {
+		if matchesID(entity, id, hexID) {
+			matches = append(matches, entity)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no key matching %q in keyring", id)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("%d keys match %q in keyring", len(matches), id)
+	}
+}
+
+func matchesID(entity *openpgp.Entity, id, hexID string) bool {
+	keys := []*packet.PublicKey{entity.PrimaryKey}
+	for _, subkey := range entity.Subkeys {
+		keys = append(keys, subkey.PublicKey)
+	}
+	for _, key := range keys {
+		if len(hexID) >= 8 && strings.HasSuffix(fmt.Sprintf("%X", key.Fingerprint), hexID) {
+			return true
+		}
+	}
+	for name := range entity.Identities {
+		if strings.Contains(name, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unlock decrypts the private key of entity, calling passphrase to get the
+// passphrase it is encrypted with if it is encrypted.
+func Unlock(entity *openpgp.Entity, passphrase func() ([]byte, error)) error {
+	if entity.PrivateKey == nil {
+		return fmt.Errorf("no private key for %s in keyring", entity.PrimaryKey.KeyIdString())
+	}
+	if !entity.PrivateKey.Encrypted {
+		return nil
+	}
+	pass, err := passphrase()
+	if err != nil {
+		return err
+	}
+	err = entity.PrivateKey.Decrypt(pass)
+	if err != nil {
+		return fmt.Errorf("error decrypting key %s: %v", entity.PrimaryKey.KeyIdString(), err)
+	}
+	return nil
+}
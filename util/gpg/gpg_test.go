@@ -0,0 +1,266 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gpg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func newTestEntity(t *testing.T, name string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// The self-signatures of a new entity are only made when its private key
+	// is serialized, and serializing the public key fails without them
+	err = entity.SerializePrivate(ioutil.Discard, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return entity
+}
+
+// writeKeyring writes the given entities to a keyring file in dir, armoring
+// it if armored is true. Only public keys are written if public is true.
+func writeKeyring(t *testing.T, dir string, armored, public bool, entities ...*openpgp.Entity) string {
+	buf := &bytes.Buffer{}
+	for _, entity := range entities {
+		var err error
+		if public {
+			err = entity.Serialize(buf)
+		} else {
+			err = entity.SerializePrivate(buf, nil)
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	data := buf.Bytes()
+	if armored {
+		armoredBuf := &bytes.Buffer{}
+		w, err := armor.Encode(armoredBuf, openpgp.PrivateKeyType, nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		w.Write(data)
+		w.Close()
+		data = armoredBuf.Bytes()
+	}
+	p := path.Join(dir, fmt.Sprintf("keyring-%t-%t", armored, public))
+	err := ioutil.WriteFile(p, data, 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return p
+}
+
+func checkSignsWith(t *testing.T, signer *openpgp.Entity, verifier *openpgp.Entity) {
+	msg := []byte("an image")
+	sig := &bytes.Buffer{}
+	err := openpgp.DetachSign(sig, signer, bytes.NewReader(msg), nil)
+	if err != nil {
+		t.Fatalf("error signing: %v", err)
+	}
+	_, err = openpgp.CheckDetachedSignature(openpgp.EntityList{verifier}, bytes.NewReader(msg), sig)
+	if err != nil {
+		t.Errorf("signature doesn't verify: %v", err)
+	}
+}
+
+func TestLoadKeyringAndSelectKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-gpg-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice := newTestEntity(t, "alice")
+	bob := newTestEntity(t, "bob")
+
+	for _, armored := range []bool{false, true} {
+		keyringPath := writeKeyring(t, dir, armored, false, alice, bob)
+		keyring, err := LoadKeyring(keyringPath)
+		if err != nil {
+			t.Fatalf("armored=%t: %v", armored, err)
+		}
+		if len(keyring) != 2 {
+			t.Fatalf("armored=%t: expected 2 keys, got %d", armored, len(keyring))
+		}
+
+		_, err = SelectKey(keyring, "")
+		if err == nil {
+			t.Errorf("expected an error when no key is picked from several")
+		}
+
+		fingerprint := fmt.Sprintf("%x", bob.PrimaryKey.Fingerprint)
+		for _, id := range []string{"bob@example.com", "0x" + bob.PrimaryKey.KeyIdShortString(), fingerprint} {
+			entity, err := SelectKey(keyring, id)
+			if err != nil {
+				t.Errorf("selecting %q: %v", id, err)
+				continue
+			}
+			if entity.PrimaryKey.KeyId != bob.PrimaryKey.KeyId {
+				t.Errorf("selecting %q returned the wrong key", id)
+			}
+		}
+
+		_, err = SelectKey(keyring, "example.com")
+		if err == nil {
+			t.Errorf("expected an error when several keys match")
+		}
+		_, err = SelectKey(keyring, "carol")
+		if err == nil {
+			t.Errorf("expected an error when no keys match")
+		}
+
+		entity, _ := SelectKey(keyring, "alice")
+		err = Unlock(entity, func() ([]byte, error) {
+			t.Fatalf("asked for a passphrase for an unencrypted key")
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		checkSignsWith(t, entity, alice)
+	}
+}
+
+func TestUnlockPublicKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-gpg-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyring, err := LoadKeyring(writeKeyring(t, dir, true, true, newTestEntity(t, "alice")))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = Unlock(keyring[0], nil)
+	if err == nil || !strings.Contains(err.Error(), "no private key") {
+		t.Errorf("expected missing private key error, got %v", err)
+	}
+}
+
+// fakeAgent serves enough of gpg-agent's protocol to sign with key.
+func fakeAgent(t *testing.T, socketPath string, key *rsa.PrivateKey) net.Listener {
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveAgent(conn, key)
+		}
+	}()
+	return l
+}
+
+func serveAgent(conn net.Conn, key *rsa.PrivateKey) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "# a comment\nOK Pleased to meet you\n")
+
+	var digest []byte
+	var hash crypto.Hash
+	var grip string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "SIGKEY":
+			grip = fields[1]
+		case "SETHASH":
+			hash = map[string]crypto.Hash{"2": crypto.SHA1, "8": crypto.SHA256, "10": crypto.SHA512}[fields[1]]
+			digest, _ = hex.DecodeString(fields[2])
+		case "PKSIGN":
+			if grip != keygrip(&key.PublicKey) {
+				fmt.Fprintf(conn, "ERR 67108881 No secret key <GPG Agent>\n")
+				continue
+			}
+			fmt.Fprintf(conn, "INQUIRE PINENTRY_LAUNCHED 1234\n")
+			if l, _ := r.ReadString('\n'); l != "END\n" {
+				return
+			}
+			sig, err := rsa.SignPKCS1v15(nil, key, hash, digest)
+			if err != nil {
+				fmt.Fprintf(conn, "ERR 1 %v\n", err)
+				continue
+			}
+			sexp := fmt.Sprintf("(7:sig-val(3:rsa(1:s%d:%s)))", len(sig), sig)
+			escaped := strings.NewReplacer("%", "%25", "\n", "%0A", "\r", "%0D").Replace(sexp)
+			fmt.Fprintf(conn, "S PROGRESS\nD %s\n", escaped)
+		}
+		fmt.Fprintf(conn, "OK\n")
+	}
+}
+
+func TestUseAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-gpg-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice := newTestEntity(t, "alice")
+	socketPath := path.Join(dir, "S.gpg-agent")
+	l := fakeAgent(t, socketPath, alice.PrivateKey.PrivateKey.(*rsa.PrivateKey))
+	defer l.Close()
+
+	keyring, err := LoadKeyring(writeKeyring(t, dir, false, true, alice))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = UseAgent(keyring[0], socketPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	checkSignsWith(t, keyring[0], alice)
+
+	// The agent doesn't have bob's key
+	keyring, err = LoadKeyring(writeKeyring(t, dir, true, true, newTestEntity(t, "bob")))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = UseAgent(keyring[0], socketPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = openpgp.DetachSign(ioutil.Discard, keyring[0], strings.NewReader("an image"), nil)
+	if err == nil || !strings.Contains(err.Error(), "No secret key") {
+		t.Errorf("expected missing key error from agent, got %v", err)
+	}
+}
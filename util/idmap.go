@@ -0,0 +1,191 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// overflowID is the ID the kernel reports for IDs that aren't mapped into a
+// user namespace.
+const overflowID = 65534
+
+var (
+	subuidPath = "/etc/subuid"
+	subgidPath = "/etc/subgid"
+)
+
+// IDMapping maps Size IDs starting at ContainerID inside of a user namespace to
+// the IDs starting at HostID outside of it.
+type IDMapping struct {
+	ContainerID uint32
+	HostID      uint32
+	Size        uint32
+}
+
+// IDMap holds the user and group ID mappings of a user namespace.
+type IDMap struct {
+	UIDs []IDMapping
+	GIDs []IDMapping
+}
+
+// RootlessIDMap returns the mappings of the user namespaces commands are run in
+// when acbuild isn't run as root. The current user and group are root in the
+// namespace, and the subordinate IDs assigned to the user in /etc/subuid and
+// /etc/subgid follow from 1. Subordinate IDs can only be mapped with the
+// newuidmap and newgidmap helpers, so they're left out if those aren't
+// installed. When run as root, every ID is mapped to itself.
+func RootlessIDMap() (*IDMap, error) {
+	if os.Geteuid() == 0 {
+		identity := []IDMapping{{ContainerID: 0, HostID: 0, Size: 4294967295}}
+		return &IDMap{UIDs: identity, GIDs: identity}, nil
+	}
+
+	uid, gid := uint32(os.Geteuid()), uint32(os.Getegid())
+	m := &IDMap{
+		UIDs: []IDMapping{{ContainerID: 0, HostID: uid, Size: 1}},
+		GIDs: []IDMapping{{ContainerID: 0, HostID: gid, Size: 1}},
+	}
+	if _, err := exec.LookPath("newuidmap"); err != nil {
+		return m, nil
+	}
+	if _, err := exec.LookPath("newgidmap"); err != nil {
+		return m, nil
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return nil, fmt.Errorf("error determining current user: %v", err)
+	}
+	subuids, err := readSubIDs(subuidPath, u.Username, uid)
+	if err != nil {
+		return nil, err
+	}
+	subgids, err := readSubIDs(subgidPath, u.Username, uid)
+	if err != nil {
+		return nil, err
+	}
+	if len(subuids) == 0 || len(subgids) == 0 {
+		return m, nil
+	}
+	m.UIDs = appendSubIDs(m.UIDs, subuids)
+	m.GIDs = appendSubIDs(m.GIDs, subgids)
+	return m, nil
+}
+
+// HasSubordinateIDs returns whether IDs other than root's are mapped.
+func (m *IDMap) HasSubordinateIDs() bool {
+	return len(m.UIDs) > 1 && len(m.GIDs) > 1
+}
+
+// ToContainer returns the IDs in the namespace of the given IDs outside of it.
+// IDs that aren't mapped become the overflow ID, as they do in the kernel.
+func (m *IDMap) ToContainer(uid, gid int) (int, int) {
+	return toContainer(m.UIDs, uid), toContainer(m.GIDs, gid)
+}
+
+// TarHeaderEditor returns a function that replaces the owners of tar headers
+// of files outside of the namespace with the owners the files have in it. The
+// user and group names, which are those of the owners outside of the
+// namespace, are removed.
+func (m *IDMap) TarHeaderEditor() func(*tar.Header) {
+	return func(hdr *tar.Header) {
+		hdr.Uid, hdr.Gid = m.ToContainer(hdr.Uid, hdr.Gid)
+		hdr.Uname, hdr.Gname = "", ""
+	}
+}
+
+func toContainer(mappings []IDMapping, id int) int {
+	for _, mapping := range mappings {
+		if id >= int(mapping.HostID) && id-int(mapping.HostID) < int(mapping.Size) {
+			return int(mapping.ContainerID) + id - int(mapping.HostID)
+		}
+	}
+	return overflowID
+}
+
+// appendSubIDs maps the ranges of subordinate IDs in subids to the IDs following
+// the ones mapped by mappings.
+func appendSubIDs(mappings []IDMapping, subids []IDMapping) []IDMapping {
+	next := uint32(0)
+	for _, mapping := range mappings {
+		if end := mapping.ContainerID + mapping.Size; end > next {
+			next = end
+		}
+	}
+	for _, subid := range subids {
+		mappings = append(mappings, IDMapping{ContainerID: next, HostID: subid.HostID, Size: subid.Size})
+		next += subid.Size
+	}
+	return mappings
+}
+
+func readSubIDs(path, name string, id uint32) ([]IDMapping, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	subids, err := parseSubIDs(f, name, id)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return subids, nil
+}
+
+// parseSubIDs returns the ranges of subordinate IDs assigned to the user with
+// the given name or ID in r, which is in the format of /etc/subuid. The host
+// IDs of the returned mappings hold the first ID of each range.
+func parseSubIDs(r io.Reader, name string, id uint32) ([]IDMapping, error) {
+	var subids []IDMapping
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens := strings.Split(line, ":")
+		if len(tokens) != 3 {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		if tokens[0] != name && tokens[0] != strconv.FormatUint(uint64(id), 10) {
+			continue
+		}
+		start, err := strconv.ParseUint(tokens[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		count, err := strconv.ParseUint(tokens[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		if count == 0 {
+			continue
+		}
+		subids = append(subids, IDMapping{HostID: uint32(start), Size: uint32(count)})
+	}
+	return subids, s.Err()
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const subuidFile = `# comment
+builder:100000:65536
+other:165536:65536
+1000:300000:1000
+builder:400000:0
+`
+
+func TestParseSubIDs(t *testing.T) {
+	tests := []struct {
+		name string
+		id   uint32
+		want []IDMapping
+	}{
+		{"builder", 1001, []IDMapping{{HostID: 100000, Size: 65536}}},
+		{"builder", 1000, []IDMapping{{HostID: 100000, Size: 65536}, {HostID: 300000, Size: 1000}}},
+		{"nobody", 2000, nil},
+	}
+	for _, tt := range tests {
+		subids, err := parseSubIDs(strings.NewReader(subuidFile), tt.name, tt.id)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !reflect.DeepEqual(subids, tt.want) {
+			t.Errorf("subordinate IDs of %s/%d: got %v, wanted %v", tt.name, tt.id, subids, tt.want)
+		}
+	}
+
+	_, err := parseSubIDs(strings.NewReader("builder:100000\n"), "builder", 1000)
+	if err == nil {
+		t.Errorf("expected an error parsing a malformed line")
+	}
+}
+
+func TestIDMap(t *testing.T) {
+	subids := []IDMapping{{HostID: 100000, Size: 65536}, {HostID: 300000, Size: 1000}}
+	m := &IDMap{
+		UIDs: appendSubIDs([]IDMapping{{ContainerID: 0, HostID: 1000, Size: 1}}, subids),
+		GIDs: appendSubIDs([]IDMapping{{ContainerID: 0, HostID: 1000, Size: 1}}, subids),
+	}
+	wantUIDs := []IDMapping{
+		{ContainerID: 0, HostID: 1000, Size: 1},
+		{ContainerID: 1, HostID: 100000, Size: 65536},
+		{ContainerID: 65537, HostID: 300000, Size: 1000},
+	}
+	if !reflect.DeepEqual(m.UIDs, wantUIDs) {
+		t.Fatalf("got mappings %v, wanted %v", m.UIDs, wantUIDs)
+	}
+	if !m.HasSubordinateIDs() {
+		t.Errorf("subordinate IDs not reported")
+	}
+
+	tests := []struct {
+		host, container int
+	}{
+		{1000, 0},
+		{100000, 1},
+		{100032, 33},
+		{300000, 65537},
+		{0, overflowID},
+		{1001, overflowID},
+		{301000, overflowID},
+	}
+	for _, tt := range tests {
+		uid, gid := m.ToContainer(tt.host, tt.host)
+		if uid != tt.container || gid != tt.container {
+			t.Errorf("%d mapped to %d:%d, wanted %d", tt.host, uid, gid, tt.container)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/coreos/rkt/pkg/fileutil"
+
+	"github.com/containers/build/util/fsdiffer"
+)
+
+// These functions stand in for overlayfs where it can't be mounted, by
+// copying the layers of a root filesystem into a single directory and copying
+// what a command changed in it back into the upper layer afterwards.
+
+// MergeLayers copies the directories in layers, bottom-most first, into dst, so
+// that dst holds what overlayfs would show were they mounted on top of each
+// other. Overlayfs whiteouts and opaque directories remove what they hide from
+// dst. Device nodes are left out if they can't be created, such as in a user
+// namespace.
+func MergeLayers(layers []string, dst string) error {
+	for _, layer := range layers {
+		err := filepath.Walk(layer, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(layer, p)
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(dst, rel)
+			if isWhiteout(info) {
+				return os.RemoveAll(target)
+			}
+			if _, ok := isOpaque(p); ok && info.IsDir() && rel != "." {
+				// Nothing from the layers below shows through it
+				err := os.RemoveAll(target)
+				if err != nil {
+					return err
+				}
+			}
+			return copyEntry(p, target, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyChanges copies the paths changes says were added or modified in from
+// into to, and removes the ones it says were deleted from to. Deleted paths
+// that are in any of the layers in lower are hidden with a whiteout, as
+// overlayfs would. Whiteouts are device nodes, which kernels older than Linux
+// 5.8 only let privileged users create, so the paths they couldn't be created
+// for are returned.
+func CopyChanges(changes fsdiffer.FSChanges, from, to string, lower []string) ([]string, error) {
+	var copied, deleted []string
+	for _, change := range changes {
+		if change.ChangeType == fsdiffer.Deleted {
+			deleted = append(deleted, change.Path)
+		} else {
+			copied = append(copied, change.Path)
+		}
+	}
+	// Parents are copied before their children, and children removed before
+	// their parents
+	sort.Strings(copied)
+	sort.Sort(sort.Reverse(sort.StringSlice(deleted)))
+
+	for _, p := range copied {
+		err := copyParents(p, from, to)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Lstat(filepath.Join(from, p))
+		if err != nil {
+			return nil, err
+		}
+		err = copyEntry(filepath.Join(from, p), filepath.Join(to, p), info)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var unremovable []string
+	for _, p := range deleted {
+		_, err := os.Lstat(filepath.Join(to, p))
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, err
+		default:
+			err = os.RemoveAll(filepath.Join(to, p))
+			if err != nil {
+				return nil, err
+			}
+		}
+		inLower, err := existsInAny(p, lower)
+		if err != nil {
+			return nil, err
+		}
+		if !inLower {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(from, filepath.Dir(p))); err != nil {
+			// The parent was removed too, and whiting it out hides p
+			continue
+		}
+		err = copyParents(p, from, to)
+		if err != nil {
+			return nil, err
+		}
+		err = syscall.Mknod(filepath.Join(to, p), syscall.S_IFCHR, 0)
+		if err == syscall.EPERM {
+			unremovable = append(unremovable, p)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return unremovable, nil
+}
+
+// existsInAny returns whether p is in any of the directories in dirs.
+func existsInAny(p string, dirs []string) (bool, error) {
+	for _, dir := range dirs {
+		_, err := os.Lstat(filepath.Join(dir, p))
+		pathErr, ok := err.(*os.PathError)
+		switch {
+		case os.IsNotExist(err), ok && pathErr.Err == syscall.ENOTDIR:
+		case err != nil:
+			return false, err
+		default:
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// copyParents copies the directories above p in from that aren't in to yet.
+func copyParents(p, from, to string) error {
+	parent := filepath.Dir(p)
+	if parent == "." || parent == "/" {
+		return nil
+	}
+	_, err := os.Lstat(filepath.Join(to, parent))
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	err = copyParents(parent, from, to)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(filepath.Join(from, parent))
+	if err != nil {
+		return err
+	}
+	return copyEntry(filepath.Join(from, parent), filepath.Join(to, parent), info)
+}
+
+// copyEntry copies the file, directory, link or device at src, but not what's
+// in it, to dst, replacing what's at dst unless both are directories.
+func copyEntry(src, dst string, info os.FileInfo) error {
+	existing, err := os.Lstat(dst)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case existing.IsDir() && info.IsDir():
+	default:
+		err = os.RemoveAll(dst)
+		if err != nil {
+			return err
+		}
+	}
+
+	mode := info.Mode()
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("can't determine the owner of %s", src)
+	}
+	switch {
+	case mode.IsDir():
+		if existing == nil || !existing.IsDir() {
+			err = os.Mkdir(dst, mode.Perm())
+		}
+	case mode.IsRegular():
+		err = fileutil.CopyRegularFile(src, dst)
+	case mode&os.ModeSymlink != 0:
+		err = fileutil.CopySymlink(src, dst)
+	case mode&os.ModeNamedPipe != 0:
+		err = syscall.Mkfifo(dst, uint32(mode.Perm()))
+	case mode&os.ModeDevice != 0:
+		typ := uint32(syscall.S_IFBLK)
+		if mode&os.ModeCharDevice != 0 {
+			typ = syscall.S_IFCHR
+		}
+		err = syscall.Mknod(dst, typ|uint32(mode.Perm()), int(st.Rdev))
+		if err == syscall.EPERM {
+			fmt.Fprintf(os.Stderr, "warning: can't create device node %s, leaving it out\n", dst)
+			return nil
+		}
+	case mode&os.ModeSocket != 0:
+		return nil
+	default:
+		return fmt.Errorf("unsupported file type of %s: %v", src, mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Lchown(dst, int(st.Uid), int(st.Gid))
+	if pathErr, ok := err.(*os.PathError); ok && (pathErr.Err == syscall.EINVAL || pathErr.Err == syscall.EPERM) {
+		// Files owned by IDs that aren't mapped into the user namespace
+		// acbuild is running in can't be given to them
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+	// Chown clears the setuid and setgid bits, so the mode is set after it
+	err = os.Chmod(dst, mode)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// isWhiteout returns whether info describes an overlayfs whiteout, which is a
+// character device with the device number 0/0.
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containers/build/util/fsdiffer"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		p := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		err = ioutil.WriteFile(p, []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+}
+
+func readFiles(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		contents, err := ioutil.ReadFile(p)
+		files[rel] = string(contents)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return files
+}
+
+func TestMergeLayersAndCopyChanges(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "acbuild-layers-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	lower := filepath.Join(tmpdir, "lower")
+	upper := filepath.Join(tmpdir, "upper")
+	merged := filepath.Join(tmpdir, "merged")
+	for _, dir := range []string{lower, upper, merged} {
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	writeFiles(t, lower, map[string]string{
+		"etc/os-release": "lower",
+		"etc/hostname":   "lower",
+		"bin/sh":         "lower",
+	})
+	writeFiles(t, upper, map[string]string{
+		"etc/hostname":   "upper",
+		"etc/nginx.conf": "upper",
+	})
+
+	err = MergeLayers([]string{lower, upper}, merged)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	want := map[string]string{
+		"etc/os-release": "lower",
+		"etc/hostname":   "upper",
+		"etc/nginx.conf": "upper",
+		"bin/sh":         "lower",
+	}
+	if files := readFiles(t, merged); !reflect.DeepEqual(files, want) {
+		t.Fatalf("merged layers hold %v, wanted %v", files, want)
+	}
+
+	differ, err := fsdiffer.NewTemporalFSDiffer(merged)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	writeFiles(t, merged, map[string]string{
+		"var/www/index.html": "new file",
+		"etc/os-release":     "modified file",
+	})
+	for _, name := range []string{"etc/nginx.conf", "bin/sh"} {
+		err := os.Remove(filepath.Join(merged, name))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	changes, err := differ.Diff()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	unremovable, err := CopyChanges(changes, merged, upper, []string{lower})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// Older kernels only let privileged users create whiteouts
+	if len(unremovable) == 0 {
+		info, err := os.Lstat(filepath.Join(upper, "bin/sh"))
+		if err != nil || !isWhiteout(info) {
+			t.Errorf("bin/sh wasn't whited out in the upper layer")
+		}
+	} else if !reflect.DeepEqual(unremovable, []string{"bin/sh"}) {
+		t.Errorf("got unremovable paths %v, wanted [bin/sh]", unremovable)
+	}
+	if _, err := os.Lstat(filepath.Join(upper, "etc/nginx.conf")); !os.IsNotExist(err) {
+		t.Errorf("etc/nginx.conf wasn't removed from the upper layer")
+	}
+	want = map[string]string{
+		"etc/os-release":     "modified file",
+		"etc/hostname":       "upper",
+		"var/www/index.html": "new file",
+	}
+	if files := readFiles(t, upper); !reflect.DeepEqual(files, want) {
+		t.Errorf("upper layer holds %v, wanted %v", files, want)
+	}
+}
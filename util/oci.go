@@ -15,12 +15,33 @@
 package util
 
 import (
+	"archive/tar"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"syscall"
 )
 
+// Files deleted from lower layers of an OCI image are recorded in a layer with
+// whiteout files, named like the deleted file with the prefix below, and
+// directories that hide everything below them with an opaque whiteout file in
+// them. Overlayfs instead records them with character devices with the device
+// number 0/0 and the overlay.opaque xattr.
+const (
+	ociWhiteoutPrefix = ".wh."
+	ociOpaqueWhiteout = ".wh..wh..opq"
+
+	paxSchilyXattr = "SCHILY.xattr."
+)
+
+// overlayOpaqueXattrs are the xattrs overlayfs marks opaque directories with,
+// the first when mounted by root and the second when mounted in a user
+// namespace.
+var overlayOpaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
 func SplitOCILayerID(layerID string) (string, string, error) {
 	tokens := strings.Split(layerID, ":")
 	if len(tokens) != 2 {
@@ -44,22 +65,170 @@ func OCIExtractLayers(layerIDs []string, imageLoc, blobsDest string) error {
 		_, err = os.Stat(to)
 		if err == nil {
 			// This has already been extracted
-			break
+			continue
+		}
+
+		// The layer is extracted from within a chroot of to, so it must exist
+		err = os.MkdirAll(to, 0755)
+		if err != nil {
+			return err
 		}
 
-		err = os.MkdirAll(path.Join(blobsDest, algo), 0755)
+		err = ExtractOCILayer(from, to)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtractOCILayer extracts the OCI layer at path to the directory at dst, as
+// ExtractImage does. The whiteout files in the layer are replaced with the
+// whiteouts and opaque directories of overlayfs, so that dst can be mounted as
+// a lower layer of an overlay.
+func ExtractOCILayer(path, dst string) error {
+	m, err := userNamespaceIDMap()
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		return extractImageInUserNamespace(m, path, dst, nil, true)
+	}
+	err = ExtractImage(path, dst, nil)
+	if err != nil {
+		return err
+	}
+	return ociToOverlayWhiteouts(dst)
+}
+
+// ociToOverlayWhiteouts replaces the OCI whiteout files under dir with overlayfs
+// whiteouts and opaque directories.
+func ociToOverlayWhiteouts(dir string) error {
+	var whiteouts []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if strings.HasPrefix(info.Name(), ociWhiteoutPrefix) {
+			whiteouts = append(whiteouts, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		err = ExtractImage(from, to, nil)
+	for _, p := range whiteouts {
+		err := os.Remove(p)
+		if err != nil {
+			return err
+		}
+		parent, name := filepath.Split(p)
+		if name == ociOpaqueWhiteout {
+			err = setOpaque(parent)
+			if err != nil {
+				return fmt.Errorf("error marking %s opaque: %v", parent, err)
+			}
+			continue
+		}
+		target := filepath.Join(parent, strings.TrimPrefix(name, ociWhiteoutPrefix))
+		err = os.RemoveAll(target)
 		if err != nil {
 			return err
 		}
+		err = syscall.Mknod(target, syscall.S_IFCHR, 0)
+		if err != nil {
+			return fmt.Errorf("error creating whiteout for %s: %v", target, err)
+		}
 	}
 	return nil
 }
 
+// setOpaque sets every overlayfs opaque xattr on dir that can be set, since the
+// overlay the directory is used in may be mounted either by root or in a user
+// namespace. Only root can set the xattr that root's overlays use.
+func setOpaque(dir string) error {
+	var setErr error
+	set := false
+	for _, name := range overlayOpaqueXattrs {
+		err := syscall.Setxattr(dir, name, []byte("y"), 0)
+		if err == nil {
+			set = true
+		} else if setErr == nil {
+			setErr = err
+		}
+	}
+	if set {
+		return nil
+	}
+	return setErr
+}
+
+// isOpaque returns whether the directory at p is marked opaque by overlayfs,
+// and the xattr it is marked with.
+func isOpaque(p string) (string, bool) {
+	buf := make([]byte, 1)
+	for _, name := range overlayOpaqueXattrs {
+		n, err := syscall.Getxattr(p, name, buf)
+		if err == nil && n == 1 && buf[0] == 'y' {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// WriteOCILayer adds everything under dir, which holds an OCI layer, to
+// twriter, as WalkTree reads it. Overlayfs whiteouts and opaque directories are
+// replaced with OCI whiteout files. If editHeader is non-nil it is called on
+// each header before it is written.
+func WriteOCILayer(twriter *tar.Writer, dir string, editHeader func(*tar.Header)) error {
+	write := func(hdr *tar.Header, r io.Reader) error {
+		if editHeader != nil {
+			editHeader(hdr)
+		}
+		err := twriter.WriteHeader(hdr)
+		if err != nil || r == nil {
+			return err
+		}
+		_, err = io.Copy(twriter, r)
+		return err
+	}
+
+	return WalkTree(dir, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Typeflag == tar.TypeChar && hdr.Devmajor == 0 && hdr.Devminor == 0 {
+			name := path.Join(path.Dir(hdr.Name), ociWhiteoutPrefix+path.Base(hdr.Name))
+			return write(whiteoutHeader(hdr, name), nil)
+		}
+
+		opaque := false
+		for _, xattr := range overlayOpaqueXattrs {
+			if hdr.PAXRecords[paxSchilyXattr+xattr] == "y" {
+				opaque = true
+			}
+			delete(hdr.PAXRecords, paxSchilyXattr+xattr)
+			delete(hdr.Xattrs, xattr)
+		}
+		err := write(hdr, r)
+		if err != nil || !opaque {
+			return err
+		}
+		return write(whiteoutHeader(hdr, path.Join(hdr.Name, ociOpaqueWhiteout)), nil)
+	})
+}
+
+// whiteoutHeader returns the header of an OCI whiteout file with the given
+// name, owned by the owner of the file described by hdr and modified when it
+// was.
+func whiteoutHeader(hdr *tar.Header, name string) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Uid:      hdr.Uid,
+		Gid:      hdr.Gid,
+		ModTime:  hdr.ModTime,
+	}
+}
+
 func OCINewExpandedLayer(ociExpandedBlobsPath string) (string, error) {
 	targetPath := path.Join(ociExpandedBlobsPath, "sha256", "new-layer")
 	_, err := os.Stat(targetPath)
@@ -0,0 +1,119 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+func TestWriteOCILayerWhiteouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-oci-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"keep":        "kept",
+		"opaque/file": "new",
+	})
+	err = syscall.Mknod(filepath.Join(dir, "gone"), syscall.S_IFCHR, 0)
+	if err != nil {
+		t.Skipf("can't create whiteouts: %v", err)
+	}
+	err = setOpaque(filepath.Join(dir, "opaque"))
+	if err != nil {
+		t.Skipf("can't set xattrs: %v", err)
+	}
+
+	var buf bytes.Buffer
+	twriter := tar.NewWriter(&buf)
+	err = WriteOCILayer(twriter, dir, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	twriter.Close()
+
+	var names []string
+	treader := tar.NewReader(&buf)
+	for {
+		hdr, err := treader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if hdr.Typeflag == tar.TypeChar {
+			t.Errorf("overlayfs whiteout %s was written to the layer", hdr.Name)
+		}
+		if len(hdr.PAXRecords) != 0 {
+			t.Errorf("%s was written with PAX records %v", hdr.Name, hdr.PAXRecords)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	want := []string{".wh.gone", "keep", "opaque", "opaque/.wh..wh..opq", "opaque/file"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("layer holds %v, wanted %v", names, want)
+	}
+}
+
+func TestOCIToOverlayWhiteouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-oci-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"keep":                "kept",
+		".wh.gone":            "",
+		"opaque/.wh..wh..opq": "",
+		"opaque/file":         "new",
+	})
+
+	err = ociToOverlayWhiteouts(dir)
+	if err != nil {
+		t.Skipf("can't create whiteouts or set xattrs: %v", err)
+	}
+
+	want := map[string]string{
+		"keep":        "kept",
+		"opaque/file": "new",
+	}
+	if files := readFiles(t, dir); !reflect.DeepEqual(files, want) {
+		t.Errorf("layer holds %v, wanted %v", files, want)
+	}
+	info, err := os.Lstat(filepath.Join(dir, "gone"))
+	if err != nil || !isWhiteout(info) {
+		t.Errorf("gone wasn't replaced with an overlayfs whiteout")
+	}
+	if _, ok := isOpaque(filepath.Join(dir, "opaque")); !ok {
+		t.Errorf("opaque wasn't marked opaque")
+	}
+	if _, ok := isOpaque(dir); ok {
+		t.Errorf("the layer's root was marked opaque")
+	}
+}
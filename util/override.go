@@ -0,0 +1,280 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// FileOverrides records the files written into a directory by OverrideFiles,
+// and what they replaced, so that Restore can put the directory back the way
+// it was.
+type FileOverrides struct {
+	Dir string
+	// Originals holds what was at each path written, keyed by the path.
+	Originals map[string]originalFile
+	// CreatedDirs holds the directories created for the files, parents
+	// first.
+	CreatedDirs []string
+	// DirTimes holds the modification times of the directories the files
+	// were written in, which writing them changes.
+	DirTimes map[string]time.Time
+}
+
+type originalFile struct {
+	Exists   bool
+	Contents []byte
+	Link     string
+	Mode     os.FileMode
+	Uid, Gid int
+	ModTime  time.Time
+}
+
+// overrideRequest is what the acbuild-userns-override command is told to do.
+type overrideRequest struct {
+	Dir       string
+	Files     map[string][]byte
+	Dirs      []string
+	Overrides *FileOverrides
+}
+
+// OverrideFiles writes files, keyed by their path in dir, into dir, and makes
+// the directories in dirs that don't exist yet. Restore must be called on what
+// it returns to put back what they replaced. In builds where files may be
+// owned by subordinate IDs the files are written from within a user namespace.
+func OverrideFiles(dir string, files map[string][]byte, dirs []string) (*FileOverrides, error) {
+	m, err := userNamespaceIDMap()
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		var o FileOverrides
+		err := m.runOverrideInUserNamespace(overrideRequest{Dir: dir, Files: files, Dirs: dirs}, &o)
+		if err != nil {
+			return nil, err
+		}
+		return &o, nil
+	}
+
+	o := &FileOverrides{
+		Dir:       dir,
+		Originals: make(map[string]originalFile),
+		DirTimes:  make(map[string]time.Time),
+	}
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		err := o.override(p, files[p])
+		if err != nil {
+			o.restore()
+			return nil, err
+		}
+	}
+	for _, d := range dirs {
+		err := o.makeParents(filepath.Join(dir, d))
+		if err != nil {
+			o.restore()
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (o *FileOverrides) override(p string, contents []byte) error {
+	target := filepath.Join(o.Dir, p)
+	parent := filepath.Dir(target)
+	err := o.makeParents(parent)
+	if err != nil {
+		return err
+	}
+	if _, ok := o.DirTimes[parent]; !ok {
+		info, err := os.Stat(parent)
+		if err != nil {
+			return err
+		}
+		o.DirTimes[parent] = info.ModTime()
+	}
+
+	var original originalFile
+	info, err := os.Lstat(target)
+	switch {
+	case os.IsNotExist(err):
+		err = nil
+	case err != nil:
+		return err
+	case info.Mode().IsRegular():
+		original.Contents, err = ioutil.ReadFile(target)
+	case info.Mode()&os.ModeSymlink != 0:
+		original.Link, err = os.Readlink(target)
+	default:
+		return fmt.Errorf("can't replace %s, which isn't a file", p)
+	}
+	if err != nil {
+		return err
+	}
+	if info != nil {
+		original.Exists = true
+		original.Mode = info.Mode()
+		original.ModTime = info.ModTime()
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			original.Uid, original.Gid = int(st.Uid), int(st.Gid)
+		}
+		err = os.Remove(target)
+		if err != nil {
+			return err
+		}
+	}
+	o.Originals[p] = original
+	return ioutil.WriteFile(target, contents, 0644)
+}
+
+// makeParents creates dir and the directories above it that don't exist yet,
+// recording the ones it created.
+func (o *FileOverrides) makeParents(dir string) error {
+	_, err := os.Stat(dir)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	parent := filepath.Dir(dir)
+	err = o.makeParents(parent)
+	if err != nil {
+		return err
+	}
+	if _, ok := o.DirTimes[parent]; !ok {
+		info, err := os.Stat(parent)
+		if err != nil {
+			return err
+		}
+		o.DirTimes[parent] = info.ModTime()
+	}
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		return err
+	}
+	o.CreatedDirs = append(o.CreatedDirs, dir)
+	return nil
+}
+
+// Restore puts back what the files written by OverrideFiles replaced, and
+// removes the directories created for them.
+func (o *FileOverrides) Restore() error {
+	m, err := userNamespaceIDMap()
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		return m.runOverrideInUserNamespace(overrideRequest{Overrides: o}, nil)
+	}
+	return o.restore()
+}
+
+func (o *FileOverrides) restore() error {
+	for p, original := range o.Originals {
+		target := filepath.Join(o.Dir, p)
+		err := os.RemoveAll(target)
+		if err != nil {
+			return err
+		}
+		if !original.Exists {
+			continue
+		}
+		if original.Mode&os.ModeSymlink != 0 {
+			err = os.Symlink(original.Link, target)
+		} else {
+			err = ioutil.WriteFile(target, original.Contents, original.Mode.Perm())
+		}
+		if err != nil {
+			return err
+		}
+		err = os.Lchown(target, original.Uid, original.Gid)
+		if err != nil && !os.IsPermission(err) {
+			return err
+		}
+		if original.Mode&os.ModeSymlink == 0 {
+			// Chown clears the setuid and setgid bits
+			err = os.Chmod(target, original.Mode)
+			if err != nil {
+				return err
+			}
+			err = os.Chtimes(target, original.ModTime, original.ModTime)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(o.CreatedDirs) - 1; i >= 0; i-- {
+		err := os.Remove(o.CreatedDirs[i])
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for dir, modTime := range o.DirTimes {
+		err := os.Chtimes(dir, modTime, modTime)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *IDMap) runOverrideInUserNamespace(req overrideRequest, result *FileOverrides) error {
+	reqBlob, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var stdout bytes.Buffer
+	cmd := overrideEntrypoint.Cmd()
+	cmd.Stdin = bytes.NewReader(reqBlob)
+	cmd.Stdout = &stdout
+	err = m.runInUserNamespace(cmd)
+	if err != nil {
+		return fmt.Errorf("error writing files in user namespace: %v", err)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(stdout.Bytes(), result)
+}
+
+func runOverrideInUserNamespace() error {
+	err := EnterUserNamespace()
+	if err != nil {
+		return err
+	}
+	var req overrideRequest
+	err = json.NewDecoder(os.Stdin).Decode(&req)
+	if err != nil {
+		return err
+	}
+	if req.Overrides != nil {
+		return req.Overrides.Restore()
+	}
+	o, err := OverrideFiles(req.Dir, req.Files, req.Dirs)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(o)
+}
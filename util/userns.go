@@ -0,0 +1,362 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/coreos/rkt/pkg/multicall"
+)
+
+// When acbuild isn't run as root, the commands given to `acbuild run` are run
+// in a user namespace, and files they give to users other than root are owned
+// by the subordinate IDs of the user running acbuild. Those files can't be
+// chowned to, and may not be readable or removable by, that user, so in such
+// builds extracting, reading and removing the files of the build is done from
+// within a user namespace as well, by the multicall commands below.
+
+// userNamespaceSyncEnvVar holds the file descriptor a process started in a user
+// namespace reads from to wait for the namespace's mappings to be set up.
+const userNamespaceSyncEnvVar = "ACBUILD_USERNS_SYNC_FD"
+
+var (
+	extractEntrypoint  multicall.Entrypoint
+	tarEntrypoint      multicall.Entrypoint
+	removeEntrypoint   multicall.Entrypoint
+	overrideEntrypoint multicall.Entrypoint
+)
+
+func init() {
+	extractEntrypoint = multicall.Add("acbuild-userns-extract", runExtractInUserNamespace)
+	tarEntrypoint = multicall.Add("acbuild-userns-tar", runTarInUserNamespace)
+	removeEntrypoint = multicall.Add("acbuild-userns-rm", runRemoveInUserNamespace)
+	overrideEntrypoint = multicall.Add("acbuild-userns-override", runOverrideInUserNamespace)
+}
+
+// StartInUserNamespace starts cmd as root in new user and mount namespaces with
+// the mappings in m. cmd must be an acbuild multicall command, which calls
+// EnterUserNamespace before doing anything else.
+func (m *IDMap) StartInUserNamespace(cmd *exec.Cmd) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	defer w.Close()
+
+	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", userNamespaceSyncEnvVar, 2+len(cmd.ExtraFiles)))
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS
+
+	err = cmd.Start()
+	if err != nil {
+		if os.IsNotExist(err) || err == syscall.EPERM || err == syscall.EINVAL || err == syscall.ENOSPC {
+			return fmt.Errorf("couldn't create a user namespace, user namespaces may be disabled on this system: %v", err)
+		}
+		return err
+	}
+	err = m.writeMappings(cmd.Process.Pid)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("error setting up user namespace: %v", err)
+	}
+	_, err = w.Write([]byte{0})
+	return err
+}
+
+// writeMappings sets the mappings of the user namespace of the process with
+// the given pid. An unprivileged user can only map their own IDs, so
+// subordinate IDs are mapped with the setuid newuidmap and newgidmap helpers.
+func (m *IDMap) writeMappings(pid int) error {
+	if os.Geteuid() != 0 && m.HasSubordinateIDs() {
+		err := runIDMapHelper("newuidmap", pid, m.UIDs)
+		if err != nil {
+			return err
+		}
+		return runIDMapHelper("newgidmap", pid, m.GIDs)
+	}
+
+	procPath := fmt.Sprintf("/proc/%d", pid)
+	err := ioutil.WriteFile(filepath.Join(procPath, "uid_map"), formatIDMappings(m.UIDs), 0)
+	if err != nil {
+		return err
+	}
+	if os.Geteuid() != 0 {
+		// Unprivileged users may only map their group once they've given up
+		// the ability to drop it with setgroups
+		err = ioutil.WriteFile(filepath.Join(procPath, "setgroups"), []byte("deny"), 0)
+		if err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(procPath, "gid_map"), formatIDMappings(m.GIDs), 0)
+}
+
+func runIDMapHelper(helper string, pid int, mappings []IDMapping) error {
+	args := []string{strconv.Itoa(pid)}
+	for _, mapping := range mappings {
+		args = append(args,
+			strconv.FormatUint(uint64(mapping.ContainerID), 10),
+			strconv.FormatUint(uint64(mapping.HostID), 10),
+			strconv.FormatUint(uint64(mapping.Size), 10))
+	}
+	out, err := exec.Command(helper, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", helper, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func formatIDMappings(mappings []IDMapping) []byte {
+	var buf bytes.Buffer
+	for _, mapping := range mappings {
+		fmt.Fprintf(&buf, "%d %d %d\n", mapping.ContainerID, mapping.HostID, mapping.Size)
+	}
+	return buf.Bytes()
+}
+
+// EnterUserNamespace must be called first by multicall commands started with
+// StartInUserNamespace. It waits for the mappings of the namespace to be set
+// up, and then executes the command again, since the process was executed
+// before it was root in the namespace and so has none of root's capabilities.
+// It does nothing if the process wasn't started with StartInUserNamespace, or
+// is already running as root in the namespace.
+func EnterUserNamespace() error {
+	fdStr := os.Getenv(userNamespaceSyncEnvVar)
+	if fdStr == "" {
+		return nil
+	}
+	os.Unsetenv(userNamespaceSyncEnvVar)
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %q", userNamespaceSyncEnvVar, fdStr)
+	}
+	sync := os.NewFile(uintptr(fd), "userns-sync")
+	_, err = sync.Read(make([]byte, 1))
+	sync.Close()
+	if err != nil {
+		return fmt.Errorf("error waiting for the user namespace to be set up: %v", err)
+	}
+	return syscall.Exec("/proc/self/exe", os.Args, os.Environ())
+}
+
+// userNamespaceIDMap returns the mappings of the user namespace the files of
+// the build must be handled in, or nil if they can be handled directly, which
+// they can when acbuild is run as root, or when the current user has no
+// subordinate IDs and so owns every file of the build.
+func userNamespaceIDMap() (*IDMap, error) {
+	if os.Geteuid() == 0 {
+		return nil, nil
+	}
+	m, err := RootlessIDMap()
+	if err != nil || !m.HasSubordinateIDs() {
+		return nil, err
+	}
+	return m, nil
+}
+
+// runInUserNamespace runs cmd with StartInUserNamespace and waits for it,
+// returning what it printed to stderr in any error.
+func (m *IDMap) runInUserNamespace(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := m.StartInUserNamespace(cmd)
+	if err != nil {
+		return err
+	}
+	err = cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// extractRequest is what the acbuild-userns-extract command is told to extract,
+// besides the image and destination given as its arguments.
+type extractRequest struct {
+	FileMap  map[string]struct{}
+	OCILayer bool
+}
+
+func extractImageInUserNamespace(m *IDMap, path, dst string, fileMap map[string]struct{}, ociLayer bool) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	dst, err = filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	reqBlob, err := json.Marshal(extractRequest{FileMap: fileMap, OCILayer: ociLayer})
+	if err != nil {
+		return err
+	}
+	cmd := extractEntrypoint.Cmd(path, dst)
+	cmd.Stdin = bytes.NewReader(reqBlob)
+	err = m.runInUserNamespace(cmd)
+	if err != nil {
+		return fmt.Errorf("error extracting image in user namespace: %v", err)
+	}
+	return nil
+}
+
+func runExtractInUserNamespace() error {
+	err := EnterUserNamespace()
+	if err != nil {
+		return err
+	}
+	if len(os.Args) != 3 {
+		return fmt.Errorf("usage: %s IMAGE DEST", os.Args[0])
+	}
+	var req extractRequest
+	err = json.NewDecoder(os.Stdin).Decode(&req)
+	if err != nil {
+		return err
+	}
+	if req.OCILayer {
+		return ExtractOCILayer(os.Args[1], os.Args[2])
+	}
+	return ExtractImage(os.Args[1], os.Args[2], req.FileMap)
+}
+
+func runTarInUserNamespace() error {
+	err := EnterUserNamespace()
+	if err != nil {
+		return err
+	}
+	if len(os.Args) != 2 {
+		return fmt.Errorf("usage: %s DIR", os.Args[0])
+	}
+	// The names of the owners would be looked up outside of the namespace
+	clearNames := func(hdr *tar.Header) {
+		hdr.Uname, hdr.Gname = "", ""
+	}
+	twriter := tar.NewWriter(os.Stdout)
+	err = filepath.Walk(os.Args[1], PathWalker(twriter, os.Args[1], clearNames))
+	if err != nil {
+		return err
+	}
+	return twriter.Close()
+}
+
+func runRemoveInUserNamespace() error {
+	err := EnterUserNamespace()
+	if err != nil {
+		return err
+	}
+	if len(os.Args) != 2 {
+		return fmt.Errorf("usage: %s PATH", os.Args[0])
+	}
+	return os.RemoveAll(os.Args[1])
+}
+
+// WalkTree calls fn with the tar header and contents of everything under dir,
+// in lexical order. In builds where files may be owned by subordinate IDs the
+// tree is read from within a user namespace, and in builds run by an
+// unprivileged user without any the current user is mapped to root, so that
+// the owners given to fn are the ones the files have in the image rather than
+// on the host.
+func WalkTree(dir string, fn func(*tar.Header, io.Reader) error) error {
+	m, err := userNamespaceIDMap()
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	var cmd *exec.Cmd
+	if m != nil {
+		cmd = tarEntrypoint.Cmd(dir)
+		cmd.Stdout = pw
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		err = m.StartInUserNamespace(cmd)
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := cmd.Wait()
+			if err != nil {
+				err = fmt.Errorf("error reading %s in user namespace: %v: %s", dir, err, strings.TrimSpace(stderr.String()))
+			}
+			pw.CloseWithError(err)
+		}()
+	} else {
+		var editHeader func(*tar.Header)
+		if os.Geteuid() != 0 {
+			m, err := RootlessIDMap()
+			if err != nil {
+				return err
+			}
+			editHeader = m.TarHeaderEditor()
+		}
+		go func() {
+			twriter := tar.NewWriter(pw)
+			err := filepath.Walk(dir, PathWalker(twriter, dir, editHeader))
+			if err == nil {
+				err = twriter.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+	}
+	defer pr.Close()
+
+	treader := tar.NewReader(pr)
+	for {
+		hdr, err := treader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(hdr, treader)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// RemoveAll is like os.RemoveAll, except that in builds where files may be
+// owned by subordinate IDs, what the current user can't remove is removed from
+// within a user namespace.
+func RemoveAll(path string) error {
+	err := os.RemoveAll(path)
+	if err == nil || !os.IsPermission(err) {
+		return err
+	}
+	m, err1 := userNamespaceIDMap()
+	if err1 != nil || m == nil {
+		return err
+	}
+	return m.runInUserNamespace(removeEntrypoint.Cmd(path))
+}